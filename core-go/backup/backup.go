@@ -0,0 +1,344 @@
+// Package backup writes scheduled, verified encrypted archives of a
+// core.Core to a local directory, optionally copies them to a remote Target
+// such as an S3-compatible object store, and rotates both.
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"logwayss/core-go/core"
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid backup config")
+
+	archivePrefix = "logwayss-"
+	archiveExt    = ".lwx"
+	timeLayout    = "20060102T150405.000000000Z"
+)
+
+// Config configures a Scheduler.
+type Config struct {
+	// Dir is where archives are written. It is created with mode 0700.
+	Dir string
+	// Interval between backups.
+	Interval time.Duration
+	// Retention controls which archives survive rotation. The zero value
+	// means DefaultRetention.
+	Retention Retention
+	// Options are passed to ExportArchive and VerifyArchive, e.g. an export
+	// passphrase.
+	Options []core.ArchiveOption
+	// Remote, if set, receives a copy of every verified archive and is
+	// rotated with the same retention.
+	Remote Target
+}
+
+// Archive is a verified backup on disk.
+type Archive struct {
+	Path      string
+	CreatedAt time.Time
+}
+
+// Status reports the outcome of the most recent backups.
+type Status struct {
+	LastGood     time.Time `json:"last_good,omitempty"`
+	LastGoodPath string    `json:"last_good_path,omitempty"`
+	LastAttempt  time.Time `json:"last_attempt,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	LastUpload   time.Time `json:"last_upload,omitempty"`
+	UploadError  string    `json:"upload_error,omitempty"`
+}
+
+// Scheduler periodically exports the Core into Config.Dir. Archives are
+// verified by a test restore before they are moved into place, so every
+// archive in the directory is known to be restorable.
+type Scheduler struct {
+	core *core.Core
+	cfg  Config
+	now  func() time.Time
+
+	run    sync.Mutex // serialises backups
+	mu     sync.Mutex // guards status
+	status Status
+}
+
+// NewScheduler validates cfg, prepares the backup directory and picks up the
+// newest existing archive as the last good backup.
+func NewScheduler(c *core.Core, cfg Config) (*Scheduler, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("%w: dir is required", ErrInvalidConfig)
+	}
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("%w: interval must be positive", ErrInvalidConfig)
+	}
+	if cfg.Retention == (Retention{}) {
+		cfg.Retention = DefaultRetention
+	}
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Scheduler{core: c, cfg: cfg, now: time.Now}
+	archives, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(archives) > 0 {
+		s.status.LastGood = archives[0].CreatedAt
+		s.status.LastGoodPath = archives[0].Path
+	}
+	return s, nil
+}
+
+// Run performs a backup whenever the last good one is older than the
+// interval, until ctx is cancelled. Failures are recorded in Status and
+// retried on the next tick.
+func (s *Scheduler) Run(ctx context.Context) error {
+	for {
+		var wait time.Duration
+		if last := s.Status().LastGood; !last.IsZero() {
+			wait = time.Until(last.Add(s.cfg.Interval))
+		}
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+		if _, err := s.BackupNow(ctx); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// Back off for a full interval rather than spinning on a locked
+			// profile or a full disk.
+			t := time.NewTimer(s.cfg.Interval)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			case <-t.C:
+			}
+		}
+	}
+}
+
+// BackupNow exports, verifies and rotates immediately, returning the new
+// archive. It fails with core.ErrReadOnly while the profile is read-only
+// after corruption, so rotation cannot push out the backups taken before it.
+func (s *Scheduler) BackupNow(ctx context.Context) (Archive, error) {
+	s.run.Lock()
+	defer s.run.Unlock()
+
+	started := s.now().UTC()
+	a, err := s.backup(ctx, started)
+
+	s.mu.Lock()
+	s.status.LastAttempt = started
+	if err != nil {
+		s.status.LastError = err.Error()
+	} else {
+		s.status.LastError = ""
+		s.status.LastGood = a.CreatedAt
+		s.status.LastGoodPath = a.Path
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return Archive{}, err
+	}
+
+	if s.cfg.Remote != nil {
+		err := s.upload(ctx, a)
+		s.mu.Lock()
+		if err != nil {
+			s.status.UploadError = err.Error()
+		} else {
+			s.status.UploadError = ""
+			s.status.LastUpload = a.CreatedAt
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return a, fmt.Errorf("upload: %w", err)
+		}
+	}
+	return a, s.rotate(ctx)
+}
+
+func (s *Scheduler) upload(ctx context.Context, a Archive) error {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.cfg.Remote.Put(ctx, filepath.Base(a.Path), f)
+}
+
+func (s *Scheduler) backup(ctx context.Context, at time.Time) (Archive, error) {
+	if reason := s.core.ReadOnlyReason(); reason != "" {
+		return Archive{}, fmt.Errorf("%w: %s", core.ErrReadOnly, reason)
+	}
+	name := archivePrefix + at.Format(timeLayout) + archiveExt
+	dest := filepath.Join(s.cfg.Dir, name)
+	tmp := filepath.Join(s.cfg.Dir, "."+name+".unverified")
+
+	if err := s.core.ExportArchive(ctx, tmp, s.cfg.Options...); err != nil {
+		return Archive{}, fmt.Errorf("export: %w", err)
+	}
+	if err := s.core.VerifyArchive(ctx, tmp, s.cfg.Options...); err != nil {
+		_ = os.Remove(tmp)
+		return Archive{}, fmt.Errorf("verify: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		_ = os.Remove(tmp)
+		return Archive{}, err
+	}
+	return Archive{Path: dest, CreatedAt: at}, nil
+}
+
+// Status returns a snapshot of the scheduler's status.
+func (s *Scheduler) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// List returns the archives in the backup directory, newest first.
+func (s *Scheduler) List() ([]Archive, error) {
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	archives := parseArchives(names)
+	for i := range archives {
+		archives[i].Path = filepath.Join(s.cfg.Dir, archives[i].Path)
+	}
+	return archives, nil
+}
+
+// ListRemote returns the archives on the remote target, newest first. Their
+// Path is the name to pass to RestoreRemote.
+func (s *Scheduler) ListRemote(ctx context.Context) ([]Archive, error) {
+	if s.cfg.Remote == nil {
+		return nil, fmt.Errorf("%w: no remote target", ErrInvalidConfig)
+	}
+	names, err := s.cfg.Remote.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return parseArchives(names), nil
+}
+
+// RestoreRemote downloads the named archive from the remote target, verifies
+// it and imports it into the Core.
+func (s *Scheduler) RestoreRemote(ctx context.Context, name string) error {
+	if s.cfg.Remote == nil {
+		return fmt.Errorf("%w: no remote target", ErrInvalidConfig)
+	}
+	if len(parseArchives([]string{name})) != 1 {
+		return fmt.Errorf("%w: %q is not a backup archive name", ErrRemote, name)
+	}
+	s.run.Lock()
+	defer s.run.Unlock()
+
+	rc, err := s.cfg.Remote.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tmp := filepath.Join(s.cfg.Dir, "."+name+".download")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(f, rc)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.core.VerifyArchive(ctx, tmp, s.cfg.Options...); err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	return s.core.ImportArchive(ctx, tmp, s.cfg.Options...)
+}
+
+// parseArchives keeps the names that look like backup archives and returns
+// them newest first, with the name as Path.
+func parseArchives(names []string) []Archive {
+	var archives []Archive
+	for _, name := range names {
+		if !strings.HasPrefix(name, archivePrefix) || !strings.HasSuffix(name, archiveExt) {
+			continue
+		}
+		ts := strings.TrimSuffix(strings.TrimPrefix(name, archivePrefix), archiveExt)
+		t, err := time.Parse(timeLayout, ts)
+		if err != nil {
+			continue
+		}
+		archives = append(archives, Archive{Path: name, CreatedAt: t})
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].CreatedAt.After(archives[j].CreatedAt) })
+	return archives
+}
+
+func (s *Scheduler) rotate(ctx context.Context) error {
+	var errs []error
+	local, err := s.List()
+	if err != nil {
+		return err
+	}
+	for _, a := range s.expired(local) {
+		if err := os.Remove(a.Path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if s.cfg.Remote != nil {
+		remote, err := s.ListRemote(ctx)
+		if err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		for _, a := range s.expired(remote) {
+			if err := s.cfg.Remote.Delete(ctx, a.Path); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Scheduler) expired(archives []Archive) []Archive {
+	times := make([]time.Time, len(archives))
+	for i, a := range archives {
+		times[i] = a.CreatedAt
+	}
+	keep := s.cfg.Retention.Retained(times)
+	var out []Archive
+	for _, a := range archives {
+		if !keep[a.CreatedAt] {
+			out = append(out, a)
+		}
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"logwayss/core-go/core"
+	"logwayss/core-go/internal/storage"
+	"logwayss/core-go/internal/testutil"
+)
+
+func TestRetentionRetained(t *testing.T) {
+	base := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	var times []time.Time
+	// Two backups a day for 90 days.
+	for d := 0; d < 90; d++ {
+		day := base.AddDate(0, 0, -d)
+		times = append(times, day, day.Add(-6*time.Hour))
+	}
+
+	keep := Retention{Daily: 3, Weekly: 2, Monthly: 3}.Retained(times)
+	want := []time.Time{
+		base,                    // newest; also daily, weekly and monthly for 2026-03
+		base.AddDate(0, 0, -1),  // daily
+		base.AddDate(0, 0, -2),  // daily; also last of the previous ISO week
+		base.AddDate(0, 0, -31), // 2026-02-28, newest of February
+		base.AddDate(0, 0, -59), // 2026-01-31, newest of January
+	}
+	for _, w := range want {
+		if !keep[w] {
+			t.Errorf("expected %s to be retained", w)
+		}
+	}
+	if len(keep) != len(want) {
+		t.Fatalf("retained %d archives, want %d: %v", len(keep), len(want), keep)
+	}
+}
+
+func TestSchedulerBackupNow(t *testing.T) {
+	ctx := context.Background()
+	c := testutil.NewCore(t)
+
+	s, err := NewScheduler(c, Config{Dir: t.TempDir(), Interval: time.Hour, Retention: Retention{Daily: 1}})
+	if err != nil {
+		t.Fatalf("NewScheduler failed: %v", err)
+	}
+	clock := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return clock }
+
+	first, err := s.BackupNow(ctx)
+	if err != nil {
+		t.Fatalf("BackupNow failed: %v", err)
+	}
+	clock = clock.Add(time.Hour)
+	second, err := s.BackupNow(ctx)
+	if err != nil {
+		t.Fatalf("BackupNow failed: %v", err)
+	}
+
+	// Same day, one daily slot: only the newer archive survives rotation.
+	if _, err := os.Stat(first.Path); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be rotated out, stat err: %v", first.Path, err)
+	}
+	if err := c.VerifyArchive(ctx, second.Path); err != nil {
+		t.Fatalf("VerifyArchive failed: %v", err)
+	}
+	st := s.Status()
+	if st.LastGoodPath != second.Path || st.LastError != "" {
+		t.Fatalf("unexpected status: %+v", st)
+	}
+
+	c.Lock()
+	clock = clock.Add(time.Hour)
+	if _, err := s.BackupNow(ctx); err == nil {
+		t.Fatal("BackupNow should fail while the profile is locked")
+	}
+	if st := s.Status(); st.LastError == "" || st.LastGoodPath != second.Path {
+		t.Fatalf("failed backup should keep last good: %+v", st)
+	}
+}
+
+func TestSchedulerSkipsReadOnlyProfile(t *testing.T) {
+	ctx := context.Background()
+	c := core.New()
+	dataDir := t.TempDir()
+	if err := c.CreateProfile(ctx, dataDir, []byte("password"), testutil.Scrypt); err != nil {
+		t.Fatalf("CreateProfile failed: %v", err)
+	}
+	if err := c.UnlockProfile(ctx, dataDir, []byte("password")); err != nil {
+		t.Fatalf("UnlockProfile failed: %v", err)
+	}
+	t.Cleanup(c.Lock)
+	e, err := c.CreateEntry(ctx, core.NewEntry{Type: core.EntryTypeText, Payload: []byte(`{"text":"x"}`)})
+	if err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+
+	s, err := NewScheduler(c, Config{Dir: t.TempDir(), Interval: time.Hour, Retention: Retention{Daily: 1}})
+	if err != nil {
+		t.Fatalf("NewScheduler failed: %v", err)
+	}
+	clock := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return clock }
+	before, err := s.BackupNow(ctx)
+	if err != nil {
+		t.Fatalf("BackupNow failed: %v", err)
+	}
+
+	// Damage the entry on disk; the scrub that finds it makes the profile
+	// read-only.
+	db, err := storage.OpenDB(ctx, filepath.Join(dataDir, "db.sqlite3"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ExecContext(ctx, "UPDATE entries SET tag = zeroblob(16) WHERE id = ?", e.ID)
+	db.Close()
+	if err != nil {
+		t.Fatalf("tamper failed: %v", err)
+	}
+	if report, err := c.Scrub(ctx); err != nil || report.Clean() || c.ReadOnlyReason() == "" {
+		t.Fatalf("scrub of a damaged profile: report=%+v err=%v", report, err)
+	}
+
+	// A newer backup in the same daily slot would rotate the old one out.
+	clock = clock.Add(time.Hour)
+	if _, err := s.BackupNow(ctx); !errors.Is(err, core.ErrReadOnly) {
+		t.Fatalf("BackupNow on a read-only profile: got %v, want ErrReadOnly", err)
+	}
+	archives, err := s.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(archives) != 1 || archives[0].Path != before.Path {
+		t.Fatalf("backup from before the corruption not kept: %+v", archives)
+	}
+	if st := s.Status(); st.LastError == "" || st.LastGoodPath != before.Path {
+		t.Fatalf("skipped backup not recorded: %+v", st)
+	}
+}
@@ -0,0 +1,58 @@
+package backup
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Retention configures grandfather-father-son rotation: the newest archive of
+// each of the last Daily days, Weekly ISO weeks and Monthly months that have
+// archives is kept. The newest archive overall is always kept.
+type Retention struct {
+	Daily   int `json:"daily"`
+	Weekly  int `json:"weekly"`
+	Monthly int `json:"monthly"`
+}
+
+// DefaultRetention keeps a week of dailies, a month of weeklies and a year of
+// monthlies.
+var DefaultRetention = Retention{Daily: 7, Weekly: 4, Monthly: 12}
+
+// Retained returns the subset of times to keep under r. Periods are computed
+// in UTC.
+func (r Retention) Retained(times []time.Time) map[time.Time]bool {
+	sorted := append([]time.Time(nil), times...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].After(sorted[j]) })
+
+	keep := make(map[time.Time]bool)
+	if len(sorted) > 0 {
+		keep[sorted[0]] = true
+	}
+	tiers := []struct {
+		limit  int
+		bucket func(time.Time) string
+	}{
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", y, w)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, tier := range tiers {
+		seen := make(map[string]bool)
+		for _, t := range sorted {
+			if len(seen) >= tier.limit {
+				break
+			}
+			b := tier.bucket(t.UTC())
+			if seen[b] {
+				continue
+			}
+			seen[b] = true
+			keep[t] = true
+		}
+	}
+	return keep
+}
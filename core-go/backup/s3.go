@@ -0,0 +1,281 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrRemote = errors.New("remote backup target error")
+
+const (
+	defaultS3Region   = "us-east-1"
+	defaultS3PartSize = 8 << 20
+	minS3PartSize     = 5 << 20
+	emptyPayloadHash  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// Target is an off-site location that verified archives are copied to.
+// Archives are encrypted before they reach a Target, so it only ever sees
+// ciphertext.
+type Target interface {
+	Put(ctx context.Context, name string, r io.Reader) error
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	List(ctx context.Context) ([]string, error)
+	Delete(ctx context.Context, name string) error
+}
+
+// S3Config configures an S3Target. Any S3-compatible store that supports
+// path-style addressing and Signature Version 4 works, e.g. MinIO.
+type S3Config struct {
+	// Endpoint is the base URL, e.g. "http://nas.local:9000".
+	Endpoint string `json:"endpoint"`
+	// Region defaults to "us-east-1", which MinIO accepts by default.
+	Region string `json:"region,omitempty"`
+	Bucket string `json:"bucket"`
+	// Prefix is prepended to every object key, e.g. "logwayss/".
+	Prefix    string `json:"prefix,omitempty"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"-"`
+	// PartSize is the multipart upload part size. Archives no larger than one
+	// part are uploaded with a single PUT. Defaults to 8 MiB; S3 requires at
+	// least 5 MiB.
+	PartSize int64 `json:"part_size,omitempty"`
+	// Client defaults to http.DefaultClient.
+	Client *http.Client `json:"-"`
+}
+
+// S3Target stores archives as objects in an S3-compatible bucket.
+type S3Target struct {
+	cfg      S3Config
+	endpoint *url.URL
+	signer   sigV4Signer
+	now      func() time.Time
+}
+
+// NewS3Target validates cfg and returns a Target for it.
+func NewS3Target(cfg S3Config) (*S3Target, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: endpoint must be an http(s) URL", ErrInvalidConfig)
+	}
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("%w: bucket is required", ErrInvalidConfig)
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("%w: access and secret keys are required", ErrInvalidConfig)
+	}
+	if cfg.Region == "" {
+		cfg.Region = defaultS3Region
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = defaultS3PartSize
+	}
+	if cfg.PartSize < minS3PartSize {
+		return nil, fmt.Errorf("%w: part size must be at least %d bytes", ErrInvalidConfig, minS3PartSize)
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	return &S3Target{
+		cfg:      cfg,
+		endpoint: u,
+		signer:   sigV4Signer{accessKey: cfg.AccessKey, secretKey: cfg.SecretKey, region: cfg.Region},
+		now:      time.Now,
+	}, nil
+}
+
+// Put uploads r as name, switching to a multipart upload once more than one
+// part of data has been read.
+func (t *S3Target) Put(ctx context.Context, name string, r io.Reader) error {
+	first, err := readPart(r, t.cfg.PartSize)
+	if err != nil {
+		return err
+	}
+	if int64(len(first)) < t.cfg.PartSize {
+		resp, err := t.do(ctx, http.MethodPut, t.cfg.Prefix+name, nil, first)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+	return t.putMultipart(ctx, t.cfg.Prefix+name, first, r)
+}
+
+func (t *S3Target) putMultipart(ctx context.Context, key string, first []byte, r io.Reader) error {
+	resp, err := t.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("%w: initiate multipart upload: %v", ErrRemote, err)
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	abort := func(cause error) error {
+		q := url.Values{"uploadId": {initiated.UploadID}}
+		if resp, err := t.do(context.Background(), http.MethodDelete, key, q, nil); err == nil {
+			resp.Body.Close()
+		}
+		return cause
+	}
+
+	data := first
+	for n := 1; len(data) > 0; n++ {
+		q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {initiated.UploadID}}
+		resp, err := t.do(ctx, http.MethodPut, key, q, data)
+		if err != nil {
+			return abort(err)
+		}
+		resp.Body.Close()
+		parts = append(parts, part{PartNumber: n, ETag: resp.Header.Get("ETag")})
+		if int64(len(data)) < t.cfg.PartSize {
+			break
+		}
+		if data, err = readPart(r, t.cfg.PartSize); err != nil {
+			return abort(err)
+		}
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+	resp, err = t.do(ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, body)
+	if err != nil {
+		return abort(err)
+	}
+	defer resp.Body.Close()
+	// CompleteMultipartUpload can fail with a 200 status and an error body.
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		return abort(fmt.Errorf("%w: complete multipart upload: %s: %s", ErrRemote, result.Code, result.Message))
+	}
+	return nil
+}
+
+// Get downloads the archive stored as name.
+func (t *S3Target) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := t.do(ctx, http.MethodGet, t.cfg.Prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// List returns the names of all objects under the configured prefix.
+func (t *S3Target) List(ctx context.Context) ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {t.cfg.Prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := t.do(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: list objects: %v", ErrRemote, err)
+		}
+		for _, c := range page.Contents {
+			name := strings.TrimPrefix(c.Key, t.cfg.Prefix)
+			if name != "" && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Delete removes the archive stored as name.
+func (t *S3Target) Delete(ctx context.Context, name string) error {
+	resp, err := t.do(ctx, http.MethodDelete, t.cfg.Prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends a signed request for key (or the bucket itself when key is empty)
+// and turns non-2xx responses into errors.
+func (t *S3Target) do(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *t.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + t.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	hash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		hash = hex.EncodeToString(sum[:])
+	}
+	t.signer.sign(req, hash, t.now())
+
+	resp, err := t.cfg.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrRemote, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%w: %s %s: %s: %s", ErrRemote, method, key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+func readPart(r io.Reader, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+	return buf[:n], nil
+}
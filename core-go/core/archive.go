@@ -0,0 +1,981 @@
+package core
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ccrypto "logwayss/core-go/internal/crypto"
+	"logwayss/core-go/internal/storage"
+)
+
+// Archive layout:
+//
+//	magic(16) || header length(4, big-endian) || header JSON || encrypted stream
+//
+// The encrypted stream (see ccrypto.StreamWriter) is keyed by an HKDF subkey
+// of the archive key and authenticates the whole header as AAD. Its plaintext
+// is a tar file whose first member is manifest.json, followed by the files the
+// manifest lists with their sizes and SHA-256 digests.
+//
+// The archive key is either the exporting profile's session key (kdf
+// "session") or derived from a separate export passphrase with scrypt (kdf
+// "scrypt"). In the latter case the entry payloads inside the archive are
+// re-encrypted under the passphrase key as well, so any profile that knows
+// the passphrase can import them.
+var (
+	ErrInvalidArchive            = errors.New("invalid or corrupt archive")
+	ErrArchivePassphraseRequired = errors.New("archive is protected by an export passphrase")
+	ErrInvalidArchivePassphrase  = errors.New("invalid archive passphrase")
+
+	archiveMagic                = "LOGWAYSS_ARCHIVE"
+	archiveFormatVersion        = 1
+	archiveKDFSession           = "session"
+	archiveKDFScrypt            = "scrypt"
+	archiveKeyInfo              = "logwayss archive v1"
+	archiveCheckInfo            = "logwayss archive check v1"
+	archiveManifestName         = "manifest.json"
+	maxArchiveHeaderSize uint32 = 64 * 1024
+	maxManifestSize      int64  = 16 << 20
+	reencryptBatchSize          = 500
+
+	// The largest scrypt parameters an archive may ask for. They come from
+	// the unauthenticated header, and scrypt needs 128*N*R*P bytes.
+	maxArchiveScryptN = 1 << 20
+	maxArchiveScryptR = 16
+	maxArchiveScryptP = 4
+)
+
+type archiveHeader struct {
+	FormatVersion int                   `json:"format_version"`
+	SchemaVersion int                   `json:"schema_version"`
+	KDF           string                `json:"kdf"`
+	Scrypt        *ccrypto.ScryptParams `json:"scrypt,omitempty"`
+	Salt          string                `json:"salt"`
+	Check         string                `json:"check,omitempty"`
+	NoncePrefix   string                `json:"nonce_prefix"`
+}
+
+type archiveManifest struct {
+	FormatVersion int           `json:"format_version"`
+	SchemaVersion int           `json:"schema_version"`
+	CreatedAt     string        `json:"created_at"`
+	Kind          string        `json:"kind"`
+	Parent        string        `json:"parent,omitempty"`
+	HighWater     Watermark     `json:"high_water"`
+	Collection    string        `json:"collection,omitempty"`
+	Files         []archiveFile `json:"files"`
+
+	// hash is the SHA-256 of the manifest as stored in the archive.
+	hash string
+}
+
+type archiveFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArchiveOption configures archive export and import.
+type ArchiveOption func(*archiveOptions)
+
+type archiveOptions struct {
+	passphrase []byte
+	scrypt     ccrypto.ScryptParams
+	since      *ArchiveInfo
+	collection string
+}
+
+// WithPassphrase protects an exported archive with passphrase instead of the
+// profile's session key, or supplies the passphrase needed to import one.
+func WithPassphrase(passphrase []byte) ArchiveOption {
+	return func(o *archiveOptions) { o.passphrase = passphrase }
+}
+
+// WithScrypt sets the scrypt parameters used to derive the export passphrase
+// key. It defaults to ccrypto.DesktopScrypt and is ignored on import, where
+// the parameters are read from the archive header.
+func WithScrypt(params ccrypto.ScryptParams) ArchiveOption {
+	return func(o *archiveOptions) { o.scrypt = params }
+}
+
+func newArchiveOptions(opts []ArchiveOption) archiveOptions {
+	o := archiveOptions{scrypt: ccrypto.DesktopScrypt}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// ExportArchive writes an encrypted archive of the profile to dest. The file
+// is written under a temporary name and renamed once complete.
+func (c *Core) ExportArchive(ctx context.Context, dest string, opts ...ArchiveOption) error {
+	tmp := dest + ".partial"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := c.ExportArchiveTo(ctx, f, opts...); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// ExportArchiveTo streams an encrypted archive of the profile, including its
+// media, to w. The snapshot is taken up front, so the Core is not held while
+// w is being written.
+func (c *Core) ExportArchiveTo(ctx context.Context, w io.Writer, opts ...ArchiveOption) error {
+	o := newArchiveOptions(opts)
+	dir, key, err := c.snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	defer zero(key)
+	snapshot := filepath.Join(dir, dbFileName)
+	media := filepath.Join(dir, mediaDirName)
+
+	header, archiveKey, err := newArchiveHeader(key, o)
+	if err != nil {
+		return err
+	}
+	defer zero(archiveKey)
+	manifest := archiveManifest{Kind: ArchiveKindFull}
+	if o.collection != "" {
+		if o.since != nil {
+			return ErrCollectionIncremental
+		}
+		manifest.Kind = ArchiveKindCollection
+		manifest.Collection = o.collection
+		if err := trimToCollection(ctx, snapshot, o.collection); err != nil {
+			return err
+		}
+		refs, err := mediaRefsOf(ctx, snapshot, key)
+		if err != nil {
+			return err
+		}
+		if err := trimMediaToRefs(media, refs); err != nil {
+			return err
+		}
+	}
+	if o.since != nil {
+		manifest.Kind = ArchiveKindIncremental
+		manifest.Parent = o.since.Hash
+		if err := trimToDelta(ctx, snapshot, o.since.HighWater); err != nil {
+			return err
+		}
+		if err := trimMediaToDelta(media, o.since.HighWater); err != nil {
+			return err
+		}
+	}
+	if manifest.HighWater, err = highWaterOf(ctx, snapshot); err != nil {
+		return err
+	}
+	if o.since != nil && manifest.HighWater.before(o.since.HighWater) {
+		manifest.HighWater = o.since.HighWater
+	}
+	if header.KDF == archiveKDFScrypt {
+		if err := reencryptDBFile(ctx, snapshot, key, archiveKey); err != nil {
+			return err
+		}
+		if err := rewrapMediaDir(media, key, archiveKey); err != nil {
+			return err
+		}
+	}
+
+	files, err := stagedFiles(dir)
+	if err != nil {
+		return err
+	}
+	return writeArchive(w, header, archiveKey, manifest, files)
+}
+
+// ImportArchive replaces the profile's database and media with the contents
+// of the archive at src.
+func (c *Core) ImportArchive(ctx context.Context, src string, opts ...ArchiveOption) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.ImportArchiveFrom(ctx, f, opts...)
+}
+
+// ImportArchiveFrom reads an encrypted archive from r and replaces the
+// profile's database and media with it. The archive is fully authenticated
+// and its manifest checksums verified before the live database is touched.
+// Archives protected by an export passphrase need WithPassphrase; their
+// entries are re-encrypted under this profile's key.
+func (c *Core) ImportArchiveFrom(ctx context.Context, r io.Reader, opts ...ArchiveOption) error {
+	o := newArchiveOptions(opts)
+	// Reading r can take as long as its sender does, so the archive is staged
+	// and authenticated without holding c.mu; only the swap needs it.
+	c.mu.RLock()
+	if !c.isUnlocked() {
+		c.mu.RUnlock()
+		return ErrLocked
+	}
+	sessionKey := append([]byte(nil), c.sessionKey...)
+	dataDir := c.dataDir
+	c.mu.RUnlock()
+	defer zero(sessionKey)
+
+	staging, err := os.MkdirTemp(dataDir, "import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	header, manifest, archiveKey, err := readArchive(r, sessionKey, o, staging)
+	if err != nil {
+		return err
+	}
+	defer zero(archiveKey)
+	if manifest.Kind == ArchiveKindIncremental {
+		return ErrIncrementalArchive
+	}
+	if manifest.Kind == ArchiveKindCollection {
+		return ErrCollectionArchive
+	}
+
+	if header.KDF == archiveKDFScrypt {
+		if err := reencryptDBFile(ctx, filepath.Join(staging, dbFileName), archiveKey, sessionKey); err != nil {
+			return err
+		}
+		if err := rewrapMediaDir(filepath.Join(staging, mediaDirName), archiveKey, sessionKey); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The profile may have been locked, or another one unlocked, while the
+	// archive was read.
+	if !c.isUnlocked() || c.dataDir != dataDir || subtle.ConstantTimeCompare(c.sessionKey, sessionKey) != 1 {
+		return ErrLocked
+	}
+	return c.replaceData(ctx, staging)
+}
+
+// snapshot writes a consistent copy of the database into a fresh temporary
+// directory under the data dir, hard-links the media store next to it, and
+// returns the directory with a copy of the session key.
+func (c *Core) snapshot(ctx context.Context) (string, []byte, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return "", nil, ErrLocked
+	}
+
+	dir, err := os.MkdirTemp(c.dataDir, "export-")
+	if err != nil {
+		return "", nil, err
+	}
+	// This command safely creates a compacted, consistent backup of the database,
+	// correctly handling the WAL file.
+	if _, err := c.db.ExecContext(ctx, "VACUUM INTO ?", filepath.Join(dir, dbFileName)); err != nil {
+		_ = os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("failed to vacuum database for export: %w", err)
+	}
+	// Media files are immutable once committed, so links are a snapshot.
+	c.mediaMu.Lock()
+	err = linkTree(filepath.Join(c.dataDir, mediaDirName), filepath.Join(dir, mediaDirName))
+	c.mediaMu.Unlock()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return dir, append([]byte(nil), c.sessionKey...), nil
+}
+
+// replaceData swaps the live database and media store for the verified ones
+// in staging. The replaced media store is moved into staging, so removing
+// staging afterwards disposes of it. The caller must hold c.mu for writing.
+func (c *Core) replaceData(ctx context.Context, staging string) error {
+	if c.db != nil {
+		if err := c.db.Close(); err != nil {
+			return fmt.Errorf("failed to close db for import: %w", err)
+		}
+		c.db = nil
+	}
+
+	liveMedia := filepath.Join(c.dataDir, mediaDirName)
+	if err := os.Rename(liveMedia, filepath.Join(staging, "replaced-"+mediaDirName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(filepath.Join(staging, mediaDirName), liveMedia); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	dbPath := filepath.Join(c.dataDir, dbFileName)
+	// Remove WAL and SHM files to prevent state corruption.
+	_ = os.Remove(dbPath + "-wal")
+	_ = os.Remove(dbPath + "-shm")
+	if err := os.Rename(filepath.Join(staging, dbFileName), dbPath); err != nil {
+		return err
+	}
+
+	db, err := storage.OpenDB(ctx, dbPath, false)
+	if err != nil {
+		c.sessionKey = nil
+		return fmt.Errorf("failed to open imported database: %w", err)
+	}
+	c.db = db
+	if err := migrate(ctx, c.db); err != nil {
+		return err
+	}
+	if err := c.loadEntryTypes(ctx); err != nil {
+		return err
+	}
+	return c.clearReadOnly()
+}
+
+// stagedFiles lists the database and media files under dir for archiving,
+// database first.
+func stagedFiles(dir string) ([]stagedFile, error) {
+	files := []stagedFile{{Path: dbFileName, Src: filepath.Join(dir, dbFileName)}}
+	err := filepath.WalkDir(filepath.Join(dir, mediaDirName), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, stagedFile{Path: filepath.ToSlash(rel), Src: path})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return files, nil
+}
+
+// linkTree recreates the regular files under src in dst as hard links,
+// falling back to copies where linking is not possible. A missing src is
+// not an error.
+func linkTree(src, dst string) error {
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func copyFile(src, dst string) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destFile, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer destFile.Close()
+
+	if _, err := io.Copy(destFile, sourceFile); err != nil {
+		return err
+	}
+	return destFile.Close()
+}
+
+type stagedFile struct {
+	Path string
+	Src  string
+}
+
+// writeArchive completes manifest with the staged files' checksums and writes
+// the archive to w.
+func writeArchive(w io.Writer, header archiveHeader, key []byte, manifest archiveManifest, files []stagedFile) error {
+	manifest.FormatVersion = archiveFormatVersion
+	manifest.SchemaVersion = schemaVersion
+	manifest.CreatedAt = time.Now().UTC().Format(storedTimeFormat)
+	for _, f := range files {
+		size, sum, err := hashFile(f.Src)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, archiveFile{Path: f.Path, Size: size, SHA256: sum})
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, ccrypto.StreamPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header.NoncePrefix = hex.EncodeToString(prefix)
+	headerBytes, err := encodeArchiveHeader(header)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(headerBytes); err != nil {
+		return err
+	}
+
+	salt, err := hex.DecodeString(header.Salt)
+	if err != nil {
+		return err
+	}
+	streamKey, err := ccrypto.DeriveSubkey(key, salt, archiveKeyInfo)
+	if err != nil {
+		return err
+	}
+	defer zero(streamKey)
+	sw, err := ccrypto.NewStreamWriter(w, streamKey, prefix, headerBytes)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(sw)
+	if err := writeTarBytes(tw, archiveManifestName, manifestBytes); err != nil {
+		return err
+	}
+	for i, f := range files {
+		if err := writeTarFile(tw, f.Path, f.Src, manifest.Files[i].Size); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// readArchive authenticates the archive on r, extracts its files into dir and
+// verifies them against the manifest. It returns the archive key, which the
+// caller must zero.
+func readArchive(r io.Reader, sessionKey []byte, o archiveOptions, dir string) (archiveHeader, archiveManifest, []byte, error) {
+	header, headerBytes, err := decodeArchiveHeader(r)
+	if err != nil {
+		return header, archiveManifest{}, nil, err
+	}
+	key, err := openArchiveKey(header, sessionKey, o)
+	if err != nil {
+		return header, archiveManifest{}, nil, err
+	}
+	sr, err := openArchiveStream(r, header, headerBytes, key)
+	if err != nil {
+		zero(key)
+		return header, archiveManifest{}, nil, err
+	}
+
+	manifest, err := extractArchive(sr, dir)
+	if err == nil {
+		// Drain the stream so the final chunk and trailing data are checked
+		// even when the tar reader stops early.
+		_, err = io.Copy(io.Discard, sr)
+	}
+	if err != nil {
+		zero(key)
+		return header, archiveManifest{}, nil, archiveError(err)
+	}
+	return header, manifest, key, nil
+}
+
+// openArchiveStream returns the decrypting reader positioned after the
+// archive header.
+func openArchiveStream(r io.Reader, header archiveHeader, headerBytes, key []byte) (*ccrypto.StreamReader, error) {
+	salt, _ := hex.DecodeString(header.Salt)
+	prefix, err := hex.DecodeString(header.NoncePrefix)
+	if err != nil || len(prefix) != ccrypto.StreamPrefixSize {
+		return nil, ErrInvalidArchive
+	}
+	streamKey, err := ccrypto.DeriveSubkey(key, salt, archiveKeyInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(streamKey)
+	return ccrypto.NewStreamReader(r, streamKey, prefix, headerBytes)
+}
+
+// newArchiveHeader prepares the header for a new archive and returns the key
+// the archive is encrypted under.
+func newArchiveHeader(sessionKey []byte, o archiveOptions) (archiveHeader, []byte, error) {
+	salt, err := ccrypto.GenerateSalt(32)
+	if err != nil {
+		return archiveHeader{}, nil, err
+	}
+	header := archiveHeader{
+		FormatVersion: archiveFormatVersion,
+		SchemaVersion: schemaVersion,
+		KDF:           archiveKDFSession,
+		Salt:          hex.EncodeToString(salt),
+	}
+	if o.passphrase == nil {
+		return header, append([]byte(nil), sessionKey...), nil
+	}
+
+	params := o.scrypt
+	if err := checkArchiveScrypt(params); err != nil {
+		return archiveHeader{}, nil, err
+	}
+	key, err := ccrypto.DeriveKey(o.passphrase, salt, params.N, params.R, params.P, 32)
+	if err != nil {
+		return archiveHeader{}, nil, err
+	}
+	check, err := ccrypto.DeriveSubkey(key, salt, archiveCheckInfo)
+	if err != nil {
+		zero(key)
+		return archiveHeader{}, nil, err
+	}
+	header.KDF = archiveKDFScrypt
+	header.Scrypt = &params
+	header.Check = hex.EncodeToString(check)
+	return header, key, nil
+}
+
+// openArchiveKey resolves the key an existing archive is encrypted under.
+func openArchiveKey(header archiveHeader, sessionKey []byte, o archiveOptions) ([]byte, error) {
+	salt, err := hex.DecodeString(header.Salt)
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("%w: bad salt", ErrInvalidArchive)
+	}
+	switch header.KDF {
+	case archiveKDFSession:
+		return append([]byte(nil), sessionKey...), nil
+	case archiveKDFScrypt:
+		if header.Scrypt == nil {
+			return nil, fmt.Errorf("%w: missing scrypt parameters", ErrInvalidArchive)
+		}
+		if o.passphrase == nil {
+			return nil, ErrArchivePassphraseRequired
+		}
+		p := header.Scrypt
+		if err := checkArchiveScrypt(*p); err != nil {
+			return nil, err
+		}
+		key, err := ccrypto.DeriveKey(o.passphrase, salt, p.N, p.R, p.P, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+		check, err := ccrypto.DeriveSubkey(key, salt, archiveCheckInfo)
+		if err != nil {
+			zero(key)
+			return nil, err
+		}
+		want, _ := hex.DecodeString(header.Check)
+		if subtle.ConstantTimeCompare(check, want) != 1 {
+			zero(key)
+			return nil, ErrInvalidArchivePassphrase
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported kdf %q", ErrInvalidArchive, header.KDF)
+	}
+}
+
+// checkArchiveScrypt rejects scrypt parameters that are invalid or would
+// make deriving the archive key exhaust memory.
+func checkArchiveScrypt(p ccrypto.ScryptParams) error {
+	if p.N < 2 || p.N&(p.N-1) != 0 || p.N > maxArchiveScryptN ||
+		p.R < 1 || p.R > maxArchiveScryptR || p.P < 1 || p.P > maxArchiveScryptP {
+		return fmt.Errorf("%w: unsupported scrypt parameters N=%d r=%d p=%d", ErrInvalidArchive, p.N, p.R, p.P)
+	}
+	return nil
+}
+
+// reencryptDBFile opens the standalone database at path and re-encrypts every
+// entry payload and collection from one key to another.
+func reencryptDBFile(ctx context.Context, path string, from, to []byte) error {
+	db, err := storage.OpenDB(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if err := reencryptEntries(ctx, db, from, to); err != nil {
+		_ = db.Close()
+		return err
+	}
+	if err := reencryptCollections(ctx, db, from, to); err != nil {
+		_ = db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+type sealedRow struct {
+	id            string
+	entryType     string
+	schemaVersion int
+	payload       []byte
+	iv            []byte
+	tag           []byte
+}
+
+func (r sealedRow) aad() []byte {
+	return []byte(fmt.Sprintf("schema=%d|id=%s|type=%s", r.schemaVersion, r.id, r.entryType))
+}
+
+func (r sealedRow) open(key []byte) ([]byte, error) {
+	return ccrypto.Decrypt(r.aad(), key, r.iv, r.tag, r.payload)
+}
+
+// forEachSealedRow calls fn for every entries row in db, reading in batches
+// ordered by id so memory stays bounded on large profiles. fn runs with no
+// rows cursor open, so it may write to db.
+func forEachSealedRow(ctx context.Context, db *sql.DB, fn func(sealedRow) error) error {
+	return forEachSealedBatch(ctx, db, func(batch []sealedRow) error {
+		for _, r := range batch {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func forEachSealedBatch(ctx context.Context, db *sql.DB, fn func([]sealedRow) error) error {
+	after := ""
+	for {
+		rows, err := db.QueryContext(ctx,
+			`SELECT id, type, schema_version, payload, iv, tag FROM entries WHERE id > ? ORDER BY id LIMIT ?`,
+			after, reencryptBatchSize)
+		if err != nil {
+			return err
+		}
+		var batch []sealedRow
+		for rows.Next() {
+			var r sealedRow
+			if err := rows.Scan(&r.id, &r.entryType, &r.schemaVersion, &r.payload, &r.iv, &r.tag); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		after = batch[len(batch)-1].id
+	}
+}
+
+// reencryptEntries re-encrypts all entry payloads in db from one key to
+// another, committing one batch at a time.
+func reencryptEntries(ctx context.Context, db *sql.DB, from, to []byte) error {
+	return forEachSealedBatch(ctx, db, func(batch []sealedRow) error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, r := range batch {
+			pt, err := r.open(from)
+			if err != nil {
+				return fmt.Errorf("%w: entry %s: %v", ErrInvalidArchive, r.id, err)
+			}
+			iv, tag, ciphertext, err := ccrypto.Encrypt(r.aad(), to, pt)
+			zero(pt)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE entries SET payload = ?, iv = ?, tag = ? WHERE id = ?`, ciphertext, iv, tag, r.id); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+func extractArchive(r io.Reader, dir string) (archiveManifest, error) {
+	tr := tar.NewReader(r)
+
+	manifest, err := readManifest(tr)
+	if err != nil {
+		return manifest, err
+	}
+
+	expected := make(map[string]archiveFile, len(manifest.Files))
+	for _, f := range manifest.Files {
+		if !filepath.IsLocal(f.Path) {
+			return manifest, fmt.Errorf("%w: unsafe path %q", ErrInvalidArchive, f.Path)
+		}
+		expected[f.Path] = f
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return manifest, err
+		}
+		want, ok := expected[hdr.Name]
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			return manifest, fmt.Errorf("%w: unexpected member %q", ErrInvalidArchive, hdr.Name)
+		}
+		delete(expected, hdr.Name)
+		if err := extractFile(tr, filepath.Join(dir, filepath.FromSlash(want.Path)), want); err != nil {
+			return manifest, err
+		}
+	}
+	for name := range expected {
+		return manifest, fmt.Errorf("%w: missing member %q", ErrInvalidArchive, name)
+	}
+	return manifest, nil
+}
+
+// readManifest reads the manifest, which must be the first member of the
+// archive's tar stream.
+func readManifest(tr *tar.Reader) (archiveManifest, error) {
+	var manifest archiveManifest
+	hdr, err := tr.Next()
+	if err != nil {
+		return manifest, err
+	}
+	if hdr.Name != archiveManifestName {
+		return manifest, fmt.Errorf("%w: manifest missing", ErrInvalidArchive)
+	}
+	raw, err := io.ReadAll(io.LimitReader(tr, maxManifestSize+1))
+	if err != nil {
+		return manifest, err
+	}
+	if int64(len(raw)) > maxManifestSize {
+		return manifest, fmt.Errorf("%w: manifest too large", ErrInvalidArchive)
+	}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return manifest, fmt.Errorf("%w: manifest: %v", ErrInvalidArchive, err)
+	}
+	if manifest.FormatVersion != archiveFormatVersion {
+		return manifest, fmt.Errorf("%w: unsupported format version %d", ErrInvalidArchive, manifest.FormatVersion)
+	}
+	switch manifest.Kind {
+	case ArchiveKindFull, ArchiveKindIncremental, ArchiveKindCollection:
+	default:
+		return manifest, fmt.Errorf("%w: unknown archive kind %q", ErrInvalidArchive, manifest.Kind)
+	}
+	sum := sha256.Sum256(raw)
+	manifest.hash = hex.EncodeToString(sum[:])
+	return manifest, nil
+}
+
+func extractFile(r io.Reader, dst string, want archiveFile) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, want.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != want.Size || hex.EncodeToString(h.Sum(nil)) != want.SHA256 {
+		return fmt.Errorf("%w: checksum mismatch for %q", ErrInvalidArchive, want.Path)
+	}
+	return f.Close()
+}
+
+func encodeArchiveHeader(h archiveHeader) ([]byte, error) {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(archiveMagic)+4+len(body))
+	buf = append(buf, archiveMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+	return append(buf, body...), nil
+}
+
+func decodeArchiveHeader(r io.Reader) (archiveHeader, []byte, error) {
+	var h archiveHeader
+	prefix := make([]byte, len(archiveMagic)+4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return h, nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	if !bytes.Equal(prefix[:len(archiveMagic)], []byte(archiveMagic)) {
+		return h, nil, fmt.Errorf("%w: bad magic", ErrInvalidArchive)
+	}
+	size := binary.BigEndian.Uint32(prefix[len(archiveMagic):])
+	if size > maxArchiveHeaderSize {
+		return h, nil, fmt.Errorf("%w: header too large", ErrInvalidArchive)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return h, nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	if err := json.Unmarshal(body, &h); err != nil {
+		return h, nil, fmt.Errorf("%w: header: %v", ErrInvalidArchive, err)
+	}
+	if h.FormatVersion != archiveFormatVersion {
+		return h, nil, fmt.Errorf("%w: unsupported format version %d", ErrInvalidArchive, h.FormatVersion)
+	}
+	return h, append(prefix, body...), nil
+}
+
+// archiveError maps stream authentication failures to ErrInvalidArchive while
+// keeping the underlying cause inspectable with errors.Is.
+func archiveError(err error) error {
+	if errors.Is(err, ErrInvalidArchive) {
+		return err
+	}
+	if errors.Is(err, ccrypto.ErrStreamTruncated) || errors.Is(err, ccrypto.ErrStreamCorrupt) {
+		return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	if errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %w", ErrInvalidArchive, err)
+	}
+	return err
+}
+
+func writeTarBytes(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name, src string, size int64) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: size}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, size)
+	return err
+}
+
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// VerifyArchive test-restores the archive at src into a scratch directory
+// without touching the live database: the stream and manifest are
+// authenticated, the restored database passes PRAGMA integrity_check and
+// every entry payload decrypts under the archive key.
+func (c *Core) VerifyArchive(ctx context.Context, src string, opts ...ArchiveOption) error {
+	o := newArchiveOptions(opts)
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c.mu.RLock()
+	if !c.isUnlocked() {
+		c.mu.RUnlock()
+		return ErrLocked
+	}
+	sessionKey := append([]byte(nil), c.sessionKey...)
+	dataDir := c.dataDir
+	c.mu.RUnlock()
+	defer zero(sessionKey)
+
+	staging, err := os.MkdirTemp(dataDir, "verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	_, _, archiveKey, err := readArchive(f, sessionKey, o, staging)
+	if err != nil {
+		return err
+	}
+	defer zero(archiveKey)
+
+	db, err := storage.OpenDB(ctx, filepath.Join(staging, dbFileName), false)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	defer db.Close()
+	if err := checkIntegrity(ctx, db); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	err = forEachSealedRow(ctx, db, func(r sealedRow) error {
+		if _, err := r.open(archiveKey); err != nil {
+			return fmt.Errorf("%w: entry %s: %v", ErrInvalidArchive, r.id, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return verifyMediaDir(filepath.Join(staging, mediaDirName), archiveKey)
+}
+
+// checkIntegrity runs SQLite's integrity check and reports the first problem.
+func checkIntegrity(ctx context.Context, db *sql.DB) error {
+	var result string
+	if err := db.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+	return nil
+}
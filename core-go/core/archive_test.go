@@ -0,0 +1,258 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ccrypto "logwayss/core-go/internal/crypto"
+)
+
+var testScrypt = ccrypto.ScryptParams{N: 1 << 10, R: 8, P: 1}
+
+// newTestCore returns an unlocked Core backed by a fresh profile.
+func newTestCore(t *testing.T) *Core {
+	t.Helper()
+	ctx := context.Background()
+	c := New()
+	dir := t.TempDir()
+	if err := c.CreateProfile(ctx, dir, []byte("password"), testScrypt); err != nil {
+		t.Fatalf("CreateProfile failed: %v", err)
+	}
+	if err := c.UnlockProfile(ctx, dir, []byte("password")); err != nil {
+		t.Fatalf("UnlockProfile failed: %v", err)
+	}
+	t.Cleanup(c.Lock)
+	return c
+}
+
+func TestArchiveStreamRoundtrip(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+
+	kept, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"kept"}`)})
+	if err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.ExportArchiveTo(ctx, &buf); err != nil {
+		t.Fatalf("ExportArchiveTo failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	if _, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"dropped"}`)}); err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+
+	// A truncated stream must be rejected and leave the live data untouched.
+	err = c.ImportArchiveFrom(ctx, bytes.NewReader(archive[:len(archive)-10]))
+	if !errors.Is(err, ErrInvalidArchive) || !errors.Is(err, ccrypto.ErrStreamTruncated) {
+		t.Fatalf("truncated import: got %v", err)
+	}
+	if entries, _ := c.Query(ctx, QueryFilter{}, Pagination{}); len(entries) != 2 {
+		t.Fatalf("failed import modified data: got %d entries", len(entries))
+	}
+
+	if err := c.ImportArchiveFrom(ctx, bytes.NewReader(archive)); err != nil {
+		t.Fatalf("ImportArchiveFrom failed: %v", err)
+	}
+	entries, err := c.Query(ctx, QueryFilter{}, Pagination{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(entries) != 1 || entries[0].ID != kept.ID {
+		t.Fatalf("restored dataset mismatch: got %d entries", len(entries))
+	}
+}
+
+func TestArchiveImportDoesNotHoldCore(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+	if _, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"kept"}`)}); err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := c.ExportArchiveTo(ctx, &buf); err != nil {
+		t.Fatalf("ExportArchiveTo failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	// importSlowly starts an import whose reader stalls halfway, runs during
+	// the stall, then delivers the rest and returns the import's result.
+	importSlowly := func(during func()) error {
+		pr, pw := io.Pipe()
+		// Ends the import if during fails the test.
+		defer pw.CloseWithError(io.ErrUnexpectedEOF)
+		done := make(chan error, 1)
+		go func() { done <- c.ImportArchiveFrom(ctx, pr) }()
+		if _, err := pw.Write(archive[:len(archive)/2]); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		during()
+		go func() {
+			pw.Write(archive[len(archive)/2:])
+			pw.Close()
+		}()
+		return <-done
+	}
+
+	// The profile stays usable while the archive is still arriving.
+	err := importSlowly(func() {
+		queried := make(chan error, 1)
+		go func() {
+			_, err := c.Query(ctx, QueryFilter{}, Pagination{})
+			queried <- err
+		}()
+		select {
+		case err := <-queried:
+			if err != nil {
+				t.Fatalf("Query during import failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Query blocked by an import waiting on its reader")
+		}
+	})
+	if err != nil {
+		t.Fatalf("ImportArchiveFrom failed: %v", err)
+	}
+
+	// A profile locked meanwhile is not replaced.
+	if err := importSlowly(c.Lock); !errors.Is(err, ErrLocked) {
+		t.Fatalf("import into a profile locked during the read: got %v, want ErrLocked", err)
+	}
+}
+
+func TestArchivePassphrasePortability(t *testing.T) {
+	ctx := context.Background()
+	src := newTestCore(t)
+	dst := newTestCore(t)
+
+	created, err := src.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"moving house"}`)})
+	if err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	pass := []byte("export passphrase")
+	if err := src.ExportArchiveTo(ctx, &buf, WithPassphrase(pass), WithScrypt(testScrypt)); err != nil {
+		t.Fatalf("ExportArchiveTo failed: %v", err)
+	}
+	archive := buf.Bytes()
+
+	if err := dst.ImportArchiveFrom(ctx, bytes.NewReader(archive)); !errors.Is(err, ErrArchivePassphraseRequired) {
+		t.Fatalf("import without passphrase: got %v", err)
+	}
+	if err := dst.ImportArchiveFrom(ctx, bytes.NewReader(archive), WithPassphrase([]byte("wrong"))); !errors.Is(err, ErrInvalidArchivePassphrase) {
+		t.Fatalf("import with wrong passphrase: got %v", err)
+	}
+	if err := dst.ImportArchiveFrom(ctx, bytes.NewReader(archive), WithPassphrase(pass)); err != nil {
+		t.Fatalf("ImportArchiveFrom failed: %v", err)
+	}
+
+	got, err := dst.GetEntry(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("GetEntry after import failed: %v", err)
+	}
+	if string(got.Payload) != `{"text":"moving house"}` {
+		t.Fatalf("payload mismatch: %s", got.Payload)
+	}
+}
+
+func TestArchiveRejectsCostlyScrypt(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+	pass := []byte("export passphrase")
+
+	huge := ccrypto.ScryptParams{N: 1 << 40, R: 8, P: 1}
+	if err := c.ExportArchiveTo(ctx, io.Discard, WithPassphrase(pass), WithScrypt(huge)); !errors.Is(err, ErrInvalidArchive) {
+		t.Fatalf("export with huge N: got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := c.ExportArchiveTo(ctx, &buf, WithPassphrase(pass), WithScrypt(testScrypt)); err != nil {
+		t.Fatalf("ExportArchiveTo failed: %v", err)
+	}
+	header, headerBytes, err := decodeArchiveHeader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decodeArchiveHeader failed: %v", err)
+	}
+	rest := buf.Bytes()[len(headerBytes):]
+	for _, p := range []ccrypto.ScryptParams{
+		huge,
+		{N: 1000, R: 8, P: 1},
+		{N: 1 << 10, R: 1 << 20, P: 1},
+		{N: 1 << 10, R: 8, P: 1 << 20},
+		{N: 1 << 10, R: 0, P: 1},
+	} {
+		header.Scrypt = &p
+		crafted, err := encodeArchiveHeader(header)
+		if err != nil {
+			t.Fatalf("encodeArchiveHeader failed: %v", err)
+		}
+		crafted = append(crafted, rest...)
+		if err := c.ImportArchiveFrom(ctx, bytes.NewReader(crafted), WithPassphrase(pass)); !errors.Is(err, ErrInvalidArchive) {
+			t.Fatalf("import with scrypt %+v: got %v", p, err)
+		}
+	}
+}
+
+func TestIncrementalChainRestore(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+	dir := t.TempDir()
+	add := func(text string) Entry {
+		e, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"` + text + `"}`)})
+		if err != nil {
+			t.Fatalf("CreateEntry failed: %v", err)
+		}
+		return e
+	}
+	export := func(name string, opts ...ArchiveOption) (string, ArchiveInfo) {
+		path := filepath.Join(dir, name)
+		if err := c.ExportArchive(ctx, path, opts...); err != nil {
+			t.Fatalf("ExportArchive(%s) failed: %v", name, err)
+		}
+		info, err := c.InspectArchive(ctx, path)
+		if err != nil {
+			t.Fatalf("InspectArchive(%s) failed: %v", name, err)
+		}
+		return path, info
+	}
+
+	add("one")
+	full, fullInfo := export("full.lwx")
+	second := add("two")
+	inc1, inc1Info := export("inc1.lwx", WithIncrementalSince(fullInfo))
+	add("three")
+	inc2, inc2Info := export("inc2.lwx", WithIncrementalSince(inc1Info))
+
+	if inc1Info.Parent != fullInfo.Hash || inc2Info.Parent != inc1Info.Hash {
+		t.Fatalf("chain hashes not linked: %+v %+v %+v", fullInfo, inc1Info, inc2Info)
+	}
+	if inc1Info.HighWater.ID != second.ID {
+		t.Fatalf("incremental high-water = %+v, want id %s", inc1Info.HighWater, second.ID)
+	}
+	if err := c.ImportArchive(ctx, inc1); !errors.Is(err, ErrIncrementalArchive) {
+		t.Fatalf("importing an incremental alone: got %v", err)
+	}
+	if err := c.RestoreChain(ctx, []string{full, inc2}); !errors.Is(err, ErrArchiveChainGap) {
+		t.Fatalf("restoring with a gap: got %v", err)
+	}
+
+	add("four")
+	if err := c.RestoreChain(ctx, []string{inc2, full, inc1}); err != nil {
+		t.Fatalf("RestoreChain failed: %v", err)
+	}
+	entries, err := c.Query(ctx, QueryFilter{}, Pagination{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("restored %d entries, want 3", len(entries))
+	}
+}
@@ -0,0 +1,180 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"logwayss/core-go/internal/storage"
+)
+
+// Collection archives (spec §6.4) hold one collection, the collections
+// nested in it, their entries and the media those entries refer to. They are
+// merged into a profile with RestoreCollection rather than replacing it.
+var (
+	ErrCollectionArchive     = errors.New("collection archive cannot replace a profile; use RestoreCollection")
+	ErrCollectionIncremental = errors.New("collection archives cannot be incremental")
+)
+
+const ArchiveKindCollection = "collection"
+
+var (
+	copyCollectionsSQL = `INSERT INTO collections (id, parent_id, position, created_at, updated_at, schema_version, sealed, iv, tag)
+		SELECT id, parent_id, position, created_at, updated_at, schema_version, sealed, iv, tag FROM delta.collections`
+	copyCollectionEntriesSQL = `INSERT OR IGNORE INTO collection_entries (collection_id, entry_id, position, added_at)
+		SELECT collection_id, entry_id, position, added_at FROM delta.collection_entries`
+
+	// mergeCollectionSQL replaces the archived collections in main with the
+	// ones in delta. A root whose parent no longer exists moves to the end
+	// of the top level.
+	mergeCollectionSQL = []string{
+		`DELETE FROM collection_entries WHERE collection_id IN (SELECT id FROM delta.collections)`,
+		`DELETE FROM collections WHERE id IN (SELECT id FROM delta.collections)`,
+		copyCollectionsSQL,
+		copyCollectionEntriesSQL,
+		`UPDATE collections SET parent_id = NULL,
+			position = (SELECT COALESCE(MAX(position) + 1, 0) FROM collections WHERE parent_id IS NULL)
+		WHERE parent_id IS NOT NULL AND parent_id NOT IN (SELECT id FROM collections)
+			AND id IN (SELECT id FROM delta.collections)`,
+	}
+)
+
+// WithCollection makes the export a collection archive of the collection id
+// and everything nested in it.
+func WithCollection(id string) ArchiveOption {
+	return func(o *archiveOptions) { o.collection = id }
+}
+
+// RestoreCollection merges the collection archive at src into the profile.
+// Its collections replace any with the same IDs, and its entries replace
+// earlier versions of themselves; nothing else in the profile changes.
+func (c *Core) RestoreCollection(ctx context.Context, src string, opts ...ArchiveOption) error {
+	o := newArchiveOptions(opts)
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(c.dataDir, "restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	header, manifest, archiveKey, err := readArchive(f, c.sessionKey, o, staging)
+	if err != nil {
+		return err
+	}
+	defer zero(archiveKey)
+	if manifest.Kind != ArchiveKindCollection {
+		return fmt.Errorf("%w: %s archive is not a collection archive", ErrInvalidArchive, manifest.Kind)
+	}
+	delta := filepath.Join(staging, dbFileName)
+	if header.KDF == archiveKDFScrypt {
+		if err := reencryptDBFile(ctx, delta, archiveKey, c.sessionKey); err != nil {
+			return err
+		}
+		if err := rewrapMediaDir(filepath.Join(staging, mediaDirName), archiveKey, c.sessionKey); err != nil {
+			return err
+		}
+	}
+	if err := migrateFile(ctx, delta); err != nil {
+		return err
+	}
+
+	// Media goes first: an entry must never be visible before its blob.
+	c.mediaMu.Lock()
+	err = mergeMedia(filepath.Join(staging, mediaDirName), filepath.Join(c.dataDir, mediaDirName))
+	c.mediaMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := mergeAttached(ctx, c.db, delta, append(slices.Clone(mergeEntriesSQL), mergeCollectionSQL...)); err != nil {
+		return err
+	}
+	return c.loadEntryTypes(ctx)
+}
+
+// trimToCollection deletes everything outside the collection id from the
+// snapshot at path and compacts it.
+func trimToCollection(ctx context.Context, path, id string) error {
+	db, err := storage.OpenDB(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM collections WHERE id = ?", id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	if _, err := db.ExecContext(ctx, subtreeSQL+` DELETE FROM collections WHERE id NOT IN subtree`, id); err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		`DELETE FROM collection_entries WHERE collection_id NOT IN (SELECT id FROM collections)`,
+		`DELETE FROM entries WHERE id NOT IN (SELECT entry_id FROM collection_entries)`,
+		`DELETE FROM entry_tags WHERE entry_id NOT IN (SELECT id FROM entries)`,
+		`DELETE FROM relations WHERE from_id NOT IN (SELECT id FROM entries)`,
+		`DELETE FROM quarantine`,
+		`VACUUM`,
+	} {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return db.Close()
+}
+
+// mediaRefsOf returns the media referenced by the media_ref entries in the
+// database at path, whose payloads are encrypted under key.
+func mediaRefsOf(ctx context.Context, path string, key []byte) (map[string]bool, error) {
+	db, err := storage.OpenDB(ctx, path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	refs := make(map[string]bool)
+	err = forEachSealedRow(ctx, db, func(r sealedRow) error {
+		if EntryType(r.entryType) != EntryTypeMediaRef {
+			return nil
+		}
+		pt, err := r.open(key)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrCorruptEntry, r.id)
+		}
+		var p mediaRefPayload
+		err = json.Unmarshal(pt, &p)
+		zero(pt)
+		if err == nil {
+			refs[p.Ref] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, db.Close()
+}
+
+// trimMediaToRefs removes the media under dir that is not in refs.
+func trimMediaToRefs(dir string, refs map[string]bool) error {
+	return walkMediaSidecars(dir, func(path, ref string) error {
+		if refs[ref] {
+			return nil
+		}
+		return removeMedia(path)
+	})
+}
@@ -0,0 +1,554 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	ccrypto "logwayss/core-go/internal/crypto"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Collections (spec §6.1) group entries into notebooks. A collection has an
+// encrypted name and description, may sit inside another collection, and
+// keeps its entries and sub-collections in a user-defined order. An entry
+// can belong to any number of collections; deleting a collection never
+// deletes entries.
+var (
+	ErrInvalidCollection = errors.New("invalid collection")
+	ErrCollectionCycle   = errors.New("collection cannot be moved inside itself")
+	ErrCollectionOrder   = errors.New("order must list every entry of the collection exactly once")
+
+	maxCollectionName        = 200
+	maxCollectionDescription = 4000
+
+	collectionsSQL = `
+		CREATE TABLE IF NOT EXISTS collections (
+			id TEXT PRIMARY KEY,
+			parent_id TEXT,
+			position INTEGER NOT NULL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			schema_version INTEGER NOT NULL,
+			sealed BLOB NOT NULL,
+			iv BLOB NOT NULL,
+			tag BLOB NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_collections_parent ON collections(parent_id, position);
+		CREATE TABLE IF NOT EXISTS collection_entries (
+			collection_id TEXT NOT NULL,
+			entry_id TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			added_at TEXT NOT NULL,
+			PRIMARY KEY (collection_id, entry_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_collection_entries_entry ON collection_entries(entry_id);
+`
+	// subtreeSQL is a recursive CTE "subtree(id)" of the collection given as
+	// the first query argument and everything nested inside it.
+	subtreeSQL = `
+		WITH RECURSIVE subtree(id) AS (
+			SELECT ?
+			UNION
+			SELECT c.id FROM collections c JOIN subtree ON c.parent_id = subtree.id
+		)`
+)
+
+// Collection is a named, ordered group of entries.
+type Collection struct {
+	ID string `json:"id"`
+	// ParentID is the enclosing collection, or "" at the top level.
+	ParentID    string    `json:"parent_id,omitempty"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Position    int       `json:"position"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// NewCollection is used to create a collection.
+type NewCollection struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	ParentID    string `json:"parent_id,omitempty"`
+}
+
+// collectionText is the encrypted part of a collection.
+type collectionText struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+func (t collectionText) validate() error {
+	var found issues
+	if t.Name == "" {
+		found.add(ErrInvalidCollection, "name", CodeRequired, "is required")
+	} else if len(t.Name) > maxCollectionName {
+		found.add(ErrInvalidCollection, "name", CodeTooLong, fmt.Sprintf("must be at most %d bytes", maxCollectionName))
+	}
+	if len(t.Description) > maxCollectionDescription {
+		found.add(ErrInvalidCollection, "description", CodeTooLong, fmt.Sprintf("must be at most %d bytes", maxCollectionDescription))
+	}
+	return found.err()
+}
+
+func collectionAAD(schemaVersion int, id string) []byte {
+	return []byte(fmt.Sprintf("schema=%d|collection=%s", schemaVersion, id))
+}
+
+// CreateCollection creates a collection at the end of its parent, or of the
+// top level when nc.ParentID is empty.
+func (c *Core) CreateCollection(ctx context.Context, nc NewCollection) (Collection, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.writable(); err != nil {
+		return Collection{}, err
+	}
+	text := collectionText{Name: nc.Name, Description: nc.Description}
+	if err := text.validate(); err != nil {
+		return Collection{}, err
+	}
+
+	now := time.Now().UTC()
+	id, err := ulid.New(ulid.Timestamp(now), ulid.Monotonic(rand.Reader, 0))
+	if err != nil {
+		return Collection{}, fmt.Errorf("failed to generate collection ID: %w", err)
+	}
+	col := Collection{ID: id.String(), ParentID: nc.ParentID, Name: nc.Name, Description: nc.Description, CreatedAt: now, UpdatedAt: now}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Collection{}, err
+	}
+	defer tx.Rollback()
+	if err := checkParent(ctx, tx, col.ParentID); err != nil {
+		return Collection{}, err
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(position) + 1, 0) FROM collections WHERE parent_id IS ?",
+		nullable(col.ParentID)).Scan(&col.Position); err != nil {
+		return Collection{}, err
+	}
+	sealed, iv, tag, err := c.sealCollection(col.ID, text)
+	if err != nil {
+		return Collection{}, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO collections (id, parent_id, position, created_at, updated_at, schema_version, sealed, iv, tag)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		col.ID, nullable(col.ParentID), col.Position, now.Format(storedTimeFormat), now.Format(storedTimeFormat), schemaVersion, sealed, iv, tag); err != nil {
+		return Collection{}, err
+	}
+	return col, tx.Commit()
+}
+
+// GetCollection returns the collection id.
+func (c *Core) GetCollection(ctx context.Context, id string) (Collection, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return Collection{}, ErrLocked
+	}
+	cols, err := c.queryCollections(ctx, "WHERE id = ?", id)
+	if err != nil {
+		return Collection{}, err
+	}
+	if len(cols) == 0 {
+		return Collection{}, ErrNotFound
+	}
+	return cols[0], nil
+}
+
+// ListCollections returns the collections directly inside parentID, or the
+// top-level ones when parentID is empty, in order.
+func (c *Core) ListCollections(ctx context.Context, parentID string) ([]Collection, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return nil, ErrLocked
+	}
+	return c.queryCollections(ctx, "WHERE parent_id IS ? ORDER BY position, id", nullable(parentID))
+}
+
+// RenameCollection replaces the name and description of a collection.
+func (c *Core) RenameCollection(ctx context.Context, id, name, description string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	text := collectionText{Name: name, Description: description}
+	if err := text.validate(); err != nil {
+		return err
+	}
+	sealed, iv, tag, err := c.sealCollection(id, text)
+	if err != nil {
+		return err
+	}
+	res, err := c.db.ExecContext(ctx, `UPDATE collections SET sealed = ?, iv = ?, tag = ?, schema_version = ?, updated_at = ? WHERE id = ?`,
+		sealed, iv, tag, schemaVersion, time.Now().UTC().Format(storedTimeFormat), id)
+	return rowAffected(res, err)
+}
+
+// MoveCollection moves a collection inside parentID ("" for the top level)
+// at position among its new siblings; positions past the end append.
+func (c *Core) MoveCollection(ctx context.Context, id, parentID string, position int) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := collectionExists(ctx, tx, id); err != nil {
+		return err
+	}
+	if err := checkParent(ctx, tx, parentID); err != nil {
+		return err
+	}
+	if parentID != "" {
+		var inside int
+		if err := tx.QueryRowContext(ctx, subtreeSQL+` SELECT COUNT(*) FROM subtree WHERE id = ?`, id, parentID).Scan(&inside); err != nil {
+			return err
+		}
+		if inside > 0 {
+			return ErrCollectionCycle
+		}
+	}
+
+	siblings, err := txIDs(ctx, tx, "SELECT id FROM collections WHERE parent_id IS ? AND id != ? ORDER BY position, id", nullable(parentID), id)
+	if err != nil {
+		return err
+	}
+	position = max(0, min(position, len(siblings)))
+	siblings = append(siblings[:position], append([]string{id}, siblings[position:]...)...)
+	now := time.Now().UTC().Format(storedTimeFormat)
+	if _, err := tx.ExecContext(ctx, "UPDATE collections SET parent_id = ?, updated_at = ? WHERE id = ?", nullable(parentID), now, id); err != nil {
+		return err
+	}
+	for i, sib := range siblings {
+		if _, err := tx.ExecContext(ctx, "UPDATE collections SET position = ? WHERE id = ?", i, sib); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteCollection deletes a collection and every collection nested in it.
+// Their entries are kept.
+func (c *Core) DeleteCollection(ctx context.Context, id string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := collectionExists(ctx, tx, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, subtreeSQL+` DELETE FROM collection_entries WHERE collection_id IN subtree`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, subtreeSQL+` DELETE FROM collections WHERE id IN subtree`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddToCollection appends entries to a collection. Entries already in it
+// keep their place.
+func (c *Core) AddToCollection(ctx context.Context, collectionID string, entryIDs ...string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := collectionExists(ctx, tx, collectionID); err != nil {
+		return err
+	}
+	var next int
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(position) + 1, 0) FROM collection_entries WHERE collection_id = ?", collectionID).Scan(&next); err != nil {
+		return err
+	}
+	var found issues
+	now := time.Now().UTC().Format(storedTimeFormat)
+	for i, entryID := range entryIDs {
+		var n int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM entries WHERE id = ?", entryID).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			found.add(ErrNotFound, fmt.Sprintf("entry_ids[%d]", i), CodeReference, fmt.Sprintf("entry %s does not exist", entryID))
+			continue
+		}
+		res, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO collection_entries (collection_id, entry_id, position, added_at) VALUES (?, ?, ?, ?)",
+			collectionID, entryID, next, now)
+		if err != nil {
+			return err
+		}
+		if added, _ := res.RowsAffected(); added > 0 {
+			next++
+		}
+	}
+	if err := found.err(); err != nil {
+		return err
+	}
+	if err := touchCollection(ctx, tx, collectionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveFromCollection removes entries from a collection. Entries that are
+// not in it are ignored.
+func (c *Core) RemoveFromCollection(ctx context.Context, collectionID string, entryIDs ...string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := collectionExists(ctx, tx, collectionID); err != nil {
+		return err
+	}
+	for _, entryID := range entryIDs {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM collection_entries WHERE collection_id = ? AND entry_id = ?", collectionID, entryID); err != nil {
+			return err
+		}
+	}
+	if err := touchCollection(ctx, tx, collectionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetCollectionOrder puts the entries of a collection in the given order,
+// which must list each of them exactly once.
+func (c *Core) SetCollectionOrder(ctx context.Context, collectionID string, entryIDs []string) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := collectionExists(ctx, tx, collectionID); err != nil {
+		return err
+	}
+	members, err := txIDs(ctx, tx, "SELECT entry_id FROM collection_entries WHERE collection_id = ?", collectionID)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(entryIDs))
+	for _, id := range entryIDs {
+		seen[id] = true
+	}
+	if len(seen) != len(entryIDs) || len(entryIDs) != len(members) {
+		return ErrCollectionOrder
+	}
+	for _, id := range members {
+		if !seen[id] {
+			return ErrCollectionOrder
+		}
+	}
+	for i, id := range entryIDs {
+		if _, err := tx.ExecContext(ctx, "UPDATE collection_entries SET position = ? WHERE collection_id = ? AND entry_id = ?", i, collectionID, id); err != nil {
+			return err
+		}
+	}
+	if err := touchCollection(ctx, tx, collectionID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// EntryCollections returns the IDs of the collections entryID belongs to.
+func (c *Core) EntryCollections(ctx context.Context, entryID string) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return nil, ErrLocked
+	}
+	return c.queryIDs(ctx, "SELECT collection_id FROM collection_entries WHERE entry_id = ? ORDER BY collection_id", entryID)
+}
+
+func (c *Core) sealCollection(id string, text collectionText) (sealed, iv, tag []byte, err error) {
+	pt, err := json.Marshal(text)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer zero(pt)
+	iv, tag, sealed, err = ccrypto.Encrypt(collectionAAD(schemaVersion, id), c.sessionKey, pt)
+	return sealed, iv, tag, err
+}
+
+// queryCollections reads and decrypts the collections selected by where.
+// The caller must hold c.mu.
+func (c *Core) queryCollections(ctx context.Context, where string, args ...any) ([]Collection, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT id, parent_id, position, created_at, updated_at, schema_version, sealed, iv, tag FROM collections `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cols []Collection
+	for rows.Next() {
+		var col Collection
+		var parent sql.NullString
+		var createdAt, updatedAt string
+		var version int
+		var sealed, iv, tag []byte
+		if err := rows.Scan(&col.ID, &parent, &col.Position, &createdAt, &updatedAt, &version, &sealed, &iv, &tag); err != nil {
+			return nil, err
+		}
+		pt, err := ccrypto.Decrypt(collectionAAD(version, col.ID), c.sessionKey, iv, tag, sealed)
+		if err != nil {
+			return nil, fmt.Errorf("%w: collection %s: %v", ErrCorruptEntry, col.ID, err)
+		}
+		var text collectionText
+		err = json.Unmarshal(pt, &text)
+		zero(pt)
+		if err != nil {
+			return nil, fmt.Errorf("%w: collection %s: %v", ErrCorruptEntry, col.ID, err)
+		}
+		col.ParentID, col.Name, col.Description = parent.String, text.Name, text.Description
+		col.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt)
+		col.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt)
+		cols = append(cols, col)
+	}
+	return cols, rows.Err()
+}
+
+// reencryptCollections re-encrypts every collection name and description in
+// db from one key to another.
+func reencryptCollections(ctx context.Context, db *sql.DB, from, to []byte) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, "SELECT id, schema_version, sealed, iv, tag FROM collections")
+	if err != nil {
+		return err
+	}
+	type sealedCollection struct {
+		id              string
+		version         int
+		sealed, iv, tag []byte
+	}
+	var all []sealedCollection
+	for rows.Next() {
+		var s sealedCollection
+		if err := rows.Scan(&s.id, &s.version, &s.sealed, &s.iv, &s.tag); err != nil {
+			rows.Close()
+			return err
+		}
+		all = append(all, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, s := range all {
+		aad := collectionAAD(s.version, s.id)
+		pt, err := ccrypto.Decrypt(aad, from, s.iv, s.tag, s.sealed)
+		if err != nil {
+			return fmt.Errorf("%w: collection %s: %v", ErrInvalidArchive, s.id, err)
+		}
+		iv, tag, sealed, err := ccrypto.Encrypt(aad, to, pt)
+		zero(pt)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE collections SET sealed = ?, iv = ?, tag = ? WHERE id = ?", sealed, iv, tag, s.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func checkParent(ctx context.Context, tx *sql.Tx, parentID string) error {
+	if parentID == "" {
+		return nil
+	}
+	if err := collectionExists(ctx, tx, parentID); errors.Is(err, ErrNotFound) {
+		var found issues
+		found.add(ErrInvalidCollection, "parent_id", CodeReference, fmt.Sprintf("collection %s does not exist", parentID))
+		return found.err()
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func collectionExists(ctx context.Context, tx *sql.Tx, id string) error {
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM collections WHERE id = ?", id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func touchCollection(ctx context.Context, tx *sql.Tx, id string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE collections SET updated_at = ? WHERE id = ?", time.Now().UTC().Format(storedTimeFormat), id)
+	return err
+}
+
+func txIDs(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func rowAffected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// nullable maps "" to SQL NULL.
+func nullable(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
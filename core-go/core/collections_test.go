@@ -0,0 +1,234 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCollections(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+
+	create := func(text string) Entry {
+		t.Helper()
+		e, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"` + text + `"}`)})
+		if err != nil {
+			t.Fatalf("CreateEntry(%s) failed: %v", text, err)
+		}
+		return e
+	}
+	ids := func(entries []Entry) []string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.ID)
+		}
+		return out
+	}
+	a, b, d := create("a"), create("b"), create("d")
+
+	trips, err := c.CreateCollection(ctx, NewCollection{Name: "Trips", Description: "Places I went"})
+	if err != nil {
+		t.Fatalf("CreateCollection failed: %v", err)
+	}
+	japan, err := c.CreateCollection(ctx, NewCollection{Name: "Japan", ParentID: trips.ID})
+	if err != nil {
+		t.Fatalf("CreateCollection(nested) failed: %v", err)
+	}
+	if _, err := c.CreateCollection(ctx, NewCollection{Name: ""}); !errors.Is(err, ErrInvalidCollection) || Issues(err)[0].Code != CodeRequired {
+		t.Fatalf("empty name: %v", err)
+	}
+	if _, err := c.CreateCollection(ctx, NewCollection{Name: "x", ParentID: "missing"}); Issues(err) == nil || Issues(err)[0].Code != CodeReference {
+		t.Fatalf("missing parent: %v", err)
+	}
+
+	// Names are encrypted at rest.
+	var sealed []byte
+	if err := c.db.QueryRowContext(ctx, "SELECT sealed FROM collections WHERE id = ?", trips.ID).Scan(&sealed); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("Trips")) {
+		t.Fatal("collection name stored in plaintext")
+	}
+
+	if err := c.AddToCollection(ctx, japan.ID, b.ID, a.ID, d.ID, a.ID); err != nil {
+		t.Fatalf("AddToCollection failed: %v", err)
+	}
+	got, err := c.Query(ctx, QueryFilter{Collection: japan.ID}, Pagination{})
+	if err != nil || !slices.Equal(ids(got), []string{b.ID, a.ID, d.ID}) {
+		t.Fatalf("Query(collection) = %v, %v", ids(got), err)
+	}
+	if err := c.AddToCollection(ctx, japan.ID, "missing"); !errors.Is(err, ErrNotFound) || Issues(err)[0].Code != CodeReference {
+		t.Fatalf("add missing entry: %v", err)
+	}
+	if err := c.SetCollectionOrder(ctx, japan.ID, []string{d.ID, b.ID}); !errors.Is(err, ErrCollectionOrder) {
+		t.Fatalf("partial order: %v", err)
+	}
+	if err := c.SetCollectionOrder(ctx, japan.ID, []string{d.ID, b.ID, a.ID}); err != nil {
+		t.Fatalf("SetCollectionOrder failed: %v", err)
+	}
+	if err := c.RemoveFromCollection(ctx, japan.ID, b.ID); err != nil {
+		t.Fatalf("RemoveFromCollection failed: %v", err)
+	}
+	got, err = c.Query(ctx, QueryFilter{Collection: japan.ID, Type: EntryTypeText}, Pagination{Limit: 10})
+	if err != nil || !slices.Equal(ids(got), []string{d.ID, a.ID}) {
+		t.Fatalf("Query after reorder = %v, %v", ids(got), err)
+	}
+	in, err := c.EntryCollections(ctx, a.ID)
+	if err != nil || !slices.Equal(in, []string{japan.ID}) {
+		t.Fatalf("EntryCollections = %v, %v", in, err)
+	}
+
+	if err := c.RenameCollection(ctx, japan.ID, "Japan 2024", "Spring"); err != nil {
+		t.Fatalf("RenameCollection failed: %v", err)
+	}
+	if got, err := c.GetCollection(ctx, japan.ID); err != nil || got.Name != "Japan 2024" || got.Description != "Spring" || got.ParentID != trips.ID {
+		t.Fatalf("GetCollection = %+v, %v", got, err)
+	}
+	if err := c.RenameCollection(ctx, "missing", "x", ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("rename missing: %v", err)
+	}
+
+	// Moving a collection into its own subtree is refused.
+	if err := c.MoveCollection(ctx, trips.ID, japan.ID, 0); !errors.Is(err, ErrCollectionCycle) {
+		t.Fatalf("move into child: %v", err)
+	}
+	work, err := c.CreateCollection(ctx, NewCollection{Name: "Work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MoveCollection(ctx, japan.ID, "", 0); err != nil {
+		t.Fatalf("MoveCollection failed: %v", err)
+	}
+	top, err := c.ListCollections(ctx, "")
+	if err != nil || len(top) != 3 || top[0].ID != japan.ID || top[1].ID != trips.ID || top[2].ID != work.ID {
+		t.Fatalf("ListCollections after move = %+v, %v", top, err)
+	}
+
+	// Deleting a collection removes what is nested in it but keeps entries.
+	if err := c.MoveCollection(ctx, japan.ID, trips.ID, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteCollection(ctx, trips.ID); err != nil {
+		t.Fatalf("DeleteCollection failed: %v", err)
+	}
+	if _, err := c.GetCollection(ctx, japan.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("nested collection survived delete: %v", err)
+	}
+	if _, err := c.GetEntry(ctx, a.ID); err != nil {
+		t.Fatalf("entry deleted with its collection: %v", err)
+	}
+	var members int
+	if err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM collection_entries").Scan(&members); err != nil || members != 0 {
+		t.Fatalf("memberships left behind: %d, %v", members, err)
+	}
+}
+
+func TestCollectionArchive(t *testing.T) {
+	ctx := context.Background()
+	src := newTestCore(t)
+	dst := newTestCore(t)
+
+	inside, err := src.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"inside"}`), Tags: []string{"kept"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err := src.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"outside"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keptRef, err := src.PutMedia(ctx, bytes.NewReader([]byte("kept media")), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo, err := src.CreateMediaEntry(ctx, NewEntry{Type: EntryTypeMediaRef, Payload: []byte(`{"ref":"` + keptRef + `","type":"image"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	droppedRef, err := src.PutMedia(ctx, bytes.NewReader([]byte("other media")), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notebook, err := src.CreateCollection(ctx, NewCollection{Name: "Notebook"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chapter, err := src.CreateCollection(ctx, NewCollection{Name: "Chapter", ParentID: notebook.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := src.CreateCollection(ctx, NewCollection{Name: "Other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddToCollection(ctx, chapter.ID, inside.ID, photo.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.AddToCollection(ctx, other.ID, outside.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.ExportArchive(ctx, filepath.Join(t.TempDir(), "x"), WithCollection(notebook.ID), WithIncrementalSince(ArchiveInfo{})); !errors.Is(err, ErrCollectionIncremental) {
+		t.Fatalf("incremental collection archive: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "notebook.lwx")
+	pass := []byte("share")
+	if err := src.ExportArchive(ctx, path, WithCollection(notebook.ID), WithPassphrase(pass), WithScrypt(testScrypt)); err != nil {
+		t.Fatalf("ExportArchive(collection) failed: %v", err)
+	}
+	info, err := dst.InspectArchive(ctx, path, WithPassphrase(pass))
+	if err != nil || info.Kind != ArchiveKindCollection || info.Collection != notebook.ID {
+		t.Fatalf("InspectArchive = %+v, %v", info, err)
+	}
+	if err := dst.ImportArchive(ctx, path, WithPassphrase(pass)); !errors.Is(err, ErrCollectionArchive) {
+		t.Fatalf("ImportArchive(collection): %v", err)
+	}
+
+	existing, err := dst.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"mine"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.RestoreCollection(ctx, path, WithPassphrase(pass)); err != nil {
+		t.Fatalf("RestoreCollection failed: %v", err)
+	}
+	if _, err := dst.GetEntry(ctx, existing.ID); err != nil {
+		t.Fatalf("existing entry lost: %v", err)
+	}
+	if _, err := dst.GetEntry(ctx, outside.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("entry outside the collection was restored: %v", err)
+	}
+	got, err := dst.GetEntry(ctx, inside.ID)
+	if err != nil || string(got.Payload) != `{"text":"inside"}` || !slices.Equal(got.Tags, []string{"kept"}) {
+		t.Fatalf("restored entry = %+v, %v", got, err)
+	}
+	restored, err := dst.GetCollection(ctx, chapter.ID)
+	if err != nil || restored.Name != "Chapter" || restored.ParentID != notebook.ID {
+		t.Fatalf("restored collection = %+v, %v", restored, err)
+	}
+	if _, err := dst.GetCollection(ctx, other.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("collection outside the archive was restored: %v", err)
+	}
+	members, err := dst.Query(ctx, QueryFilter{Collection: chapter.ID}, Pagination{})
+	if err != nil || len(members) != 2 || members[0].ID != inside.ID {
+		t.Fatalf("restored members = %v, %v", members, err)
+	}
+	if _, err := dst.StatMedia(ctx, keptRef); err != nil {
+		t.Fatalf("media of a member not restored: %v", err)
+	}
+	if _, err := dst.StatMedia(ctx, droppedRef); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("media outside the collection was restored: %v", err)
+	}
+
+	// Restoring again replaces the collection rather than duplicating it.
+	if err := dst.RestoreCollection(ctx, path, WithPassphrase(pass)); err != nil {
+		t.Fatalf("second RestoreCollection failed: %v", err)
+	}
+	top, err := dst.ListCollections(ctx, "")
+	if err != nil || len(top) != 1 || top[0].ID != notebook.ID {
+		t.Fatalf("top-level collections after second restore = %+v, %v", top, err)
+	}
+}
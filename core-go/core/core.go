@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -31,7 +30,10 @@ var (
 	profileMagic      = "LOGWAYSS_PROFILE"
 	dbFileName        = "db.sqlite3"
 	profileFileName   = "profile.json"
-	schemaSQL         = `
+	// storedTimeFormat is RFC 3339 with fixed-width nanoseconds, so stored
+	// timestamps sort correctly as text.
+	storedTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
+	schemaSQL        = `
 		CREATE TABLE IF NOT EXISTS entries (
 			id TEXT PRIMARY KEY,
 			type TEXT NOT NULL,
@@ -43,7 +45,10 @@ var (
 			meta_json TEXT,
 			payload BLOB NOT NULL,
 			iv BLOB NOT NULL,
-			tag BLOB NOT NULL
+			tag BLOB NOT NULL,
+			recorded_at TEXT,
+			tz_offset INTEGER,
+			type_version INTEGER
 		);
 		CREATE TABLE IF NOT EXISTS entry_tags (
 			entry_id TEXT NOT NULL,
@@ -51,10 +56,34 @@ var (
 			PRIMARY KEY (entry_id, tag),
 			FOREIGN KEY (entry_id) REFERENCES entries(id) ON DELETE CASCADE
 		);
+		CREATE TABLE IF NOT EXISTS quarantine (
+			id TEXT PRIMARY KEY,
+			type TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			updated_at TEXT NOT NULL,
+			schema_version INTEGER NOT NULL,
+			source TEXT,
+			device_id TEXT,
+			meta_json TEXT,
+			payload BLOB NOT NULL,
+			iv BLOB NOT NULL,
+			tag BLOB NOT NULL,
+			recorded_at TEXT,
+			tz_offset INTEGER,
+			type_version INTEGER,
+			reason TEXT NOT NULL,
+			quarantined_at TEXT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS entry_types (
+			name TEXT PRIMARY KEY,
+			version INTEGER NOT NULL,
+			schema_json TEXT NOT NULL,
+			registered_at TEXT NOT NULL
+		);
 		CREATE INDEX IF NOT EXISTS idx_entries_type ON entries(type);
 		CREATE INDEX IF NOT EXISTS idx_entries_created_at ON entries(created_at);
 		CREATE INDEX IF NOT EXISTS idx_entry_tags_tag ON entry_tags(tag);
-`
+` + relationsSQL + collectionsSQL
 )
 
 // For JSON marshaling, compatible with core-js
@@ -75,28 +104,40 @@ type profilePayload struct {
 
 type Core struct {
 	mu         sync.RWMutex
+	mediaMu    sync.Mutex // serialises media store commits
 	sessionKey []byte
 	dataDir    string
 	db         *sql.DB
+	readOnly   string // reason, set by Scrub until the next restore
+	entryTypes map[EntryType]*entryType
+	migrations map[EntryType]MigrateFunc // registered since the last unlock
 }
 
 func New() *Core { return &Core{} }
 
+// CreateEntry stores ne. Its created_at is ne.CreatedAt when given, for
+// back-dated entries, and the current time otherwise; recorded_at and
+// updated_at are always the current time, so incremental archives pick up
+// back-dated entries too.
 func (c *Core) CreateEntry(ctx context.Context, ne NewEntry) (Entry, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	if !c.isUnlocked() {
-		return Entry{}, ErrLocked
+	if err := c.writable(); err != nil {
+		return Entry{}, err
 	}
 
 	// Validate the new entry
-	if err := ne.Validate(); err != nil {
+	if err := ne.validate(c.customSchema); err != nil {
 		return Entry{}, err
 	}
 
 	now := time.Now().UTC()
+	createdAt, tzOffset := now, ne.tzOffset()
+	if ne.CreatedAt != nil {
+		createdAt = ne.CreatedAt.UTC()
+	}
 	entropy := ulid.Monotonic(rand.Reader, 0)
-	id, err := ulid.New(ulid.Timestamp(now), entropy)
+	id, err := ulid.New(ulid.Timestamp(createdAt), entropy)
 	if err != nil {
 		return Entry{}, fmt.Errorf("failed to generate entry ID: %w", err)
 	}
@@ -104,7 +145,9 @@ func (c *Core) CreateEntry(ctx context.Context, ne NewEntry) (Entry, error) {
 	e := Entry{
 		ID:            id.String(),
 		Type:          ne.Type,
-		CreatedAt:     now,
+		CreatedAt:     createdAt,
+		RecordedAt:    now,
+		TZOffset:      tzOffset,
 		UpdatedAt:     now,
 		SchemaVersion: schemaVersion,
 		Tags:          ne.Tags,
@@ -112,6 +155,7 @@ func (c *Core) CreateEntry(ctx context.Context, ne NewEntry) (Entry, error) {
 		DeviceID:      ne.DeviceID,
 		Meta:          ne.Meta,
 		Payload:       ne.Payload,
+		TypeVersion:   c.typeVersion(ne.Type),
 	}
 
 	payloadBuf := e.Payload
@@ -141,9 +185,10 @@ func (c *Core) CreateEntry(ctx context.Context, ne NewEntry) (Entry, error) {
 	}
 
 	_, err = tx.ExecContext(ctx, `
-		INSERT INTO entries (id, type, created_at, updated_at, schema_version, source, device_id, meta_json, payload, iv, tag)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		e.ID, e.Type, e.CreatedAt.Format(time.RFC3339Nano), e.UpdatedAt.Format(time.RFC3339Nano), e.SchemaVersion, e.Source, e.DeviceID, string(metaJSON), ciphertext, iv, tag,
+		INSERT INTO entries (id, type, created_at, updated_at, schema_version, source, device_id, meta_json, payload, iv, tag, recorded_at, tz_offset, type_version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.ID, e.Type, e.CreatedAt.Format(storedTimeFormat), e.UpdatedAt.Format(storedTimeFormat), e.SchemaVersion, e.Source, e.DeviceID, string(metaJSON), ciphertext, iv, tag,
+		e.RecordedAt.Format(storedTimeFormat), e.TZOffset, sql.NullInt64{Int64: int64(e.TypeVersion), Valid: e.TypeVersion > 0},
 	)
 	if err != nil {
 		return Entry{}, err
@@ -162,6 +207,10 @@ func (c *Core) CreateEntry(ctx context.Context, ne NewEntry) (Entry, error) {
 		}
 	}
 
+	if err := insertRelations(ctx, tx, e.ID, RelationsOf(e.Meta)); err != nil {
+		return Entry{}, err
+	}
+
 	return e, tx.Commit()
 }
 
@@ -171,16 +220,21 @@ func (c *Core) GetEntry(ctx context.Context, id string) (Entry, error) {
 	if !c.isUnlocked() {
 		return Entry{}, ErrLocked
 	}
+	return c.getEntry(ctx, id)
+}
 
-	query := `SELECT type, created_at, updated_at, schema_version, source, device_id, meta_json, payload, iv, tag FROM entries WHERE id = ?`
+// getEntry reads and decrypts one entry. The caller must hold c.mu.
+func (c *Core) getEntry(ctx context.Context, id string) (Entry, error) {
+	query := `SELECT type, created_at, updated_at, schema_version, source, device_id, meta_json, payload, iv, tag, recorded_at, tz_offset, COALESCE(type_version, 0) FROM entries WHERE id = ?`
 	row := c.db.QueryRowContext(ctx, query, id)
 
 	var e Entry
-	var createdAt, updatedAt, metaJSON sql.NullString
+	var createdAt, updatedAt, recordedAt, metaJSON sql.NullString
+	var tzOffset sql.NullInt64
 	var payload, iv, tag []byte
 	e.ID = id
 
-	if err := row.Scan(&e.Type, &createdAt, &updatedAt, &e.SchemaVersion, &e.Source, &e.DeviceID, &metaJSON, &payload, &iv, &tag); err != nil {
+	if err := row.Scan(&e.Type, &createdAt, &updatedAt, &e.SchemaVersion, &e.Source, &e.DeviceID, &metaJSON, &payload, &iv, &tag, &recordedAt, &tzOffset, &e.TypeVersion); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Entry{}, ErrNotFound
 		}
@@ -189,6 +243,11 @@ func (c *Core) GetEntry(ctx context.Context, id string) (Entry, error) {
 
 	e.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAt.String)
 	e.UpdatedAt, _ = time.Parse(time.RFC3339Nano, updatedAt.String)
+	e.RecordedAt, _ = time.Parse(time.RFC3339Nano, recordedAt.String)
+	if tzOffset.Valid {
+		offset := int(tzOffset.Int64)
+		e.TZOffset = &offset
+	}
 	if metaJSON.Valid && metaJSON.String != "null" {
 		_ = json.Unmarshal([]byte(metaJSON.String), &e.Meta)
 	}
@@ -196,9 +255,12 @@ func (c *Core) GetEntry(ctx context.Context, id string) (Entry, error) {
 	aad := []byte(fmt.Sprintf("schema=%d|id=%s|type=%s", e.SchemaVersion, e.ID, e.Type))
 	pt, err := ccrypto.Decrypt(aad, c.sessionKey, iv, tag, payload)
 	if err != nil {
-		return Entry{}, fmt.Errorf("failed to decrypt payload: %w", err)
+		return Entry{}, fmt.Errorf("%w: failed to decrypt payload: %v", ErrCorruptEntry, err)
 	}
 	e.Payload = pt
+	if err := c.upgradePayload(&e); err != nil {
+		return Entry{}, err
+	}
 
 	tagRows, err := c.db.QueryContext(ctx, "SELECT tag FROM entry_tags WHERE entry_id = ?", id)
 	if err != nil {
@@ -223,18 +285,39 @@ func (c *Core) Query(ctx context.Context, filter QueryFilter, pagination Paginat
 		return nil, ErrLocked
 	}
 
+	column, err := filter.TimeField.column()
+	if err != nil {
+		return nil, err
+	}
+
 	var args []interface{}
 	var where []string
 	if filter.Type != "" {
 		where = append(where, "type = ?")
 		args = append(args, filter.Type)
 	}
+	if filter.From != nil {
+		where = append(where, column+" >= ?")
+		args = append(args, filter.From.UTC().Format(storedTimeFormat))
+	}
+	if filter.To != nil {
+		where = append(where, column+" <= ?")
+		args = append(args, filter.To.UTC().Format(storedTimeFormat))
+	}
 
 	query := "SELECT id FROM entries"
+	order := column + " DESC, id DESC"
+	if filter.Collection != "" {
+		// Members come in the collection's own order.
+		query = "SELECT id FROM entries JOIN collection_entries ce ON ce.entry_id = id"
+		where = append(where, "ce.collection_id = ?")
+		args = append(args, filter.Collection)
+		order = "ce.position, id"
+	}
 	if len(where) > 0 {
 		query += " WHERE " + strings.Join(where, " AND ")
 	}
-	query += " ORDER BY created_at DESC"
+	query += " ORDER BY " + order
 
 	if pagination.Limit > 0 {
 		query += " LIMIT ?"
@@ -257,7 +340,7 @@ func (c *Core) Query(ctx context.Context, filter QueryFilter, pagination Paginat
 		if err := rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		e, err := c.GetEntry(ctx, id)
+		e, err := c.getEntry(ctx, id)
 		if err != nil {
 			return nil, err
 		}
@@ -266,57 +349,6 @@ func (c *Core) Query(ctx context.Context, filter QueryFilter, pagination Paginat
 	return entries, nil
 }
 
-func (c *Core) ExportArchive(ctx context.Context, dest string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if !c.isUnlocked() {
-		return ErrLocked
-	}
-
-	// This command safely creates a compacted, consistent backup of the database,
-	// correctly handling the WAL file.
-	_, err := c.db.ExecContext(ctx, "VACUUM INTO ?", dest)
-	if err != nil {
-		return fmt.Errorf("failed to vacuum database for export: %w", err)
-	}
-
-	return nil
-}
-
-func (c *Core) ImportArchive(ctx context.Context, src string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if !c.isUnlocked() {
-		return ErrLocked
-	}
-
-	// Close the current database
-	if c.db != nil {
-		if err := c.db.Close(); err != nil {
-			return fmt.Errorf("failed to close db for import: %w", err)
-		}
-		c.db = nil
-	}
-
-	dbPath := filepath.Join(c.dataDir, dbFileName)
-	// CRITICAL FIX: Remove WAL and SHM files to prevent state corruption.
-	_ = os.Remove(dbPath)
-	_ = os.Remove(dbPath + "-wal")
-	_ = os.Remove(dbPath + "-shm")
-
-	if err := copyFile(src, dbPath); err != nil {
-		return err
-	}
-
-	db, err := storage.OpenDB(ctx, dbPath, false)
-	if err != nil {
-		c.sessionKey = nil
-		return fmt.Errorf("failed to open imported database: %w", err)
-	}
-	c.db = db
-	return nil
-}
-
 // Profile & Session lifecycle
 func (c *Core) CreateProfile(ctx context.Context, dataDir string, password []byte, params ccrypto.ScryptParams) error {
 	c.mu.Lock()
@@ -416,8 +448,13 @@ func (c *Core) UnlockProfile(ctx context.Context, dataDir string, password []byt
 	}
 	c.db = db
 
-	_, err = c.db.ExecContext(ctx, schemaSQL)
-	return err
+	if err := migrate(ctx, c.db); err != nil {
+		return err
+	}
+	if err := c.loadEntryTypes(ctx); err != nil {
+		return err
+	}
+	return c.loadReadOnly()
 }
 
 func (c *Core) Lock() {
@@ -435,6 +472,9 @@ func (c *Core) Lock() {
 	c.sessionKey = nil
 	c.dataDir = ""
 	c.db = nil
+	c.readOnly = ""
+	c.entryTypes = nil
+	c.migrations = nil
 }
 
 func (c *Core) IsUnlocked() bool {
@@ -446,20 +486,3 @@ func (c *Core) IsUnlocked() bool {
 func (c *Core) isUnlocked() bool {
 	return c.sessionKey != nil && c.dataDir != "" && c.db != nil
 }
-
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer sourceFile.Close()
-
-	destFile, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer destFile.Close()
-
-	_, err = io.Copy(destFile, sourceFile)
-	return err
-}
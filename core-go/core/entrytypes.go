@@ -0,0 +1,301 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	ccrypto "logwayss/core-go/internal/crypto"
+	"logwayss/core-go/internal/schema"
+)
+
+// Custom entry types: a profile can define types beyond the built-in six,
+// each with a JSON Schema for its payload and a version. Definitions live in
+// the entry_types table, so they travel with archives and every client that
+// opens the profile validates against the same schemas. Migration functions
+// are code, so each process registers its own; they are not persisted.
+var (
+	ErrReservedEntryType   = errors.New("entry type name is reserved for a built-in type")
+	ErrInvalidEntryTypeDef = errors.New("invalid entry type definition")
+	ErrEntryTypeConflict   = errors.New("entry type is already registered with a different schema")
+	ErrEntryTypeVersion    = errors.New("entry type is registered at a newer version")
+
+	entryTypeNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+)
+
+// MigrateFunc upgrades a payload written at fromVersion of a custom entry
+// type to the type's current version.
+type MigrateFunc func(fromVersion int, payload json.RawMessage) (json.RawMessage, error)
+
+// EntryTypeDef defines a custom entry type.
+type EntryTypeDef struct {
+	Name EntryType `json:"name"`
+	// Version starts at 1 and must increase whenever Schema changes.
+	Version int `json:"version"`
+	// Schema is a JSON Schema for the payload.
+	Schema       json.RawMessage `json:"schema"`
+	RegisteredAt time.Time       `json:"registered_at"`
+	// Migrate, if set, upgrades payloads written at older versions. It runs
+	// over the stored entries when a newer version is registered, and on
+	// read for entries that arrive later from older archives.
+	Migrate MigrateFunc `json:"-"`
+}
+
+type entryType struct {
+	def    EntryTypeDef
+	schema *schema.Schema
+}
+
+// RegisterEntryType adds a custom entry type to the profile, or upgrades it
+// to a newer version. Registering the same name and version again is a no-op
+// apart from attaching def.Migrate, but the schema must be identical. When
+// the version increases and def.Migrate is set, stored entries of the type
+// are migrated and re-validated in the same transaction.
+func (c *Core) RegisterEntryType(ctx context.Context, def EntryTypeDef) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	compiled, canonical, err := def.check()
+	if err != nil {
+		return err
+	}
+
+	existing := c.entryTypes[def.Name]
+	if existing != nil {
+		switch {
+		case def.Version < existing.def.Version:
+			return fmt.Errorf("%w: %s is at version %d", ErrEntryTypeVersion, def.Name, existing.def.Version)
+		case def.Version == existing.def.Version:
+			if !sameJSON(canonical, existing.def.Schema) {
+				return fmt.Errorf("%w: %s version %d", ErrEntryTypeConflict, def.Name, def.Version)
+			}
+			c.setMigration(def.Name, def.Migrate)
+			return nil
+		}
+	}
+
+	now := time.Now().UTC()
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx,
+		`INSERT OR REPLACE INTO entry_types (name, version, schema_json, registered_at) VALUES (?, ?, ?, ?)`,
+		def.Name, def.Version, string(canonical), now.Format(storedTimeFormat)); err != nil {
+		return err
+	}
+	if existing != nil && def.Migrate != nil {
+		if err := c.migrateEntries(ctx, tx, def.Name, def.Version, compiled, def.Migrate); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	def.Schema, def.RegisteredAt = canonical, now
+	if c.entryTypes == nil {
+		c.entryTypes = make(map[EntryType]*entryType)
+	}
+	c.entryTypes[def.Name] = &entryType{def: def, schema: compiled}
+	c.setMigration(def.Name, def.Migrate)
+	return nil
+}
+
+// EntryTypes returns the profile's custom entry types, ordered by name.
+func (c *Core) EntryTypes() ([]EntryTypeDef, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return nil, ErrLocked
+	}
+	defs := make([]EntryTypeDef, 0, len(c.entryTypes))
+	for name, t := range c.entryTypes {
+		def := t.def
+		def.Migrate = c.migrations[name]
+		defs = append(defs, def)
+	}
+	slices.SortFunc(defs, func(a, b EntryTypeDef) int { return strings.Compare(string(a.Name), string(b.Name)) })
+	return defs, nil
+}
+
+// check validates def and returns its compiled and compacted schema.
+func (def EntryTypeDef) check() (*schema.Schema, json.RawMessage, error) {
+	var found issues
+	switch {
+	case builtinTypes[def.Name]:
+		return nil, nil, fmt.Errorf("%w: %s", ErrReservedEntryType, def.Name)
+	case !entryTypeNamePattern.MatchString(string(def.Name)):
+		found.add(ErrInvalidEntryTypeDef, "name", CodeFormat, "must be lowercase letters, digits and underscores, starting with a letter")
+	}
+	if def.Version < 1 {
+		found.add(ErrInvalidEntryTypeDef, "version", CodeRange, "must be at least 1")
+	}
+	var canonical bytes.Buffer
+	var root map[string]any
+	if err := json.Unmarshal(def.Schema, &root); err != nil || root == nil {
+		found.add(ErrInvalidEntryTypeDef, "schema", CodeType, "must be a JSON Schema object")
+	} else if err := json.Compact(&canonical, def.Schema); err != nil {
+		found.add(ErrInvalidEntryTypeDef, "schema", CodeFormat, "is not valid JSON")
+	}
+	if err := found.err(); err != nil {
+		return nil, nil, err
+	}
+	compiled, err := schema.Parse(canonical.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return compiled, canonical.Bytes(), nil
+}
+
+// migrateEntries rewrites the stored entries of type t below version with
+// migrate, re-validating each against s. The caller must hold c.mu.
+func (c *Core) migrateEntries(ctx context.Context, tx *sql.Tx, t EntryType, version int, s *schema.Schema, migrate MigrateFunc) error {
+	type row struct {
+		sealedRow
+		from int
+	}
+	rows, err := tx.QueryContext(ctx,
+		`SELECT id, schema_version, payload, iv, tag, COALESCE(type_version, 0) FROM entries WHERE type = ? AND COALESCE(type_version, 0) < ?`, t, version)
+	if err != nil {
+		return err
+	}
+	var pending []row
+	for rows.Next() {
+		r := row{sealedRow: sealedRow{entryType: string(t)}}
+		if err := rows.Scan(&r.id, &r.schemaVersion, &r.payload, &r.iv, &r.tag, &r.from); err != nil {
+			rows.Close()
+			return err
+		}
+		pending = append(pending, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(storedTimeFormat)
+	for _, r := range pending {
+		pt, err := r.open(c.sessionKey)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrCorruptEntry, r.id)
+		}
+		migrated, err := migrate(r.from, pt)
+		if err != nil {
+			return fmt.Errorf("migrate %s entry %s from version %d: %w", t, r.id, r.from, err)
+		}
+		var found issues
+		validatePayload(&found, t, s, migrated)
+		if err := found.err(); err != nil {
+			return fmt.Errorf("migrate %s entry %s from version %d: %w", t, r.id, r.from, err)
+		}
+		iv, tag, ciphertext, err := ccrypto.Encrypt(r.aad(), c.sessionKey, migrated)
+		zero(pt)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE entries SET payload = ?, iv = ?, tag = ?, type_version = ?, updated_at = ? WHERE id = ?`,
+			ciphertext, iv, tag, version, now, r.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradePayload migrates an entry read at an older version of its custom
+// type, if a migration is registered. The caller must hold c.mu.
+func (c *Core) upgradePayload(e *Entry) error {
+	t := c.entryTypes[e.Type]
+	migrate := c.migrations[e.Type]
+	if t == nil || migrate == nil || e.TypeVersion >= t.def.Version {
+		return nil
+	}
+	migrated, err := migrate(e.TypeVersion, e.Payload)
+	if err != nil {
+		return fmt.Errorf("migrate %s entry %s from version %d: %w", e.Type, e.ID, e.TypeVersion, err)
+	}
+	e.Payload, e.TypeVersion = migrated, t.def.Version
+	return nil
+}
+
+// customSchema returns the payload schema of a registered custom type, or
+// nil. The caller must hold c.mu.
+func (c *Core) customSchema(t EntryType) *schema.Schema {
+	if et := c.entryTypes[t]; et != nil {
+		return et.schema
+	}
+	return nil
+}
+
+// typeVersion returns the version new entries of t are written at: the
+// registered version for custom types and 0 for built-in ones. The caller
+// must hold c.mu.
+func (c *Core) typeVersion(t EntryType) int {
+	if et := c.entryTypes[t]; et != nil {
+		return et.def.Version
+	}
+	return 0
+}
+
+// setMigration records migrate for t. The caller must hold c.mu for writing.
+func (c *Core) setMigration(t EntryType, migrate MigrateFunc) {
+	if migrate == nil {
+		return
+	}
+	if c.migrations == nil {
+		c.migrations = make(map[EntryType]MigrateFunc)
+	}
+	c.migrations[t] = migrate
+}
+
+// loadEntryTypes reads the custom entry types from the database on unlock
+// and after a restore. Definitions that fail to parse are skipped, so a
+// damaged row cannot lock the user out of the profile. The caller must hold
+// c.mu for writing.
+func (c *Core) loadEntryTypes(ctx context.Context) error {
+	rows, err := c.db.QueryContext(ctx, "SELECT name, version, schema_json, registered_at FROM entry_types")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	types := make(map[EntryType]*entryType)
+	for rows.Next() {
+		var def EntryTypeDef
+		var schemaJSON, registeredAt string
+		if err := rows.Scan(&def.Name, &def.Version, &schemaJSON, &registeredAt); err != nil {
+			return err
+		}
+		def.Schema = json.RawMessage(schemaJSON)
+		def.RegisteredAt, _ = time.Parse(time.RFC3339Nano, registeredAt)
+		compiled, err := schema.Parse(def.Schema)
+		if err != nil || builtinTypes[def.Name] {
+			continue
+		}
+		types[def.Name] = &entryType{def: def, schema: compiled}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	c.entryTypes = types
+	return nil
+}
+
+func sameJSON(a, b []byte) bool {
+	var x, y any
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
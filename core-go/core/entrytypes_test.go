@@ -0,0 +1,130 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestCustomEntryTypes(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+
+	workout := EntryTypeDef{
+		Name:    "workout",
+		Version: 1,
+		Schema: json.RawMessage(`{"type": "object", "required": ["kind", "minutes"],
+			"properties": {"kind": {"type": "string"}, "minutes": {"type": "number", "minimum": 0}}}`),
+	}
+	if err := c.RegisterEntryType(ctx, workout); err != nil {
+		t.Fatalf("RegisterEntryType failed: %v", err)
+	}
+	if err := c.RegisterEntryType(ctx, workout); err != nil {
+		t.Fatalf("re-registering the same definition: %v", err)
+	}
+	for name, def := range map[string]EntryTypeDef{
+		"reserved": {Name: EntryTypeMetrics, Version: 1, Schema: workout.Schema},
+		"conflict": {Name: "workout", Version: 1, Schema: json.RawMessage(`{"type":"object"}`)},
+		"bad name": {Name: "Sleep Log", Version: 1, Schema: workout.Schema},
+		"bad":      {Name: "sleep", Version: 0, Schema: json.RawMessage(`[]`)},
+	} {
+		err := c.RegisterEntryType(ctx, def)
+		want := map[string]error{"reserved": ErrReservedEntryType, "conflict": ErrEntryTypeConflict, "bad name": ErrInvalidEntryTypeDef, "bad": ErrInvalidEntryTypeDef}[name]
+		if !errors.Is(err, want) {
+			t.Errorf("%s: got %v, want %v", name, err, want)
+		}
+	}
+
+	run, err := c.CreateEntry(ctx, NewEntry{Type: "workout", Payload: []byte(`{"kind":"run","minutes":30}`)})
+	if err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+	if run.TypeVersion != 1 {
+		t.Fatalf("TypeVersion = %d, want 1", run.TypeVersion)
+	}
+	_, err = c.CreateEntry(ctx, NewEntry{Type: "workout", Payload: []byte(`{"kind":"run","minutes":-5}`)})
+	if got := Issues(err); len(got) != 1 || got[0].Path != "payload.minutes" || got[0].Code != CodeRange {
+		t.Fatalf("invalid workout: %v", err)
+	}
+	if _, err := c.CreateEntry(ctx, NewEntry{Type: "sleep", Payload: []byte(`{}`)}); !errors.Is(err, ErrInvalidEntryType) {
+		t.Fatalf("unregistered type: got %v", err)
+	}
+
+	// Definitions are persisted in the profile.
+	dir := c.dataDir
+	c.Lock()
+	if err := c.UnlockProfile(ctx, dir, []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	defs, err := c.EntryTypes()
+	if err != nil || len(defs) != 1 || defs[0].Name != "workout" || defs[0].Version != 1 {
+		t.Fatalf("EntryTypes after reopening = %v, %v", defs, err)
+	}
+	if entries, err := c.Query(ctx, QueryFilter{Type: "workout"}, Pagination{}); err != nil || len(entries) != 1 {
+		t.Fatalf("Query by custom type = %v, %v", entries, err)
+	}
+
+	// Version 2 renames minutes to duration_s; stored entries are migrated.
+	v2 := EntryTypeDef{
+		Name:    "workout",
+		Version: 2,
+		Schema: json.RawMessage(`{"type": "object", "required": ["kind", "duration_s"],
+			"properties": {"kind": {"type": "string"}, "duration_s": {"type": "number"}}}`),
+		Migrate: func(from int, payload json.RawMessage) (json.RawMessage, error) {
+			var p map[string]any
+			if err := json.Unmarshal(payload, &p); err != nil {
+				return nil, err
+			}
+			p["duration_s"] = p["minutes"].(float64) * 60
+			delete(p, "minutes")
+			return json.Marshal(p)
+		},
+	}
+	if err := c.RegisterEntryType(ctx, v2); err != nil {
+		t.Fatalf("registering version 2: %v", err)
+	}
+	got, err := c.GetEntry(ctx, run.ID)
+	if err != nil {
+		t.Fatalf("GetEntry failed: %v", err)
+	}
+	if got.TypeVersion != 2 || string(got.Payload) != `{"duration_s":1800,"kind":"run"}` {
+		t.Fatalf("migrated entry: version %d, payload %s", got.TypeVersion, got.Payload)
+	}
+	if !got.UpdatedAt.After(run.UpdatedAt) {
+		t.Fatal("migration did not bump updated_at")
+	}
+	if err := c.RegisterEntryType(ctx, workout); !errors.Is(err, ErrEntryTypeVersion) {
+		t.Fatalf("downgrade: got %v", err)
+	}
+}
+
+func TestLockForgetsMigrations(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+	def := EntryTypeDef{
+		Name:    "workout",
+		Version: 1,
+		Schema:  json.RawMessage(`{"type": "object"}`),
+		Migrate: func(from int, payload json.RawMessage) (json.RawMessage, error) { return payload, nil },
+	}
+	if err := c.RegisterEntryType(ctx, def); err != nil {
+		t.Fatalf("RegisterEntryType failed: %v", err)
+	}
+	if defs, _ := c.EntryTypes(); len(defs) != 1 || defs[0].Migrate == nil {
+		t.Fatalf("EntryTypes before Lock = %v", defs)
+	}
+
+	// The next unlock, of this profile or another, starts without them.
+	dir := c.dataDir
+	c.Lock()
+	if c.migrations != nil {
+		t.Fatal("Lock kept the registered migrations")
+	}
+	if err := c.UnlockProfile(ctx, dir, []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	if defs, _ := c.EntryTypes(); len(defs) != 1 || defs[0].Migrate != nil {
+		t.Fatalf("EntryTypes after Lock = %v", defs)
+	}
+}
@@ -0,0 +1,402 @@
+package core
+
+import (
+	"archive/tar"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"logwayss/core-go/internal/storage"
+)
+
+// Incremental archives hold only the entries changed after a parent
+// archive's high-water mark. Each names its parent by the SHA-256 of the
+// parent's manifest, so a full archive followed by incrementals forms a chain
+// that RestoreChain can verify for gaps before replaying it.
+var (
+	ErrIncrementalArchive = errors.New("incremental archive cannot be imported on its own; use RestoreChain")
+	ErrArchiveChainGap    = errors.New("archive chain is broken")
+)
+
+const (
+	ArchiveKindFull        = "full"
+	ArchiveKindIncremental = "incremental"
+)
+
+// Watermark is the position of the newest change captured by an archive:
+// entries are ordered by updated_at, then by ULID.
+type Watermark struct {
+	UpdatedAt string `json:"updated_at,omitempty"`
+	ID        string `json:"id,omitempty"`
+}
+
+func (w Watermark) before(o Watermark) bool {
+	if w.UpdatedAt != o.UpdatedAt {
+		return w.UpdatedAt < o.UpdatedAt
+	}
+	return w.ID < o.ID
+}
+
+// ArchiveInfo describes an archive and its place in a backup chain.
+type ArchiveInfo struct {
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"created_at"`
+	Hash      string    `json:"hash"`
+	Parent    string    `json:"parent,omitempty"`
+	HighWater Watermark `json:"high_water"`
+	// Collection is the root collection of a collection archive.
+	Collection string `json:"collection,omitempty"`
+}
+
+func (m archiveManifest) info() ArchiveInfo {
+	created, _ := time.Parse(time.RFC3339Nano, m.CreatedAt)
+	return ArchiveInfo{
+		Kind:       m.Kind,
+		CreatedAt:  created,
+		Hash:       m.hash,
+		Parent:     m.Parent,
+		HighWater:  m.HighWater,
+		Collection: m.Collection,
+	}
+}
+
+// WithIncrementalSince makes the export an incremental archive containing
+// only the entries changed after parent's high-water mark.
+func WithIncrementalSince(parent ArchiveInfo) ArchiveOption {
+	return func(o *archiveOptions) { o.since = &parent }
+}
+
+// InspectArchive authenticates the header and manifest of the archive at src
+// and describes it. The rest of the archive is not read; use VerifyArchive
+// for a full check.
+func (c *Core) InspectArchive(ctx context.Context, src string, opts ...ArchiveOption) (ArchiveInfo, error) {
+	o := newArchiveOptions(opts)
+	f, err := os.Open(src)
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+	defer f.Close()
+
+	c.mu.RLock()
+	if !c.isUnlocked() {
+		c.mu.RUnlock()
+		return ArchiveInfo{}, ErrLocked
+	}
+	sessionKey := append([]byte(nil), c.sessionKey...)
+	c.mu.RUnlock()
+	defer zero(sessionKey)
+
+	header, headerBytes, err := decodeArchiveHeader(f)
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+	key, err := openArchiveKey(header, sessionKey, o)
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+	defer zero(key)
+	sr, err := openArchiveStream(f, header, headerBytes, key)
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+	manifest, err := readManifest(tar.NewReader(sr))
+	if err != nil {
+		return ArchiveInfo{}, archiveError(err)
+	}
+	return manifest.info(), nil
+}
+
+// RestoreChain replaces the profile's database with the result of replaying a
+// full archive followed by its incrementals. srcs may be given in any order;
+// the chain is rebuilt from the parent hashes and rejected with
+// ErrArchiveChainGap if any link is missing, duplicated or unused.
+func (c *Core) RestoreChain(ctx context.Context, srcs []string, opts ...ArchiveOption) error {
+	o := newArchiveOptions(opts)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isUnlocked() {
+		return ErrLocked
+	}
+
+	staging, err := os.MkdirTemp(c.dataDir, "restore-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	type link struct {
+		dir      string
+		manifest archiveManifest
+		key      []byte
+		kdf      string
+	}
+	links := make([]link, 0, len(srcs))
+	defer func() {
+		for _, l := range links {
+			zero(l.key)
+		}
+	}()
+	for i, src := range srcs {
+		dir := filepath.Join(staging, fmt.Sprintf("%d", i))
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return err
+		}
+		header, manifest, key, err := readArchiveFile(src, c.sessionKey, o, dir)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filepath.Base(src), err)
+		}
+		links = append(links, link{dir: dir, manifest: manifest, key: key, kdf: header.KDF})
+	}
+
+	// Rebuild the chain: exactly one full archive, then each link's parent
+	// must be the previous link.
+	var chain []link
+	children := make(map[string]link)
+	for _, l := range links {
+		if l.manifest.Kind == ArchiveKindCollection {
+			return ErrCollectionArchive
+		}
+		if l.manifest.Kind == ArchiveKindFull {
+			if chain != nil {
+				return fmt.Errorf("%w: more than one full archive", ErrArchiveChainGap)
+			}
+			chain = append(chain, l)
+			continue
+		}
+		if _, dup := children[l.manifest.Parent]; dup {
+			return fmt.Errorf("%w: two archives share parent %s", ErrArchiveChainGap, l.manifest.Parent)
+		}
+		children[l.manifest.Parent] = l
+	}
+	if chain == nil {
+		return fmt.Errorf("%w: no full archive", ErrArchiveChainGap)
+	}
+	for {
+		next, ok := children[chain[len(chain)-1].manifest.hash]
+		if !ok {
+			break
+		}
+		chain = append(chain, next)
+	}
+	if len(chain) != len(links) {
+		return fmt.Errorf("%w: %d archive(s) do not follow from the full archive", ErrArchiveChainGap, len(links)-len(chain))
+	}
+
+	for _, l := range chain {
+		if l.kdf == archiveKDFScrypt {
+			if err := reencryptDBFile(ctx, filepath.Join(l.dir, dbFileName), l.key, c.sessionKey); err != nil {
+				return err
+			}
+			if err := rewrapMediaDir(filepath.Join(l.dir, mediaDirName), l.key, c.sessionKey); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Links may come from different schema versions: bring each up to date
+	// before merging.
+	for _, l := range chain[1:] {
+		if err := migrateFile(ctx, filepath.Join(l.dir, dbFileName)); err != nil {
+			return err
+		}
+	}
+	base := filepath.Join(chain[0].dir, dbFileName)
+	db, err := storage.OpenDB(ctx, base, false)
+	if err != nil {
+		return err
+	}
+	if err := migrate(ctx, db); err != nil {
+		_ = db.Close()
+		return err
+	}
+	for _, l := range chain[1:] {
+		if err := mergeDelta(ctx, db, filepath.Join(l.dir, dbFileName)); err != nil {
+			_ = db.Close()
+			return err
+		}
+		if err := mergeMedia(filepath.Join(l.dir, mediaDirName), filepath.Join(chain[0].dir, mediaDirName)); err != nil {
+			_ = db.Close()
+			return err
+		}
+	}
+	if err := db.Close(); err != nil {
+		return err
+	}
+	return c.replaceData(ctx, chain[0].dir)
+}
+
+func readArchiveFile(src string, sessionKey []byte, o archiveOptions, dir string) (archiveHeader, archiveManifest, []byte, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return archiveHeader{}, archiveManifest{}, nil, err
+	}
+	defer f.Close()
+	return readArchive(f, sessionKey, o, dir)
+}
+
+// trimToDelta deletes every entry at or before since from the snapshot at
+// path and compacts it.
+func trimToDelta(ctx context.Context, path string, since Watermark) error {
+	db, err := storage.OpenDB(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	const unchanged = `NOT (updated_at > ? OR (updated_at = ? AND id > ?))`
+	if _, err := db.ExecContext(ctx,
+		`DELETE FROM entry_tags WHERE entry_id IN (SELECT id FROM entries WHERE `+unchanged+`)`,
+		since.UpdatedAt, since.UpdatedAt, since.ID); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx,
+		`DELETE FROM relations WHERE from_id IN (SELECT id FROM entries WHERE `+unchanged+`)`,
+		since.UpdatedAt, since.UpdatedAt, since.ID); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM entries WHERE `+unchanged, since.UpdatedAt, since.UpdatedAt, since.ID); err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "VACUUM"); err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// trimMediaToDelta removes media committed before since from a snapshot's
+// media store. Files are compared by modification time, so media restored
+// from an archive is simply carried again by the next incremental.
+func trimMediaToDelta(dir string, since Watermark) error {
+	cutoff, err := time.Parse(time.RFC3339Nano, since.UpdatedAt)
+	if err != nil {
+		return nil
+	}
+	return walkMediaSidecars(dir, func(path, ref string) error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !fi.ModTime().Before(cutoff) {
+			return nil
+		}
+		return removeMedia(path)
+	})
+}
+
+// removeMedia removes the media whose sidecar is at path, with its blob and
+// thumbnails.
+func removeMedia(path string) error {
+	blob := strings.TrimSuffix(path, mediaMetaSuffix)
+	for _, size := range ThumbnailSizes {
+		if err := os.Remove(thumbPath(blob, size)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Remove(blob); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// mergeMedia moves the media files under src into dst, keeping any that dst
+// already holds: media is content-addressed, so an existing ref is the same
+// blob.
+func mergeMedia(src, dst string) error {
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if _, err := os.Stat(target); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		return os.Rename(path, target)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// highWaterOf returns the newest (updated_at, id) in the database at path.
+func highWaterOf(ctx context.Context, path string) (Watermark, error) {
+	db, err := storage.OpenDB(ctx, path, false)
+	if err != nil {
+		return Watermark{}, err
+	}
+	defer db.Close()
+	var w Watermark
+	err = db.QueryRowContext(ctx, `SELECT updated_at, id FROM entries ORDER BY updated_at DESC, id DESC LIMIT 1`).Scan(&w.UpdatedAt, &w.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Watermark{}, err
+	}
+	return w, nil
+}
+
+// mergeEntriesSQL copies the entries in the attached database "delta" into
+// main, replacing any previous version of each, with their tags, relations
+// and the entry types they may use.
+var mergeEntriesSQL = []string{
+	`DELETE FROM entry_tags WHERE entry_id IN (SELECT id FROM delta.entries)`,
+	`INSERT OR REPLACE INTO entries (id, type, created_at, updated_at, schema_version, source, device_id, meta_json, payload, iv, tag, recorded_at, tz_offset, type_version)
+		SELECT id, type, created_at, updated_at, schema_version, source, device_id, meta_json, payload, iv, tag, recorded_at, tz_offset, type_version FROM delta.entries`,
+	`INSERT OR IGNORE INTO entry_tags (entry_id, tag) SELECT entry_id, tag FROM delta.entry_tags`,
+	`DELETE FROM relations WHERE from_id IN (SELECT id FROM delta.entries)`,
+	`INSERT OR IGNORE INTO relations (from_id, kind, to_id, pos) SELECT from_id, kind, to_id, pos FROM delta.relations`,
+	// Entry types only move forward: an older delta never downgrades one.
+	`INSERT OR REPLACE INTO entry_types (name, version, schema_json, registered_at)
+		SELECT name, version, schema_json, registered_at FROM delta.entry_types d
+		WHERE NOT EXISTS (SELECT 1 FROM entry_types t WHERE t.name = d.name AND t.version > d.version)`,
+}
+
+// mergeDelta applies the entries of the incremental database at path on top
+// of db, replacing any previous version of each entry. Incrementals carry
+// every collection, so those are replaced wholesale.
+func mergeDelta(ctx context.Context, db *sql.DB, path string) error {
+	return mergeAttached(ctx, db, path, append(slices.Clone(mergeEntriesSQL),
+		`DELETE FROM collection_entries`,
+		`DELETE FROM collections`,
+		copyCollectionsSQL,
+		copyCollectionEntriesSQL,
+	))
+}
+
+// mergeAttached runs stmts in one transaction with the database at path
+// attached to db as "delta".
+func mergeAttached(ctx context.Context, db *sql.DB, path string, stmts []string) error {
+	// ATTACH is per connection, so pin one for the whole merge.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS delta", path); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "DETACH DATABASE delta")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,478 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	ccrypto "logwayss/core-go/internal/crypto"
+)
+
+// Media store layout under the data dir:
+//
+//	media/<ref[:2]>/<ref>       blob: magic(8) || nonce prefix(7) || encrypted stream
+//	media/<ref[:2]>/<ref>.meta  sidecar: encrypted MediaInfo plus the blob key
+//
+// A ref is the hex HMAC-SHA256 of the plaintext under a key derived from the
+// session key, so identical content dedups without letting anyone holding
+// the files confirm a guess of the plaintext. Every blob is encrypted under
+// its own random key, which only the sidecar holds.
+var (
+	ErrMediaTooLarge = errors.New("media exceeds size limit")
+	ErrInvalidMedia  = errors.New("invalid media")
+
+	mediaDirName    = "media"
+	mediaMagic      = "LWMEDIA1"
+	mediaMetaSuffix = ".meta"
+	mediaRefInfo    = "logwayss media ref v1"
+	mediaMetaInfo   = "logwayss media meta v1"
+)
+
+// MaxMediaSize is the largest blob PutMedia accepts.
+const MaxMediaSize = 512 << 20
+
+// MediaInfo describes a stored media blob.
+type MediaInfo struct {
+	Ref       string    `json:"ref"`
+	MIME      string    `json:"mime"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	// Width and Height are set for images PutMedia could decode.
+	Width    int            `json:"width,omitempty"`
+	Height   int            `json:"height,omitempty"`
+	Metadata *MediaMetadata `json:"metadata,omitempty"`
+}
+
+type mediaRecord struct {
+	MediaInfo
+	Key         string        `json:"key"`
+	NoncePrefix string        `json:"nonce_prefix"`
+	Thumbnails  []thumbRecord `json:"thumbnails,omitempty"`
+}
+
+type sealedFileJSON struct {
+	IV         string `json:"iv"`
+	Tag        string `json:"tag"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// PutMedia encrypts the content of r into the media store and returns its
+// ref. Storing content that is already present returns the existing ref
+// without writing anything.
+func (c *Core) PutMedia(ctx context.Context, r io.Reader, mime string) (string, error) {
+	// Encrypting r can take as long as its sender does, so it happens without
+	// holding c.mu; only the commit needs it.
+	c.mu.RLock()
+	if err := c.writable(); err != nil {
+		c.mu.RUnlock()
+		return "", err
+	}
+	sessionKey := append([]byte(nil), c.sessionKey...)
+	dataDir := c.dataDir
+	c.mu.RUnlock()
+	defer zero(sessionKey)
+	if !validMIME(mime) {
+		return "", fmt.Errorf("%w: bad mime type %q", ErrInvalidMedia, mime)
+	}
+
+	dir := filepath.Join(dataDir, mediaDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, ".put-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	blobKey, err := ccrypto.GenerateSalt(32)
+	if err != nil {
+		return "", err
+	}
+	defer zero(blobKey)
+	prefix := make([]byte, ccrypto.StreamPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return "", err
+	}
+	refKey, err := ccrypto.DeriveSubkey(sessionKey, nil, mediaRefInfo)
+	if err != nil {
+		return "", err
+	}
+	defer zero(refKey)
+
+	bw := bufio.NewWriter(tmp)
+	sw, err := newMediaBlobWriter(bw, blobKey, prefix)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, refKey)
+	sniff := &metaSniffer{}
+	sink := io.MultiWriter(sw, mac, sniff)
+	var img *limitedBuffer
+	if thumbnailable(mime) {
+		img = &limitedBuffer{limit: maxThumbnailSource}
+		sink = io.MultiWriter(sw, mac, sniff, img)
+	}
+	n, err := io.Copy(sink, &ctxReader{ctx: ctx, r: io.LimitReader(r, MaxMediaSize+1)})
+	if err != nil {
+		return "", err
+	}
+	if n > MaxMediaSize {
+		return "", ErrMediaTooLarge
+	}
+	if err := sw.Close(); err != nil {
+		return "", err
+	}
+	if err := bw.Flush(); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+
+	ref := hex.EncodeToString(mac.Sum(nil))
+	rec := mediaRecord{
+		MediaInfo: MediaInfo{
+			Ref:       ref,
+			MIME:      mime,
+			Size:      n,
+			CreatedAt: time.Now().UTC(),
+			Metadata:  sniff.metadata(),
+		},
+		Key:         hex.EncodeToString(blobKey),
+		NoncePrefix: hex.EncodeToString(prefix),
+	}
+	var thumbs []thumbFile
+	if img != nil && !img.overflow {
+		thumbs, rec.Width, rec.Height, err = makeThumbnails(dir, img.Bytes())
+		if err != nil {
+			return "", err
+		}
+		defer removeThumbFiles(thumbs)
+		for _, t := range thumbs {
+			rec.Thumbnails = append(rec.Thumbnails, t.rec)
+		}
+	}
+	sidecar, err := sealMediaRecord(sessionKey, rec)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	// The profile may have been locked, replaced or made read-only while r
+	// was read.
+	if err := c.writable(); err != nil {
+		return "", err
+	}
+	if c.dataDir != dataDir || subtle.ConstantTimeCompare(c.sessionKey, sessionKey) != 1 {
+		return "", ErrLocked
+	}
+	// Serialise commits so a blob is never paired with another put's sidecar.
+	c.mediaMu.Lock()
+	defer c.mediaMu.Unlock()
+	blobPath := mediaPath(dataDir, ref)
+	if _, err := os.Stat(blobPath + mediaMetaSuffix); err == nil {
+		return ref, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0700); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), blobPath); err != nil {
+		return "", err
+	}
+	for _, t := range thumbs {
+		if err := os.Rename(t.tmp, thumbPath(blobPath, t.rec.Size)); err != nil {
+			return "", err
+		}
+	}
+	if err := writeFileAtomic(blobPath+mediaMetaSuffix, sidecar); err != nil {
+		return "", err
+	}
+	return ref, nil
+}
+
+// OpenMedia returns a reader over the decrypted content of ref. Corruption or
+// truncation of the blob surfaces as an error from Read.
+func (c *Core) OpenMedia(ctx context.Context, ref string) (io.ReadCloser, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return nil, ErrLocked
+	}
+	rec, err := c.mediaRecord(ref)
+	if err != nil {
+		return nil, err
+	}
+	blobKey, _ := hex.DecodeString(rec.Key)
+	defer zero(blobKey)
+	prefix, _ := hex.DecodeString(rec.NoncePrefix)
+	return openMediaBlob(mediaPath(c.dataDir, ref), blobKey, prefix)
+}
+
+// StatMedia returns the metadata stored alongside ref.
+func (c *Core) StatMedia(ctx context.Context, ref string) (MediaInfo, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return MediaInfo{}, ErrLocked
+	}
+	rec, err := c.mediaRecord(ref)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	return rec.MediaInfo, nil
+}
+
+func (c *Core) mediaRecord(ref string) (mediaRecord, error) {
+	if !validMediaRef(ref) {
+		return mediaRecord{}, ErrNotFound
+	}
+	raw, err := os.ReadFile(mediaPath(c.dataDir, ref) + mediaMetaSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return mediaRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return mediaRecord{}, err
+	}
+	return openMediaRecord(c.sessionKey, ref, raw)
+}
+
+// newMediaBlobWriter writes the blob header to w and returns the stream that
+// encrypts the content after it.
+func newMediaBlobWriter(w io.Writer, key, prefix []byte) (*ccrypto.StreamWriter, error) {
+	if _, err := io.WriteString(w, mediaMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return ccrypto.NewStreamWriter(w, key, prefix, []byte(mediaMagic))
+}
+
+func openMediaBlob(path string, key, prefix []byte) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(mediaMagic)+ccrypto.StreamPrefixSize)
+	if _, err := io.ReadFull(f, header); err != nil || string(header[:len(mediaMagic)]) != mediaMagic || !hmac.Equal(header[len(mediaMagic):], prefix) {
+		f.Close()
+		return nil, fmt.Errorf("%w: bad blob header", ErrInvalidMedia)
+	}
+	sr, err := ccrypto.NewStreamReader(bufio.NewReader(f), key, prefix, []byte(mediaMagic))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &mediaReader{StreamReader: sr, f: f}, nil
+}
+
+type mediaReader struct {
+	*ccrypto.StreamReader
+	f *os.File
+}
+
+func (m *mediaReader) Close() error { return m.f.Close() }
+
+func mediaMetaKey(key []byte) ([]byte, error) {
+	return ccrypto.DeriveSubkey(key, nil, mediaMetaInfo)
+}
+
+func mediaMetaAAD(ref string) []byte {
+	return []byte(fmt.Sprintf("schema=%d|media=%s|type=media_meta", schemaVersion, ref))
+}
+
+// sealMediaRecord encrypts a sidecar under a subkey of key.
+func sealMediaRecord(key []byte, rec mediaRecord) ([]byte, error) {
+	metaKey, err := mediaMetaKey(key)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(metaKey)
+	pt, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(pt)
+	iv, tag, ciphertext, err := ccrypto.Encrypt(mediaMetaAAD(rec.Ref), metaKey, pt)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealedFileJSON{
+		IV:         hex.EncodeToString(iv),
+		Tag:        hex.EncodeToString(tag),
+		Ciphertext: hex.EncodeToString(ciphertext),
+	})
+}
+
+func openMediaRecord(key []byte, ref string, raw []byte) (mediaRecord, error) {
+	var rec mediaRecord
+	var sealed sealedFileJSON
+	if err := json.Unmarshal(raw, &sealed); err != nil {
+		return rec, fmt.Errorf("%w: sidecar: %v", ErrInvalidMedia, err)
+	}
+	iv, err1 := hex.DecodeString(sealed.IV)
+	tag, err2 := hex.DecodeString(sealed.Tag)
+	ciphertext, err3 := hex.DecodeString(sealed.Ciphertext)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return rec, fmt.Errorf("%w: sidecar: %v", ErrInvalidMedia, err)
+	}
+	metaKey, err := mediaMetaKey(key)
+	if err != nil {
+		return rec, err
+	}
+	defer zero(metaKey)
+	pt, err := ccrypto.Decrypt(mediaMetaAAD(ref), metaKey, iv, tag, ciphertext)
+	if err != nil {
+		return rec, fmt.Errorf("%w: sidecar: %v", ErrInvalidMedia, err)
+	}
+	defer zero(pt)
+	if err := json.Unmarshal(pt, &rec); err != nil || rec.Ref != ref {
+		return rec, fmt.Errorf("%w: sidecar does not match ref", ErrInvalidMedia)
+	}
+	return rec, nil
+}
+
+// rewrapMediaDir re-encrypts every sidecar under dir from one key to another.
+// Blobs are left untouched: their keys live inside the sidecars.
+func rewrapMediaDir(dir string, from, to []byte) error {
+	return walkMediaSidecars(dir, func(path, ref string) error {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rec, err := openMediaRecord(from, ref, raw)
+		if err != nil {
+			return err
+		}
+		sealed, err := sealMediaRecord(to, rec)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(path, sealed)
+	})
+}
+
+// walkMediaSidecars calls fn for every sidecar under dir, which need not
+// exist.
+func walkMediaSidecars(dir string, fn func(path, ref string) error) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() || !strings.HasSuffix(name, mediaMetaSuffix) {
+			return nil
+		}
+		ref := strings.TrimSuffix(name, mediaMetaSuffix)
+		if !validMediaRef(ref) {
+			return nil
+		}
+		return fn(path, ref)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// verifyMediaDir checks that every sidecar under dir opens with key and that
+// its blob decrypts completely to the recorded size.
+func verifyMediaDir(dir string, key []byte) error {
+	return walkMediaSidecars(dir, func(path, ref string) error {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rec, err := openMediaRecord(key, ref, raw)
+		if err != nil {
+			return fmt.Errorf("%w: media %s: %v", ErrInvalidArchive, ref, err)
+		}
+		blobKey, _ := hex.DecodeString(rec.Key)
+		defer zero(blobKey)
+		prefix, _ := hex.DecodeString(rec.NoncePrefix)
+		rc, err := openMediaBlob(strings.TrimSuffix(path, mediaMetaSuffix), blobKey, prefix)
+		if err != nil {
+			return fmt.Errorf("%w: media %s: %v", ErrInvalidArchive, ref, err)
+		}
+		defer rc.Close()
+		n, err := io.Copy(io.Discard, rc)
+		if err != nil || n != rec.Size {
+			return fmt.Errorf("%w: media %s: blob does not match sidecar", ErrInvalidArchive, ref)
+		}
+		for _, t := range rec.Thumbnails {
+			key, _ := hex.DecodeString(t.Key)
+			prefix, _ := hex.DecodeString(t.NoncePrefix)
+			rc, err := openMediaBlob(thumbPath(strings.TrimSuffix(path, mediaMetaSuffix), t.Size), key, prefix)
+			zero(key)
+			if err != nil {
+				return fmt.Errorf("%w: media %s: thumbnail %d: %v", ErrInvalidArchive, ref, t.Size, err)
+			}
+			n, err := io.Copy(io.Discard, rc)
+			rc.Close()
+			if err != nil || n != t.Bytes {
+				return fmt.Errorf("%w: media %s: thumbnail %d does not match sidecar", ErrInvalidArchive, ref, t.Size)
+			}
+		}
+		return nil
+	})
+}
+
+func mediaPath(dataDir, ref string) string {
+	return filepath.Join(dataDir, mediaDirName, ref[:2], ref)
+}
+
+func validMediaRef(ref string) bool {
+	if len(ref) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(ref)
+	return err == nil && strings.ToLower(ref) == ref
+}
+
+func validMIME(mime string) bool {
+	typ, sub, ok := strings.Cut(mime, "/")
+	return ok && typ != "" && sub != "" && len(mime) <= 100 && !strings.ContainsAny(mime, " \t\r\n")
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ctxReader stops a long copy once ctx is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
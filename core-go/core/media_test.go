@@ -0,0 +1,228 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMediaStore(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+	content := bytes.Repeat([]byte("jpeg bytes "), 10000)
+
+	ref, err := c.PutMedia(ctx, bytes.NewReader(content), "image/jpeg")
+	if err != nil {
+		t.Fatalf("PutMedia failed: %v", err)
+	}
+	again, err := c.PutMedia(ctx, bytes.NewReader(content), "image/jpeg")
+	if err != nil {
+		t.Fatalf("PutMedia (dedup) failed: %v", err)
+	}
+	if again != ref {
+		t.Fatalf("identical content got different refs: %s vs %s", ref, again)
+	}
+
+	info, err := c.StatMedia(ctx, ref)
+	if err != nil {
+		t.Fatalf("StatMedia failed: %v", err)
+	}
+	if info.MIME != "image/jpeg" || info.Size != int64(len(content)) {
+		t.Fatalf("unexpected media info: %+v", info)
+	}
+
+	rc, err := c.OpenMedia(ctx, ref)
+	if err != nil {
+		t.Fatalf("OpenMedia failed: %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("OpenMedia content mismatch (err %v)", err)
+	}
+
+	if _, err := c.OpenMedia(ctx, "../profile.json"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("OpenMedia with a bad ref: got %v", err)
+	}
+	if _, err := c.PutMedia(ctx, bytes.NewReader(content), "jpeg"); !errors.Is(err, ErrInvalidMedia) {
+		t.Fatalf("PutMedia with a bad mime type: got %v", err)
+	}
+
+	// Flip a ciphertext byte: reading must fail rather than return bad data.
+	path := mediaPath(c.dataDir, ref)
+	blob, _ := os.ReadFile(path)
+	blob[len(blob)/2] ^= 1
+	if err := os.WriteFile(path, blob, 0600); err != nil {
+		t.Fatal(err)
+	}
+	rc, err = c.OpenMedia(ctx, ref)
+	if err != nil {
+		t.Fatalf("OpenMedia failed: %v", err)
+	}
+	defer rc.Close()
+	if _, err := io.ReadAll(rc); err == nil {
+		t.Fatal("reading a tampered blob should fail")
+	}
+}
+
+func TestPutMediaDoesNotHoldCore(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+	content := bytes.Repeat([]byte("pdf bytes "), 10000)
+
+	// putSlowly starts a put whose reader stalls halfway, runs during the
+	// stall, then delivers the rest and returns the put's result.
+	putSlowly := func(during func()) (string, error) {
+		pr, pw := io.Pipe()
+		// Ends the put if during fails the test.
+		defer pw.CloseWithError(io.ErrUnexpectedEOF)
+		type result struct {
+			ref string
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			ref, err := c.PutMedia(ctx, pr, "application/pdf")
+			done <- result{ref, err}
+		}()
+		if _, err := pw.Write(content[:len(content)/2]); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		during()
+		go func() {
+			pw.Write(content[len(content)/2:])
+			pw.Close()
+		}()
+		res := <-done
+		return res.ref, res.err
+	}
+
+	ref, err := putSlowly(func() {})
+	if err != nil {
+		t.Fatalf("PutMedia failed: %v", err)
+	}
+	if info, err := c.StatMedia(ctx, ref); err != nil || info.Size != int64(len(content)) {
+		t.Fatalf("StatMedia after a slow put: %+v, %v", info, err)
+	}
+
+	// The profile can be locked while the content is still arriving, and
+	// nothing is committed to it then.
+	content = append(content, "more"...)
+	_, err = putSlowly(func() {
+		locked := make(chan struct{})
+		go func() {
+			c.Lock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Lock blocked by a put waiting on its reader")
+		}
+	})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("put into a profile locked during the read: got %v, want ErrLocked", err)
+	}
+}
+
+func TestMediaSurvivesPassphraseArchive(t *testing.T) {
+	ctx := context.Background()
+	src := newTestCore(t)
+	dst := newTestCore(t)
+
+	ref, err := src.PutMedia(ctx, bytes.NewReader([]byte("voice note")), "audio/ogg")
+	if err != nil {
+		t.Fatalf("PutMedia failed: %v", err)
+	}
+	var buf bytes.Buffer
+	pass := []byte("export passphrase")
+	if err := src.ExportArchiveTo(ctx, &buf, WithPassphrase(pass), WithScrypt(testScrypt)); err != nil {
+		t.Fatalf("ExportArchiveTo failed: %v", err)
+	}
+	if err := dst.ImportArchiveFrom(ctx, &buf, WithPassphrase(pass)); err != nil {
+		t.Fatalf("ImportArchiveFrom failed: %v", err)
+	}
+
+	rc, err := dst.OpenMedia(ctx, ref)
+	if err != nil {
+		t.Fatalf("OpenMedia after import failed: %v", err)
+	}
+	defer rc.Close()
+	if got, _ := io.ReadAll(rc); string(got) != "voice note" {
+		t.Fatalf("media content mismatch: %q", got)
+	}
+}
+
+func TestMediaThumbnails(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+
+	src := image.NewNRGBA(image.Rect(0, 0, 1000, 400))
+	for y := 0; y < 400; y++ {
+		for x := 0; x < 1000; x++ {
+			src.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := c.PutMedia(ctx, bytes.NewReader(buf.Bytes()), "image/png")
+	if err != nil {
+		t.Fatalf("PutMedia failed: %v", err)
+	}
+	info, err := c.StatMedia(ctx, ref)
+	if err != nil || info.Width != 1000 || info.Height != 400 {
+		t.Fatalf("StatMedia = %+v, %v", info, err)
+	}
+
+	for _, size := range ThumbnailSizes {
+		rc, err := c.OpenThumbnail(ctx, ref, size)
+		if err != nil {
+			t.Fatalf("OpenThumbnail(%d) failed: %v", size, err)
+		}
+		thumb, err := jpeg.Decode(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("thumbnail %d is not a JPEG: %v", size, err)
+		}
+		if b := thumb.Bounds(); b.Dx() != size || b.Dy() != size*400/1000 {
+			t.Fatalf("thumbnail %d has size %v", size, b.Size())
+		}
+	}
+	if _, err := c.OpenThumbnail(ctx, ref, 300); !errors.Is(err, ErrInvalidMedia) {
+		t.Fatalf("OpenThumbnail with an unsupported size: got %v", err)
+	}
+
+	other, err := c.PutMedia(ctx, bytes.NewReader([]byte("not an image")), "image/png")
+	if err != nil {
+		t.Fatalf("PutMedia failed: %v", err)
+	}
+	if _, err := c.OpenThumbnail(ctx, other, ThumbnailSizes[0]); !errors.Is(err, ErrNoThumbnail) {
+		t.Fatalf("OpenThumbnail on undecodable media: got %v", err)
+	}
+
+	// Thumbnails travel with the media through a verified archive.
+	dst := newTestCore(t)
+	var archive bytes.Buffer
+	pass := []byte("export passphrase")
+	if err := c.ExportArchiveTo(ctx, &archive, WithPassphrase(pass), WithScrypt(testScrypt)); err != nil {
+		t.Fatalf("ExportArchiveTo failed: %v", err)
+	}
+	if err := dst.ImportArchiveFrom(ctx, &archive, WithPassphrase(pass)); err != nil {
+		t.Fatalf("ImportArchiveFrom failed: %v", err)
+	}
+	rc, err := dst.OpenThumbnail(ctx, ref, ThumbnailSizes[0])
+	if err != nil {
+		t.Fatalf("OpenThumbnail after import failed: %v", err)
+	}
+	rc.Close()
+}
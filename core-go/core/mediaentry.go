@@ -0,0 +1,267 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"time"
+)
+
+// MediaEntryOption configures CreateMediaEntry.
+type MediaEntryOption func(*mediaEntryOptions)
+
+type mediaEntryOptions struct {
+	meta        bool
+	captureTime bool
+}
+
+// WithMediaMeta copies the media's MIME type, dimensions, duration, capture
+// time and camera into the entry's meta under "media". Location is left out:
+// entry meta is stored unencrypted, so it stays in the media sidecar.
+func WithMediaMeta() MediaEntryOption {
+	return func(o *mediaEntryOptions) { o.meta = true }
+}
+
+// WithCaptureTime sets the entry's created_at, and its timezone offset when
+// EXIF records one, to the media's capture time when one is known and
+// NewEntry.CreatedAt is not already set.
+func WithCaptureTime() MediaEntryOption {
+	return func(o *mediaEntryOptions) { o.captureTime = true }
+}
+
+type mediaRefPayload struct {
+	Ref  string `json:"ref"`
+	Type string `json:"type"`
+}
+
+// CreateMediaEntry creates a media_ref entry for media already stored with
+// PutMedia, optionally filling in meta and created_at from the media's
+// metadata.
+func (c *Core) CreateMediaEntry(ctx context.Context, ne NewEntry, opts ...MediaEntryOption) (Entry, error) {
+	var o mediaEntryOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if ne.Type != EntryTypeMediaRef {
+		var found issues
+		found.add(ErrInvalidEntryType, "type", CodeEnum, `must be "media_ref"`)
+		return Entry{}, found.err()
+	}
+	if err := ne.Validate(); err != nil {
+		return Entry{}, err
+	}
+	var p mediaRefPayload
+	if err := json.Unmarshal(ne.Payload, &p); err != nil {
+		return Entry{}, err
+	}
+	info, err := c.StatMedia(ctx, p.Ref)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	if m := info.Metadata; m != nil && m.CapturedAt != nil && o.captureTime && ne.CreatedAt == nil {
+		captured := *m.CapturedAt
+		ne.CreatedAt = &captured
+	}
+	if o.meta {
+		media := map[string]any{"mime": info.MIME, "size": info.Size}
+		if info.Width > 0 {
+			media["width"], media["height"] = info.Width, info.Height
+		}
+		if m := info.Metadata; m != nil {
+			if m.DurationSeconds > 0 {
+				media["duration_seconds"] = m.DurationSeconds
+			}
+			if m.CapturedAt != nil {
+				media["captured_at"] = m.CapturedAt.Format(time.RFC3339)
+			}
+			if m.CameraMake != "" {
+				media["camera_make"] = m.CameraMake
+			}
+			if m.CameraModel != "" {
+				media["camera_model"] = m.CameraModel
+			}
+		}
+		meta := maps.Clone(ne.Meta)
+		if meta == nil {
+			meta = make(map[string]any)
+		}
+		meta["media"] = media
+		ne.Meta = meta
+	}
+	return c.CreateEntry(ctx, ne)
+}
+
+// ExportMedia writes the plaintext media referenced by the media_ref entry id
+// to w, for sharing outside the app. When the entry's meta.sensitivity is
+// "high", location data is stripped on the way out: the EXIF GPS directory
+// and XMP packets of JPEGs, and eXIf chunks of PNGs.
+func (c *Core) ExportMedia(ctx context.Context, id string, w io.Writer) (MediaInfo, error) {
+	e, err := c.GetEntry(ctx, id)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	if e.Type != EntryTypeMediaRef {
+		return MediaInfo{}, ErrInvalidEntryType
+	}
+	var p mediaRefPayload
+	if err := json.Unmarshal(e.Payload, &p); err != nil {
+		return MediaInfo{}, ErrInvalidEntryPayload
+	}
+	info, err := c.StatMedia(ctx, p.Ref)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	rc, err := c.OpenMedia(ctx, p.Ref)
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer rc.Close()
+	r := &ctxReader{ctx: ctx, r: rc}
+
+	if e.Meta["sensitivity"] != "high" {
+		_, err = io.Copy(w, r)
+		return info, err
+	}
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(8)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xff, 0xd8}):
+		err = stripJPEGLocation(w, br)
+	case bytes.Equal(head, pngSignature):
+		err = stripPNGLocation(w, br)
+	default:
+		_, err = io.Copy(w, br)
+	}
+	return info, err
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// stripJPEGLocation copies a JPEG from r to w, emptying the EXIF GPS
+// directory and dropping XMP segments. Everything from the start of the
+// image data on is copied unchanged.
+func stripJPEGLocation(w io.Writer, r *bufio.Reader) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0xff {
+			return fmt.Errorf("%w: bad JPEG segment", ErrInvalidMedia)
+		}
+		marker := byte(0xff)
+		for marker == 0xff {
+			if marker, err = r.ReadByte(); err != nil {
+				return err
+			}
+		}
+		// Start of scan, end of image and markers without a length: the
+		// rest is image data.
+		if marker == 0xda || marker == 0xd9 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			if _, err := w.Write([]byte{0xff, marker}); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, r)
+			return err
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(size[:]))
+		if n < 2 {
+			return fmt.Errorf("%w: bad JPEG segment", ErrInvalidMedia)
+		}
+		body := make([]byte, n-2)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		if marker == 0xe1 {
+			if bytes.HasPrefix(body, xmpHeader) || bytes.HasPrefix(body, []byte("http://ns.adobe.com/xmp/extension/\x00")) {
+				continue
+			}
+			if bytes.HasPrefix(body, exifHeader) {
+				clearGPS(body[len(exifHeader):])
+			}
+		}
+		if _, err := w.Write([]byte{0xff, marker, size[0], size[1]}); err != nil {
+			return err
+		}
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+	}
+}
+
+// clearGPS empties the GPS directory of an EXIF block in place, zeroing the
+// values it pointed to. The directory itself stays, with no entries.
+func clearGPS(b []byte) {
+	t, off, err := newTIFF(b)
+	if err != nil {
+		return
+	}
+	ifd0, err := t.ifd(off)
+	if err != nil {
+		return
+	}
+	p, ok := t.uint(lookup(ifd0, tagGPSIFD))
+	if !ok {
+		return
+	}
+	gps, err := t.ifd(int(p))
+	if err != nil {
+		return
+	}
+	for _, e := range gps {
+		clear(t.b[e.at : e.at+t.valueSize(e)])
+	}
+	// The entry count, the entries and the next-directory offset.
+	n := int(t.bo.Uint16(t.b[p:]))
+	clear(t.b[p:min(int(p)+2+12*n+4, len(t.b))])
+}
+
+// stripPNGLocation copies a PNG from r to w without its eXIf chunks.
+func stripPNGLocation(w io.Writer, r *bufio.Reader) error {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return err
+	}
+	if _, err := w.Write(sig); err != nil {
+		return err
+	}
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Chunk data plus its CRC.
+		n := int64(binary.BigEndian.Uint32(hdr[:4])) + 4
+		if string(hdr[4:]) == "eXIf" {
+			if _, err := io.CopyN(io.Discard, r, n); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, n); err != nil {
+			return err
+		}
+	}
+}
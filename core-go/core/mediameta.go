@@ -0,0 +1,471 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// Media metadata is extracted by PutMedia while the content streams through
+// it and kept in the encrypted sidecar: EXIF from JPEG images, duration and
+// creation time from MP4/QuickTime containers, and duration from WAV files.
+// Nothing here fails a put; unrecognised or malformed content simply yields
+// no metadata.
+
+// MediaMetadata is what PutMedia could learn about a blob's content.
+type MediaMetadata struct {
+	// CapturedAt is when the photo or recording was made. EXIF times without
+	// an offset are taken as UTC.
+	CapturedAt      *time.Time   `json:"captured_at,omitempty"`
+	CameraMake      string       `json:"camera_make,omitempty"`
+	CameraModel     string       `json:"camera_model,omitempty"`
+	Orientation     int          `json:"orientation,omitempty"`
+	Location        *GeoLocation `json:"location,omitempty"`
+	DurationSeconds float64      `json:"duration_seconds,omitempty"`
+}
+
+// GeoLocation is a WGS 84 position from EXIF GPS tags.
+type GeoLocation struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+const (
+	// metaHeadSize covers a JPEG APP1 segment (at most 64 KiB) and a WAV
+	// header with a few extra chunks.
+	metaHeadSize = 128 << 10
+	// maxMoovSize bounds how much of an MP4 moov box is buffered.
+	maxMoovSize = 8 << 20
+
+	// mp4EpochUnix is the zero time of MP4 creation timestamps, 1904-01-01,
+	// in Unix seconds.
+	mp4EpochUnix = -2082844800
+	// maxMP4Created is the first MP4 creation timestamp past year 9999, the
+	// last one a capture time can be stored and encoded in.
+	maxMP4Created = 253402300800 - mp4EpochUnix
+)
+
+// EXIF tags.
+const (
+	tagMake               = 0x010f
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagGPSLatitudeRef     = 0x0001
+	tagGPSLatitude        = 0x0002
+	tagGPSLongitudeRef    = 0x0003
+	tagGPSLongitude       = 0x0004
+	tagGPSAltitudeRef     = 0x0005
+	tagGPSAltitude        = 0x0006
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// metaSniffer is an io.Writer that PutMedia tees the content into. It keeps
+// the head of the stream and follows MP4 box boundaries so that a moov box
+// is found wherever it sits, without buffering the media data.
+type metaSniffer struct {
+	head []byte
+
+	// MP4 box scanning state.
+	isMP4   bool
+	done    bool
+	offset  int64
+	boxHdr  []byte
+	skip    int64
+	inMoov  bool
+	moov    []byte
+	moovLen int64
+}
+
+func (s *metaSniffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := metaHeadSize - len(s.head); room > 0 {
+		s.head = append(s.head, p[:min(room, len(p))]...)
+	}
+	if s.offset == 0 && len(p) >= 8 {
+		s.isMP4 = string(p[4:8]) == "ftyp"
+	}
+	if s.isMP4 && !s.done {
+		s.scanBoxes(p)
+	}
+	s.offset += int64(n)
+	return n, nil
+}
+
+func (s *metaSniffer) scanBoxes(p []byte) {
+	for len(p) > 0 && !s.done {
+		switch {
+		case s.inMoov:
+			take := min(int64(len(p)), s.moovLen-int64(len(s.moov)))
+			s.moov = append(s.moov, p[:take]...)
+			p = p[take:]
+			if int64(len(s.moov)) == s.moovLen {
+				s.done = true
+			}
+		case s.skip > 0:
+			take := min(int64(len(p)), s.skip)
+			s.skip -= take
+			p = p[take:]
+		default:
+			need := 8
+			if len(s.boxHdr) >= 8 && binary.BigEndian.Uint32(s.boxHdr) == 1 {
+				need = 16
+			}
+			take := min(need-len(s.boxHdr), len(p))
+			s.boxHdr = append(s.boxHdr, p[:take]...)
+			p = p[take:]
+			if len(s.boxHdr) < need {
+				continue
+			}
+			if need == 8 && binary.BigEndian.Uint32(s.boxHdr) == 1 {
+				continue // 64-bit size follows
+			}
+			size := int64(binary.BigEndian.Uint32(s.boxHdr))
+			if need == 16 {
+				size = int64(binary.BigEndian.Uint64(s.boxHdr[8:]))
+			}
+			typ := string(s.boxHdr[4:8])
+			body := size - int64(need)
+			s.boxHdr = s.boxHdr[:0]
+			switch {
+			case size == 0 || body < 0:
+				s.done = true // box runs to the end of the file, or garbage
+			case typ == "moov" && body <= maxMoovSize:
+				s.inMoov, s.moovLen = true, body
+				if body == 0 {
+					s.done = true
+				}
+			default:
+				s.skip = body
+			}
+		}
+	}
+}
+
+// metadata returns what was learned from the content, or nil.
+func (s *metaSniffer) metadata() *MediaMetadata {
+	var m *MediaMetadata
+	switch {
+	case s.moov != nil && s.done:
+		m = parseMoov(s.moov)
+	case bytes.HasPrefix(s.head, []byte{0xff, 0xd8}):
+		m = parseJPEGMeta(s.head)
+	case len(s.head) >= 12 && string(s.head[:4]) == "RIFF" && string(s.head[8:12]) == "WAVE":
+		m = parseWAV(s.head)
+	}
+	if m == nil || *m == (MediaMetadata{}) {
+		return nil
+	}
+	return m
+}
+
+// parseMoov reads the duration and creation time from the mvhd box.
+func parseMoov(moov []byte) *MediaMetadata {
+	for len(moov) >= 8 {
+		size := int(binary.BigEndian.Uint32(moov))
+		if size < 8 || size > len(moov) {
+			return nil
+		}
+		if string(moov[4:8]) != "mvhd" {
+			moov = moov[size:]
+			continue
+		}
+		b := moov[8:size]
+		var created uint64
+		var timescale uint32
+		var duration uint64
+		switch {
+		case len(b) >= 20 && b[0] == 0:
+			created = uint64(binary.BigEndian.Uint32(b[4:]))
+			timescale = binary.BigEndian.Uint32(b[12:])
+			duration = uint64(binary.BigEndian.Uint32(b[16:]))
+		case len(b) >= 32 && b[0] == 1:
+			created = binary.BigEndian.Uint64(b[4:])
+			timescale = binary.BigEndian.Uint32(b[20:])
+			duration = binary.BigEndian.Uint64(b[24:])
+		default:
+			return nil
+		}
+		m := &MediaMetadata{}
+		if timescale > 0 && duration != math.MaxUint32 && duration != math.MaxUint64 {
+			m.DurationSeconds = float64(duration) / float64(timescale)
+		}
+		if created > 0 && created < maxMP4Created {
+			t := time.Unix(mp4EpochUnix+int64(created), 0).UTC()
+			m.CapturedAt = &t
+		}
+		return m
+	}
+	return nil
+}
+
+// parseWAV computes the duration from the fmt byte rate and data size.
+func parseWAV(head []byte) *MediaMetadata {
+	var byteRate uint32
+	b := head[12:]
+	for len(b) >= 8 {
+		id := string(b[:4])
+		size := binary.LittleEndian.Uint32(b[4:])
+		body := b[8:]
+		switch id {
+		case "fmt ":
+			if len(body) >= 12 {
+				byteRate = binary.LittleEndian.Uint32(body[8:])
+			}
+		case "data":
+			if byteRate == 0 {
+				return nil
+			}
+			return &MediaMetadata{DurationSeconds: float64(size) / float64(byteRate)}
+		}
+		if uint64(size)+uint64(size&1) > uint64(len(body)) {
+			return nil
+		}
+		b = body[size+size&1:]
+	}
+	return nil
+}
+
+// jpegSegments calls fn with the marker and body of every segment before the
+// image data. It stops early if fn returns false.
+func jpegSegments(b []byte, fn func(marker byte, body []byte) bool) {
+	if !bytes.HasPrefix(b, []byte{0xff, 0xd8}) {
+		return
+	}
+	b = b[2:]
+	for len(b) >= 4 && b[0] == 0xff {
+		marker := b[1]
+		if marker == 0xda || marker == 0xd9 {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if n < 2 || 2+n > len(b) {
+			return
+		}
+		if !fn(marker, b[4:2+n]) {
+			return
+		}
+		b = b[2+n:]
+	}
+}
+
+func parseJPEGMeta(head []byte) *MediaMetadata {
+	var m *MediaMetadata
+	jpegSegments(head, func(marker byte, body []byte) bool {
+		if marker != 0xe1 || !bytes.HasPrefix(body, exifHeader) {
+			return true
+		}
+		m = parseEXIF(body[len(exifHeader):])
+		return false
+	})
+	return m
+}
+
+// tiff reads the TIFF structure at the heart of an EXIF block.
+type tiff struct {
+	b  []byte
+	bo binary.ByteOrder
+}
+
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	// at is the offset of the value: inline in the entry when it fits in
+	// four bytes, elsewhere in the block otherwise.
+	at    int
+	entry int
+}
+
+var tiffTypeSize = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+var errBadTIFF = errors.New("malformed TIFF structure")
+
+func newTIFF(b []byte) (tiff, int, error) {
+	if len(b) < 8 {
+		return tiff{}, 0, errBadTIFF
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.bo = binary.LittleEndian
+	case "MM":
+		t.bo = binary.BigEndian
+	default:
+		return tiff{}, 0, errBadTIFF
+	}
+	if t.bo.Uint16(b[2:]) != 42 {
+		return tiff{}, 0, errBadTIFF
+	}
+	return t, int(t.bo.Uint32(b[4:])), nil
+}
+
+// ifd returns the entries of the directory at off.
+func (t tiff) ifd(off int) (map[uint16]tiffEntry, error) {
+	if off < 8 || off+2 > len(t.b) {
+		return nil, errBadTIFF
+	}
+	n := int(t.bo.Uint16(t.b[off:]))
+	if off+2+12*n > len(t.b) {
+		return nil, errBadTIFF
+	}
+	entries := make(map[uint16]tiffEntry, n)
+	for i := 0; i < n; i++ {
+		p := off + 2 + 12*i
+		e := tiffEntry{typ: t.bo.Uint16(t.b[p+2:]), count: t.bo.Uint32(t.b[p+4:]), at: p + 8, entry: p}
+		size, ok := tiffTypeSize[e.typ]
+		if !ok || uint64(size)*uint64(e.count) > uint64(len(t.b)) {
+			continue
+		}
+		if size*int(e.count) > 4 {
+			e.at = int(t.bo.Uint32(t.b[p+8:]))
+			if e.at+size*int(e.count) > len(t.b) {
+				continue
+			}
+		}
+		entries[t.bo.Uint16(t.b[p:])] = e
+	}
+	return entries, nil
+}
+
+func (t tiff) valueSize(e tiffEntry) int {
+	return tiffTypeSize[e.typ] * int(e.count)
+}
+
+func (t tiff) str(e tiffEntry, ok bool) string {
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	s := t.b[e.at : e.at+int(e.count)]
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(string(s))
+}
+
+func (t tiff) uint(e tiffEntry, ok bool) (uint32, bool) {
+	if !ok || e.count == 0 {
+		return 0, false
+	}
+	switch e.typ {
+	case 1:
+		return uint32(t.b[e.at]), true
+	case 3:
+		return uint32(t.bo.Uint16(t.b[e.at:])), true
+	case 4:
+		return t.bo.Uint32(t.b[e.at:]), true
+	}
+	return 0, false
+}
+
+func (t tiff) rationals(e tiffEntry, ok bool) []float64 {
+	if !ok || e.typ != 5 {
+		return nil
+	}
+	out := make([]float64, e.count)
+	for i := range out {
+		num := t.bo.Uint32(t.b[e.at+8*i:])
+		den := t.bo.Uint32(t.b[e.at+8*i+4:])
+		if den == 0 {
+			return nil
+		}
+		out[i] = float64(num) / float64(den)
+	}
+	return out
+}
+
+func parseEXIF(b []byte) *MediaMetadata {
+	t, off, err := newTIFF(b)
+	if err != nil {
+		return nil
+	}
+	ifd0, err := t.ifd(off)
+	if err != nil {
+		return nil
+	}
+	m := &MediaMetadata{}
+	m.CameraMake = t.str(lookup(ifd0, tagMake))
+	m.CameraModel = t.str(lookup(ifd0, tagModel))
+	if o, ok := t.uint(lookup(ifd0, tagOrientation)); ok && o >= 1 && o <= 8 {
+		m.Orientation = int(o)
+	}
+
+	taken, offset := t.str(lookup(ifd0, tagDateTime)), ""
+	if p, ok := t.uint(lookup(ifd0, tagExifIFD)); ok {
+		if exif, err := t.ifd(int(p)); err == nil {
+			if s := t.str(lookup(exif, tagDateTimeOriginal)); s != "" {
+				taken = s
+			}
+			offset = t.str(lookup(exif, tagOffsetTimeOriginal))
+		}
+	}
+	if ts, ok := parseEXIFTime(taken, offset); ok {
+		m.CapturedAt = &ts
+	}
+
+	if p, ok := t.uint(lookup(ifd0, tagGPSIFD)); ok {
+		if gps, err := t.ifd(int(p)); err == nil {
+			m.Location = parseGPS(t, gps)
+		}
+	}
+	return m
+}
+
+func lookup(ifd map[uint16]tiffEntry, tag uint16) (tiffEntry, bool) {
+	e, ok := ifd[tag]
+	return e, ok
+}
+
+func parseEXIFTime(s, offset string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", s+offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", s)
+	return t, err == nil
+}
+
+func parseGPS(t tiff, gps map[uint16]tiffEntry) *GeoLocation {
+	lat := dms(t.rationals(lookup(gps, tagGPSLatitude)))
+	lon := dms(t.rationals(lookup(gps, tagGPSLongitude)))
+	if math.IsNaN(lat) || math.IsNaN(lon) {
+		return nil
+	}
+	if t.str(lookup(gps, tagGPSLatitudeRef)) == "S" {
+		lat = -lat
+	}
+	if t.str(lookup(gps, tagGPSLongitudeRef)) == "W" {
+		lon = -lon
+	}
+	loc := &GeoLocation{Latitude: lat, Longitude: lon}
+	if alt := t.rationals(lookup(gps, tagGPSAltitude)); len(alt) == 1 {
+		if ref, ok := t.uint(lookup(gps, tagGPSAltitudeRef)); ok && ref == 1 {
+			alt[0] = -alt[0]
+		}
+		loc.Altitude = &alt[0]
+	}
+	return loc
+}
+
+// dms converts degrees, minutes and seconds to decimal degrees.
+func dms(v []float64) float64 {
+	if len(v) != 3 {
+		return math.NaN()
+	}
+	return v[0] + v[1]/60 + v[2]/3600
+}
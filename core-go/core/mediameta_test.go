@@ -0,0 +1,167 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"math"
+	"testing"
+	"time"
+)
+
+// testEXIF builds a big-endian EXIF block with a camera make, a capture time
+// with offset and a GPS position of 48°30'N 2°15'W.
+func testEXIF() []byte {
+	be := binary.BigEndian
+	b := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	entry := func(tag, typ uint16, count, value uint32) {
+		b = be.AppendUint16(b, tag)
+		b = be.AppendUint16(b, typ)
+		b = be.AppendUint32(b, count)
+		b = be.AppendUint32(b, value)
+	}
+	// IFD0 at 8: 3 entries, ends at 50.
+	b = be.AppendUint16(b, 3)
+	entry(tagMake, 2, 5, 50)
+	entry(tagExifIFD, 4, 1, 56)
+	entry(tagGPSIFD, 4, 1, 114)
+	b = be.AppendUint32(b, 0)
+	b = append(b, "Acme\x00\x00"...) // 50..56
+	// Exif IFD at 56: 2 entries, ends at 86.
+	b = be.AppendUint16(b, 2)
+	entry(tagDateTimeOriginal, 2, 20, 86)
+	entry(tagOffsetTimeOriginal, 2, 7, 106)
+	b = be.AppendUint32(b, 0)
+	b = append(b, "2024:05:06 07:08:09\x00"...) // 86..106
+	b = append(b, "+02:00\x00\x00"...)          // 106..114
+	// GPS IFD at 114: 4 entries, ends at 168.
+	b = be.AppendUint16(b, 4)
+	entry(tagGPSLatitudeRef, 2, 2, uint32('N')<<24)
+	entry(tagGPSLatitude, 5, 3, 168)
+	entry(tagGPSLongitudeRef, 2, 2, uint32('W')<<24)
+	entry(tagGPSLongitude, 5, 3, 192)
+	b = be.AppendUint32(b, 0)
+	for _, v := range []uint32{48, 1, 30, 1, 0, 1, 2, 1, 15, 1, 0, 1} {
+		b = be.AppendUint32(b, v)
+	}
+	return b
+}
+
+func testJPEGWithEXIF(t *testing.T) []byte {
+	t.Helper()
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	app1 := append(append([]byte(nil), exifHeader...), testEXIF()...)
+	seg := binary.BigEndian.AppendUint16([]byte{0xff, 0xe1}, uint16(len(app1)+2))
+	out := append([]byte{0xff, 0xd8}, seg...)
+	out = append(out, app1...)
+	return append(out, img.Bytes()[2:]...)
+}
+
+func TestMediaMetadataExtraction(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+	photo := testJPEGWithEXIF(t)
+
+	ref, err := c.PutMedia(ctx, bytes.NewReader(photo), "image/jpeg")
+	if err != nil {
+		t.Fatalf("PutMedia failed: %v", err)
+	}
+	info, err := c.StatMedia(ctx, ref)
+	if err != nil {
+		t.Fatalf("StatMedia failed: %v", err)
+	}
+	m := info.Metadata
+	if m == nil || m.CameraMake != "Acme" || m.Location == nil {
+		t.Fatalf("unexpected metadata: %+v", m)
+	}
+	want := time.Date(2024, 5, 6, 5, 8, 9, 0, time.UTC)
+	if m.CapturedAt == nil || !m.CapturedAt.Equal(want) {
+		t.Fatalf("CapturedAt = %v, want %v", m.CapturedAt, want)
+	}
+	if math.Abs(m.Location.Latitude-48.5) > 1e-9 || math.Abs(m.Location.Longitude+2.25) > 1e-9 {
+		t.Fatalf("unexpected location: %+v", m.Location)
+	}
+
+	payload, _ := json.Marshal(mediaRefPayload{Ref: ref, Type: "image"})
+	e, err := c.CreateMediaEntry(ctx, NewEntry{Type: EntryTypeMediaRef, Payload: payload,
+		Meta: map[string]any{"sensitivity": "high"}}, WithMediaMeta(), WithCaptureTime())
+	if err != nil {
+		t.Fatalf("CreateMediaEntry failed: %v", err)
+	}
+	if !e.CreatedAt.Equal(want) {
+		t.Fatalf("entry created_at = %v, want %v", e.CreatedAt, want)
+	}
+	media, _ := e.Meta["media"].(map[string]any)
+	if media["camera_make"] != "Acme" || media["location"] != nil {
+		t.Fatalf("unexpected entry meta: %+v", e.Meta)
+	}
+
+	var out bytes.Buffer
+	if _, err := c.ExportMedia(ctx, e.ID, &out); err != nil {
+		t.Fatalf("ExportMedia failed: %v", err)
+	}
+	stripped := parseJPEGMeta(out.Bytes())
+	if stripped == nil || stripped.Location != nil || stripped.CameraMake != "Acme" {
+		t.Fatalf("location not stripped: %+v", stripped)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out.Bytes())); err != nil {
+		t.Fatalf("stripped JPEG does not decode: %v", err)
+	}
+}
+
+func TestContainerDuration(t *testing.T) {
+	be := binary.BigEndian
+	box := func(typ string, body []byte) []byte {
+		return append(append(be.AppendUint32(nil, uint32(8+len(body))), typ...), body...)
+	}
+	// mvhd v0: version/flags, creation, modification, timescale 1000, duration 90500.
+	mvhd := make([]byte, 100)
+	be.PutUint32(mvhd[4:], 3786912000) // 2024-01-01T00:00:00Z
+	be.PutUint32(mvhd[12:], 1000)
+	be.PutUint32(mvhd[16:], 90500)
+	mp4 := box("ftyp", []byte("isom\x00\x00\x02\x00"))
+	mp4 = append(mp4, box("mdat", make([]byte, 100000))...)
+	mp4 = append(mp4, box("moov", box("mvhd", mvhd))...)
+
+	s := &metaSniffer{}
+	for p := mp4; len(p) > 0; p = p[min(len(p), 3000):] {
+		s.Write(p[:min(len(p), 3000)])
+	}
+	m := s.metadata()
+	if m == nil || m.DurationSeconds != 90.5 || m.CapturedAt == nil || m.CapturedAt.Year() != 2024 {
+		t.Fatalf("unexpected mp4 metadata: %+v", m)
+	}
+
+	// mvhd v1 with 64-bit times: 1e10 s overflows a time.Duration in
+	// nanoseconds; 3e11 s is past year 9999.
+	mvhd1 := make([]byte, 112)
+	mvhd1[0] = 1
+	be.PutUint32(mvhd1[20:], 1000)
+	be.PutUint64(mvhd1[4:], 10e9)
+	m = parseMoov(box("mvhd", mvhd1))
+	if want := time.Date(2220, 11, 19, 17, 46, 40, 0, time.UTC); m == nil || m.CapturedAt == nil || !m.CapturedAt.Equal(want) {
+		t.Fatalf("mvhd v1 creation 1e10: unexpected metadata %+v", m)
+	}
+	be.PutUint64(mvhd1[4:], 300e9)
+	if m = parseMoov(box("mvhd", mvhd1)); m == nil || m.CapturedAt != nil {
+		t.Fatalf("mvhd v1 creation 3e11: unexpected metadata %+v", m)
+	}
+
+	le := binary.LittleEndian
+	wav := []byte("RIFF\x00\x00\x00\x00WAVEfmt \x10\x00\x00\x00")
+	wav = append(wav, make([]byte, 16)...)
+	le.PutUint32(wav[28:], 8000) // byte rate
+	wav = append(wav, "data"...)
+	wav = le.AppendUint32(wav, 20000)
+	s = &metaSniffer{}
+	s.Write(wav)
+	if m := s.metadata(); m == nil || m.DurationSeconds != 2.5 {
+		t.Fatalf("unexpected wav metadata: %+v", m)
+	}
+}
@@ -0,0 +1,218 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"logwayss/core-go/internal/storage"
+)
+
+// addedColumns are columns introduced after a table was first shipped.
+// CREATE TABLE in schemaSQL already has them; migrate adds them to databases
+// created before, including those restored from older archives.
+var addedColumns = []struct {
+	table, column, decl, backfill string
+}{
+	{"entries", "recorded_at", "TEXT", "created_at"},
+	{"entries", "tz_offset", "INTEGER", ""},
+	{"entries", "type_version", "INTEGER", ""},
+	{"quarantine", "recorded_at", "TEXT", "created_at"},
+	{"quarantine", "tz_offset", "INTEGER", ""},
+	{"quarantine", "type_version", "INTEGER", ""},
+}
+
+// addedTables are tables introduced after the first release, with the SQL
+// that fills them from existing rows. migrate creates and fills each in one
+// transaction, before schemaSQL would create it empty.
+var addedTables = []struct {
+	table, create, backfill string
+}{
+	{"relations", relationsSQL, backfillRelationsSQL},
+}
+
+// retimedColumns hold timestamps that older versions wrote as RFC 3339 with
+// a variable-length fraction, which does not sort as text. migrate rewrites
+// them in storedTimeFormat.
+var retimedColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"entries", []string{"created_at", "updated_at", "recorded_at"}},
+	{"quarantine", []string{"created_at", "updated_at", "recorded_at"}},
+}
+
+// storedTimeGlob matches a UTC timestamp in storedTimeFormat.
+const storedTimeGlob = "????-??-??T??:??:??.?????????Z"
+
+// postMigrationSQL runs once every added column exists.
+const postMigrationSQL = `
+	CREATE INDEX IF NOT EXISTS idx_entries_recorded_at ON entries(recorded_at);
+`
+
+// migrate brings db up to the current schema. It is idempotent, and each
+// step commits on its own, so an interrupted run resumes where it stopped.
+func migrate(ctx context.Context, db *sql.DB) error {
+	for _, t := range addedTables {
+		if err := addTable(ctx, db, t.table, t.create, t.backfill); err != nil {
+			return err
+		}
+	}
+	if _, err := db.ExecContext(ctx, schemaSQL); err != nil {
+		return err
+	}
+	for _, col := range addedColumns {
+		has, err := hasColumn(ctx, db, col.table, col.column)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.column, col.decl)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if col.backfill != "" {
+			if _, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET %s = %s", col.table, col.column, col.backfill)); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	for _, t := range retimedColumns {
+		if err := retime(ctx, db, t.table, t.columns); err != nil {
+			return err
+		}
+	}
+	_, err := db.ExecContext(ctx, postMigrationSQL)
+	return err
+}
+
+// addTable creates table with create and fills it with backfill, unless it
+// exists. A database without an entries table is new: schemaSQL creates
+// everything.
+func addTable(ctx context.Context, db *sql.DB, table, create, backfill string) error {
+	hasEntries, err := hasTable(ctx, db, "entries")
+	if err != nil || !hasEntries {
+		return err
+	}
+	has, err := hasTable(ctx, db, table)
+	if err != nil || has {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, create); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, backfill); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// retime rewrites the timestamps in columns of table that are not already
+// in storedTimeFormat. Values that do not parse as RFC 3339 are left alone.
+func retime(ctx context.Context, db *sql.DB, table string, columns []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var stale []string
+	for _, col := range columns {
+		stale = append(stale, fmt.Sprintf("(%[1]s IS NOT NULL AND %[1]s NOT GLOB '%[2]s')", col, storedTimeGlob))
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT id, %s FROM %s WHERE %s",
+		strings.Join(columns, ", "), table, strings.Join(stale, " OR ")))
+	if err != nil {
+		return err
+	}
+	type update struct {
+		id     string
+		values []any
+	}
+	var updates []update
+	for rows.Next() {
+		var id string
+		values := make([]sql.NullString, len(columns))
+		dest := []any{&id}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+		u := update{id: id}
+		for _, v := range values {
+			t, err := time.Parse(time.RFC3339Nano, v.String)
+			if !v.Valid || err != nil {
+				u.values = append(u.values, v)
+				continue
+			}
+			u.values = append(u.values, t.UTC().Format(storedTimeFormat))
+		}
+		updates = append(updates, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	var set []string
+	for _, col := range columns {
+		set = append(set, col+" = ?")
+	}
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("UPDATE %s SET %s WHERE id = ?", table, strings.Join(set, ", ")))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, u := range updates {
+		if _, err := stmt.ExecContext(ctx, append(u.values, u.id)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func hasTable(ctx context.Context, db *sql.DB, table string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&n)
+	return n > 0, err
+}
+
+func hasColumn(ctx context.Context, db *sql.DB, table, column string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&n)
+	return n > 0, err
+}
+
+// migrateFile migrates the database at path.
+func migrateFile(ctx context.Context, path string) error {
+	db, err := storage.OpenDB(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if err := migrate(ctx, db); err != nil {
+		_ = db.Close()
+		return err
+	}
+	return db.Close()
+}
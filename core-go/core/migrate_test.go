@@ -0,0 +1,54 @@
+package core
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"logwayss/core-go/internal/storage"
+)
+
+func TestMigrateRewritesLegacyTimestamps(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), dbFileName)
+	db, err := storage.OpenDB(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Rows as written before storedTimeFormat: RFC 3339 with a fraction of
+	// whatever length the time needed, which sorts '...:05Z' after '...:05.5Z'.
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE entries (id TEXT PRIMARY KEY, type TEXT NOT NULL, created_at TEXT NOT NULL, updated_at TEXT NOT NULL,
+			schema_version INTEGER NOT NULL, source TEXT, device_id TEXT, meta_json TEXT, payload BLOB NOT NULL, iv BLOB NOT NULL, tag BLOB NOT NULL);
+		INSERT INTO entries VALUES ('01', 'text', '2020-01-01T00:00:05Z', '2020-01-01T00:00:05Z', 1, '', '', 'null', x'00', x'00', x'00');
+		INSERT INTO entries VALUES ('02', 'text', '2020-01-01T00:00:05.5Z', '2020-01-01T02:00:05.5+02:00', 1, '', '', 'null', x'00', x'00', x'00');`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := migrate(ctx, db); err != nil {
+			t.Fatalf("migrate run %d failed: %v", i, err)
+		}
+	}
+	want := map[string]string{
+		"01": "2020-01-01T00:00:05.000000000Z",
+		"02": "2020-01-01T00:00:05.500000000Z",
+	}
+	for id, ts := range want {
+		var created, updated, recorded string
+		if err := db.QueryRowContext(ctx, "SELECT created_at, updated_at, recorded_at FROM entries WHERE id = ?", id).Scan(&created, &updated, &recorded); err != nil {
+			t.Fatal(err)
+		}
+		if created != ts || updated != ts || recorded != ts {
+			t.Errorf("entry %s: got %q %q %q, want %q", id, created, updated, recorded, ts)
+		}
+	}
+	// The incremental high-water mark is the newest (updated_at, id).
+	w, err := highWaterOf(ctx, path)
+	if err != nil {
+		t.Fatalf("highWaterOf failed: %v", err)
+	}
+	if w.ID != "02" {
+		t.Fatalf("high-water mark %+v, want entry 02", w)
+	}
+}
@@ -0,0 +1,338 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Relations (spec §6.1): an entry's meta.relations names its parents, which
+// make up threads such as conversations, and the entries it refers to. The
+// relations table indexes those links in both directions. Targets must exist
+// when an entry is created; an entry can never link to itself because its ID
+// is only assigned then.
+var (
+	ErrInvalidRelation = errors.New("invalid entry relation")
+
+	// maxRelations bounds parents and refs separately.
+	maxRelations = 100
+
+	relationsSQL = `
+		CREATE TABLE IF NOT EXISTS relations (
+			from_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			to_id TEXT NOT NULL,
+			pos INTEGER NOT NULL,
+			PRIMARY KEY (from_id, kind, to_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_relations_to ON relations(to_id, kind);
+`
+	// backfillRelationsSQL indexes the relations of entries written before
+	// the relations table existed.
+	backfillRelationsSQL = `
+		INSERT OR IGNORE INTO relations (from_id, kind, to_id, pos)
+		SELECT e.id, 'parent', j.value, j.key FROM entries e, json_each(e.meta_json, '$.relations.parents') j
+		WHERE json_valid(e.meta_json) AND json_type(e.meta_json, '$.relations.parents') = 'array' AND j.type = 'text';
+		INSERT OR IGNORE INTO relations (from_id, kind, to_id, pos)
+		SELECT e.id, 'ref', j.value, j.key FROM entries e, json_each(e.meta_json, '$.relations.refs') j
+		WHERE json_valid(e.meta_json) AND json_type(e.meta_json, '$.relations.refs') = 'array' AND j.type = 'text';
+`
+)
+
+// MaxTraversalDepth is the depth Ancestors and Descendants use when asked
+// for a depth outside 1..MaxTraversalDepth. It also bounds GetThread.
+const MaxTraversalDepth = 100
+
+// RelationKind is the kind of link stored in the relations table.
+type RelationKind string
+
+const (
+	RelationParent RelationKind = "parent"
+	RelationRef    RelationKind = "ref"
+)
+
+// Relations is the meta.relations object of an entry.
+type Relations struct {
+	Parents []string `json:"parents,omitempty"`
+	Refs    []string `json:"refs,omitempty"`
+}
+
+// RelatedEntry is an entry reached by a traversal, Depth links away from
+// where it started.
+type RelatedEntry struct {
+	Entry
+	Depth int `json:"depth"`
+}
+
+// RelationsOf returns the relations in an entry's meta. Malformed values
+// are ignored; Validate reports them.
+func RelationsOf(meta map[string]any) Relations {
+	raw, _ := meta["relations"].(map[string]any)
+	ids := func(v any) []string {
+		list, _ := relationList(v)
+		var out []string
+		for _, item := range list {
+			if id, ok := item.(string); ok {
+				out = append(out, id)
+			}
+		}
+		return out
+	}
+	return Relations{Parents: ids(raw["parents"]), Refs: ids(raw["refs"])}
+}
+
+// relationList returns v as a list. Meta decoded from JSON holds []any;
+// callers building it in Go may use []string.
+func relationList(v any) ([]any, bool) {
+	switch v := v.(type) {
+	case []any:
+		return v, true
+	case []string:
+		list := make([]any, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+// validateRelations checks the shape of meta.relations.
+func validateRelations(found *issues, v any) {
+	raw, ok := v.(map[string]any)
+	if !ok {
+		found.add(ErrInvalidEntryMeta, "meta.relations", CodeType, "must be an object")
+		return
+	}
+	for _, key := range []string{"parents", "refs"} {
+		v, ok := raw[key]
+		if !ok {
+			continue
+		}
+		path := "meta.relations." + key
+		list, ok := relationList(v)
+		if !ok {
+			found.add(ErrInvalidEntryMeta, path, CodeType, "must be an array")
+			continue
+		}
+		if len(list) > maxRelations {
+			found.add(ErrInvalidEntryMeta, path, CodeTooMany, fmt.Sprintf("must have at most %d items", maxRelations))
+		}
+		for i, item := range list {
+			id, ok := item.(string)
+			if !ok {
+				found.add(ErrInvalidEntryMeta, fmt.Sprintf("%s[%d]", path, i), CodeType, "must be a string")
+			} else if _, err := ulid.ParseStrict(id); err != nil {
+				found.add(ErrInvalidEntryMeta, fmt.Sprintf("%s[%d]", path, i), CodeFormat, "must be an entry ID")
+			}
+		}
+	}
+}
+
+// insertRelations checks that every target of rels exists and indexes the
+// links from id.
+func insertRelations(ctx context.Context, tx *sql.Tx, id string, rels Relations) error {
+	var found issues
+	for _, kind := range []struct {
+		kind RelationKind
+		path string
+		ids  []string
+	}{{RelationParent, "meta.relations.parents", rels.Parents}, {RelationRef, "meta.relations.refs", rels.Refs}} {
+		for i, target := range kind.ids {
+			var exists int
+			if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM entries WHERE id = ?", target).Scan(&exists); err != nil {
+				return err
+			}
+			if exists == 0 {
+				found.add(ErrInvalidRelation, fmt.Sprintf("%s[%d]", kind.path, i), CodeReference, fmt.Sprintf("entry %s does not exist", target))
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO relations (from_id, kind, to_id, pos) VALUES (?, ?, ?, ?)",
+				id, kind.kind, target, i); err != nil {
+				return err
+			}
+		}
+	}
+	return found.err()
+}
+
+// GetChildren returns the entries that list id as a parent, oldest first.
+func (c *Core) GetChildren(ctx context.Context, id string) ([]Entry, error) {
+	return c.linkedTo(ctx, id, RelationParent, "ASC")
+}
+
+// GetBacklinks returns the entries that list id in meta.relations.refs,
+// newest first.
+func (c *Core) GetBacklinks(ctx context.Context, id string) ([]Entry, error) {
+	return c.linkedTo(ctx, id, RelationRef, "DESC")
+}
+
+func (c *Core) linkedTo(ctx context.Context, id string, kind RelationKind, order string) ([]Entry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.mustExist(ctx, id); err != nil {
+		return nil, err
+	}
+	ids, err := c.queryIDs(ctx, `
+		SELECT e.id FROM relations r JOIN entries e ON e.id = r.from_id
+		WHERE r.to_id = ? AND r.kind = ?
+		ORDER BY e.created_at `+order+`, e.id `+order, id, kind)
+	if err != nil {
+		return nil, err
+	}
+	return c.getEntries(ctx, ids)
+}
+
+// GetThread returns the conversation id belongs to: the root reached by
+// following first parents, and every descendant of that root, oldest first.
+func (c *Core) GetThread(ctx context.Context, id string) ([]Entry, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.mustExist(ctx, id); err != nil {
+		return nil, err
+	}
+	var root string
+	err := c.db.QueryRowContext(ctx, `
+		WITH RECURSIVE up(id, depth) AS (
+			SELECT ?, 0
+			UNION
+			SELECT r.to_id, up.depth + 1 FROM relations r JOIN up ON r.from_id = up.id
+			JOIN entries e ON e.id = r.to_id
+			WHERE r.kind = 'parent' AND r.pos = 0 AND up.depth < ?
+		)
+		SELECT id FROM up ORDER BY depth DESC LIMIT 1`, id, MaxTraversalDepth).Scan(&root)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := c.queryIDs(ctx, walkSQL(RelationParent, false)+`
+		SELECT w.id FROM walk w JOIN entries e ON e.id = w.id
+		GROUP BY w.id ORDER BY e.created_at, w.id`, root, MaxTraversalDepth)
+	if err != nil {
+		return nil, err
+	}
+	return c.getEntries(ctx, ids)
+}
+
+// Ancestors returns the entries reachable from id by following parent links
+// up to maxDepth steps, nearest first.
+func (c *Core) Ancestors(ctx context.Context, id string, maxDepth int) ([]RelatedEntry, error) {
+	return c.traverse(ctx, id, true, maxDepth)
+}
+
+// Descendants returns the entries that reach id by following parent links,
+// at most maxDepth steps away, nearest first.
+func (c *Core) Descendants(ctx context.Context, id string, maxDepth int) ([]RelatedEntry, error) {
+	return c.traverse(ctx, id, false, maxDepth)
+}
+
+func (c *Core) traverse(ctx context.Context, id string, up bool, maxDepth int) ([]RelatedEntry, error) {
+	if maxDepth < 1 || maxDepth > MaxTraversalDepth {
+		maxDepth = MaxTraversalDepth
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if err := c.mustExist(ctx, id); err != nil {
+		return nil, err
+	}
+	rows, err := c.db.QueryContext(ctx, walkSQL(RelationParent, up)+`
+		SELECT w.id, MIN(w.depth) AS d FROM walk w JOIN entries e ON e.id = w.id
+		WHERE w.id != ? GROUP BY w.id ORDER BY d, e.created_at, w.id`, id, maxDepth, id)
+	if err != nil {
+		return nil, err
+	}
+	type hit struct {
+		id    string
+		depth int
+	}
+	var hits []hit
+	for rows.Next() {
+		var h hit
+		if err := rows.Scan(&h.id, &h.depth); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]RelatedEntry, 0, len(hits))
+	for _, h := range hits {
+		e, err := c.getEntry(ctx, h.id)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, RelatedEntry{Entry: e, Depth: h.depth})
+	}
+	return out, nil
+}
+
+// walkSQL is a recursive CTE "walk(id, depth)" over links of kind, starting
+// at the first query argument and stopping at the depth in the second. up
+// follows links from an entry to its targets; otherwise it follows them
+// backwards. UNION drops repeated (id, depth) pairs, and the depth bound
+// ends any cycle.
+func walkSQL(kind RelationKind, up bool) string {
+	next, join := "r.from_id", "r.to_id"
+	if up {
+		next, join = join, next
+	}
+	return fmt.Sprintf(`
+		WITH RECURSIVE walk(id, depth) AS (
+			SELECT ?, 0
+			UNION
+			SELECT %s, walk.depth + 1 FROM relations r JOIN walk ON %s = walk.id
+			WHERE r.kind = '%s' AND walk.depth < ?
+		)`, next, join, kind)
+}
+
+// mustExist checks that the profile is unlocked and id is an entry. The
+// caller must hold c.mu.
+func (c *Core) mustExist(ctx context.Context, id string) error {
+	if !c.isUnlocked() {
+		return ErrLocked
+	}
+	var n int
+	if err := c.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM entries WHERE id = ?", id).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (c *Core) queryIDs(ctx context.Context, query string, args ...any) ([]string, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// getEntries reads the entries with the given IDs, in order. The caller must
+// hold c.mu.
+func (c *Core) getEntries(ctx context.Context, ids []string) ([]Entry, error) {
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		e, err := c.getEntry(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"logwayss/core-go/internal/storage"
+)
+
+func TestRelations(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+
+	create := func(text string, parents, refs []string) Entry {
+		t.Helper()
+		rel := map[string]any{}
+		if parents != nil {
+			rel["parents"] = parents
+		}
+		if refs != nil {
+			rel["refs"] = refs
+		}
+		e, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"` + text + `"}`), Meta: map[string]any{"relations": rel}})
+		if err != nil {
+			t.Fatalf("CreateEntry(%s) failed: %v", text, err)
+		}
+		return e
+	}
+	ids := func(entries []Entry) []string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.ID)
+		}
+		return out
+	}
+
+	// root ← a ← b ← d, root ← c; note refs a and c.
+	root := create("root", nil, nil)
+	a := create("a", []string{root.ID}, nil)
+	b := create("b", []string{a.ID}, nil)
+	cc := create("c", []string{root.ID}, nil)
+	d := create("d", []string{b.ID}, nil)
+	note := create("note", nil, []string{a.ID, cc.ID})
+
+	children, err := c.GetChildren(ctx, root.ID)
+	if err != nil || !slices.Equal(ids(children), []string{a.ID, cc.ID}) {
+		t.Fatalf("GetChildren = %v, %v", ids(children), err)
+	}
+	thread, err := c.GetThread(ctx, d.ID)
+	if err != nil || !slices.Equal(ids(thread), []string{root.ID, a.ID, b.ID, cc.ID, d.ID}) {
+		t.Fatalf("GetThread = %v, %v", ids(thread), err)
+	}
+	backlinks, err := c.GetBacklinks(ctx, cc.ID)
+	if err != nil || !slices.Equal(ids(backlinks), []string{note.ID}) {
+		t.Fatalf("GetBacklinks = %v, %v", ids(backlinks), err)
+	}
+
+	ancestors, err := c.Ancestors(ctx, d.ID, 2)
+	if err != nil || len(ancestors) != 2 || ancestors[0].ID != b.ID || ancestors[1].ID != a.ID || ancestors[1].Depth != 2 {
+		t.Fatalf("Ancestors(d, 2) = %v, %v", ancestors, err)
+	}
+	descendants, err := c.Descendants(ctx, root.ID, 0)
+	if err != nil || len(descendants) != 4 || descendants[3].ID != d.ID || descendants[3].Depth != 3 {
+		t.Fatalf("Descendants(root) = %v, %v", descendants, err)
+	}
+
+	// Targets must exist and be entry IDs.
+	missing := "01ARZ3NDEKTSV4RRFFQ69G5FAV"
+	_, err = c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"x"}`),
+		Meta: map[string]any{"relations": map[string]any{"parents": []any{root.ID, missing}}}})
+	if !errors.Is(err, ErrInvalidRelation) || Issues(err)[0].Path != "meta.relations.parents[1]" || Issues(err)[0].Code != CodeReference {
+		t.Fatalf("dangling parent: %v", err)
+	}
+	_, err = c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"x"}`),
+		Meta: map[string]any{"relations": map[string]any{"refs": "nope"}}})
+	if !errors.Is(err, ErrInvalidEntryMeta) {
+		t.Fatalf("malformed refs: %v", err)
+	}
+	if _, err := c.GetChildren(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetChildren of a missing entry: %v", err)
+	}
+}
+
+func TestMigrateBackfillsRelations(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), dbFileName)
+	db, err := storage.OpenDB(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE entries (id TEXT PRIMARY KEY, type TEXT NOT NULL, created_at TEXT NOT NULL, updated_at TEXT NOT NULL,
+			schema_version INTEGER NOT NULL, source TEXT, device_id TEXT, meta_json TEXT, payload BLOB NOT NULL, iv BLOB NOT NULL, tag BLOB NOT NULL);
+		INSERT INTO entries VALUES ('01', 'text', '2020-01-01T00:00:00.000000000Z', '2020-01-01T00:00:00.000000000Z', 1, '', '', 'null', x'00', x'00', x'00');
+		INSERT INTO entries VALUES ('02', 'text', '2020-01-02T00:00:00.000000000Z', '2020-01-02T00:00:00.000000000Z', 1, '', '', '{"relations":{"parents":["01"],"refs":"bad"}}', x'00', x'00', x'00');`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(ctx, db); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	var from, kind, to string
+	if err := db.QueryRowContext(ctx, "SELECT from_id, kind, to_id FROM relations").Scan(&from, &kind, &to); err != nil {
+		t.Fatal(err)
+	}
+	if from != "02" || kind != "parent" || to != "01" {
+		t.Fatalf("backfilled relation = %s %s %s", from, kind, to)
+	}
+}
@@ -0,0 +1,236 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"logwayss/core-go/internal/storage"
+)
+
+// Corruption handling (spec §6.4): Scrub checks the database structure and
+// authenticates every entry. Entries that fail are moved to the quarantine
+// table and the profile becomes read-only until it is restored with
+// ImportArchive or RestoreChain. The read-only state is persisted next to the
+// database so it survives a restart.
+var (
+	ErrReadOnly     = errors.New("profile is read-only after corruption was detected; restore from a backup")
+	ErrCorruptEntry = errors.New("entry failed authentication")
+
+	readOnlyFileName = "readonly.json"
+)
+
+// ScrubReport is the outcome of Scrub.
+type ScrubReport struct {
+	IntegrityOK     bool      `json:"integrity_ok"`
+	IntegrityErrors []string  `json:"integrity_errors,omitempty"`
+	Checked         int       `json:"checked"`
+	BadEntries      []string  `json:"bad_entries,omitempty"`
+	FinishedAt      time.Time `json:"finished_at"`
+}
+
+// Clean reports whether the scrub found no problems.
+func (r ScrubReport) Clean() bool {
+	return r.IntegrityOK && len(r.BadEntries) == 0
+}
+
+type readOnlyState struct {
+	Reason     string `json:"reason"`
+	DetectedAt string `json:"detected_at"`
+}
+
+// Scrub runs PRAGMA integrity_check and authenticates the GCM tag of every
+// entry. If anything is wrong, the failing entries are quarantined and the
+// Core switches to read-only mode, in which writes fail with ErrReadOnly.
+// SQLite reporting the file as corrupt while it is scanned counts as a
+// failed integrity check.
+func (c *Core) Scrub(ctx context.Context) (ScrubReport, error) {
+	report, err := c.scan(ctx)
+	if storage.IsCorrupt(err) {
+		report.IntegrityOK = false
+		report.IntegrityErrors = append(report.IntegrityErrors, err.Error())
+		err = nil
+	}
+	if err != nil || report.Clean() {
+		return report, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.isUnlocked() {
+		return report, ErrLocked
+	}
+	// A database too damaged to quarantine from must still stop taking
+	// writes.
+	qerr := c.quarantine(ctx, report.BadEntries)
+	reason := fmt.Sprintf("%d entries failed authentication", len(report.BadEntries))
+	if !report.IntegrityOK {
+		reason = "database integrity check failed"
+	}
+	if err := c.setReadOnly(reason); err != nil {
+		return report, err
+	}
+	return report, qerr
+}
+
+// ReadOnlyReason returns why the profile is read-only, or "" if it is not.
+func (c *Core) ReadOnlyReason() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.readOnly
+}
+
+func (c *Core) scan(ctx context.Context) (ScrubReport, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return ScrubReport{}, ErrLocked
+	}
+
+	report := ScrubReport{IntegrityOK: true}
+	rows, err := c.db.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			rows.Close()
+			return report, err
+		}
+		if line != "ok" {
+			report.IntegrityOK = false
+			report.IntegrityErrors = append(report.IntegrityErrors, line)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	err = forEachSealedRow(ctx, c.db, func(r sealedRow) error {
+		report.Checked++
+		pt, err := r.open(c.sessionKey)
+		if err != nil {
+			report.BadEntries = append(report.BadEntries, r.id)
+			return nil
+		}
+		zero(pt)
+		return nil
+	})
+	report.FinishedAt = time.Now().UTC()
+	return report, err
+}
+
+// quarantine moves the given entries out of the entries table. The caller
+// must hold c.mu for writing.
+func (c *Core) quarantine(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC().Format(storedTimeFormat)
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR REPLACE INTO quarantine (id, type, created_at, updated_at, schema_version, source, device_id, meta_json, payload, iv, tag, recorded_at, tz_offset, type_version, reason, quarantined_at)
+			SELECT id, type, created_at, updated_at, schema_version, source, device_id, meta_json, payload, iv, tag, recorded_at, tz_offset, type_version, ?, ? FROM entries WHERE id = ?`,
+			"authentication failed", now, id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM entry_tags WHERE entry_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM relations WHERE from_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM collection_entries WHERE entry_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM entries WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// QuarantinedEntries returns the IDs of entries moved aside by Scrub.
+func (c *Core) QuarantinedEntries(ctx context.Context) ([]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return nil, ErrLocked
+	}
+	rows, err := c.db.QueryContext(ctx, "SELECT id FROM quarantine ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// setReadOnly persists and enters read-only mode. The caller must hold c.mu
+// for writing.
+func (c *Core) setReadOnly(reason string) error {
+	c.readOnly = reason
+	state, err := json.Marshal(readOnlyState{Reason: reason, DetectedAt: time.Now().UTC().Format(storedTimeFormat)})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.dataDir, readOnlyFileName), state)
+}
+
+// clearReadOnly leaves read-only mode after a restore. The caller must hold
+// c.mu for writing.
+func (c *Core) clearReadOnly() error {
+	c.readOnly = ""
+	if err := os.Remove(filepath.Join(c.dataDir, readOnlyFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// loadReadOnly restores the persisted read-only state on unlock.
+func (c *Core) loadReadOnly() error {
+	raw, err := os.ReadFile(filepath.Join(c.dataDir, readOnlyFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		c.readOnly = ""
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state readOnlyState
+	if err := json.Unmarshal(raw, &state); err != nil || state.Reason == "" {
+		state.Reason = "corruption detected"
+	}
+	c.readOnly = state.Reason
+	return nil
+}
+
+// writable reports whether mutations are currently allowed. The caller must
+// hold c.mu.
+func (c *Core) writable() error {
+	if !c.isUnlocked() {
+		return ErrLocked
+	}
+	if c.readOnly != "" {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScrubQuarantinesAndRestores(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+	dir := c.dataDir
+
+	good, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"good"}`)})
+	if err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+	backup := filepath.Join(t.TempDir(), "backup.lwx")
+	bad, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Tags: []string{"x"}, Payload: []byte(`{"text":"bad"}`)})
+	if err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+	if err := c.ExportArchive(ctx, backup); err != nil {
+		t.Fatalf("ExportArchive failed: %v", err)
+	}
+
+	report, err := c.Scrub(ctx)
+	if err != nil || !report.Clean() || report.Checked != 2 {
+		t.Fatalf("clean scrub: report=%+v err=%v", report, err)
+	}
+
+	if _, err := c.db.ExecContext(ctx, "UPDATE entries SET tag = zeroblob(16) WHERE id = ?", bad.ID); err != nil {
+		t.Fatalf("tamper failed: %v", err)
+	}
+	if _, err := c.GetEntry(ctx, bad.ID); !errors.Is(err, ErrCorruptEntry) {
+		t.Fatalf("GetEntry on tampered row: got %v, want ErrCorruptEntry", err)
+	}
+
+	report, err = c.Scrub(ctx)
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if !report.IntegrityOK || len(report.BadEntries) != 1 || report.BadEntries[0] != bad.ID {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if _, err := c.GetEntry(ctx, bad.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("quarantined entry still readable: %v", err)
+	}
+	if q, err := c.QuarantinedEntries(ctx); err != nil || len(q) != 1 || q[0] != bad.ID {
+		t.Fatalf("QuarantinedEntries = %v, %v", q, err)
+	}
+	if _, err := c.GetEntry(ctx, good.ID); err != nil {
+		t.Fatalf("good entry unreadable: %v", err)
+	}
+
+	if _, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"new"}`)}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("CreateEntry in read-only mode: got %v, want ErrReadOnly", err)
+	}
+	if _, err := c.PutMedia(ctx, bytes.NewReader([]byte("x")), "text/plain"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("PutMedia in read-only mode: got %v, want ErrReadOnly", err)
+	}
+
+	// Read-only mode survives a restart.
+	c.Lock()
+	if err := c.UnlockProfile(ctx, dir, []byte("password")); err != nil {
+		t.Fatalf("UnlockProfile failed: %v", err)
+	}
+	if c.ReadOnlyReason() == "" {
+		t.Fatal("read-only state lost across unlock")
+	}
+
+	if err := c.ImportArchive(ctx, backup); err != nil {
+		t.Fatalf("ImportArchive failed: %v", err)
+	}
+	if c.ReadOnlyReason() != "" {
+		t.Fatalf("still read-only after restore: %q", c.ReadOnlyReason())
+	}
+	if _, err := c.GetEntry(ctx, bad.ID); err != nil {
+		t.Fatalf("restored entry unreadable: %v", err)
+	}
+	if _, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"new"}`)}); err != nil {
+		t.Fatalf("CreateEntry after restore failed: %v", err)
+	}
+}
+
+func TestScrubCorruptDatabaseGoesReadOnly(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+	text := strings.Repeat("x", 400)
+	for i := 0; i < 200; i++ {
+		if _, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"` + text + `"}`)}); err != nil {
+			t.Fatalf("CreateEntry failed: %v", err)
+		}
+	}
+
+	// Damage the second half of the file under the open database; closing
+	// idle connections drops the pages they had cached.
+	if _, err := c.db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		t.Fatalf("checkpoint failed: %v", err)
+	}
+	c.db.SetMaxIdleConns(0)
+	path := filepath.Join(c.dataDir, dbFileName)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(raw) / 2; i < len(raw); i++ {
+		raw[i] = 0xa5
+	}
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.Scrub(ctx)
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+	if report.IntegrityOK || len(report.IntegrityErrors) == 0 {
+		t.Fatalf("corruption not reported: %+v", report)
+	}
+	if c.ReadOnlyReason() == "" {
+		t.Fatal("corrupt database left writable")
+	}
+}
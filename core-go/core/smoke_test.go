@@ -46,7 +46,7 @@ func TestClientFlow_Smoke(t *testing.T) {
 		}
 		defer c.Lock()
 
-		payloadMap := map[string]interface{}{"message": "hello, logwayss"}
+		payloadMap := map[string]interface{}{"text": "hello, logwayss"}
 		payloadBytes, err := json.Marshal(payloadMap)
 		if err != nil {
 			t.Fatalf("failed to marshal payload map: %v", err)
@@ -259,7 +259,7 @@ func TestClientFlow_Smoke(t *testing.T) {
 			originalIDs[entry.ID] = true
 		}
 
-		_, err = c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{}`), DeviceID: "temp-device"})
+		_, err = c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: []byte(`{"text":"temporary"}`), DeviceID: "temp-device"})
 		if err != nil {
 			t.Fatalf("Failed to create temporary entry: %v", err)
 		}
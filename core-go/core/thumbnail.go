@@ -0,0 +1,243 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	ccrypto "logwayss/core-go/internal/crypto"
+)
+
+// Thumbnails are generated by PutMedia for JPEG, PNG and GIF images and
+// stored next to the blob as media/<ref[:2]>/<ref>.thumb<size>, in the same
+// encrypted blob format with their own keys recorded in the sidecar. Each is
+// a JPEG whose longest edge is at most the thumbnail size; images that are
+// already smaller are re-encoded at their own size.
+var (
+	ErrNoThumbnail = errors.New("no thumbnail for media")
+
+	// ThumbnailSizes are the longest-edge sizes, in pixels, generated for
+	// every image.
+	ThumbnailSizes = []int{128, 512}
+
+	thumbnailMIMEs = []string{"image/jpeg", "image/png", "image/gif"}
+)
+
+const (
+	// maxThumbnailSource is the largest image PutMedia decodes for
+	// thumbnails; larger images are stored without them.
+	maxThumbnailSource = 64 << 20
+	// maxThumbnailPixels guards against decompression bombs.
+	maxThumbnailPixels = 64 << 20
+	thumbnailQuality   = 80
+)
+
+type thumbRecord struct {
+	Size        int    `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Bytes       int64  `json:"bytes"`
+	Key         string `json:"key"`
+	NoncePrefix string `json:"nonce_prefix"`
+}
+
+// thumbFile is an encrypted thumbnail waiting to be moved into the store.
+type thumbFile struct {
+	tmp string
+	rec thumbRecord
+}
+
+// OpenThumbnail returns a reader over the JPEG thumbnail of ref at size, one
+// of ThumbnailSizes. Media that is not a decodable image has no thumbnails
+// and yields ErrNoThumbnail.
+func (c *Core) OpenThumbnail(ctx context.Context, ref string, size int) (io.ReadCloser, error) {
+	if !slices.Contains(ThumbnailSizes, size) {
+		return nil, fmt.Errorf("%w: unsupported thumbnail size %d", ErrInvalidMedia, size)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !c.isUnlocked() {
+		return nil, ErrLocked
+	}
+	rec, err := c.mediaRecord(ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range rec.Thumbnails {
+		if t.Size != size {
+			continue
+		}
+		key, _ := hex.DecodeString(t.Key)
+		defer zero(key)
+		prefix, _ := hex.DecodeString(t.NoncePrefix)
+		return openMediaBlob(thumbPath(mediaPath(c.dataDir, ref), size), key, prefix)
+	}
+	return nil, ErrNoThumbnail
+}
+
+// makeThumbnails decodes src and writes an encrypted thumbnail for every
+// size into dir. It returns nothing, without error, for images it cannot
+// decode: the media itself is still stored.
+func makeThumbnails(dir string, src []byte) (thumbs []thumbFile, width, height int, err error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxThumbnailPixels {
+		return nil, 0, 0, nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, cfg.Width, cfg.Height, nil
+	}
+	defer func() {
+		if err != nil {
+			removeThumbFiles(thumbs)
+			thumbs = nil
+		}
+	}()
+	for _, size := range ThumbnailSizes {
+		scaled := scaleToFit(img, size)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, scaled, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return thumbs, 0, 0, err
+		}
+		t, err := writeThumbFile(dir, buf.Bytes())
+		if err != nil {
+			return thumbs, 0, 0, err
+		}
+		t.rec.Size = size
+		t.rec.Width = scaled.Bounds().Dx()
+		t.rec.Height = scaled.Bounds().Dy()
+		thumbs = append(thumbs, t)
+	}
+	return thumbs, cfg.Width, cfg.Height, nil
+}
+
+func writeThumbFile(dir string, data []byte) (thumbFile, error) {
+	key, err := ccrypto.GenerateSalt(32)
+	if err != nil {
+		return thumbFile{}, err
+	}
+	defer zero(key)
+	prefix, err := ccrypto.GenerateSalt(ccrypto.StreamPrefixSize)
+	if err != nil {
+		return thumbFile{}, err
+	}
+	f, err := os.CreateTemp(dir, ".thumb-")
+	if err != nil {
+		return thumbFile{}, err
+	}
+	t := thumbFile{tmp: f.Name(), rec: thumbRecord{
+		Bytes:       int64(len(data)),
+		Key:         hex.EncodeToString(key),
+		NoncePrefix: hex.EncodeToString(prefix),
+	}}
+	sw, err := newMediaBlobWriter(f, key, prefix)
+	if err == nil {
+		_, err = sw.Write(data)
+	}
+	if err == nil {
+		err = sw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(t.tmp)
+		return thumbFile{}, err
+	}
+	return t, nil
+}
+
+func removeThumbFiles(thumbs []thumbFile) {
+	for _, t := range thumbs {
+		os.Remove(t.tmp)
+	}
+}
+
+// scaleToFit downsamples img so that its longest edge is at most size,
+// averaging every source pixel that falls within each destination pixel.
+// Transparency is flattened onto white since thumbnails are JPEGs.
+func scaleToFit(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, max(1, sh*size/sw)
+		} else {
+			dw, dh = max(1, sw*size/sh), size
+		}
+	}
+
+	src, ok := img.(*image.RGBA)
+	if !ok || b.Min != (image.Point{}) {
+		src = image.NewRGBA(image.Rect(0, 0, sw, sh))
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, max((x+1)*sw/dw, x*sw/dw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					bl += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+			// Pixels are alpha-premultiplied: composite over white.
+			white := 255*n - a
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8((r + white) / n)
+			dst.Pix[i+1] = uint8((g + white) / n)
+			dst.Pix[i+2] = uint8((bl + white) / n)
+			dst.Pix[i+3] = 255
+		}
+	}
+	return dst
+}
+
+func thumbnailable(mime string) bool {
+	base, _, _ := strings.Cut(mime, ";")
+	return slices.Contains(thumbnailMIMEs, strings.ToLower(strings.TrimSpace(base)))
+}
+
+func thumbPath(blobPath string, size int) string {
+	return fmt.Sprintf("%s.thumb%d", blobPath, size)
+}
+
+// limitedBuffer collects up to limit bytes and then drops the rest, noting
+// that it overflowed. It never fails a write.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.overflow || b.Len()+len(p) > b.limit {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+
+	"logwayss/core-go/internal/storage"
+)
+
+func TestBackdatedEntries(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCore(t)
+
+	text := []byte(`{"text":"run"}`)
+	yesterday := time.Now().Add(-24 * time.Hour).In(time.FixedZone("", 5*3600+45*60)).Truncate(time.Millisecond)
+	old, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: text, CreatedAt: &yesterday})
+	if err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+	now, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: text})
+	if err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+
+	got, err := c.GetEntry(ctx, old.ID)
+	if err != nil {
+		t.Fatalf("GetEntry failed: %v", err)
+	}
+	if !got.CreatedAt.Equal(yesterday) || got.RecordedAt.Sub(got.CreatedAt) < 23*time.Hour {
+		t.Fatalf("created_at %v, recorded_at %v", got.CreatedAt, got.RecordedAt)
+	}
+	if got.TZOffset == nil || *got.TZOffset != 345 {
+		t.Fatalf("tz_offset = %v, want 345", got.TZOffset)
+	}
+	if id := ulid.MustParse(got.ID); ulid.Time(id.Time()).UnixMilli() != yesterday.UnixMilli() {
+		t.Fatalf("ULID time %v, want %v", ulid.Time(id.Time()), yesterday)
+	}
+
+	// A back-dated entry recorded last sorts first by occurrence and last
+	// by recording.
+	later := time.Now().Add(-time.Hour)
+	backfilled, err := c.CreateEntry(ctx, NewEntry{Type: EntryTypeText, Payload: text, CreatedAt: &later})
+	if err != nil {
+		t.Fatalf("CreateEntry failed: %v", err)
+	}
+	ids := func(f QueryFilter) []string {
+		t.Helper()
+		entries, err := c.Query(ctx, f, Pagination{})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.ID)
+		}
+		return out
+	}
+	if got, want := ids(QueryFilter{}), []string{now.ID, backfilled.ID, old.ID}; !slices.Equal(got, want) {
+		t.Fatalf("order by occurrence = %v, want %v", got, want)
+	}
+	if got, want := ids(QueryFilter{TimeField: TimeRecorded}), []string{backfilled.ID, now.ID, old.ID}; !slices.Equal(got, want) {
+		t.Fatalf("order by recording = %v, want %v", got, want)
+	}
+	from := time.Now().Add(-2 * time.Hour)
+	if got, want := ids(QueryFilter{From: &from}), []string{now.ID, backfilled.ID}; !slices.Equal(got, want) {
+		t.Fatalf("occurred since %v = %v, want %v", from, got, want)
+	}
+	if got := ids(QueryFilter{From: &from, TimeField: TimeRecorded}); len(got) != 3 {
+		t.Fatalf("recorded since %v = %v, want all", from, got)
+	}
+	if _, err := c.Query(ctx, QueryFilter{TimeField: "bogus"}, Pagination{}); !errors.Is(err, ErrInvalidTimeField) {
+		t.Fatalf("Query with a bad time field: got %v", err)
+	}
+
+	future := time.Now().Add(48 * time.Hour)
+	preEpoch := time.Date(1960, 1, 1, 0, 0, 0, 0, time.UTC)
+	badOffset := 7
+	for name, ne := range map[string]NewEntry{
+		"future":     {Type: EntryTypeText, Payload: text, CreatedAt: &future},
+		"pre-epoch":  {Type: EntryTypeText, Payload: text, CreatedAt: &preEpoch},
+		"bad offset": {Type: EntryTypeText, Payload: text, TZOffset: &badOffset},
+	} {
+		if _, err := c.CreateEntry(ctx, ne); !errors.Is(err, ErrInvalidEntryTime) {
+			t.Errorf("%s: got %v, want ErrInvalidEntryTime", name, err)
+		}
+	}
+}
+
+func TestMigrateAddsTimestampColumns(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), dbFileName)
+	db, err := storage.OpenDB(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.ExecContext(ctx, `
+		CREATE TABLE entries (id TEXT PRIMARY KEY, type TEXT NOT NULL, created_at TEXT NOT NULL, updated_at TEXT NOT NULL,
+			schema_version INTEGER NOT NULL, source TEXT, device_id TEXT, meta_json TEXT, payload BLOB NOT NULL, iv BLOB NOT NULL, tag BLOB NOT NULL);
+		INSERT INTO entries VALUES ('01', 'text', '2020-01-01T00:00:00.000000000Z', '2020-01-01T00:00:00.000000000Z', 1, '', '', 'null', x'00', x'00', x'00');`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := migrate(ctx, db); err != nil {
+			t.Fatalf("migrate run %d failed: %v", i, err)
+		}
+	}
+	var recorded string
+	if err := db.QueryRowContext(ctx, "SELECT recorded_at FROM entries WHERE id = '01'").Scan(&recorded); err != nil {
+		t.Fatal(err)
+	}
+	if recorded != "2020-01-01T00:00:00.000000000Z" {
+		t.Fatalf("recorded_at not backfilled: %q", recorded)
+	}
+}
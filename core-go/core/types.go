@@ -3,7 +3,10 @@ package core
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
+
+	"logwayss/core-go/internal/schema"
 )
 
 var (
@@ -13,6 +16,17 @@ var (
 	ErrInvalidEntryDeviceID = errors.New("invalid entry device_id")
 	ErrInvalidEntryMeta     = errors.New("invalid entry meta")
 	ErrInvalidEntryPayload  = errors.New("invalid entry payload")
+	ErrInvalidEntryTime     = errors.New("invalid entry time")
+	ErrInvalidTimeField     = errors.New("invalid query time field")
+)
+
+const (
+	// maxFutureSkew is how far ahead of the local clock a created_at may be,
+	// to allow for devices whose clocks disagree.
+	maxFutureSkew = 24 * time.Hour
+	// Timezone offsets are minutes east of UTC, from UTC-12:00 to UTC+14:00.
+	minTZOffset = -12 * 60
+	maxTZOffset = 14 * 60
 )
 
 // EntryType represents the type of an entry
@@ -36,53 +50,78 @@ type NewEntry struct {
 	DeviceID string          `json:"device_id,omitempty"`
 	Meta     map[string]any  `json:"meta,omitempty"`
 	Payload  json.RawMessage `json:"payload"`
+	// CreatedAt is when the entry occurred, for back-dated entries and
+	// entries synced from another device. It defaults to the current time.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// TZOffset is the local timezone offset, in minutes east of UTC, where
+	// the entry occurred. If unset, it is taken from CreatedAt's location
+	// unless that is UTC.
+	TZOffset *int `json:"tz_offset,omitempty"`
 }
 
-// Validate validates the NewEntry fields
+// builtinTypes are the entry types defined by the spec. Their names are
+// reserved: custom types registered with RegisterEntryType cannot use them.
+var builtinTypes = map[EntryType]bool{
+	EntryTypeText:     true,
+	EntryTypeMarkdown: true,
+	EntryTypeMetrics:  true,
+	EntryTypeMediaRef: true,
+	EntryTypeEvent:    true,
+	EntryTypeLog:      true,
+}
+
+// Validate validates the NewEntry fields. It reports every problem at once
+// as a *ValidationError, which matches the ErrInvalidEntry* sentinel of each
+// failing field. Only built-in types are known here; Core.CreateEntry also
+// accepts the profile's custom types.
 func (ne *NewEntry) Validate() error {
-	if ne.Type == "" {
-		return ErrInvalidEntryType
-	}
+	return ne.validate(nil)
+}
+
+// validate is Validate with custom, if non-nil, looking up the payload
+// schema of a custom entry type.
+func (ne *NewEntry) validate(custom func(EntryType) *schema.Schema) error {
+	var found issues
 
 	// Validate entry type
-	validTypes := map[EntryType]bool{
-		EntryTypeText:     true,
-		EntryTypeMarkdown: true,
-		EntryTypeMetrics:  true,
-		EntryTypeMediaRef: true,
-		EntryTypeEvent:    true,
-		EntryTypeLog:      true,
+	var customSchema *schema.Schema
+	if custom != nil && !builtinTypes[ne.Type] {
+		customSchema = custom(ne.Type)
 	}
-
-	if !validTypes[ne.Type] {
-		return ErrInvalidEntryType
+	known := builtinTypes[ne.Type] || customSchema != nil
+	if ne.Type == "" {
+		found.add(ErrInvalidEntryType, "type", CodeRequired, "is required")
+	} else if !known {
+		found.add(ErrInvalidEntryType, "type", CodeEnum, fmt.Sprintf("unknown entry type %q", ne.Type))
 	}
 
 	// Validate tags
 	if len(ne.Tags) > 20 {
-		return ErrInvalidEntryTags
+		found.add(ErrInvalidEntryTags, "tags", CodeTooMany, "must have at most 20 tags")
 	}
-	for _, tag := range ne.Tags {
+	for i, tag := range ne.Tags {
 		if len(tag) > 50 {
-			return ErrInvalidEntryTags
+			found.add(ErrInvalidEntryTags, fmt.Sprintf("tags[%d]", i), CodeTooLong, "must be at most 50 bytes")
 		}
 	}
 
 	// Validate source
 	if len(ne.Source) > 50 {
-		return ErrInvalidEntrySource
+		found.add(ErrInvalidEntrySource, "source", CodeTooLong, "must be at most 50 bytes")
 	}
 
 	// Validate device_id
 	if len(ne.DeviceID) > 100 {
-		return ErrInvalidEntryDeviceID
+		found.add(ErrInvalidEntryDeviceID, "device_id", CodeTooLong, "must be at most 100 bytes")
 	}
 
 	// Validate meta
 	if ne.Meta != nil {
 		if confidence, ok := ne.Meta["confidence"]; ok {
-			if c, ok := confidence.(float64); !ok || c < 0 || c > 1 {
-				return ErrInvalidEntryMeta
+			if c, ok := confidence.(float64); !ok {
+				found.add(ErrInvalidEntryMeta, "meta.confidence", CodeType, "must be a number")
+			} else if c < 0 || c > 1 {
+				found.add(ErrInvalidEntryMeta, "meta.confidence", CodeRange, "must be between 0 and 1")
 			}
 		}
 
@@ -94,7 +133,7 @@ func (ne *NewEntry) Validate() error {
 					"friends": true,
 				}
 				if !valid[v] {
-					return ErrInvalidEntryMeta
+					found.add(ErrInvalidEntryMeta, "meta.visibility", CodeEnum, `must be one of "public", "private", "friends"`)
 				}
 			}
 		}
@@ -107,18 +146,68 @@ func (ne *NewEntry) Validate() error {
 					"high":   true,
 				}
 				if !valid[s] {
-					return ErrInvalidEntryMeta
+					found.add(ErrInvalidEntryMeta, "meta.sensitivity", CodeEnum, `must be one of "low", "medium", "high"`)
 				}
 			}
 		}
+
+		if relations, ok := ne.Meta["relations"]; ok {
+			validateRelations(&found, relations)
+		}
 	}
 
-	// Validate payload is not empty
+	// Validate payload is not empty and has its type's shape
 	if len(ne.Payload) == 0 {
-		return ErrInvalidEntryPayload
+		found.add(ErrInvalidEntryPayload, "payload", CodeRequired, "is required")
+	} else if known {
+		validatePayload(&found, ne.Type, customSchema, ne.Payload)
+	}
+
+	// Validate timestamps: ULIDs cannot encode times before the Unix epoch.
+	if ne.CreatedAt != nil {
+		if ne.CreatedAt.Before(time.Unix(0, 0)) {
+			found.add(ErrInvalidEntryTime, "created_at", CodeRange, "must not be before 1970-01-01")
+		} else if ne.CreatedAt.After(time.Now().Add(maxFutureSkew)) {
+			found.add(ErrInvalidEntryTime, "created_at", CodeRange, "must not be more than 24h in the future")
+		}
+	}
+	if ne.TZOffset != nil {
+		if o := *ne.TZOffset; o < minTZOffset || o > maxTZOffset || o%15 != 0 {
+			found.add(ErrInvalidEntryTime, "tz_offset", CodeRange, "must be a multiple of 15 minutes between -720 and 840")
+		}
 	}
 
-	return nil
+	return found.err()
+}
+
+// validatePayload checks a payload against the shared entry schema's
+// definition for its type, payload_<type>, or against custom, the schema of
+// a custom type, reporting every failing field.
+func validatePayload(found *issues, t EntryType, custom *schema.Schema, payload json.RawMessage) {
+	var v any
+	if err := json.Unmarshal(payload, &v); err != nil {
+		found.add(ErrInvalidEntryPayload, "payload", CodeFormat, "is not valid JSON")
+		return
+	}
+	if custom != nil {
+		found.addSchema(ErrInvalidEntryPayload, custom.Validate(v, "payload"))
+		return
+	}
+	found.addSchema(ErrInvalidEntryPayload, schema.Entry.ValidateDefinition("payload_"+string(t), v, "payload"))
+}
+
+// tzOffset returns the offset to store for the entry, or nil if unknown.
+func (ne *NewEntry) tzOffset() *int {
+	if ne.TZOffset != nil {
+		o := *ne.TZOffset
+		return &o
+	}
+	if ne.CreatedAt == nil || ne.CreatedAt.Location() == time.UTC {
+		return nil
+	}
+	_, secs := ne.CreatedAt.Zone()
+	o := secs / 60
+	return &o
 }
 
 type Entry struct {
@@ -126,19 +215,48 @@ type Entry struct {
 	Type          EntryType       `json:"type"`
 	CreatedAt     time.Time       `json:"created_at"`
 	UpdatedAt     time.Time       `json:"updated_at"`
+	RecordedAt    time.Time       `json:"recorded_at"`
+	TZOffset      *int            `json:"tz_offset,omitempty"`
 	SchemaVersion int             `json:"schema_version"`
 	Tags          []string        `json:"tags,omitempty"`
 	Source        string          `json:"source,omitempty"`
 	DeviceID      string          `json:"device_id,omitempty"`
 	Meta          map[string]any  `json:"meta,omitempty"`
 	Payload       json.RawMessage `json:"payload"`
+	// TypeVersion is the version of a custom entry type the payload follows;
+	// it is zero for built-in types.
+	TypeVersion int `json:"type_version,omitempty"`
+}
+
+// TimeField selects which timestamp a query filters and orders by.
+type TimeField string
+
+const (
+	// TimeOccurred is created_at: when the entry happened. It is the default.
+	TimeOccurred TimeField = "created_at"
+	// TimeRecorded is recorded_at: when the entry was stored on this device.
+	TimeRecorded TimeField = "recorded_at"
+)
+
+func (f TimeField) column() (string, error) {
+	switch f {
+	case "", TimeOccurred:
+		return "created_at", nil
+	case TimeRecorded:
+		return "recorded_at", nil
+	}
+	return "", ErrInvalidTimeField
 }
 
 type QueryFilter struct {
-	From *time.Time `json:"from,omitempty"`
-	To   *time.Time `json:"to,omitempty"`
-	Type EntryType  `json:"type,omitempty"`
-	Tags []string   `json:"tags,omitempty"`
+	From      *time.Time `json:"from,omitempty"`
+	To        *time.Time `json:"to,omitempty"`
+	Type      EntryType  `json:"type,omitempty"`
+	Tags      []string   `json:"tags,omitempty"`
+	TimeField TimeField  `json:"time_field,omitempty"`
+	// Collection limits results to the entries of one collection, in the
+	// collection's order.
+	Collection string `json:"collection,omitempty"`
 }
 
 type Pagination struct {
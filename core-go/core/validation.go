@@ -0,0 +1,190 @@
+package core
+
+import (
+	"errors"
+	"strings"
+
+	"logwayss/core-go/internal/schema"
+)
+
+// ErrorCode is a stable, machine-readable error code. The catalogue lives in
+// spec-and-tests/api/error-codes.json and is shared with core-js and the
+// processing server; codes are never renamed or reused.
+type ErrorCode string
+
+const (
+	// CodeValidation is the envelope code for a request whose input failed
+	// validation; the individual problems are in the details.
+	CodeValidation ErrorCode = "E_VALIDATION"
+
+	CodeRequired     ErrorCode = "E_REQUIRED"
+	CodeType         ErrorCode = "E_TYPE"
+	CodeEnum         ErrorCode = "E_ENUM"
+	CodeRange        ErrorCode = "E_RANGE"
+	CodeFormat       ErrorCode = "E_FORMAT"
+	CodeTooLong      ErrorCode = "E_TOO_LONG"
+	CodeTooShort     ErrorCode = "E_TOO_SHORT"
+	CodeTooMany      ErrorCode = "E_TOO_MANY"
+	CodeTooFew       ErrorCode = "E_TOO_FEW"
+	CodeUnknownField ErrorCode = "E_UNKNOWN_FIELD"
+	CodeInvalid      ErrorCode = "E_INVALID"
+	CodeReference    ErrorCode = "E_REFERENCE"
+
+	CodeLocked   ErrorCode = "E_LOCKED"
+	CodeNotFound ErrorCode = "E_NOT_FOUND"
+	CodeReadOnly ErrorCode = "E_READ_ONLY"
+	CodeInternal ErrorCode = "E_INTERNAL"
+)
+
+// errorCodes lists every code core-go emits, for the catalogue test.
+var errorCodes = []ErrorCode{
+	CodeValidation, CodeRequired, CodeType, CodeEnum, CodeRange, CodeFormat, CodeTooLong, CodeTooShort,
+	CodeTooMany, CodeTooFew, CodeUnknownField, CodeInvalid, CodeReference, CodeLocked, CodeNotFound, CodeReadOnly, CodeInternal,
+}
+
+// ErrorCodeOf returns the envelope code for err.
+func ErrorCodeOf(err error) ErrorCode {
+	var ve *ValidationError
+	switch {
+	case errors.As(err, &ve):
+		return CodeValidation
+	case errors.Is(err, ErrLocked):
+		return CodeLocked
+	case errors.Is(err, ErrNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrReadOnly):
+		return CodeReadOnly
+	}
+	return CodeInternal
+}
+
+// schemaCodes maps the JSON Schema keyword that failed to its error code.
+var schemaCodes = map[string]ErrorCode{
+	"required":             CodeRequired,
+	"type":                 CodeType,
+	"enum":                 CodeEnum,
+	"const":                CodeEnum,
+	"minimum":              CodeRange,
+	"maximum":              CodeRange,
+	"exclusiveMinimum":     CodeRange,
+	"exclusiveMaximum":     CodeRange,
+	"format":               CodeFormat,
+	"pattern":              CodeFormat,
+	"maxLength":            CodeTooLong,
+	"minLength":            CodeTooShort,
+	"maxItems":             CodeTooMany,
+	"minItems":             CodeTooFew,
+	"additionalProperties": CodeUnknownField,
+}
+
+// Issue is one field-level validation problem.
+type Issue struct {
+	// Path locates the field, e.g. "meta.confidence" or "tags[3]".
+	Path    string    `json:"path"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+
+	// err is the sentinel the issue belongs to, e.g. ErrInvalidEntryMeta.
+	err error
+}
+
+func (i Issue) String() string {
+	return i.Path + ": " + i.Message + " (" + string(i.Code) + ")"
+}
+
+// ValidationError reports every problem found in an input. It matches, via
+// errors.Is, the sentinel of each field that failed, so callers checking for
+// ErrInvalidEntryMeta and the like keep working.
+type ValidationError struct {
+	Issues []Issue
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	var last error
+	for i, issue := range e.Issues {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		if issue.err != last {
+			b.WriteString(issue.err.Error() + ": ")
+			last = issue.err
+		}
+		b.WriteString(issue.String())
+	}
+	return b.String()
+}
+
+// Unwrap returns the distinct sentinels of the issues.
+func (e *ValidationError) Unwrap() []error {
+	var errs []error
+	for _, issue := range e.Issues {
+		seen := false
+		for _, err := range errs {
+			seen = seen || err == issue.err
+		}
+		if !seen {
+			errs = append(errs, issue.err)
+		}
+	}
+	return errs
+}
+
+// ErrorEnvelope is the `{ "error": { code, message, details } }` body the
+// processing server returns on failure.
+type ErrorEnvelope struct {
+	Error ErrorBody `json:"error"`
+}
+
+// ErrorBody is the error object of an ErrorEnvelope.
+type ErrorBody struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Details any       `json:"details,omitempty"`
+}
+
+// Envelope returns err as the processing server reports it. The issues of a
+// ValidationError become the details.
+func Envelope(err error) ErrorEnvelope {
+	body := ErrorBody{Code: ErrorCodeOf(err), Message: err.Error()}
+	if found := Issues(err); found != nil {
+		body.Details = found
+	}
+	return ErrorEnvelope{Error: body}
+}
+
+// Issues returns the field-level issues in err, or nil if err is not a
+// ValidationError.
+func Issues(err error) []Issue {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return ve.Issues
+	}
+	return nil
+}
+
+// issues collects Issues for one ValidationError.
+type issues []Issue
+
+func (is *issues) add(sentinel error, path string, code ErrorCode, message string) {
+	*is = append(*is, Issue{Path: path, Code: code, Message: message, err: sentinel})
+}
+
+func (is *issues) addSchema(sentinel error, found []schema.Issue) {
+	for _, f := range found {
+		code, ok := schemaCodes[f.Keyword]
+		if !ok {
+			code = CodeInvalid
+		}
+		is.add(sentinel, f.Path, code, f.Message)
+	}
+}
+
+// err returns the collected issues as a *ValidationError, or nil if there
+// are none.
+func (is issues) err() error {
+	if len(is) == 0 {
+		return nil
+	}
+	return &ValidationError{Issues: is}
+}
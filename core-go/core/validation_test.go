@@ -0,0 +1,141 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestPayloadConformance runs the shared payload fixtures that core-js also
+// runs, so both cores accept and reject exactly the same payloads.
+func TestPayloadConformance(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("..", "..", "spec-and-tests", "conformance", "payloads.json"))
+	if err != nil {
+		t.Skipf("conformance fixtures not available: %v", err)
+	}
+	var fixture struct {
+		Cases []struct {
+			Type    EntryType       `json:"type"`
+			Payload json.RawMessage `json:"payload"`
+			Valid   bool            `json:"valid"`
+			Paths   []string        `json:"paths"`
+		} `json:"cases"`
+	}
+	if err := json.Unmarshal(raw, &fixture); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range fixture.Cases {
+		ne := NewEntry{Type: tc.Type, Payload: tc.Payload}
+		err := ne.Validate()
+		if tc.Valid {
+			if err != nil {
+				t.Errorf("%s %s: unexpected error %v", tc.Type, tc.Payload, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrInvalidEntryPayload) {
+			t.Errorf("%s %s: got %v, want ErrInvalidEntryPayload", tc.Type, tc.Payload, err)
+			continue
+		}
+		var paths []string
+		for _, issue := range Issues(err) {
+			paths = append(paths, issue.Path)
+		}
+		slices.Sort(paths)
+		slices.Sort(tc.Paths)
+		if !slices.Equal(paths, tc.Paths) {
+			t.Errorf("%s %s: issues at %v, want %v", tc.Type, tc.Payload, paths, tc.Paths)
+		}
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	ne := NewEntry{
+		Type:    EntryTypeEvent,
+		Tags:    []string{"ok", strings.Repeat("x", 51)},
+		Meta:    map[string]any{"confidence": 1.5, "visibility": "everyone"},
+		Payload: json.RawMessage(`{"title":"x","start":"soon"}`),
+	}
+	err := ne.Validate()
+	for _, sentinel := range []error{ErrInvalidEntryTags, ErrInvalidEntryMeta, ErrInvalidEntryPayload} {
+		if !errors.Is(err, sentinel) {
+			t.Errorf("errors.Is(%v, %v) = false", err, sentinel)
+		}
+	}
+	if errors.Is(err, ErrInvalidEntrySource) {
+		t.Errorf("errors.Is(%v, ErrInvalidEntrySource) = true", err)
+	}
+	var got []string
+	for _, issue := range Issues(err) {
+		got = append(got, issue.Path+": "+string(issue.Code))
+	}
+	want := []string{"tags[1]: E_TOO_LONG", "meta.confidence: E_RANGE", "meta.visibility: E_ENUM", "payload.start: E_FORMAT"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("issues = %v, want %v", got, want)
+	}
+
+	raw, err := json.Marshal(Envelope(err))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env struct {
+		Error struct {
+			Code    string `json:"code"`
+			Details []struct {
+				Path, Code string
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Error.Code != "E_VALIDATION" || len(env.Error.Details) != 4 || env.Error.Details[1].Code != "E_RANGE" {
+		t.Fatalf("envelope = %s", raw)
+	}
+	if code := Envelope(ErrLocked).Error.Code; code != CodeLocked {
+		t.Fatalf("Envelope(ErrLocked) code = %s", code)
+	}
+}
+
+// TestErrorCodeCatalogue keeps the codes core-go emits in step with the
+// catalogue shared with core-js and the processing server.
+func TestErrorCodeCatalogue(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("..", "..", "spec-and-tests", "api", "error-codes.json"))
+	if err != nil {
+		t.Skipf("error-code catalogue not available: %v", err)
+	}
+	var catalogue struct {
+		Codes []struct {
+			Code  ErrorCode `json:"code"`
+			Scope string    `json:"scope"`
+		} `json:"codes"`
+	}
+	if err := json.Unmarshal(raw, &catalogue); err != nil {
+		t.Fatal(err)
+	}
+	var listed []ErrorCode
+	for _, c := range catalogue.Codes {
+		if c.Scope != "server" {
+			listed = append(listed, c.Code)
+		}
+	}
+	for _, code := range errorCodes {
+		if !slices.Contains(listed, code) {
+			t.Errorf("%s is missing from error-codes.json", code)
+		}
+	}
+	for _, code := range listed {
+		if !slices.Contains(errorCodes, code) {
+			t.Errorf("%s is in error-codes.json but not emitted by core-go", code)
+		}
+	}
+	for _, code := range schemaCodes {
+		if !slices.Contains(errorCodes, code) {
+			t.Errorf("schema keyword code %s is not in errorCodes", code)
+		}
+	}
+}
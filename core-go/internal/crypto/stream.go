@@ -0,0 +1,234 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Chunked AES-256-GCM stream. Every chunk is sealed independently with
+// nonce = prefix(7) || counter(4, big-endian) || final(1), so reordered,
+// dropped or truncated chunks fail authentication. On the wire each chunk is
+// framed as final(1) || length(4, big-endian) || sealed chunk.
+const (
+	StreamChunkSize  = 64 * 1024
+	StreamPrefixSize = 7
+	streamFrameSize  = 5
+)
+
+var (
+	ErrStreamTruncated = errors.New("encrypted stream is truncated")
+	ErrStreamCorrupt   = errors.New("encrypted stream is corrupt or tampered")
+)
+
+// DeriveSubkey derives a 32-byte key bound to salt and info using HKDF-SHA256.
+func DeriveSubkey(key, salt []byte, info string) ([]byte, error) {
+	out := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(info)), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func newStreamAEAD(key, prefix []byte) (cipher.AEAD, error) {
+	if len(prefix) != StreamPrefixSize {
+		return nil, fmt.Errorf("stream nonce prefix must be %d bytes", StreamPrefixSize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func streamNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, IVSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[StreamPrefixSize:], counter)
+	if final {
+		nonce[IVSize-1] = 1
+	}
+	return nonce
+}
+
+// StreamWriter encrypts everything written to it into chunks on the
+// underlying writer. Close must be called to emit the final chunk; a stream
+// without one is rejected by StreamReader as truncated.
+type StreamWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	counter uint32
+	buf     []byte
+	err     error
+}
+
+// NewStreamWriter returns a StreamWriter sealing chunks with key. aad is bound
+// to every chunk, typically the serialized stream header.
+func NewStreamWriter(w io.Writer, key, prefix, aad []byte) (*StreamWriter, error) {
+	aead, err := newStreamAEAD(key, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamWriter{
+		w:      w,
+		aead:   aead,
+		prefix: append([]byte(nil), prefix...),
+		aad:    append([]byte(nil), aad...),
+		buf:    make([]byte, 0, StreamChunkSize),
+	}, nil
+}
+
+func (s *StreamWriter) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n := 0
+	for len(p) > 0 {
+		// Only flush a full chunk once more data arrives, so the final chunk
+		// is never empty unless the whole stream is.
+		if len(s.buf) == StreamChunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(s.buf[len(s.buf):StreamChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close seals the remaining buffered data as the final chunk. It does not
+// close the underlying writer.
+func (s *StreamWriter) Close() error {
+	if s.err != nil {
+		if errors.Is(s.err, io.ErrClosedPipe) {
+			return nil
+		}
+		return s.err
+	}
+	if err := s.flush(true); err != nil {
+		return err
+	}
+	s.err = io.ErrClosedPipe
+	return nil
+}
+
+func (s *StreamWriter) flush(final bool) error {
+	if s.counter == ^uint32(0) {
+		s.err = errors.New("encrypted stream too long")
+		return s.err
+	}
+	sealed := s.aead.Seal(nil, streamNonce(s.prefix, s.counter, final), s.buf, s.aad)
+	frame := make([]byte, streamFrameSize, streamFrameSize+len(sealed))
+	if final {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(sealed)))
+	if _, err := s.w.Write(append(frame, sealed...)); err != nil {
+		s.err = err
+		return err
+	}
+	s.counter++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// StreamReader authenticates and decrypts a stream produced by StreamWriter.
+// It returns io.EOF only after the final chunk has been verified and no
+// trailing data follows it.
+type StreamReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	aad     []byte
+	counter uint32
+	buf     []byte
+	done    bool
+	err     error
+}
+
+// NewStreamReader returns a StreamReader opening chunks with key and aad.
+func NewStreamReader(r io.Reader, key, prefix, aad []byte) (*StreamReader, error) {
+	aead, err := newStreamAEAD(key, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReader{
+		r:      r,
+		aead:   aead,
+		prefix: append([]byte(nil), prefix...),
+		aad:    append([]byte(nil), aad...),
+	}, nil
+}
+
+func (s *StreamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			s.err = s.checkTrailing()
+			continue
+		}
+		s.err = s.next()
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *StreamReader) next() error {
+	var frame [streamFrameSize]byte
+	if _, err := io.ReadFull(s.r, frame[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrStreamTruncated
+		}
+		return err
+	}
+	final := frame[0] == 1
+	if frame[0] > 1 {
+		return ErrStreamCorrupt
+	}
+	size := binary.BigEndian.Uint32(frame[1:])
+	if size < TagSize || size > StreamChunkSize+TagSize {
+		return ErrStreamCorrupt
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(s.r, sealed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrStreamTruncated
+		}
+		return err
+	}
+	pt, err := s.aead.Open(sealed[:0], streamNonce(s.prefix, s.counter, final), sealed, s.aad)
+	if err != nil {
+		return ErrStreamCorrupt
+	}
+	s.counter++
+	s.buf = pt
+	s.done = final
+	return nil
+}
+
+func (s *StreamReader) checkTrailing() error {
+	var b [1]byte
+	_, err := io.ReadFull(s.r, b[:])
+	switch {
+	case err == nil:
+		return ErrStreamCorrupt
+	case errors.Is(err, io.EOF):
+		return io.EOF
+	default:
+		return err
+	}
+}
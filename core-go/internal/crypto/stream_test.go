@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestStreamRoundtrip(t *testing.T) {
+	key := make([]byte, 32)
+	prefix := make([]byte, StreamPrefixSize)
+	aad := []byte("header")
+	for _, size := range []int{0, 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 17} {
+		plaintext := bytes.Repeat([]byte{0xab}, size)
+		var buf bytes.Buffer
+		sw, err := NewStreamWriter(&buf, key, prefix, aad)
+		if err != nil {
+			t.Fatalf("writer: %v", err)
+		}
+		if _, err := sw.Write(plaintext); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := sw.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		sr, err := NewStreamReader(&buf, key, prefix, aad)
+		if err != nil {
+			t.Fatalf("reader: %v", err)
+		}
+		got, err := io.ReadAll(sr)
+		if err != nil {
+			t.Fatalf("size %d: read: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("size %d: roundtrip mismatch", size)
+		}
+	}
+}
+
+func TestStreamDetectsTruncationAndTampering(t *testing.T) {
+	key := make([]byte, 32)
+	prefix := make([]byte, StreamPrefixSize)
+	var buf bytes.Buffer
+	sw, _ := NewStreamWriter(&buf, key, prefix, nil)
+	_, _ = sw.Write(bytes.Repeat([]byte("x"), 2*StreamChunkSize+5))
+	_ = sw.Close()
+	stream := buf.Bytes()
+
+	read := func(b []byte) error {
+		sr, _ := NewStreamReader(bytes.NewReader(b), key, prefix, nil)
+		_, err := io.ReadAll(sr)
+		return err
+	}
+
+	// Cut exactly at a chunk boundary: every remaining chunk still verifies.
+	boundary := streamFrameSize + StreamChunkSize + TagSize
+	if err := read(stream[:boundary]); !errors.Is(err, ErrStreamTruncated) {
+		t.Fatalf("boundary truncation: got %v", err)
+	}
+	if err := read(stream[:len(stream)-3]); !errors.Is(err, ErrStreamTruncated) {
+		t.Fatalf("mid-chunk truncation: got %v", err)
+	}
+
+	tampered := append([]byte(nil), stream...)
+	tampered[boundary+streamFrameSize+10] ^= 1
+	if err := read(tampered); !errors.Is(err, ErrStreamCorrupt) {
+		t.Fatalf("tampering: got %v", err)
+	}
+
+	if err := read(append(append([]byte(nil), stream...), 0)); !errors.Is(err, ErrStreamCorrupt) {
+		t.Fatalf("trailing data: got %v", err)
+	}
+}
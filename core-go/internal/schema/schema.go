@@ -0,0 +1,329 @@
+// Package schema validates decoded JSON values against the shared JSON
+// Schemas in spec-and-tests/schemas. It implements the subset of draft-07
+// those schemas use; unknown keywords are ignored.
+package schema
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// entrySchema is a copy of spec-and-tests/schemas/entry.schema.json; a test
+// keeps the two identical.
+//
+//go:embed entry.schema.json
+var entrySchema []byte
+
+// Entry is the compiled entry schema.
+var Entry = MustParse(entrySchema)
+
+// Issue is one way in which a value fails a schema.
+type Issue struct {
+	// Path locates the value, e.g. "payload.start" or "tags[3]".
+	Path string
+	// Keyword is the schema keyword that failed, e.g. "required".
+	Keyword string
+	Message string
+}
+
+func (i Issue) String() string {
+	return i.Path + ": " + i.Message
+}
+
+type node = map[string]any
+
+// Schema is a parsed JSON Schema.
+type Schema struct {
+	root     node
+	patterns sync.Map // pattern string -> *regexp.Regexp
+}
+
+// Parse parses a JSON Schema document.
+func Parse(raw []byte) (*Schema, error) {
+	var root node
+	if err := json.Unmarshal(raw, &root); err != nil {
+		return nil, fmt.Errorf("parse schema: %w", err)
+	}
+	return &Schema{root: root}, nil
+}
+
+// MustParse is like Parse but panics on error.
+func MustParse(raw []byte) *Schema {
+	s, err := Parse(raw)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Validate checks v against the whole schema. path names v in issues.
+func (s *Schema) Validate(v any, path string) []Issue {
+	return s.eval(s.root, v, path)
+}
+
+// ValidateDefinition checks v against the schema under definitions/name.
+func (s *Schema) ValidateDefinition(name string, v any, path string) []Issue {
+	def, ok := s.definition(name)
+	if !ok {
+		return []Issue{{Path: path, Keyword: "$ref", Message: fmt.Sprintf("unknown definition %q", name)}}
+	}
+	return s.eval(def, v, path)
+}
+
+// HasDefinition reports whether the schema defines name.
+func (s *Schema) HasDefinition(name string) bool {
+	_, ok := s.definition(name)
+	return ok
+}
+
+func (s *Schema) definition(name string) (node, bool) {
+	defs, _ := s.root["definitions"].(node)
+	def, ok := defs[name].(node)
+	return def, ok
+}
+
+func (s *Schema) eval(n node, v any, path string) []Issue {
+	var issues []Issue
+	add := func(keyword, format string, args ...any) {
+		issues = append(issues, Issue{Path: path, Keyword: keyword, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if ref, ok := n["$ref"].(string); ok {
+		name, found := strings.CutPrefix(ref, "#/definitions/")
+		def, ok := s.definition(name)
+		if !found || !ok {
+			add("$ref", "unresolvable reference %q", ref)
+			return issues
+		}
+		issues = append(issues, s.eval(def, v, path)...)
+	}
+
+	if t, ok := n["type"]; ok && !matchesType(t, v) {
+		add("type", "must be %s", describeType(t))
+		return issues // other keywords would only repeat the problem
+	}
+	if enum, ok := n["enum"].([]any); ok && !contains(enum, v) {
+		add("enum", "must be one of %s", formatValues(enum))
+	}
+	if c, ok := n["const"]; ok && !reflect.DeepEqual(c, v) {
+		add("const", "must be %s", formatValues([]any{c}))
+	}
+
+	switch v := v.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if limit, ok := number(n["maxLength"]); ok && float64(length) > limit {
+			add("maxLength", "must be at most %v characters", limit)
+		}
+		if limit, ok := number(n["minLength"]); ok && float64(length) < limit {
+			add("minLength", "must be at least %v characters", limit)
+		}
+		if p, ok := n["pattern"].(string); ok && !s.pattern(p).MatchString(v) {
+			add("pattern", "must match %s", p)
+		}
+		if f, ok := n["format"].(string); ok && f == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+				add("format", "must be an RFC 3339 date-time")
+			}
+		}
+	case float64:
+		if limit, ok := number(n["maximum"]); ok && v > limit {
+			add("maximum", "must be at most %v", limit)
+		}
+		if limit, ok := number(n["minimum"]); ok && v < limit {
+			add("minimum", "must be at least %v", limit)
+		}
+		if limit, ok := number(n["exclusiveMaximum"]); ok && v >= limit {
+			add("exclusiveMaximum", "must be less than %v", limit)
+		}
+		if limit, ok := number(n["exclusiveMinimum"]); ok && v <= limit {
+			add("exclusiveMinimum", "must be greater than %v", limit)
+		}
+	case map[string]any:
+		if req, ok := n["required"].([]any); ok {
+			for _, r := range req {
+				if name, _ := r.(string); name != "" {
+					if _, present := v[name]; !present {
+						issues = append(issues, Issue{Path: join(path, name), Keyword: "required", Message: "is required"})
+					}
+				}
+			}
+		}
+		props, _ := n["properties"].(node)
+		for _, k := range sortedKeys(v) {
+			if sub, ok := props[k].(node); ok {
+				issues = append(issues, s.eval(sub, v[k], join(path, k))...)
+				continue
+			}
+			switch ap := n["additionalProperties"].(type) {
+			case bool:
+				if !ap {
+					issues = append(issues, Issue{Path: join(path, k), Keyword: "additionalProperties", Message: "is not allowed"})
+				}
+			case node:
+				issues = append(issues, s.eval(ap, v[k], join(path, k))...)
+			}
+		}
+	case []any:
+		if limit, ok := number(n["maxItems"]); ok && float64(len(v)) > limit {
+			add("maxItems", "must have at most %v items", limit)
+		}
+		if limit, ok := number(n["minItems"]); ok && float64(len(v)) < limit {
+			add("minItems", "must have at least %v items", limit)
+		}
+		if items, ok := n["items"].(node); ok {
+			for i, item := range v {
+				issues = append(issues, s.eval(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+
+	if all, ok := n["allOf"].([]any); ok {
+		for _, sub := range all {
+			if sub, ok := sub.(node); ok {
+				issues = append(issues, s.eval(sub, v, path)...)
+			}
+		}
+	}
+	if cond, ok := n["if"].(node); ok {
+		branch := "else"
+		if len(s.eval(cond, v, path)) == 0 {
+			branch = "then"
+		}
+		if sub, ok := n[branch].(node); ok {
+			issues = append(issues, s.eval(sub, v, path)...)
+		}
+	}
+	for _, kw := range []string{"anyOf", "oneOf"} {
+		alts, ok := n[kw].([]any)
+		if !ok {
+			continue
+		}
+		matched := 0
+		for _, sub := range alts {
+			if sub, ok := sub.(node); ok && len(s.eval(sub, v, path)) == 0 {
+				matched++
+			}
+		}
+		if matched == 0 || (kw == "oneOf" && matched > 1) {
+			add(kw, "does not match exactly one allowed shape")
+		}
+	}
+	return issues
+}
+
+func (s *Schema) pattern(p string) *regexp.Regexp {
+	if re, ok := s.patterns.Load(p); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		re = regexp.MustCompile(`$^`) // an invalid pattern matches nothing
+	}
+	s.patterns.Store(p, re)
+	return re
+}
+
+func matchesType(t any, v any) bool {
+	switch t := t.(type) {
+	case string:
+		return isType(t, v)
+	case []any:
+		for _, name := range t {
+			if name, ok := name.(string); ok && isType(name, v) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, v any) bool {
+	switch name {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return false
+}
+
+func describeType(t any) string {
+	if list, ok := t.([]any); ok {
+		names := make([]string, 0, len(list))
+		for _, n := range list {
+			names = append(names, fmt.Sprint(n))
+		}
+		return "one of " + strings.Join(names, ", ")
+	}
+	switch t {
+	case "object", "array", "integer":
+		return "an " + fmt.Sprint(t)
+	}
+	return "a " + fmt.Sprint(t)
+}
+
+func contains(values []any, v any) bool {
+	for _, x := range values {
+		if reflect.DeepEqual(x, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatValues(values []any) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		b, _ := json.Marshal(v)
+		parts[i] = string(b)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func number(v any) (float64, bool) {
+	f, ok := v.(float64)
+	return f, ok
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,59 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmbeddedSchemaMatchesSpec(t *testing.T) {
+	spec, err := os.ReadFile(filepath.Join("..", "..", "..", "spec-and-tests", "schemas", "entry.schema.json"))
+	if err != nil {
+		t.Skipf("spec-and-tests not available: %v", err)
+	}
+	if !bytes.Equal(spec, entrySchema) {
+		t.Fatal("internal/schema/entry.schema.json differs from spec-and-tests/schemas/entry.schema.json; copy it over")
+	}
+}
+
+func TestEntrySchema(t *testing.T) {
+	decode := func(s string) any {
+		var v any
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		def, payload string
+		want         []Issue
+	}{
+		{"payload_text", `{"text":"hi"}`, nil},
+		{"payload_text", `{"message":"hi"}`, []Issue{{"payload.text", "required", "is required"}}},
+		{"payload_metrics", `{"steps":10,"mood":"ok"}`, []Issue{{"payload.mood", "type", "must be a number"}}},
+		{"payload_event", `{"title":"x","start":"yesterday"}`, []Issue{{"payload.start", "format", "must be an RFC 3339 date-time"}}},
+		{"payload_log", `{"source":"a","message":"b","level":"loud"}`, []Issue{{"payload.level", "enum", `must be one of "debug", "info", "warn", "error"`}}},
+		{"payload_media_ref", `"abc"`, []Issue{{"payload", "type", "must be an object"}}},
+	} {
+		got := Entry.ValidateDefinition(tc.def, decode(tc.payload), "payload")
+		if len(got) != len(tc.want) {
+			t.Errorf("%s %s: got %v, want %v", tc.def, tc.payload, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s %s: got %v, want %v", tc.def, tc.payload, got[i], tc.want[i])
+			}
+		}
+	}
+
+	// The if/then branches bind each entry type to its payload shape.
+	entry := decode(`{"id":"01ARZ3NDEKTSV4RRFFQ69G5FAV","type":"event","created_at":"2024-01-01T00:00:00Z",
+		"updated_at":"2024-01-01T00:00:00Z","schema_version":1,"payload":{"text":"not an event"}}`)
+	issues := Entry.Validate(entry, "")
+	if len(issues) != 2 || issues[0].Path != "payload.title" || issues[1].Path != "payload.start" {
+		t.Fatalf("whole-entry validation: %v", issues)
+	}
+}
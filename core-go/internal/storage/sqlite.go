@@ -6,10 +6,12 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"path/filepath"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 // OpenDB opens a SQLite database at the given path and applies recommended pragmas.
@@ -42,3 +44,14 @@ func OpenDB(ctx context.Context, path string, mobile bool) (*sql.DB, error) {
 	}
 	return db, nil
 }
+
+// IsCorrupt reports whether err is SQLite saying the database file is
+// damaged or not a database at all.
+func IsCorrupt(err error) bool {
+	var e *sqlite.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	code := e.Code() & 0xff
+	return code == sqlite3.SQLITE_CORRUPT || code == sqlite3.SQLITE_NOTADB
+}
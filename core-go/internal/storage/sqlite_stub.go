@@ -14,3 +14,6 @@ import (
 func OpenDB(_ context.Context, _ string, _ bool) (*sql.DB, error) {
 	return nil, errors.New("sqlite support not enabled (build with -tags sqlite)")
 }
+
+// IsCorrupt is always false without SQLite support.
+func IsCorrupt(error) bool { return false }
@@ -0,0 +1,31 @@
+// Package testutil holds fixtures shared by the tests of packages built on
+// core. Tests inside package core cannot import it, since it imports core.
+package testutil
+
+import (
+	"context"
+	"testing"
+
+	"logwayss/core-go/core"
+	ccrypto "logwayss/core-go/internal/crypto"
+)
+
+// Scrypt is a cheap key derivation setting for test profiles.
+var Scrypt = ccrypto.ScryptParams{N: 1 << 10, R: 8, P: 1}
+
+// NewCore returns an unlocked Core backed by a fresh profile, locked again
+// when the test ends.
+func NewCore(t testing.TB) *core.Core {
+	t.Helper()
+	ctx := context.Background()
+	c := core.New()
+	dir := t.TempDir()
+	if err := c.CreateProfile(ctx, dir, []byte("password"), Scrypt); err != nil {
+		t.Fatalf("CreateProfile failed: %v", err)
+	}
+	if err := c.UnlockProfile(ctx, dir, []byte("password")); err != nil {
+		t.Fatalf("UnlockProfile failed: %v", err)
+	}
+	t.Cleanup(c.Lock)
+	return c
+}
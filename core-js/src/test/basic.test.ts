@@ -27,7 +27,7 @@ async function runTest() {
     console.log("Creating entry...");
     const entry = await core.createEntry({
       type: "text",
-      payload: { content: "Hello, LogWayss!" },
+      payload: { text: "Hello, LogWayss!" },
       tags: ["test", "hello"]
     });
     console.log(`✅ Entry created with ID: ${entry.id}`);
@@ -0,0 +1,54 @@
+import { readFile } from "node:fs/promises";
+import { validateNewEntry, ValidationError, type EntryType } from "../types.js";
+
+// Runs the shared payload fixtures that core-go also runs, so both cores
+// accept and reject exactly the same payloads.
+interface PayloadCase {
+  type: EntryType;
+  payload: unknown;
+  valid: boolean;
+  paths?: string[];
+}
+
+async function runTest() {
+  const url = new URL("../../../spec-and-tests/conformance/payloads.json", import.meta.url);
+  const fixture = JSON.parse(await readFile(url, "utf8")) as { cases: PayloadCase[] };
+
+  let failures = 0;
+  for (const tc of fixture.cases) {
+    const label = `${tc.type} ${JSON.stringify(tc.payload)}`;
+    let error: unknown;
+    try {
+      validateNewEntry({ type: tc.type, payload: tc.payload });
+    } catch (err) {
+      error = err;
+    }
+    if (tc.valid) {
+      if (error) {
+        console.error(`❌ ${label}: unexpected error ${error}`);
+        failures++;
+      }
+      continue;
+    }
+    if (!(error instanceof ValidationError)) {
+      console.error(`❌ ${label}: got ${error}, want ValidationError`);
+      failures++;
+      continue;
+    }
+    const paths = error.issues.map((i) => i.path).sort();
+    const want = [...(tc.paths ?? [])].sort();
+    if (paths.join(",") !== want.join(",") || !error.has("payload")) {
+      console.error(`❌ ${label}: issues at ${paths}, want ${want}`);
+      failures++;
+    }
+  }
+
+  if (failures > 0) {
+    console.error(`\n${failures} payload conformance failures`);
+    process.exitCode = 1;
+    return;
+  }
+  console.log(`✅ ${fixture.cases.length} payload conformance cases passed`);
+}
+
+runTest();
@@ -40,92 +40,254 @@ export interface Pagination {
   offset?: number;
 }
 
-// Validation errors
+// Error codes, from spec-and-tests/api/error-codes.json. They are shared
+// with core-go and the processing server and are never renamed or reused.
+export const ErrorCodes = {
+  VALIDATION: "E_VALIDATION",
+  REQUIRED: "E_REQUIRED",
+  TYPE: "E_TYPE",
+  ENUM: "E_ENUM",
+  RANGE: "E_RANGE",
+  FORMAT: "E_FORMAT",
+  TOO_LONG: "E_TOO_LONG",
+  TOO_SHORT: "E_TOO_SHORT",
+  TOO_MANY: "E_TOO_MANY",
+  TOO_FEW: "E_TOO_FEW",
+  UNKNOWN_FIELD: "E_UNKNOWN_FIELD",
+  INVALID: "E_INVALID",
+  REFERENCE: "E_REFERENCE",
+  LOCKED: "E_LOCKED",
+  NOT_FOUND: "E_NOT_FOUND",
+  READ_ONLY: "E_READ_ONLY",
+  INTERNAL: "E_INTERNAL",
+} as const;
+
+export type ErrorCode = (typeof ErrorCodes)[keyof typeof ErrorCodes];
+
+// Issue is one field-level validation problem, e.g.
+// { path: "meta.confidence", code: "E_RANGE", message: "..." }.
+export interface Issue {
+  path: string;
+  code: ErrorCode;
+  message: string;
+}
+
+// Field groups, matching core-go's ErrInvalidEntry* sentinels; the message
+// prefixes are the sentinels' texts.
+export type IssueKind =
+  | "type"
+  | "tags"
+  | "source"
+  | "device_id"
+  | "meta"
+  | "payload";
+
+const kindMessages: Record<IssueKind, string> = {
+  type: "invalid entry type",
+  tags: "invalid entry tags",
+  source: "invalid entry source",
+  device_id: "invalid entry device_id",
+  meta: "invalid entry meta",
+  payload: "invalid entry payload",
+};
+
+interface KindedIssue extends Issue {
+  kind: IssueKind;
+}
+
+// Validation errors. A ValidationError lists every problem found; the
+// message has the same form as core-go's.
 export class ValidationError extends Error {
-  constructor(message: string) {
-    super(message);
+  readonly code = ErrorCodes.VALIDATION;
+  readonly issues: Issue[];
+  readonly kinds: IssueKind[];
+
+  constructor(issues: KindedIssue[]) {
+    const parts: string[] = [];
+    let last: IssueKind | undefined;
+    for (const issue of issues) {
+      const prefix = issue.kind !== last ? `${kindMessages[issue.kind]}: ` : "";
+      parts.push(`${prefix}${issue.path}: ${issue.message} (${issue.code})`);
+      last = issue.kind;
+    }
+    super(parts.join("; "));
     this.name = "ValidationError";
+    this.issues = issues.map(({ path, code, message }) => ({ path, code, message }));
+    this.kinds = [...new Set(issues.map((i) => i.kind))];
+  }
+
+  // has reports whether any issue is of kind, like errors.Is in core-go.
+  has(kind: IssueKind): boolean {
+    return this.kinds.includes(kind);
+  }
+
+  // toEnvelope returns the `{ error: { code, message, details } }` body the
+  // processing server reports.
+  toEnvelope(): { error: { code: ErrorCode; message: string; details: Issue[] } } {
+    return { error: { code: this.code, message: this.message, details: this.issues } };
   }
 }
 
+const validTypes: EntryType[] = [
+  "text",
+  "markdown",
+  "metrics",
+  "media_ref",
+  "event",
+  "log",
+];
+
 export function validateNewEntry(entry: NewEntry): void {
-  if (!entry.type) {
-    throw new ValidationError("Entry type is required");
-  }
+  const issues: KindedIssue[] = [];
+  const add = (kind: IssueKind, path: string, code: ErrorCode, message: string) =>
+    issues.push({ kind, path, code, message });
 
   // Validate entry type
-  const validTypes: EntryType[] = [
-    "text",
-    "markdown",
-    "metrics",
-    "media_ref",
-    "event",
-    "log",
-  ];
-
-  if (!validTypes.includes(entry.type)) {
-    throw new ValidationError("Invalid entry type");
+  if (!entry.type) {
+    add("type", "type", ErrorCodes.REQUIRED, "is required");
+  } else if (!validTypes.includes(entry.type)) {
+    add("type", "type", ErrorCodes.ENUM, `unknown entry type ${JSON.stringify(entry.type)}`);
   }
 
   // Validate tags
   if (entry.tags) {
     if (entry.tags.length > 20) {
-      throw new ValidationError("Too many tags (maximum 20)");
+      add("tags", "tags", ErrorCodes.TOO_MANY, "must have at most 20 tags");
     }
-    for (const tag of entry.tags) {
-      if (tag.length > 50) {
-        throw new ValidationError("Tag too long (maximum 50 characters)");
+    entry.tags.forEach((tag, i) => {
+      if (byteLength(tag) > 50) {
+        add("tags", `tags[${i}]`, ErrorCodes.TOO_LONG, "must be at most 50 bytes");
       }
-    }
+    });
   }
 
   // Validate source
-  if (entry.source && entry.source.length > 50) {
-    throw new ValidationError("Source too long (maximum 50 characters)");
+  if (entry.source && byteLength(entry.source) > 50) {
+    add("source", "source", ErrorCodes.TOO_LONG, "must be at most 50 bytes");
   }
 
   // Validate device_id
-  if (entry.device_id && entry.device_id.length > 100) {
-    throw new ValidationError("Device ID too long (maximum 100 characters)");
+  if (entry.device_id && byteLength(entry.device_id) > 100) {
+    add("device_id", "device_id", ErrorCodes.TOO_LONG, "must be at most 100 bytes");
   }
 
   // Validate meta
   if (entry.meta) {
-    if (entry.meta.confidence !== undefined) {
-      if (
-        typeof entry.meta.confidence !== "number" ||
-        entry.meta.confidence < 0 ||
-        entry.meta.confidence > 1
-      ) {
-        throw new ValidationError(
-          "Confidence must be a number between 0 and 1",
-        );
+    const { confidence, visibility, sensitivity } = entry.meta;
+    if (confidence !== undefined) {
+      if (typeof confidence !== "number") {
+        add("meta", "meta.confidence", ErrorCodes.TYPE, "must be a number");
+      } else if (confidence < 0 || confidence > 1) {
+        add("meta", "meta.confidence", ErrorCodes.RANGE, "must be between 0 and 1");
       }
     }
 
-    if (entry.meta.visibility !== undefined) {
-      const validVisibility = ["public", "private", "friends"];
-      if (
-        typeof entry.meta.visibility !== "string" ||
-        !validVisibility.includes(entry.meta.visibility)
-      ) {
-        throw new ValidationError("Invalid visibility value");
-      }
+    if (typeof visibility === "string" && !["public", "private", "friends"].includes(visibility)) {
+      add("meta", "meta.visibility", ErrorCodes.ENUM, 'must be one of "public", "private", "friends"');
     }
 
-    if (entry.meta.sensitivity !== undefined) {
-      const validSensitivity = ["low", "medium", "high"];
-      if (
-        typeof entry.meta.sensitivity !== "string" ||
-        !validSensitivity.includes(entry.meta.sensitivity)
-      ) {
-        throw new ValidationError("Invalid sensitivity value");
-      }
+    if (typeof sensitivity === "string" && !["low", "medium", "high"].includes(sensitivity)) {
+      add("meta", "meta.sensitivity", ErrorCodes.ENUM, 'must be one of "low", "medium", "high"');
     }
   }
 
-  // Validate payload is not empty
-  if (entry.payload === undefined || entry.payload === null) {
-    throw new ValidationError("Payload is required");
+  // Validate payload is present and has its type's shape
+  if (entry.payload === undefined) {
+    add("payload", "payload", ErrorCodes.REQUIRED, "is required");
+  } else if (validTypes.includes(entry.type)) {
+    for (const issue of validatePayload(entry.type, entry.payload)) {
+      issues.push({ kind: "payload", ...issue });
+    }
+  }
+
+  if (issues.length > 0) {
+    throw new ValidationError(issues);
+  }
+}
+
+function byteLength(s: string): number {
+  return new TextEncoder().encode(s).length;
+}
+
+// Payload shapes per entry type. These mirror the payload_* definitions in
+// spec-and-tests/schemas/entry.schema.json, which core-go validates against
+// directly; spec-and-tests/conformance/payloads.json keeps the two in step.
+type FieldRule = { type: "string" | "number"; enum?: string[]; dateTime?: boolean };
+type PayloadShape = {
+  required?: string[];
+  properties?: Record<string, FieldRule>;
+  additional?: FieldRule;
+};
+
+const payloadShapes: Record<EntryType, PayloadShape> = {
+  text: { required: ["text"], properties: { text: { type: "string" } } },
+  markdown: { required: ["markdown"], properties: { markdown: { type: "string" } } },
+  metrics: { additional: { type: "number" } },
+  media_ref: {
+    required: ["ref", "type"],
+    properties: {
+      ref: { type: "string" },
+      type: { type: "string", enum: ["image", "video", "audio"] },
+    },
+  },
+  event: {
+    required: ["title", "start"],
+    properties: {
+      title: { type: "string" },
+      start: { type: "string", dateTime: true },
+      end: { type: "string", dateTime: true },
+      location: { type: "string" },
+    },
+  },
+  log: {
+    required: ["source", "message"],
+    properties: {
+      source: { type: "string" },
+      message: { type: "string" },
+      level: { type: "string", enum: ["debug", "info", "warn", "error"] },
+    },
+  },
+};
+
+// RFC 3339 date-time, as accepted by Go's time.RFC3339Nano.
+const dateTimePattern =
+  /^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})$/;
+
+// validatePayload returns every way payload fails the shape for type, in
+// the same order core-go reports them.
+export function validatePayload(type: EntryType, payload: unknown): Issue[] {
+  const shape = payloadShapes[type];
+  if (!shape) {
+    return [{ path: "payload", code: ErrorCodes.INVALID, message: `unknown definition "payload_${type}"` }];
+  }
+  if (typeof payload !== "object" || payload === null || Array.isArray(payload)) {
+    return [{ path: "payload", code: ErrorCodes.TYPE, message: "must be an object" }];
+  }
+  const obj = payload as Record<string, unknown>;
+  const issues: Issue[] = [];
+  for (const name of shape.required ?? []) {
+    if (!Object.prototype.hasOwnProperty.call(obj, name)) {
+      issues.push({ path: `payload.${name}`, code: ErrorCodes.REQUIRED, message: "is required" });
+    }
+  }
+  for (const key of Object.keys(obj).sort()) {
+    const rule = shape.properties?.[key] ?? shape.additional;
+    if (!rule) {
+      continue;
+    }
+    const value = obj[key];
+    const path = `payload.${key}`;
+    if (typeof value !== rule.type) {
+      issues.push({ path, code: ErrorCodes.TYPE, message: `must be a ${rule.type}` });
+      continue;
+    }
+    if (rule.enum && !rule.enum.includes(value as string)) {
+      const allowed = rule.enum.map((v) => JSON.stringify(v)).join(", ");
+      issues.push({ path, code: ErrorCodes.ENUM, message: `must be one of ${allowed}` });
+    }
+    if (rule.dateTime && !dateTimePattern.test(value as string)) {
+      issues.push({ path, code: ErrorCodes.FORMAT, message: "must be an RFC 3339 date-time" });
+    }
   }
+  return issues;
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"logwayss/core-go/core"
+)
+
+// pairPath is where a device exchanges a pairing code for its token.
+const pairPath = "/pair"
+
+// maxDeviceName bounds a device's name, in characters.
+const maxDeviceName = 64
+
+// admin restricts h to MASTER_PASSWORD; device tokens are refused.
+func (s *server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if requestDevice(r) != nil {
+			writeError(w, &apiError{Status: http.StatusForbidden, ErrorBody: core.ErrorBody{
+				Code: codeForbidden, Message: "admin endpoints need MASTER_PASSWORD"}})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// newPairingCode handles `{ scopes: string[] }`, where each scope is an
+// enabled endpoint name or "*" for all of them. The code is shown on the
+// server console only; the response says when it expires.
+func (s *server) newPairingCode(w http.ResponseWriter, r *http.Request) {
+	fields, err := readObject(w, r)
+	if err != nil {
+		s.fail(w, r, "pairing", err)
+		return
+	}
+	var found []core.Issue
+	invalid := func(path string, code core.ErrorCode, msg string) {
+		found = append(found, core.Issue{Path: path, Code: code, Message: msg})
+	}
+	var scopes []string
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if name != "scopes" {
+			invalid(name, core.CodeUnknownField, "is not allowed")
+			continue
+		}
+		if err := json.Unmarshal(fields[name], &scopes); err != nil {
+			invalid("scopes", core.CodeType, "must be an array of strings")
+			continue
+		}
+		if len(scopes) == 0 {
+			invalid("scopes", core.CodeTooFew, "must have at least 1 item")
+		}
+		for i, scope := range scopes {
+			if scope != allEndpoints && !s.endpoints[scope] {
+				invalid(fmt.Sprintf("scopes[%d]", i), core.CodeReference, "must be an enabled endpoint name or \"*\"")
+			}
+		}
+	}
+	if _, ok := fields["scopes"]; !ok {
+		invalid("scopes", core.CodeRequired, "is required")
+	}
+	if found != nil {
+		writeError(w, invalidRequest(found...))
+		return
+	}
+
+	code, err := s.auth.devices.newCode(scopes)
+	if errors.Is(err, errTooManyCodes) {
+		writeError(w, &apiError{Status: http.StatusTooManyRequests, ErrorBody: core.ErrorBody{
+			Code: codeRateLimited, Message: err.Error()}})
+		return
+	}
+	if err != nil {
+		s.fail(w, r, "pairing", err)
+		return
+	}
+	s.announce(code)
+	writeJSON(w, http.StatusCreated, map[string]any{"scopes": code.scopes, "expires_at": code.expires.UTC().Format(time.RFC3339)})
+}
+
+// pair handles `{ code: string, name: string }` and returns the new device
+// with its token, which is shown only this once. A wrong or expired code
+// counts against the client like a wrong password.
+func (s *server) pair(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r)
+	if s.auth.refuse(w, ip) {
+		return
+	}
+	fields, err := readObject(w, r)
+	if err != nil {
+		s.fail(w, r, "pairing", err)
+		return
+	}
+	var found []core.Issue
+	invalid := func(path string, code core.ErrorCode, msg string) {
+		found = append(found, core.Issue{Path: path, Code: code, Message: msg})
+	}
+	values := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(fields)) {
+		if name != "code" && name != "name" {
+			invalid(name, core.CodeUnknownField, "is not allowed")
+			continue
+		}
+		var v string
+		if err := json.Unmarshal(fields[name], &v); err != nil {
+			invalid(name, core.CodeType, "must be a string")
+			continue
+		}
+		values[name] = strings.TrimSpace(v)
+	}
+	for _, name := range []string{"code", "name"} {
+		if _, ok := fields[name]; !ok {
+			invalid(name, core.CodeRequired, "is required")
+		}
+	}
+	if n := utf8.RuneCountInString(values["name"]); fields["name"] != nil && n == 0 {
+		invalid("name", core.CodeTooShort, "must not be empty")
+	} else if n > maxDeviceName {
+		invalid("name", core.CodeTooLong, fmt.Sprintf("must be at most %d characters", maxDeviceName))
+	}
+	if found != nil {
+		writeError(w, invalidRequest(found...))
+		return
+	}
+
+	code := strings.NewReplacer("-", "", " ", "").Replace(values["code"])
+	dev, token, err := s.auth.devices.redeem(code, values["name"])
+	if errors.Is(err, errPairingCode) {
+		s.auth.fail(ip, s.auth.now())
+		writeError(w, &apiError{Status: http.StatusUnauthorized, ErrorBody: core.ErrorBody{
+			Code: codeUnauthorized, Message: err.Error()}})
+		return
+	}
+	if err != nil {
+		s.fail(w, r, "pairing", err)
+		return
+	}
+	s.auth.succeed(ip)
+	requestLogger(r).Info("device paired", "device_id", dev.ID, "device_name", dev.Name, "scopes", dev.Scopes)
+	writeJSON(w, http.StatusCreated, map[string]any{"device": dev, "token": token})
+}
+
+func (s *server) listDevices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"devices": s.auth.devices.list()})
+}
+
+// revokeDevice deletes a device; its token stops working at once.
+func (s *server) revokeDevice(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	ok, err := s.auth.devices.revoke(id)
+	if err != nil {
+		s.fail(w, r, "pairing", err)
+		return
+	}
+	if !ok {
+		writeError(w, &apiError{Status: http.StatusNotFound, ErrorBody: core.ErrorBody{
+			Code: core.CodeNotFound, Message: fmt.Sprintf("no device %s", id)}})
+		return
+	}
+	requestLogger(r).Info("device revoked", "device_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// fail writes err as the response: an apiError as it is, anything else as a
+// logged 500.
+func (s *server) fail(w http.ResponseWriter, r *http.Request, what string, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		if r.Context().Err() != nil {
+			return // the client went away
+		}
+		requestLogger(r).Error("request failed", "in", what, "err", err)
+		apiErr = &apiError{Status: http.StatusInternalServerError, ErrorBody: core.ErrorBody{
+			Code: core.CodeInternal, Message: "internal error"}}
+	}
+	writeError(w, apiErr)
+}
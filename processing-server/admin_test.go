@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminRefusesDeviceTokens(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestServer(t, clock, testEndpoint(t, "echo", echoScript))
+	dev, token := pairTestDevice(t, s, "phone", allEndpoints)
+
+	requests := []struct{ method, path, body string }{
+		{"POST", "/admin/pairing-codes", `{"scopes": ["*"]}`},
+		{"GET", "/admin/devices", ""},
+		{"DELETE", "/admin/devices/" + dev.ID, ""},
+	}
+	for _, r := range requests {
+		w := serve(s, "192.0.2.1:1", r.method, r.path, token, r.body)
+		if w.Code != http.StatusForbidden || errorCode(t, w) != string(codeForbidden) {
+			t.Errorf("%s %s with a device token: %d %s", r.method, r.path, w.Code, w.Body)
+		}
+	}
+	if len(s.auth.devices.list()) != 1 || len(s.auth.devices.codes) != 0 {
+		t.Fatal("a refused admin request changed the devices")
+	}
+}
+
+func TestPairingFlow(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestServer(t, clock, testEndpoint(t, "echo", echoScript))
+	var shown []pairingCode
+	s.announce = func(c pairingCode) { shown = append(shown, c) }
+
+	w := serve(s, "192.0.2.1:1", "POST", "/admin/pairing-codes", testPassword, `{"scopes": ["echo"]}`)
+	if w.Code != http.StatusCreated || len(shown) != 1 {
+		t.Fatalf("creating a pairing code: %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), shown[0].code) {
+		t.Fatalf("the response shows the code: %s", w.Body)
+	}
+	if want := `{"expires_at":"2026-01-01T00:05:00Z","scopes":["echo"]}`; strings.TrimSpace(w.Body.String()) != want {
+		t.Fatalf("response %s, want %s", w.Body, want)
+	}
+
+	w = serve(s, "192.0.2.2:1", "POST", pairPath, "", `{"code": "`+shown[0].String()+`", "name": " phone "}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("pairing: %d %s", w.Code, w.Body)
+	}
+	var paired struct {
+		Device device `json:"device"`
+		Token  string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &paired); err != nil {
+		t.Fatal(err)
+	}
+	if paired.Device.Name != "phone" || !strings.HasPrefix(paired.Token, tokenPrefix) {
+		t.Fatalf("unexpected pairing response %s", w.Body)
+	}
+	if w := serve(s, "192.0.2.3:1", "POST", pairPath, "", `{"code": "`+shown[0].code+`", "name": "tablet"}`); w.Code != http.StatusUnauthorized {
+		t.Fatalf("reusing the code: %d %s", w.Code, w.Body)
+	}
+
+	w = serve(s, "192.0.2.1:1", "GET", "/admin/devices", testPassword, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), paired.Device.ID) || strings.Contains(w.Body.String(), "token") {
+		t.Fatalf("listing devices: %d %s", w.Code, w.Body)
+	}
+	if w := serve(s, "192.0.2.2:1", "POST", "/echo", paired.Token, ""); w.Code != http.StatusOK {
+		t.Fatalf("calling with the new token: %d %s", w.Code, w.Body)
+	}
+
+	if w := serve(s, "192.0.2.1:1", "DELETE", "/admin/devices/"+paired.Device.ID, testPassword, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoking: %d %s", w.Code, w.Body)
+	}
+	if w := serve(s, "192.0.2.2:1", "POST", "/echo", paired.Token, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("calling with a revoked token: %d %s", w.Code, w.Body)
+	}
+	if w := serve(s, "192.0.2.1:1", "DELETE", "/admin/devices/"+paired.Device.ID, testPassword, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("revoking twice: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPairWithExpiredCode(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestServer(t, clock)
+	code, err := s.auth.devices.newCode([]string{allEndpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(pairingCodeTTL)
+	w := serve(s, "192.0.2.1:1", "POST", pairPath, "", `{"code": "`+code.code+`", "name": "phone"}`)
+	if w.Code != http.StatusUnauthorized || errorCode(t, w) != string(codeUnauthorized) {
+		t.Fatalf("pairing with an expired code: %d %s", w.Code, w.Body)
+	}
+	if s.auth.blocked("192.0.2.1", clock.now()) == 0 {
+		t.Fatal("an expired code did not count as a failure")
+	}
+}
+
+func TestPairingRequestsValidated(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestServer(t, clock, testEndpoint(t, "echo", echoScript))
+	cases := []struct {
+		path, body string
+		// want is the first issue's path and code.
+		want string
+	}{
+		{"/admin/pairing-codes", `{}`, "scopes E_REQUIRED"},
+		{"/admin/pairing-codes", `{"scopes": []}`, "scopes E_TOO_FEW"},
+		{"/admin/pairing-codes", `{"scopes": "echo"}`, "scopes E_TYPE"},
+		{"/admin/pairing-codes", `{"scopes": ["echo", "nope"]}`, "scopes[1] E_REFERENCE"},
+		{"/admin/pairing-codes", `{"scopes": ["*"], "ttl": 60}`, "ttl E_UNKNOWN_FIELD"},
+		{pairPath, `{"code": "1234-5678"}`, "name E_REQUIRED"},
+		{pairPath, `{"code": "1234-5678", "name": "  "}`, "name E_TOO_SHORT"},
+		{pairPath, `{"code": "1234-5678", "name": "` + strings.Repeat("n", maxDeviceName+1) + `"}`, "name E_TOO_LONG"},
+		{pairPath, `{"code": 12345678, "name": "phone"}`, "code E_TYPE"},
+	}
+	for _, tc := range cases {
+		w := serve(s, "192.0.2.1:1", "POST", tc.path, testPassword, tc.body)
+		var env struct {
+			Error struct {
+				Details []struct{ Path, Code string }
+			}
+		}
+		if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &env) != nil || len(env.Error.Details) == 0 {
+			t.Errorf("%s %s: %d %s", tc.path, tc.body, w.Code, w.Body)
+			continue
+		}
+		if got := env.Error.Details[0].Path + " " + env.Error.Details[0].Code; got != tc.want {
+			t.Errorf("%s %s: %s, want %s", tc.path, tc.body, got, tc.want)
+		}
+	}
+}
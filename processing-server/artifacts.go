@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"logwayss/core-go/core"
+)
+
+const (
+	// runsDir holds the run directories, as runs/<date>/<endpoint>/<run-id>.
+	runsDir = "runs"
+
+	artifactFilesDir = "files"
+	stdoutArtifact   = "stdout"
+	stderrArtifact   = "stderr"
+	manifestArtifact = "manifest.json"
+
+	// runIDEnv names the run a script is executing for.
+	runIDEnv = "LOGWAYSS_RUN_ID"
+	// maxListedFiles bounds the files a manifest lists.
+	maxListedFiles = 1000
+)
+
+// runManifest describes a finished run. It is written to manifest.json in
+// the run's directory and returned by GET /runs/{id}/artifacts.
+type runManifest struct {
+	RunID       string    `json:"run_id"`
+	Endpoint    string    `json:"endpoint"`
+	Script      string    `json:"script"`
+	InputSHA256 string    `json:"input_sha256"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	DurationMS  int64     `json:"duration_ms"`
+	// ExitCode is missing when the script was killed or never started.
+	ExitCode       *int           `json:"exit_code,omitempty"`
+	Error          core.ErrorCode `json:"error,omitempty"`
+	Resources      *resourceUsage `json:"resources,omitempty"`
+	Stdout         outputFile     `json:"stdout"`
+	Stderr         outputFile     `json:"stderr"`
+	Files          []artifactFile `json:"files"`
+	FilesTruncated bool           `json:"files_truncated,omitempty"`
+}
+
+// resourceUsage is what the script's process used. MaxRSSBytes is zero
+// where the platform does not report it.
+type resourceUsage struct {
+	UserCPUMS   int64 `json:"user_cpu_ms"`
+	SystemCPUMS int64 `json:"system_cpu_ms"`
+	MaxRSSBytes int64 `json:"max_rss_bytes,omitempty"`
+}
+
+func newResourceUsage(ps *os.ProcessState) *resourceUsage {
+	return &resourceUsage{
+		UserCPUMS:   ps.UserTime().Milliseconds(),
+		SystemCPUMS: ps.SystemTime().Milliseconds(),
+		MaxRSSBytes: maxRSS(ps),
+	}
+}
+
+// outputFile describes a captured output stream.
+type outputFile struct {
+	Size      int64 `json:"size"`
+	Truncated bool  `json:"truncated,omitempty"`
+}
+
+// artifactFile is a file the script left in its working directory. Path is
+// relative to that directory and uses forward slashes.
+type artifactFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// artifactDir is the directory of run r under root: runs are grouped by the
+// UTC day they were created and by endpoint.
+func artifactDir(root string, r run) string {
+	return filepath.Join(root, r.CreatedAt.UTC().Format(time.DateOnly), r.Endpoint, r.ID)
+}
+
+// writeArtifacts stores stdout and the manifest in dir, listing the files
+// the script wrote.
+func writeArtifacts(dir string, stdout []byte, m runManifest) error {
+	if err := os.WriteFile(filepath.Join(dir, stdoutArtifact), stdout, 0o600); err != nil {
+		return err
+	}
+	files, truncated, err := listArtifacts(filepath.Join(dir, artifactFilesDir))
+	if err != nil {
+		return err
+	}
+	m.Files, m.FilesTruncated = files, truncated
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, manifestArtifact), raw, 0o600)
+}
+
+// listArtifacts returns the regular files under dir, in lexical order, up
+// to maxListedFiles. Symlinks are not followed.
+func listArtifacts(dir string) ([]artifactFile, bool, error) {
+	files := []artifactFile{}
+	errFull := errors.New("too many files")
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		if len(files) == maxListedFiles {
+			return errFull
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f := artifactFile{Path: filepath.ToSlash(rel)}
+		if f.Size, f.SHA256, err = hashFile(p); err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	})
+	if errors.Is(err, errFull) {
+		return files, true, nil
+	}
+	return files, false, err
+}
+
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sweepArtifacts removes the run directories under root for which expired
+// returns true, then the endpoint and day directories left empty. Days in
+// busy are kept even when empty: a queued run may be about to create its
+// directory there.
+func sweepArtifacts(root string, expired func(id string) bool, busy map[string]bool) {
+	days, err := os.ReadDir(root)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Error("sweeping run directories", "err", err)
+		return
+	}
+	for _, d := range days {
+		if _, err := time.Parse(time.DateOnly, d.Name()); err != nil || !d.IsDir() {
+			continue
+		}
+		dayDir := filepath.Join(root, d.Name())
+		endpoints, err := os.ReadDir(dayDir)
+		if err != nil {
+			slog.Error("sweeping run directories", "err", err)
+			continue
+		}
+		for _, e := range endpoints {
+			if !e.IsDir() {
+				continue
+			}
+			epDir := filepath.Join(dayDir, e.Name())
+			runs, err := os.ReadDir(epDir)
+			if err != nil {
+				slog.Error("sweeping run directories", "err", err)
+				continue
+			}
+			for _, r := range runs {
+				if !r.IsDir() || !expired(r.Name()) {
+					continue
+				}
+				if err := os.RemoveAll(filepath.Join(epDir, r.Name())); err != nil {
+					slog.Error("sweeping run directories", "err", err)
+				}
+			}
+			if !busy[d.Name()] {
+				os.Remove(epDir) // only if empty
+			}
+		}
+		if !busy[d.Name()] {
+			os.Remove(dayDir)
+		}
+	}
+}
+
+// runArtifacts returns a run's manifest. It is 404 until the run has
+// finished.
+func (s *server) runArtifacts(w http.ResponseWriter, r *http.Request) {
+	found, err := s.queue.get(s.runID(r))
+	if err != nil {
+		s.runError(w, r, err)
+		return
+	}
+	raw, err := os.ReadFile(filepath.Join(s.queue.artifactDir(found), manifestArtifact))
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, &apiError{Status: http.StatusNotFound, ErrorBody: core.ErrorBody{
+			Code: core.CodeNotFound, Message: fmt.Sprintf("run %s has no artifacts yet", found.ID)}})
+		return
+	}
+	if err != nil {
+		s.fail(w, r, "runs", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
+
+// downloadArtifact serves a file from a run's directory, such as stdout,
+// stderr or files/<path>. A running script's files can be fetched as they
+// are written.
+func (s *server) downloadArtifact(w http.ResponseWriter, r *http.Request) {
+	found, err := s.queue.get(s.runID(r))
+	if err != nil {
+		s.runError(w, r, err)
+		return
+	}
+	name := r.PathValue("path")
+	notFound := &apiError{Status: http.StatusNotFound, ErrorBody: core.ErrorBody{
+		Code: core.CodeNotFound, Message: fmt.Sprintf("run %s has no artifact %s", found.ID, name)}}
+	// The root confines the lookup to the run directory, symlinks included.
+	root, err := os.OpenRoot(s.queue.artifactDir(found))
+	if err != nil {
+		writeError(w, notFound)
+		return
+	}
+	defer root.Close()
+	f, err := root.Open(filepath.FromSlash(name))
+	if err != nil {
+		writeError(w, notFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		writeError(w, notFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
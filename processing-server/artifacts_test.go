@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// artifactScript leaves a report in its working directory, and symlinks to
+// a file and a directory outside the run directory.
+func artifactScript(secret string) string {
+	return "#!/bin/sh\ncat >/dev/null\nmkdir out\necho a,b > out/report.csv\n" +
+		"ln -s '" + secret + "' leak\nln -s '" + filepath.Dir(secret) + "' up\nln -s ../../.. parent\necho '{}'\n"
+}
+
+func TestDownloadArtifact(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("do not serve"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ep := testEndpoint(t, "report", artifactScript(secret))
+	s := newTestServer(t, &testClock{t: time.Now()}, ep)
+	r := awaitRun(t, s.queue, submit(t, s.queue, ep).ID)
+	if r.State != runSucceeded {
+		t.Fatalf("run %s: %+v", r.State, r.Error)
+	}
+
+	w := serve(s, "192.0.2.1:1", "GET", "/runs/"+r.ID+"/artifacts/files/out/report.csv", testPassword, "")
+	if w.Code != http.StatusOK || w.Body.String() != "a,b\n" {
+		t.Fatalf("downloading a file: %d %s", w.Code, w.Body)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":           "application/octet-stream",
+		"X-Content-Type-Options": "nosniff",
+		"Content-Disposition":    "attachment; filename=report.csv",
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if w := serve(s, "192.0.2.1:1", "GET", "/runs/"+r.ID+"/artifacts/stdout", testPassword, ""); w.Code != http.StatusOK || w.Body.String() != "{}\n" {
+		t.Fatalf("downloading stdout: %d %s", w.Code, w.Body)
+	}
+
+	// The manifest lists regular files only.
+	w = serve(s, "192.0.2.1:1", "GET", "/runs/"+r.ID+"/artifacts", testPassword, "")
+	var m runManifest
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &m) != nil {
+		t.Fatalf("manifest: %d %s", w.Code, w.Body)
+	}
+	if len(m.Files) != 1 || m.Files[0].Path != "out/report.csv" || m.Files[0].Size != 4 {
+		t.Fatalf("manifest files: %+v", m.Files)
+	}
+
+	// Path values as the router would pass them, so the handler's own
+	// checks are what is tested.
+	escapes := []string{
+		"..",
+		"../" + r.ID,
+		"../../../../" + queueDir + "/" + r.ID + ".json",
+		"files/../../" + r.ID + "/stdout/..",
+		secret,
+		"/etc/passwd",
+		"files/leak",
+		"files/up/secret",
+		"files/parent/" + queueDir + "/" + r.ID + ".json",
+		"files/out",
+		"",
+	}
+	for _, name := range escapes {
+		req := httptest.NewRequest("GET", "/runs/"+r.ID+"/artifacts/x", nil)
+		req.SetPathValue("id", r.ID)
+		req.SetPathValue("path", name)
+		w := httptest.NewRecorder()
+		s.downloadArtifact(w, req)
+		if w.Code != http.StatusNotFound || errorCode(t, w) != "E_NOT_FOUND" {
+			t.Errorf("downloading %q: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	// Through the router too.
+	for _, path := range []string{"files/leak", "files/up/secret", "files/parent/" + queueDir + "/" + r.ID + ".json", "..%2f..%2f..%2f" + queueDir} {
+		if w := serve(s, "192.0.2.1:1", "GET", "/runs/"+r.ID+"/artifacts/"+path, testPassword, ""); w.Code == http.StatusOK {
+			t.Errorf("GET artifacts/%s: %d %s", path, w.Code, w.Body)
+		}
+	}
+}
+
+func TestRunArtifactsBeforeFinish(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", gatedScript(gate))
+	s := newTestServer(t, &testClock{t: time.Now()}, ep)
+	defer openGate(t, gate)
+	r := submit(t, s.queue, ep)
+	if w := serve(s, "192.0.2.1:1", "GET", "/runs/"+r.ID+"/artifacts", testPassword, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("manifest of a running run: %d %s", w.Code, w.Body)
+	}
+}
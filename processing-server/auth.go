@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"logwayss/core-go/core"
+)
+
+const (
+	codeUnauthorized core.ErrorCode = "E_UNAUTHORIZED"
+	codeRateLimited  core.ErrorCode = "E_RATE_LIMITED"
+	codeForbidden    core.ErrorCode = "E_FORBIDDEN"
+)
+
+const (
+	// A client's first failure costs authBaseBackoff before its next attempt
+	// is considered; each further failure doubles that, up to authMaxBackoff.
+	authBaseBackoff = time.Second
+	authMaxBackoff  = 30 * time.Second
+	// After authMaxFailures consecutive failures the client is locked out
+	// for authLockout. Failures older than authLockout are forgotten.
+	authMaxFailures = 5
+	authLockout     = 15 * time.Minute
+	// authMaxClients bounds the failure table. When it fills, expired
+	// entries are swept, and if none have expired the oldest is dropped.
+	authMaxClients = 4096
+)
+
+// placeholderPassword is the MASTER_PASSWORD in .env.example.
+const placeholderPassword = "change_me"
+
+// authenticator checks the credential on every request: either
+// `Authorization: Bearer <credential>` or HTTP Basic with the credential as
+// the password and any user name. The credential is MASTER_PASSWORD or a
+// paired device's token. Only the SHA-256 of the password is kept, and
+// comparisons run in constant time.
+type authenticator struct {
+	digest  [sha256.Size]byte
+	devices *deviceStore
+	now     func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*authFailures
+}
+
+// authFailures tracks one client's consecutive failures.
+type authFailures struct {
+	count       int
+	last        time.Time
+	retryAt     time.Time
+	lockedUntil time.Time
+}
+
+func newAuthenticator(password string, devices *deviceStore) (*authenticator, error) {
+	switch password {
+	case "":
+		return nil, fmt.Errorf("MASTER_PASSWORD is not set; add it to .env")
+	case placeholderPassword:
+		return nil, fmt.Errorf("MASTER_PASSWORD is still the example value; choose a strong passphrase")
+	}
+	return &authenticator{
+		digest:  sha256.Sum256([]byte(password)),
+		devices: devices,
+		now:     time.Now,
+		clients: make(map[string]*authFailures),
+	}, nil
+}
+
+// allow reports whether r carries a credential, and returns the device it
+// belongs to, or nil for MASTER_PASSWORD. Otherwise it writes the error
+// response: 401 for a missing or wrong credential, counted against the
+// client, or 429 while the client is backing off or locked out.
+func (a *authenticator) allow(w http.ResponseWriter, r *http.Request) (*device, bool) {
+	ip := clientIP(r)
+	if a.refuse(w, ip) {
+		return nil, false
+	}
+	dev, ok := a.check(r)
+	if !ok {
+		a.fail(ip, a.now())
+		w.Header().Set("WWW-Authenticate", `Bearer realm="logwayss"`)
+		writeError(w, &apiError{Status: http.StatusUnauthorized, ErrorBody: core.ErrorBody{
+			Code: codeUnauthorized, Message: "missing or invalid credentials"}})
+		return nil, false
+	}
+	a.succeed(ip)
+	return dev, true
+}
+
+// refuse writes a 429 response and reports true while ip is backing off or
+// locked out.
+func (a *authenticator) refuse(w http.ResponseWriter, ip string) bool {
+	wait := a.blocked(ip, a.now())
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	writeError(w, &apiError{Status: http.StatusTooManyRequests, ErrorBody: core.ErrorBody{
+		Code: codeRateLimited, Message: "too many failed attempts; retry later"}})
+	return true
+}
+
+// check compares the request's credential with MASTER_PASSWORD and the
+// device tokens.
+func (a *authenticator) check(r *http.Request) (*device, bool) {
+	var given string
+	if _, pass, ok := r.BasicAuth(); ok {
+		given = pass
+	} else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		given = strings.TrimSpace(token)
+	} else {
+		return nil, false
+	}
+	// Hashing first makes the comparison independent of the lengths.
+	digest := sha256.Sum256([]byte(given))
+	if subtle.ConstantTimeCompare(digest[:], a.digest[:]) == 1 {
+		return nil, true
+	}
+	if a.devices != nil && strings.HasPrefix(given, tokenPrefix) {
+		if dev := a.devices.authenticate(given); dev != nil {
+			return dev, true
+		}
+	}
+	return nil, false
+}
+
+// succeed clears ip's failures.
+func (a *authenticator) succeed(ip string) {
+	if ip == "" {
+		return
+	}
+	a.mu.Lock()
+	delete(a.clients, ip)
+	a.mu.Unlock()
+}
+
+// blocked returns how long ip must still wait before it may try again.
+func (a *authenticator) blocked(ip string, now time.Time) time.Duration {
+	if ip == "" {
+		return 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f := a.clients[ip]
+	if f == nil {
+		return 0
+	}
+	until := f.retryAt
+	if f.lockedUntil.After(until) {
+		until = f.lockedUntil
+	}
+	return until.Sub(now)
+}
+
+// fail counts a failed attempt by ip, backing it off or locking it out.
+func (a *authenticator) fail(ip string, now time.Time) {
+	if ip == "" {
+		slog.Warn("authentication failed", "remote", "unix socket")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f := a.clients[ip]
+	if f == nil || now.Sub(f.last) > authLockout {
+		if f == nil && len(a.clients) >= authMaxClients {
+			a.sweep(now)
+		}
+		f = &authFailures{}
+		a.clients[ip] = f
+	}
+	f.count++
+	f.last = now
+	backoff := min(authBaseBackoff<<(f.count-1), authMaxBackoff)
+	f.retryAt = now.Add(backoff)
+	if f.count >= authMaxFailures {
+		f.lockedUntil = now.Add(authLockout)
+		slog.Warn("client locked out", "remote", ip, "failures", f.count, "lockout", authLockout.String())
+		return
+	}
+	slog.Warn("authentication failed", "remote", ip, "failures", f.count, "retry_after", backoff.String())
+}
+
+// sweep forgets clients whose failures have expired, or the client that
+// failed longest ago if none have, so the table never outgrows
+// authMaxClients. The caller holds a.mu.
+func (a *authenticator) sweep(now time.Time) {
+	oldest := ""
+	for ip, f := range a.clients {
+		if now.Sub(f.last) > authLockout && now.After(f.lockedUntil) {
+			delete(a.clients, ip)
+		} else if oldest == "" || f.last.Before(a.clients[oldest].last) {
+			oldest = ip
+		}
+	}
+	if len(a.clients) >= authMaxClients {
+		delete(a.clients, oldest)
+	}
+}
+
+// clientIP is the key failures are counted against: the IPv4 address, or
+// the /64 network of an IPv6 address, since a single host may use any
+// address in its /64. Forwarding headers are ignored: the server is not
+// meant to sit behind a proxy.
+//
+// It is "" for a connection over a Unix socket. Those all share one empty
+// address, so they are not counted at all; the socket's file mode decides
+// who may connect.
+func clientIP(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	ip = ip.WithZone("").Unmap()
+	if ip.Is6() {
+		prefix, _ := ip.Prefix(64)
+		return prefix.String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPassword = "correct horse battery staple"
+
+// testClock is a settable clock for the authenticator and device store.
+type testClock struct{ t time.Time }
+
+func (c *testClock) now() time.Time          { return c.t }
+func (c *testClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestAuth returns an authenticator for testPassword with an empty
+// device store, both on clock.
+func newTestAuth(t *testing.T, clock *testClock) *authenticator {
+	t.Helper()
+	devices, err := openDeviceStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("openDeviceStore failed: %v", err)
+	}
+	devices.now = clock.now
+	a, err := newAuthenticator(testPassword, devices)
+	if err != nil {
+		t.Fatalf("newAuthenticator failed: %v", err)
+	}
+	a.now = clock.now
+	return a
+}
+
+// authRequest returns a GET of path from remote with the given
+// Authorization header.
+func authRequest(path, remote, authorization string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = remote
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	return r
+}
+
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var env struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("response is not an error envelope: %s", w.Body)
+	}
+	return env.Error.Code
+}
+
+func TestNewAuthenticatorRejectsWeakPasswords(t *testing.T) {
+	for _, password := range []string{"", placeholderPassword} {
+		if _, err := newAuthenticator(password, nil); err == nil {
+			t.Errorf("newAuthenticator(%q) succeeded", password)
+		}
+	}
+}
+
+func TestAuthenticatorCredentials(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := newTestAuth(t, clock)
+	code, err := a.devices.newCode([]string{allEndpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, token, err := a.devices.redeem(code.code, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	basic := httptest.NewRequest(http.MethodGet, "/", nil)
+	basic.SetBasicAuth("anyone", testPassword)
+	cases := []struct {
+		name   string
+		r      *http.Request
+		ok     bool
+		device string
+	}{
+		{"bearer password", authRequest("/", "192.0.2.1:1", "Bearer "+testPassword), true, ""},
+		{"basic password", basic, true, ""},
+		{"device token", authRequest("/", "192.0.2.1:1", "Bearer "+token), true, dev.ID},
+		{"missing", authRequest("/", "192.0.2.1:1", ""), false, ""},
+		{"wrong password", authRequest("/", "192.0.2.1:1", "Bearer "+testPassword+"!"), false, ""},
+		{"password prefix", authRequest("/", "192.0.2.1:1", "Bearer "+testPassword[:5]), false, ""},
+		{"unknown token", authRequest("/", "192.0.2.1:1", "Bearer "+tokenPrefix+"AAAA"), false, ""},
+		{"other scheme", authRequest("/", "192.0.2.1:1", "Token "+testPassword), false, ""},
+	}
+	for _, tc := range cases {
+		got, ok := a.check(tc.r)
+		if ok != tc.ok {
+			t.Errorf("%s: ok = %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		id := ""
+		if got != nil {
+			id = got.ID
+		}
+		if id != tc.device {
+			t.Errorf("%s: device %q, want %q", tc.name, id, tc.device)
+		}
+	}
+}
+
+func TestAuthBackoffAndLockout(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := newTestAuth(t, clock)
+	const ip = "192.0.2.7"
+
+	waits := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, authLockout}
+	for i, want := range waits {
+		a.fail(ip, clock.now())
+		if got := a.blocked(ip, clock.now()); got != want {
+			t.Fatalf("after failure %d: blocked for %v, want %v", i+1, got, want)
+		}
+		w := httptest.NewRecorder()
+		if !a.refuse(w, ip) || w.Code != http.StatusTooManyRequests || errorCode(t, w) != string(codeRateLimited) {
+			t.Fatalf("after failure %d: not refused: %d %s", i+1, w.Code, w.Body)
+		}
+		if got := w.Header().Get("Retry-After"); got != fmt.Sprint(int(want/time.Second)) {
+			t.Fatalf("after failure %d: Retry-After %q, want %v", i+1, got, want)
+		}
+		if i < len(waits)-1 {
+			clock.advance(want)
+		}
+	}
+
+	// Even the right password waits out the lockout.
+	w := httptest.NewRecorder()
+	clock.advance(authLockout - time.Second)
+	if _, ok := a.allow(w, authRequest("/", ip+":1", "Bearer "+testPassword)); ok || w.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked out client allowed: %d", w.Code)
+	}
+	clock.advance(time.Second)
+	if a.blocked(ip, clock.now()) > 0 {
+		t.Fatal("lockout did not end")
+	}
+
+	// Failures older than the lockout are forgotten: the count starts over.
+	clock.advance(time.Second)
+	a.fail(ip, clock.now())
+	if got := a.blocked(ip, clock.now()); got != time.Second {
+		t.Fatalf("failure after the lockout: blocked for %v, want 1s", got)
+	}
+
+	// A success clears the count.
+	clock.advance(time.Second)
+	w = httptest.NewRecorder()
+	if _, ok := a.allow(w, authRequest("/", ip+":1", "Bearer "+testPassword)); !ok {
+		t.Fatalf("right password refused: %d %s", w.Code, w.Body)
+	}
+	a.fail(ip, clock.now())
+	if got := a.blocked(ip, clock.now()); got != time.Second {
+		t.Fatalf("failure after a success: blocked for %v, want 1s", got)
+	}
+}
+
+func TestAuthAllowResponses(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := newTestAuth(t, clock)
+
+	w := httptest.NewRecorder()
+	if _, ok := a.allow(w, authRequest("/", "192.0.2.1:1", "Bearer nope")); ok {
+		t.Fatal("wrong password allowed")
+	}
+	if w.Code != http.StatusUnauthorized || errorCode(t, w) != string(codeUnauthorized) || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("wrong password: %d %v %s", w.Code, w.Header(), w.Body)
+	}
+
+	// Other clients are not affected.
+	w = httptest.NewRecorder()
+	if _, ok := a.allow(w, authRequest("/", "192.0.2.2:1", "Bearer "+testPassword)); !ok {
+		t.Fatalf("other client refused: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthFailureTableBounded(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := newTestAuth(t, clock)
+	ip := func(i int) string { return fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff) }
+
+	// Nothing expires within the lockout, so the table fills up.
+	for i := range authMaxClients {
+		a.fail(ip(i), clock.now())
+		clock.advance(time.Millisecond)
+	}
+	a.fail("192.0.2.1", clock.now())
+	if len(a.clients) != authMaxClients {
+		t.Fatalf("failure table holds %d clients, want %d", len(a.clients), authMaxClients)
+	}
+	if a.clients[ip(0)] != nil || a.clients["192.0.2.1"] == nil || a.clients[ip(1)] == nil {
+		t.Fatal("the oldest client was not the one dropped")
+	}
+
+	// Expired clients are swept first.
+	clock.advance(authLockout + time.Second)
+	a.fail("192.0.2.2", clock.now())
+	if len(a.clients) != 1 {
+		t.Fatalf("expired clients not swept: %d left", len(a.clients))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cases := []struct{ remote, want string }{
+		{"192.0.2.1:1234", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:1234", "192.0.2.1"},
+		{"[2001:db8:1:2:3:4:5:6]:1234", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:2:ffff:ffff:ffff:ffff]:1234", "2001:db8:1:2::/64"},
+		{"[2001:db8:1:3::1]:1234", "2001:db8:1:3::/64"},
+		{"[fe80::1%eth0]:1234", "fe80::/64"},
+		{"[::1]:1234", "::/64"},
+	}
+	for _, tc := range cases {
+		if got := clientIP(authRequest("/", tc.remote, "")); got != tc.want {
+			t.Errorf("clientIP(%s) = %q, want %q", tc.remote, got, tc.want)
+		}
+	}
+	if got := clientIP(unixRequest("Bearer x")); got != "" {
+		t.Errorf("clientIP over a Unix socket = %q, want \"\"", got)
+	}
+}
+
+// unixRequest is a request as it arrives over a Unix socket listener.
+func unixRequest(authorization string) *http.Request {
+	r := authRequest("/", "@", authorization)
+	addr := &net.UnixAddr{Name: "/run/logwayss.sock", Net: "unix"}
+	return r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, addr))
+}
+
+func TestUnixSocketClientsNotLockedOut(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := newTestAuth(t, clock)
+	for i := range 2 * authMaxFailures {
+		w := httptest.NewRecorder()
+		if _, ok := a.allow(w, unixRequest("Bearer nope")); ok || w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong password %d over the socket: %d", i+1, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	if _, ok := a.allow(w, unixRequest("Bearer "+testPassword)); !ok {
+		t.Fatalf("socket client locked out by another's failures: %d %s", w.Code, w.Body)
+	}
+	if len(a.clients) != 0 {
+		t.Fatalf("socket failures tracked: %v", a.clients)
+	}
+}
+
+func TestPairSharesFailureCounter(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	a := newTestAuth(t, clock)
+	s := newServer(&Config{}, a, nil)
+	s.announce = func(pairingCode) {}
+	code, err := a.devices.newCode([]string{allEndpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const remote = "192.0.2.9:5555"
+	pair := func(code string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, pairPath, strings.NewReader(`{"code": "`+code+`", "name": "phone"}`))
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// Four wrong codes and a wrong password lock the client out.
+	for i := range authMaxFailures - 1 {
+		if w := pair("0000-0000"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code %d: %d %s", i+1, w.Code, w.Body)
+		}
+		if w := pair(code.String()); w.Code != http.StatusTooManyRequests {
+			t.Fatalf("right code during backoff: %d %s", w.Code, w.Body)
+		}
+		clock.advance(authMaxBackoff)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, authRequest("/admin/devices", remote, "Bearer nope"))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: %d", w.Code)
+	}
+	clock.advance(authMaxBackoff)
+	if w := pair(code.String()); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("right code while locked out: %d %s", w.Code, w.Body)
+	}
+
+	// The first code expired during the lockout; pair with a new one.
+	clock.advance(authLockout)
+	fresh, err := a.devices.newCode([]string{allEndpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := pair(fresh.String()); w.Code != http.StatusCreated {
+		t.Fatalf("right code after the lockout: %d %s", w.Code, w.Body)
+	}
+	if a.blocked("192.0.2.9", clock.now()) != 0 || a.clients["192.0.2.9"] != nil {
+		t.Fatal("pairing did not clear the failures")
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxTimeoutMS bounds an endpoint's timeout_ms: one hour.
+const maxTimeoutMS = 60 * 60 * 1000
+
+// maxConcurrency bounds an endpoint's max_concurrent.
+const maxConcurrency = 64
+
+// maxRetentionDays bounds run_retention_days: ten years.
+const maxRetentionDays = 3650
+
+var (
+	endpointNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+	allowedMethods      = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+	// knownField matches every field path the config may contain.
+	knownField = regexp.MustCompile(`^(endpoints(\[\d+\](\.(name|method|path|script_path|timeout_ms|enabled|max_concurrent` +
+		`|sandbox(\.(cpu_seconds|memory_mb|open_files|processes|isolate|network))?))?)?` +
+		`|data_dir|log_file|run_retention_days|listen(\.(host|port|allow_lan|unix_socket|socket_mode|tls|cert_dir))?)$`)
+	socketModePattern = regexp.MustCompile(`^0?[0-7]{3}$`)
+)
+
+// Config is server.config.json.
+type Config struct {
+	// DataDir holds the server's state, such as paired devices; it defaults
+	// to "data" next to the config file.
+	DataDir string `json:"data_dir"`
+	// LogFile is where the JSON log is written and rotated; it defaults to
+	// logs/server.log in the data directory.
+	LogFile string `json:"log_file"`
+	// RunRetentionDays is how long finished runs and their artifacts are
+	// kept; it defaults to 7.
+	RunRetentionDays int          `json:"run_retention_days"`
+	Listen           ListenConfig `json:"listen"`
+	Endpoints        []Endpoint   `json:"endpoints"`
+}
+
+// ListenConfig is where the server accepts connections. Every field is
+// optional; the HOST and PORT environment variables override host and port.
+type ListenConfig struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// AllowLAN must be set to listen on anything but a loopback address.
+	AllowLAN bool `json:"allow_lan"`
+	// UnixSocket, if set, is a socket path to listen on instead of TCP.
+	UnixSocket string `json:"unix_socket"`
+	// SocketMode is the socket file's permissions in octal, e.g. "0660".
+	SocketMode string `json:"socket_mode"`
+	// TLS serves HTTPS with a self-signed certificate. It defaults to
+	// AllowLAN, so LAN clients never send the password in cleartext.
+	TLS *bool `json:"tls"`
+	// CertDir holds the certificate and keys; it defaults to "tls" next to
+	// the config file.
+	CertDir string `json:"cert_dir"`
+}
+
+// useTLS reports whether the server speaks HTTPS.
+func (lc ListenConfig) useTLS() bool {
+	if lc.TLS != nil {
+		return *lc.TLS
+	}
+	return lc.AllowLAN
+}
+
+// Endpoint maps an HTTP route to a script.
+type Endpoint struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// ScriptPath is relative to the directory holding the config file;
+	// LoadConfig makes it absolute.
+	ScriptPath string `json:"script_path"`
+	TimeoutMS  int    `json:"timeout_ms"`
+	Enabled    bool   `json:"enabled"`
+	// MaxConcurrent is how many runs of the endpoint may execute at once;
+	// further runs wait in the queue. It is optional and defaults to 1.
+	MaxConcurrent int `json:"max_concurrent"`
+	// Sandbox restricts the script. It is optional; by default the script
+	// runs with the server's privileges and no limits.
+	Sandbox SandboxConfig `json:"sandbox"`
+}
+
+// SandboxConfig holds an endpoint's resource limits and isolation. A limit
+// of zero is no limit.
+type SandboxConfig struct {
+	// CPUSeconds bounds the CPU time of each process (RLIMIT_CPU).
+	CPUSeconds int `json:"cpu_seconds"`
+	// MemoryMB bounds the address space of each process (RLIMIT_AS).
+	MemoryMB int `json:"memory_mb"`
+	// OpenFiles bounds each process's file descriptors (RLIMIT_NOFILE).
+	OpenFiles int `json:"open_files"`
+	// Processes bounds the processes of the user the script runs as
+	// (RLIMIT_NPROC).
+	Processes int `json:"processes"`
+	// Isolate runs the script in new user, mount and network namespaces,
+	// on Linux only. It gets a private /tmp and no network.
+	Isolate bool `json:"isolate"`
+	// Network keeps the host network for an isolated script.
+	Network bool `json:"network"`
+}
+
+// enabled reports whether the script needs the sandbox at all.
+func (sb SandboxConfig) enabled() bool {
+	return sb != SandboxConfig{}
+}
+
+// ConfigError is one problem in the config file.
+type ConfigError struct {
+	File  string
+	Line  int
+	Field string
+	Msg   string
+}
+
+func (e ConfigError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		b.WriteString(":" + strconv.Itoa(e.Line))
+	}
+	if e.Field != "" {
+		b.WriteString(": " + e.Field)
+	}
+	return b.String() + ": " + e.Msg
+}
+
+// ConfigErrors is every problem found in the config file, in file order.
+type ConfigErrors []ConfigError
+
+func (es ConfigErrors) Error() string {
+	lines := make([]string, len(es))
+	for i, e := range es {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// LoadConfig reads and validates the config at file. Any problem, including
+// an unknown field or a missing script, rejects the whole config.
+func LoadConfig(file string) (*Config, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(file, raw)
+}
+
+func parseConfig(file string, raw []byte) (*Config, error) {
+	lines := newLineIndex(raw)
+	fail := func(offset int64, field, msg string) error {
+		return ConfigErrors{{File: file, Line: lines.line(offset), Field: field, Msg: msg}}
+	}
+
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, fail(0, "", "must be a JSON object")
+	}
+
+	// Walk the document once to learn where every field is, so problems
+	// found after decoding can still point at a line.
+	offsets, err := fieldOffsets(raw)
+	if err != nil {
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			return nil, fail(syntax.Offset, "", syntax.Error())
+		}
+		return nil, fail(int64(len(raw)), "", err.Error())
+	}
+
+	var errs ConfigErrors
+	report := func(field, msg string) {
+		errs = append(errs, ConfigError{File: file, Line: lines.line(offsets.find(field)), Field: field, Msg: msg})
+	}
+	for _, field := range offsets.fields() {
+		if !knownField.MatchString(field) {
+			report(field, "unknown field")
+		}
+	}
+	if errs != nil {
+		return nil, errs
+	}
+
+	var cfg Config
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if err := dec.Decode(&cfg); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, fail(typeErr.Offset, offsets.at(typeErr.Offset), fmt.Sprintf("must be %s, not %s", typeErr.Type, typeErr.Value))
+		}
+		return nil, fail(0, "", err.Error())
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fail(dec.InputOffset(), "", "unexpected data after the config object")
+	}
+
+	if _, ok := offsets["endpoints"]; !ok {
+		report("endpoints", "is required")
+	}
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := offsets["data_dir"]; ok && cfg.DataDir == "" {
+		report("data_dir", "must not be empty")
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = "data"
+	}
+	if !filepath.IsAbs(cfg.DataDir) {
+		cfg.DataDir = filepath.Join(dir, cfg.DataDir)
+	}
+	if _, ok := offsets["log_file"]; ok && cfg.LogFile == "" {
+		report("log_file", "must not be empty")
+	}
+	if cfg.LogFile == "" {
+		cfg.LogFile = filepath.Join(cfg.DataDir, "logs", "server.log")
+	} else if !filepath.IsAbs(cfg.LogFile) {
+		cfg.LogFile = filepath.Join(dir, cfg.LogFile)
+	}
+	if _, ok := offsets["run_retention_days"]; !ok {
+		cfg.RunRetentionDays = 7
+	} else if cfg.RunRetentionDays < 1 || cfg.RunRetentionDays > maxRetentionDays {
+		report("run_retention_days", fmt.Sprintf("must be between 1 and %d", maxRetentionDays))
+	}
+	lc := &cfg.Listen
+	if _, ok := offsets["listen.host"]; ok && lc.Host == "" {
+		report("listen.host", "must not be empty")
+	}
+	if _, ok := offsets["listen.port"]; ok && (lc.Port < 1 || lc.Port > 65535) {
+		report("listen.port", "must be between 1 and 65535")
+	}
+	if lc.UnixSocket != "" && !filepath.IsAbs(lc.UnixSocket) {
+		lc.UnixSocket = filepath.Join(dir, lc.UnixSocket)
+	}
+	if lc.SocketMode != "" && !socketModePattern.MatchString(lc.SocketMode) {
+		report("listen.socket_mode", `must be an octal file mode such as "0600"`)
+	}
+	if _, ok := offsets["listen.cert_dir"]; ok && lc.CertDir == "" {
+		report("listen.cert_dir", "must not be empty")
+	}
+	if lc.CertDir == "" {
+		lc.CertDir = "tls"
+	}
+	if !filepath.IsAbs(lc.CertDir) {
+		lc.CertDir = filepath.Join(dir, lc.CertDir)
+	}
+	names := make(map[string]bool)
+	routes := make(map[string]bool)
+	for i := range cfg.Endpoints {
+		ep := &cfg.Endpoints[i]
+		at := fmt.Sprintf("endpoints[%d]", i)
+		missing := make(map[string]bool)
+		for _, key := range []string{"name", "method", "path", "script_path", "timeout_ms", "enabled"} {
+			if _, ok := offsets[at+"."+key]; !ok {
+				report(at+"."+key, "is required")
+				missing[key] = true
+			}
+		}
+		switch {
+		case missing["name"]:
+		case !endpointNamePattern.MatchString(ep.Name):
+			report(at+".name", "must be lowercase letters, digits, '-' and '_', starting with a letter or digit")
+		case names[ep.Name]:
+			report(at+".name", fmt.Sprintf("duplicate endpoint name %q", ep.Name))
+		}
+		names[ep.Name] = true
+
+		if !missing["method"] && !slices.Contains(allowedMethods, ep.Method) {
+			report(at+".method", "must be one of "+strings.Join(allowedMethods, ", "))
+		}
+		switch {
+		case missing["path"]:
+		case !strings.HasPrefix(ep.Path, "/") || path.Clean(ep.Path) != ep.Path || strings.ContainsAny(ep.Path, "{}? \t"):
+			report(at+".path", "must be a clean absolute path such as /summarize")
+		case reservedPath(ep.Path):
+			report(at+".path", "is reserved for the server's own endpoints")
+		case routes[ep.Method+" "+ep.Path]:
+			report(at+".path", fmt.Sprintf("duplicate route %s %s", ep.Method, ep.Path))
+		}
+		routes[ep.Method+" "+ep.Path] = true
+
+		if !missing["timeout_ms"] && (ep.TimeoutMS < 1 || ep.TimeoutMS > maxTimeoutMS) {
+			report(at+".timeout_ms", fmt.Sprintf("must be between 1 and %d", maxTimeoutMS))
+		}
+		if _, ok := offsets[at+".max_concurrent"]; !ok {
+			ep.MaxConcurrent = 1
+		} else if ep.MaxConcurrent < 1 || ep.MaxConcurrent > maxConcurrency {
+			report(at+".max_concurrent", fmt.Sprintf("must be between 1 and %d", maxConcurrency))
+		}
+		sb := ep.Sandbox
+		limits := []struct {
+			name            string
+			value, min, max int
+		}{
+			{"cpu_seconds", sb.CPUSeconds, 1, 24 * 60 * 60},
+			{"memory_mb", sb.MemoryMB, 16, 1 << 20},
+			{"open_files", sb.OpenFiles, 16, 1 << 20},
+			{"processes", sb.Processes, 1, 1 << 16},
+		}
+		for _, l := range limits {
+			field := at + ".sandbox." + l.name
+			if _, ok := offsets[field]; ok && (l.value < l.min || l.value > l.max) {
+				report(field, fmt.Sprintf("must be between %d and %d", l.min, l.max))
+			}
+		}
+		switch {
+		case sb.enabled() && !canSandbox:
+			report(at+".sandbox", "is not supported on "+runtime.GOOS)
+		case sb.Isolate && !canIsolate:
+			report(at+".sandbox.isolate", "needs Linux")
+		case sb.Network && !sb.Isolate:
+			report(at+".sandbox.network", "only applies with isolate; scripts that are not isolated always have network access")
+		}
+		switch {
+		case missing["script_path"]:
+		case ep.ScriptPath == "":
+			report(at+".script_path", "must not be empty")
+		default:
+			if !filepath.IsAbs(ep.ScriptPath) {
+				ep.ScriptPath = filepath.Join(dir, ep.ScriptPath)
+			}
+			if ep.Enabled {
+				if err := checkScript(ep.ScriptPath); err != nil {
+					report(at+".script_path", err.Error())
+				}
+			}
+		}
+	}
+	slices.SortStableFunc(errs, func(a, b ConfigError) int { return cmp.Compare(a.Line, b.Line) })
+	if errs != nil {
+		return nil, errs
+	}
+	return &cfg, nil
+}
+
+// reservedPath reports whether p belongs to the server itself.
+func reservedPath(p string) bool {
+	for _, prefix := range []string{"/admin", "/runs"} {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return p == pairPath
+}
+
+// checkScript makes sure path is an executable regular file.
+func checkScript(path string) error {
+	fi, err := os.Stat(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("%s does not exist", path)
+	case err != nil:
+		return err
+	case !fi.Mode().IsRegular():
+		return fmt.Errorf("%s is not a regular file", path)
+	case fi.Mode().Perm()&0o111 == 0:
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+// offsetIndex maps a field path such as "endpoints[2].timeout_ms" to the
+// byte offset of its key.
+type offsetIndex map[string]int64
+
+// find returns the offset of field, or of its nearest enclosing field that
+// is present.
+func (idx offsetIndex) find(field string) int64 {
+	for field != "" {
+		if off, ok := idx[field]; ok {
+			return off
+		}
+		cut := strings.LastIndexAny(field, ".[")
+		if cut < 0 {
+			break
+		}
+		field = field[:cut]
+	}
+	return 0
+}
+
+// fields returns the recorded field paths in file order.
+func (idx offsetIndex) fields() []string {
+	fields := make([]string, 0, len(idx))
+	for f := range idx {
+		fields = append(fields, f)
+	}
+	slices.SortFunc(fields, func(a, b string) int { return cmp.Compare(idx[a], idx[b]) })
+	return fields
+}
+
+// at returns the innermost field that starts before offset.
+func (idx offsetIndex) at(offset int64) string {
+	best, bestAt := "", int64(-1)
+	for f, off := range idx {
+		if off < offset && (off > bestAt || off == bestAt && len(f) > len(best)) {
+			best, bestAt = f, off
+		}
+	}
+	return best
+}
+
+// fieldOffsets walks the JSON document in raw and records where each field
+// and array element starts.
+func fieldOffsets(raw []byte) (offsetIndex, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	idx := make(offsetIndex)
+	// InputOffset is where the previous token ended; skip to the next one.
+	next := func() int64 {
+		off := dec.InputOffset()
+		for off < int64(len(raw)) && strings.IndexByte(" \t\r\n,:", raw[off]) >= 0 {
+			off++
+		}
+		return off
+	}
+	var walk func(prefix string) error
+	walk = func(prefix string) error {
+		start := next()
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if prefix != "" {
+			if _, seen := idx[prefix]; !seen {
+				idx[prefix] = start
+			}
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				keyAt := next()
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				field := key.(string)
+				if prefix != "" {
+					field = prefix + "." + field
+				}
+				idx[field] = keyAt
+				if err := walk(field); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s[%d]", prefix, i)); err != nil {
+					return err
+				}
+			}
+			_, err = dec.Token()
+			return err
+		}
+		return nil
+	}
+	if err := walk(""); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// lineIndex converts byte offsets into 1-based line numbers.
+type lineIndex []int64
+
+func newLineIndex(raw []byte) lineIndex {
+	starts := lineIndex{0}
+	for i, b := range raw {
+		if b == '\n' {
+			starts = append(starts, int64(i+1))
+		}
+	}
+	return starts
+}
+
+func (li lineIndex) line(offset int64) int {
+	n := 0
+	for n < len(li) && li[n] <= offset {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes body as server.config.json in a new directory that
+// also holds an executable scripts/echo.sh and a plain scripts/plain.txt,
+// and returns the config's path.
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "scripts"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "scripts", "echo.sh"), []byte("#!/bin/sh\ncat\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "scripts", "plain.txt"), []byte("not a script\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "server.config.json")
+	if err := os.WriteFile(file, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		// want are the reported problems, without the file name.
+		want []string
+	}{
+		{
+			name: "not an object",
+			body: `[]`,
+			want: []string{"1: must be a JSON object"},
+		},
+		{
+			name: "syntax error",
+			body: "{\n  \"endpoints\": [\n    {\"name\": \"echo\",}\n  ]\n}",
+			want: []string{"3: invalid character ',' looking for beginning of value"},
+		},
+		{
+			name: "unknown fields",
+			body: `{
+  "endpoints": [
+    {"name": "echo", "method": "POST", "path": "/echo", "script_path": "scripts/echo.sh",
+     "timeout_ms": 5000, "enabled": true, "retries": 3}
+  ],
+  "listen": {"hots": "127.0.0.1"}
+}`,
+			want: []string{
+				"4: endpoints[0].retries: unknown field",
+				"6: listen.hots: unknown field",
+			},
+		},
+		{
+			name: "wrong type",
+			body: `{
+  "endpoints": [
+    {"name": "echo", "method": "POST", "path": "/echo", "script_path": "scripts/echo.sh",
+     "timeout_ms": "5s", "enabled": true}
+  ]
+}`,
+			want: []string{"4: endpoints[0].timeout_ms: must be int, not string"},
+		},
+		{
+			name: "trailing data",
+			body: "{\"endpoints\": []}\n{}",
+			want: []string{"2: unexpected data after the config object"},
+		},
+		{
+			name: "missing endpoints",
+			body: `{"data_dir": "state"}`,
+			want: []string{"1: endpoints: is required"},
+		},
+		{
+			name: "missing endpoint fields",
+			body: `{
+  "endpoints": [
+    {"name": "echo", "method": "POST"}
+  ]
+}`,
+			want: []string{
+				"3: endpoints[0].path: is required",
+				"3: endpoints[0].script_path: is required",
+				"3: endpoints[0].timeout_ms: is required",
+				"3: endpoints[0].enabled: is required",
+			},
+		},
+		{
+			name: "ranges",
+			body: `{
+  "run_retention_days": 0,
+  "listen": {"host": "", "port": 70000, "socket_mode": "rw"},
+  "endpoints": [
+    {"name": "echo", "method": "POST", "path": "/echo", "script_path": "scripts/echo.sh",
+     "timeout_ms": 0,
+     "max_concurrent": 65,
+     "enabled": true}
+  ]
+}`,
+			want: []string{
+				"2: run_retention_days: must be between 1 and 3650",
+				"3: listen.host: must not be empty",
+				"3: listen.port: must be between 1 and 65535",
+				`3: listen.socket_mode: must be an octal file mode such as "0600"`,
+				"6: endpoints[0].timeout_ms: must be between 1 and 3600000",
+				"7: endpoints[0].max_concurrent: must be between 1 and 64",
+			},
+		},
+		{
+			name: "names, methods and paths",
+			body: `{
+  "endpoints": [
+    {"name": "Echo", "method": "GET", "path": "/echo", "script_path": "scripts/echo.sh", "timeout_ms": 1, "enabled": false},
+    {"name": "two", "method": "FETCH", "path": "/two/../2", "script_path": "scripts/echo.sh", "timeout_ms": 1, "enabled": false},
+    {"name": "two", "method": "GET", "path": "/echo", "script_path": "scripts/echo.sh", "timeout_ms": 1, "enabled": false},
+    {"name": "admin", "method": "GET", "path": "/admin/devices", "script_path": "scripts/echo.sh", "timeout_ms": 1, "enabled": false},
+    {"name": "pair", "method": "POST", "path": "/pair", "script_path": "scripts/echo.sh", "timeout_ms": 1, "enabled": false}
+  ]
+}`,
+			want: []string{
+				"3: endpoints[0].name: must be lowercase letters, digits, '-' and '_', starting with a letter or digit",
+				"4: endpoints[1].method: must be one of GET, POST, PUT, PATCH, DELETE",
+				"4: endpoints[1].path: must be a clean absolute path such as /summarize",
+				`5: endpoints[2].name: duplicate endpoint name "two"`,
+				"5: endpoints[2].path: duplicate route GET /echo",
+				"6: endpoints[3].path: is reserved for the server's own endpoints",
+				"7: endpoints[4].path: is reserved for the server's own endpoints",
+			},
+		},
+		{
+			name: "scripts",
+			body: `{
+  "endpoints": [
+    {"name": "gone", "method": "POST", "path": "/gone", "script_path": "scripts/gone.sh", "timeout_ms": 1, "enabled": true},
+    {"name": "plain", "method": "POST", "path": "/plain", "script_path": "scripts/plain.txt", "timeout_ms": 1, "enabled": true},
+    {"name": "dir", "method": "POST", "path": "/dir", "script_path": "scripts", "timeout_ms": 1, "enabled": true},
+    {"name": "off", "method": "POST", "path": "/off", "script_path": "scripts/gone.sh", "timeout_ms": 1, "enabled": false}
+  ]
+}`,
+			want: []string{
+				"3: endpoints[0].script_path: DIR/scripts/gone.sh does not exist",
+				"4: endpoints[1].script_path: DIR/scripts/plain.txt is not executable",
+				"5: endpoints[2].script_path: DIR/scripts is not a regular file",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			file := writeConfig(t, tc.body)
+			cfg, err := LoadConfig(file)
+			var errs ConfigErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("LoadConfig = %+v, %v; want ConfigErrors", cfg, err)
+			}
+			var got []string
+			for _, e := range errs {
+				if e.File != file {
+					t.Errorf("error names file %q, want %q", e.File, file)
+				}
+				got = append(got, strings.ReplaceAll(strings.TrimPrefix(e.Error(), file+":"), filepath.Dir(file), "DIR"))
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Fatalf("got errors:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestLoadConfigSandboxErrors(t *testing.T) {
+	if !canIsolate {
+		t.Skip("sandbox errors differ where scripts cannot be isolated")
+	}
+	file := writeConfig(t, `{
+  "endpoints": [
+    {"name": "echo", "method": "POST", "path": "/echo", "script_path": "scripts/echo.sh", "timeout_ms": 1, "enabled": true,
+     "sandbox": {"cpu_seconds": 0, "memory_mb": 8, "open_files": 16, "processes": 70000,
+                 "network": true}}
+  ]
+}`)
+	_, err := LoadConfig(file)
+	want := strings.Join([]string{
+		file + ":4: endpoints[0].sandbox.cpu_seconds: must be between 1 and 86400",
+		file + ":4: endpoints[0].sandbox.memory_mb: must be between 16 and 1048576",
+		file + ":4: endpoints[0].sandbox.processes: must be between 1 and 65536",
+		file + ":5: endpoints[0].sandbox.network: only applies with isolate; scripts that are not isolated always have network access",
+	}, "\n")
+	if err == nil || err.Error() != want {
+		t.Fatalf("got %v\nwant:\n%s", err, want)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	file := writeConfig(t, `{
+  "endpoints": [
+    {"name": "echo", "method": "POST", "path": "/echo", "script_path": "scripts/echo.sh", "timeout_ms": 5000, "enabled": true},
+    {"name": "off", "method": "GET", "path": "/off", "script_path": "scripts/gone.sh", "timeout_ms": 5000, "enabled": false,
+     "max_concurrent": 4}
+  ],
+  "listen": {"unix_socket": "run/server.sock"}
+}`)
+	cfg, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	dir := filepath.Dir(file)
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"data_dir", cfg.DataDir, filepath.Join(dir, "data")},
+		{"listen.unix_socket", cfg.Listen.UnixSocket, filepath.Join(dir, "run", "server.sock")},
+		{"listen.cert_dir", cfg.Listen.CertDir, filepath.Join(dir, "tls")},
+		{"listen.tls", cfg.Listen.useTLS(), false},
+		{"log_file", cfg.LogFile, filepath.Join(dir, "data", "logs", "server.log")},
+		{"run_retention_days", cfg.RunRetentionDays, 7},
+		{"endpoints[0].script_path", cfg.Endpoints[0].ScriptPath, filepath.Join(dir, "scripts", "echo.sh")},
+		{"endpoints[1].script_path", cfg.Endpoints[1].ScriptPath, filepath.Join(dir, "scripts", "gone.sh")},
+		{"endpoints[1].enabled", cfg.Endpoints[1].Enabled, false},
+		{"endpoints[0].max_concurrent", cfg.Endpoints[0].MaxConcurrent, 1},
+		{"endpoints[1].max_concurrent", cfg.Endpoints[1].MaxConcurrent, 4},
+		{"endpoints[0].sandbox", cfg.Endpoints[0].Sandbox.enabled(), false},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+		}
+	}
+}
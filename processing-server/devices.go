@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	devicesFile = "devices.json"
+
+	// pairingCodeTTL is how long a pairing code may be redeemed.
+	pairingCodeTTL = 5 * time.Minute
+	// maxPairingCodes bounds the codes outstanding at once.
+	maxPairingCodes = 16
+	// lastSeenInterval throttles writes of last_seen to the devices file.
+	lastSeenInterval = time.Minute
+
+	// allEndpoints is the scope that grants every endpoint.
+	allEndpoints = "*"
+	// tokenPrefix marks device tokens, so they are easy to spot in a leak.
+	tokenPrefix = "lwd_"
+)
+
+var (
+	errPairingCode  = errors.New("invalid or expired pairing code")
+	errTooManyCodes = errors.New("too many pairing codes outstanding")
+)
+
+// device is a paired client, as the admin endpoints show it.
+type device struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// allows reports whether the device may call the endpoint with this name.
+func (d *device) allows(endpoint string) bool {
+	return slices.Contains(d.Scopes, allEndpoints) || slices.Contains(d.Scopes, endpoint)
+}
+
+// storedDevice is a device as the devices file keeps it. Only the SHA-256
+// of its token is stored.
+type storedDevice struct {
+	device
+	TokenHash string `json:"token_hash"`
+	// saved is when LastSeen was last written to the file.
+	saved time.Time
+}
+
+type pairingCode struct {
+	code    string // eight digits
+	scopes  []string
+	expires time.Time
+}
+
+// String shows the code as 1234-5678.
+func (c pairingCode) String() string {
+	return c.code[:4] + "-" + c.code[4:]
+}
+
+// deviceStore holds the paired devices in devices.json under the data
+// directory, and the pairing codes waiting to be redeemed in memory.
+type deviceStore struct {
+	path string
+	now  func() time.Time
+
+	mu      sync.Mutex
+	devices []*storedDevice
+	codes   []pairingCode
+}
+
+// openDeviceStore reads the devices file in dir; a missing file means no
+// device is paired yet. Like .env, a file other users can access is
+// refused.
+func openDeviceStore(dir string) (*deviceStore, error) {
+	s := &deviceStore{path: filepath.Join(dir, devicesFile), now: time.Now}
+	raw, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if perm := fi.Mode().Perm(); perm&0o007 != 0 {
+		return nil, fmt.Errorf("%s is accessible by other users (mode %#o); run chmod 600 %s", s.path, perm, s.path)
+	}
+	var file struct {
+		Devices []*storedDevice `json:"devices"`
+	}
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	for _, d := range file.Devices {
+		d.saved = d.LastSeen
+	}
+	s.devices = file.Devices
+	return s, nil
+}
+
+// save writes the devices file. The caller holds s.mu.
+func (s *deviceStore) save() error {
+	raw, err := json.MarshalIndent(map[string]any{"devices": s.devices}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, append(raw, '\n'), 0o600)
+}
+
+// newCode creates a one-time pairing code granting scopes. It is shown only
+// on the server console, so pairing needs someone who can see it.
+func (s *deviceStore) newCode(scopes []string) (pairingCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	if len(s.codes) >= maxPairingCodes {
+		return pairingCode{}, errTooManyCodes
+	}
+	// Eight digits: easy to type, and the auth lockout leaves no room to
+	// guess one before it expires.
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return pairingCode{}, err
+	}
+	for i := range b {
+		b[i] = '0' + b[i]%10
+	}
+	c := pairingCode{code: string(b), scopes: scopes, expires: s.now().Add(pairingCodeTTL)}
+	s.codes = append(s.codes, c)
+	return c, nil
+}
+
+// redeem exchanges a pairing code for a new device and its token, which is
+// returned only this once.
+func (s *deviceStore) redeem(code, name string) (device, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	found := -1
+	for i, c := range s.codes {
+		if subtle.ConstantTimeCompare([]byte(c.code), []byte(code)) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return device{}, "", errPairingCode
+	}
+	scopes := s.codes[found].scopes
+	s.codes = slices.Delete(s.codes, found, found+1)
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return device{}, "", err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	now := s.now().UTC()
+	d := &storedDevice{
+		device:    device{ID: ulid.Make().String(), Name: name, Scopes: scopes, CreatedAt: now, LastSeen: now},
+		TokenHash: tokenHash(token),
+		saved:     now,
+	}
+	s.devices = append(s.devices, d)
+	if err := s.save(); err != nil {
+		s.devices = s.devices[:len(s.devices)-1]
+		return device{}, "", err
+	}
+	return d.device, token, nil
+}
+
+// expire drops pairing codes past their expiry. The caller holds s.mu.
+func (s *deviceStore) expire() {
+	now := s.now()
+	s.codes = slices.DeleteFunc(s.codes, func(c pairingCode) bool { return !now.Before(c.expires) })
+}
+
+// authenticate returns the device a token belongs to, or nil, and records
+// that the device was seen.
+func (s *deviceStore) authenticate(token string) *device {
+	if token == "" {
+		return nil
+	}
+	hash := tokenHash(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if subtle.ConstantTimeCompare([]byte(d.TokenHash), []byte(hash)) == 1 {
+			d.LastSeen = s.now().UTC()
+			if d.LastSeen.Sub(d.saved) >= lastSeenInterval {
+				d.saved = d.LastSeen
+				// Losing a last_seen update is harmless, so a failed write
+				// does not fail the request.
+				_ = s.save()
+			}
+			dev := d.device
+			return &dev
+		}
+	}
+	return nil
+}
+
+// list returns the paired devices in pairing order.
+func (s *deviceStore) list() []device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]device, 0, len(s.devices))
+	for _, d := range s.devices {
+		out = append(out, d.device)
+	}
+	return out
+}
+
+// revoke removes a device, reporting whether it existed. Its token stops
+// working immediately.
+func (s *deviceStore) revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.IndexFunc(s.devices, func(d *storedDevice) bool { return d.ID == id })
+	if i < 0 {
+		return false, nil
+	}
+	removed := s.devices[i]
+	s.devices = slices.Delete(s.devices, i, i+1)
+	if err := s.save(); err != nil {
+		s.devices = slices.Insert(s.devices, i, removed)
+		return false, err
+	}
+	return true, nil
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDeviceStore(t *testing.T, clock *testClock) *deviceStore {
+	t.Helper()
+	s, err := openDeviceStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("openDeviceStore failed: %v", err)
+	}
+	s.now = clock.now
+	return s
+}
+
+func TestPairingCodeExpires(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestDeviceStore(t, clock)
+	early, err := s.newCode([]string{allEndpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	late, err := s.newCode([]string{allEndpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(early.code) != 8 || strings.Trim(early.code, "0123456789") != "" || early.String() != early.code[:4]+"-"+early.code[4:] {
+		t.Fatalf("unexpected code %q shown as %s", early.code, early)
+	}
+	if want := clock.now().Add(pairingCodeTTL); !early.expires.Equal(want) {
+		t.Fatalf("code expires at %v, want %v", early.expires, want)
+	}
+
+	clock.advance(pairingCodeTTL - time.Second)
+	if _, _, err := s.redeem(early.code, "phone"); err != nil {
+		t.Fatalf("redeeming a code before it expires: %v", err)
+	}
+	clock.advance(time.Second)
+	if _, _, err := s.redeem(late.code, "phone"); !errors.Is(err, errPairingCode) {
+		t.Fatalf("redeeming an expired code: %v", err)
+	}
+}
+
+func TestPairingCodeSingleUse(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestDeviceStore(t, clock)
+	code, err := s.newCode([]string{"echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, _, err := s.redeem(code.code, "phone")
+	if err != nil {
+		t.Fatalf("redeem failed: %v", err)
+	}
+	if dev.Name != "phone" || len(dev.Scopes) != 1 || dev.Scopes[0] != "echo" || !dev.CreatedAt.Equal(clock.now()) {
+		t.Fatalf("unexpected device %+v", dev)
+	}
+	if _, _, err := s.redeem(code.code, "tablet"); !errors.Is(err, errPairingCode) {
+		t.Fatalf("redeeming a code twice: %v", err)
+	}
+	if n := len(s.list()); n != 1 {
+		t.Fatalf("%d devices paired, want 1", n)
+	}
+}
+
+func TestPairingCodeLimit(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestDeviceStore(t, clock)
+	for range maxPairingCodes {
+		if _, err := s.newCode([]string{allEndpoints}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.newCode([]string{allEndpoints}); !errors.Is(err, errTooManyCodes) {
+		t.Fatalf("code beyond the limit: %v", err)
+	}
+	clock.advance(pairingCodeTTL)
+	if _, err := s.newCode([]string{allEndpoints}); err != nil {
+		t.Fatalf("code after the others expired: %v", err)
+	}
+}
+
+func TestDeviceTokenStoredHashed(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestDeviceStore(t, clock)
+	code, err := s.newCode([]string{allEndpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev, token, err := s.redeem(code.code, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, tokenPrefix) {
+		t.Fatalf("token %q lacks the %s prefix", token, tokenPrefix)
+	}
+
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), token) || strings.Contains(string(raw), strings.TrimPrefix(token, tokenPrefix)) {
+		t.Fatalf("%s holds the token:\n%s", devicesFile, raw)
+	}
+	if !strings.Contains(string(raw), `"token_hash": "`+tokenHash(token)+`"`) {
+		t.Fatalf("%s lacks the token's hash:\n%s", devicesFile, raw)
+	}
+	if fi, err := os.Stat(s.path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("%s: %v, mode %v", devicesFile, err, fi.Mode().Perm())
+	}
+
+	// The token still works after a restart; its hash does not.
+	reopened, err := openDeviceStore(filepath.Dir(s.path))
+	if err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	if got := reopened.authenticate(token); got == nil || got.ID != dev.ID {
+		t.Fatalf("token after reopening: %+v", got)
+	}
+	for _, wrong := range []string{"", tokenHash(token), token + "x", tokenPrefix} {
+		if got := reopened.authenticate(wrong); got != nil {
+			t.Errorf("authenticate(%q) = %+v", wrong, got)
+		}
+	}
+}
+
+func TestDeviceLastSeen(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestDeviceStore(t, clock)
+	code, err := s.newCode([]string{allEndpoints})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := s.redeem(code.code, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func() time.Time {
+		t.Helper()
+		reopened, err := openDeviceStore(filepath.Dir(s.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reopened.list()[0].LastSeen
+	}
+
+	// last_seen is updated at once but written at most every minute.
+	paired := clock.now()
+	clock.advance(lastSeenInterval / 2)
+	if got := s.authenticate(token).LastSeen; !got.Equal(clock.now()) {
+		t.Fatalf("last seen %v, want %v", got, clock.now())
+	}
+	if got := stored(); !got.Equal(paired) {
+		t.Fatalf("stored last seen %v, want %v", got, paired)
+	}
+	clock.advance(lastSeenInterval / 2)
+	s.authenticate(token)
+	if got := stored(); !got.Equal(clock.now()) {
+		t.Fatalf("stored last seen %v, want %v", got, clock.now())
+	}
+}
+
+func TestRevokeDevice(t *testing.T) {
+	clock := &testClock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s := newTestDeviceStore(t, clock)
+	var tokens []string
+	var ids []string
+	for _, name := range []string{"phone", "laptop"} {
+		code, err := s.newCode([]string{allEndpoints})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dev, token, err := s.redeem(code.code, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens, ids = append(tokens, token), append(ids, dev.ID)
+	}
+
+	if ok, err := s.revoke(ids[0]); !ok || err != nil {
+		t.Fatalf("revoke = %v, %v", ok, err)
+	}
+	if ok, err := s.revoke(ids[0]); ok || err != nil {
+		t.Fatalf("revoking twice = %v, %v", ok, err)
+	}
+	if s.authenticate(tokens[0]) != nil {
+		t.Fatal("revoked token still works")
+	}
+	if s.authenticate(tokens[1]) == nil {
+		t.Fatal("revoking one device revoked another")
+	}
+
+	reopened, err := openDeviceStore(filepath.Dir(s.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.authenticate(tokens[0]) != nil || len(reopened.list()) != 1 {
+		t.Fatal("revocation was not saved")
+	}
+}
+
+func TestOpenDeviceStoreRefusesExposedFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, devicesFile), []byte(`{"devices": []}`), 0o604); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDeviceStore(dir); err == nil || !strings.Contains(err.Error(), "accessible by other users") {
+		t.Fatalf("openDeviceStore with a readable file: %v", err)
+	}
+}
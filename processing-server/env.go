@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// environment holds the variables read from the .env file. Variables set in
+// the process environment take precedence.
+type environment map[string]string
+
+func (env environment) lookup(name string) (string, bool) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, true
+	}
+	v, ok := env[name]
+	return v, ok
+}
+
+// loadDotEnv reads KEY=VALUE lines from path. A missing file is an empty
+// environment; a file other users can access is refused, since it holds
+// MASTER_PASSWORD.
+func loadDotEnv(path string) (environment, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return environment{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if perm := fi.Mode().Perm(); perm&0o007 != 0 {
+		return nil, fmt.Errorf("%s is accessible by other users (mode %#o); run chmod 600 %s", path, perm, path)
+	}
+
+	env := environment{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", path, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			if value[0] == '"' {
+				if value, err = strconv.Unquote(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: %s: bad quoting", path, n, name)
+				}
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		}
+		env[name] = value
+	}
+	return env, sc.Err()
+}
+
+// deviceTokenPattern matches a device token wherever it appears.
+var deviceTokenPattern = regexp.MustCompile(tokenPrefix + `[A-Za-z0-9_-]+`)
+
+// redactor replaces secrets and device tokens in everything written through
+// it. The server's log output goes through one, so a secret that ends up in
+// an error message never reaches a log line.
+type redactor struct {
+	w       io.Writer
+	secrets [][]byte
+}
+
+func newRedactor(w io.Writer, secrets ...string) *redactor {
+	r := &redactor{w: w}
+	for _, s := range secrets {
+		if s == "" {
+			continue
+		}
+		r.secrets = append(r.secrets, []byte(s))
+		// The log is JSON, where quotes, backslashes and control characters
+		// in a secret are escaped.
+		var quoted bytes.Buffer
+		enc := json.NewEncoder(&quoted)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(s)
+		if escaped := bytes.TrimSuffix(quoted.Bytes(), []byte("\n")); len(escaped) > 2 && string(escaped[1:len(escaped)-1]) != s {
+			r.secrets = append(r.secrets, escaped[1:len(escaped)-1])
+		}
+	}
+	return r
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	out := p
+	for _, s := range r.secrets {
+		out = bytes.ReplaceAll(out, s, []byte("[REDACTED]"))
+	}
+	out = deviceTokenPattern.ReplaceAll(out, []byte("[REDACTED]"))
+	if _, err := r.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedactorWrite(t *testing.T) {
+	secrets := []string{
+		"plain-secret-value",
+		`with "quotes" and \backslash`,
+		"tab\tand\nnewline",
+		"<html> & </html>",
+		"ünïcode separator",
+	}
+	token := tokenPrefix + "Zm9vYmFyYmF6cXV4LXRva2VuX3ZhbHVl"
+	for _, secret := range secrets {
+		var buf bytes.Buffer
+		logger := newLogger(newRedactor(&buf, secret))
+		logger.Info("failed with "+secret, "err", errors.New("bad credential "+secret), "detail", secret, "device", token)
+		logger.Error("token " + token + " rejected")
+		out := buf.String()
+		if strings.Contains(out, secret) || strings.Contains(out, token) || strings.Contains(out, "Zm9vYmFy") {
+			t.Errorf("secret %q leaked:\n%s", secret, out)
+		}
+		if n := strings.Count(out, "[REDACTED]"); n != 5 {
+			t.Errorf("secret %q: %d redactions, want 5:\n%s", secret, n, out)
+		}
+		if !strings.Contains(out, `"msg":"failed with [REDACTED]"`) || !strings.Contains(out, `"err":"bad credential [REDACTED]"`) {
+			t.Errorf("secret %q: the rest of the line was not kept:\n%s", secret, out)
+		}
+	}
+}
+
+func TestRedactorKeepsOtherOutput(t *testing.T) {
+	var buf bytes.Buffer
+	r := newRedactor(&buf, "", "hunter2")
+	line := []byte("no secrets lwd here, but lwd_ and hunter2\n")
+	if n, err := r.Write(line); n != len(line) || err != nil {
+		t.Fatalf("Write = %d, %v; want %d, nil", n, err, len(line))
+	}
+	// An empty secret is ignored rather than matching everywhere, and the
+	// token prefix alone is not a token.
+	if want := "no secrets lwd here, but lwd_ and [REDACTED]\n"; buf.String() != want {
+		t.Fatalf("wrote %q, want %q", buf.String(), want)
+	}
+}
+
+func TestLoadDotEnv(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, ".env")
+	body := `# comment
+MASTER_PASSWORD="correct \"horse\" battery"
+export HOST = 0.0.0.0
+
+SINGLE='$not expanded'
+EMPTY=
+`
+	if err := os.WriteFile(file, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env, err := loadDotEnv(file)
+	if err != nil {
+		t.Fatalf("loadDotEnv failed: %v", err)
+	}
+	want := map[string]string{
+		"MASTER_PASSWORD": `correct "horse" battery`,
+		"HOST":            "0.0.0.0",
+		"SINGLE":          "$not expanded",
+		"EMPTY":           "",
+	}
+	if len(env) != len(want) {
+		t.Fatalf("got %v, want %v", env, want)
+	}
+	for k, v := range want {
+		if env[k] != v {
+			t.Errorf("%s = %q, want %q", k, env[k], v)
+		}
+	}
+
+	t.Setenv("HOST", "127.0.0.1")
+	if v, _ := env.lookup("HOST"); v != "127.0.0.1" {
+		t.Errorf("lookup(HOST) = %q; the process environment takes precedence", v)
+	}
+
+	if env, err := loadDotEnv(filepath.Join(dir, "missing")); err != nil || len(env) != 0 {
+		t.Errorf("missing file: %v, %v", env, err)
+	}
+}
+
+func TestLoadDotEnvErrors(t *testing.T) {
+	cases := []struct {
+		name, body string
+		perm       os.FileMode
+		want       string
+	}{
+		{"no equals", "A=1\nJUST_A_NAME\n", 0o600, ":2: expected NAME=value"},
+		{"space in name", "MY NAME=1\n", 0o600, ":1: expected NAME=value"},
+		{"bad quoting", `A="\q"` + "\n", 0o600, ":1: A: bad quoting"},
+		{"readable by others", "A=1\n", 0o604, "is accessible by other users"},
+	}
+	for _, tc := range cases {
+		file := filepath.Join(t.TempDir(), ".env")
+		if err := os.WriteFile(file, []byte(tc.body), tc.perm); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadDotEnv(file); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// eventKeepalive is how often an idle event stream is pinged, so proxies
+// and mobile networks do not drop it.
+const eventKeepalive = 15 * time.Second
+
+// eventSink is where a run's events go: a Server-Sent Events response or a
+// WebSocket.
+type eventSink interface {
+	send(name string, data any) error
+	ping() error
+	// gone is closed when the client disconnects.
+	gone() <-chan struct{}
+}
+
+// runEvents streams a run's events: "state" with the run as it is now and
+// again when it starts, "progress" for each progress line, and finally
+// "result" with the finished run, after which the stream ends. A run that
+// has already finished gets only "result". A WebSocket upgrade request gets
+// the same events as {"event", "data"} messages; otherwise they are sent as
+// Server-Sent Events.
+func (s *server) runEvents(w http.ResponseWriter, r *http.Request) {
+	current, ar, events, err := s.queue.watch(s.runID(r))
+	if err != nil {
+		s.runError(w, r, err)
+		return
+	}
+	if ar != nil {
+		defer s.queue.unwatch(ar, events)
+	}
+
+	var sink eventSink
+	if isWebSocket(r) {
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.close()
+		sink = ws
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		sink = &sseSink{w: w, rc: http.NewResponseController(w), done: r.Context().Done()}
+	}
+
+	if ar == nil {
+		_ = sink.send("result", current)
+		return
+	}
+	if sink.send("state", current) != nil {
+		return
+	}
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	stopping := s.queue.stopping
+	for {
+		select {
+		case ev := <-events:
+			if sink.send(ev.name, ev.data) != nil {
+				return
+			}
+		case <-ar.done:
+			// Deliver what arrived before the run finished, then the result.
+			// Nothing is added to events once done is closed.
+			for len(events) > 0 {
+				ev := <-events
+				if sink.send(ev.name, ev.data) != nil {
+					return
+				}
+			}
+			_ = sink.send("result", ar.view())
+			return
+		case <-sink.gone():
+			return
+		case <-stopping:
+			// A queued run waits for the next start; end the stream so the
+			// server can stop. A running one is waited for.
+			if s.queue.queued(ar) {
+				return
+			}
+			stopping = nil
+		case <-keepalive.C:
+			if sink.ping() != nil {
+				return
+			}
+		}
+	}
+}
+
+// sseSink writes Server-Sent Events.
+type sseSink struct {
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	done <-chan struct{}
+}
+
+func (s *sseSink) send(name string, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, raw); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+func (s *sseSink) ping() error {
+	if _, err := io.WriteString(s.w, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	return s.rc.Flush()
+}
+
+func (s *sseSink) gone() <-chan struct{} {
+	return s.done
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// progressScript waits for the file gate, so a test can subscribe first,
+// then reports progress twice and answers.
+func progressScript(gate string) string {
+	return "#!/bin/sh\ncat >/dev/null\n" +
+		"while [ ! -e '" + gate + "' ]; do sleep 0.01; done\n" +
+		`echo '{"progress": 0.5, "message": "half"}' >&2` + "\n" +
+		`echo '{"progress": 1}' >&2` + "\necho '{}'\n"
+}
+
+// startTestServer serves s over HTTP until the test ends.
+func startTestServer(t *testing.T, s *server) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+// openEvents requests the event stream of run id over SSE.
+func openEvents(t *testing.T, srv *httptest.Server, id string) *bufio.Reader {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/runs/"+id+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testPassword)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET events failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("GET events: %d %v", resp.StatusCode, resp.Header)
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+// readEvent reads the next event, skipping comments; it fails the test on
+// anything that is not an "event" line, a "data" line and a blank line.
+func readEvent(t *testing.T, br *bufio.Reader) (sseEvent, error) {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if len(lines) > 0 || line != "" {
+				t.Fatalf("stream ended inside an event: %q %q", lines, line)
+			}
+			return sseEvent{}, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, ":") && len(lines) == 0:
+			if _, err := br.ReadString('\n'); err != nil {
+				return sseEvent{}, err
+			}
+			continue
+		case line != "":
+			lines = append(lines, line)
+			continue
+		}
+		name, ok1 := strings.CutPrefix(lines[0], "event: ")
+		data, ok2 := strings.CutPrefix(lines[len(lines)-1], "data: ")
+		if len(lines) != 2 || !ok1 || !ok2 || !json.Valid([]byte(data)) {
+			t.Fatalf("malformed event %q", lines)
+		}
+		return sseEvent{name, data}, nil
+	}
+}
+
+// expectEvent reads the next event and checks its name and the state or
+// progress in its data.
+func expectEvent(t *testing.T, br *bufio.Reader, name, want string) {
+	t.Helper()
+	ev, err := readEvent(t, br)
+	if err != nil {
+		t.Fatalf("reading %s event: %v", name, err)
+	}
+	var data map[string]any
+	if err := json.Unmarshal([]byte(ev.data), &data); err != nil {
+		t.Fatal(err)
+	}
+	got := data["state"]
+	if name == "progress" {
+		got = data["progress"]
+	}
+	if ev.name != name || fmt.Sprint(got) != want {
+		t.Fatalf("got event %s %s, want %s with %s", ev.name, ev.data, name, want)
+	}
+}
+
+func expectEnd(t *testing.T, br *bufio.Reader) {
+	t.Helper()
+	if ev, err := readEvent(t, br); err != io.EOF {
+		t.Fatalf("stream did not end: %+v, %v", ev, err)
+	}
+}
+
+func TestEventsSSE(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", progressScript(gate))
+	s := newTestServer(t, &testClock{t: time.Now()}, ep)
+	srv := startTestServer(t, s)
+	defer openGate(t, gate)
+
+	r := submit(t, s.queue, ep)
+	events := openEvents(t, srv, r.ID)
+	expectEvent(t, events, "state", "running")
+	openGate(t, gate)
+	// Progress comes before the result, however close together they
+	// arrive.
+	expectEvent(t, events, "progress", "0.5")
+	expectEvent(t, events, "progress", "1")
+	expectEvent(t, events, "result", "succeeded")
+	expectEnd(t, events)
+
+	// A finished run gets only its result.
+	events = openEvents(t, srv, r.ID)
+	expectEvent(t, events, "result", "succeeded")
+	expectEnd(t, events)
+}
+
+func TestEventsQueuedRun(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", gatedScript(gate))
+	s := newTestServer(t, &testClock{t: time.Now()}, ep)
+	srv := startTestServer(t, s)
+	defer openGate(t, gate)
+
+	first, second := submit(t, s.queue, ep), submit(t, s.queue, ep)
+	events := openEvents(t, srv, second.ID)
+	expectEvent(t, events, "state", "queued")
+	openGate(t, gate)
+	expectEvent(t, events, "state", "running")
+	expectEvent(t, events, "result", "succeeded")
+	expectEnd(t, events)
+	if r := awaitRun(t, s.queue, first.ID); r.State != runSucceeded {
+		t.Fatalf("first run %s", r.State)
+	}
+}
+
+func TestEventsDuringShutdown(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", gatedScript(gate))
+	s := newTestServer(t, &testClock{t: time.Now()}, ep)
+	srv := startTestServer(t, s)
+	defer openGate(t, gate)
+
+	running, queued := submit(t, s.queue, ep), submit(t, s.queue, ep)
+	runningEvents, queuedEvents := openEvents(t, srv, running.ID), openEvents(t, srv, queued.ID)
+	expectEvent(t, runningEvents, "state", "running")
+	expectEvent(t, queuedEvents, "state", "queued")
+
+	// A queued run's stream ends so the server can stop; a running one's
+	// carries on until the script finishes.
+	s.queue.close()
+	expectEnd(t, queuedEvents)
+	openGate(t, gate)
+	expectEvent(t, runningEvents, "result", "succeeded")
+	expectEnd(t, runningEvents)
+}
+
+func TestEventsUnknownRun(t *testing.T) {
+	s := newTestServer(t, &testClock{t: time.Now()})
+	w := serve(s, "192.0.2.1:1", "GET", "/runs/01ARZ3NDEKTSV4RRFFQ69G5FAV/events", testPassword, "")
+	if w.Code != http.StatusNotFound || errorCode(t, w) != "E_NOT_FOUND" {
+		t.Fatalf("events of an unknown run: %d %s", w.Code, w.Body)
+	}
+}
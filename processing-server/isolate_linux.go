@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// canIsolate reports whether scripts can run in their own namespaces here.
+const canIsolate = true
+
+// Securebits from linux/securebits.h: uid 0 gains no capabilities at exec,
+// and that cannot be undone.
+const (
+	secbitNoRoot       = 1 << 0
+	secbitNoRootLocked = 1 << 1
+)
+
+// isolate starts cmd in new user and mount namespaces, and a new network
+// namespace unless sb allows the network. The script keeps the server's
+// user and group IDs. The helper gets the capabilities it needs to set up
+// the namespaces; it drops them before it runs the script.
+func isolate(cmd *exec.Cmd, sb SandboxConfig) {
+	attr := cmd.SysProcAttr
+	attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	attr.AmbientCaps = []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_SETPCAP}
+	if !sb.Network {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+		attr.AmbientCaps = append(attr.AmbientCaps, unix.CAP_NET_ADMIN)
+	}
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+}
+
+// enterIsolation runs in the sandbox helper, inside the new namespaces. It
+// covers up spec.Hidden, makes every mount read-only except spec.Writable
+// and a private /dev/shm, brings up loopback if the network namespace is
+// new, and drops the helper's capabilities.
+func enterIsolation(spec sandboxSpec) error {
+	// Nothing done to this namespace's mounts may reach the host's.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	views, err := isolationViews(spec)
+	if err != nil {
+		return err
+	}
+	for _, v := range views {
+		err := v.apply()
+		if v.fd >= 0 {
+			unix.Close(v.fd)
+		}
+		if err != nil {
+			return fmt.Errorf("mounting %s: %w", v.path, err)
+		}
+	}
+	// The Writable directories are mounts of their own now, which stay
+	// writable when the rest is made read-only.
+	keep := make(map[string]bool)
+	for _, v := range views {
+		if v.writable {
+			keep[v.path] = true
+		}
+	}
+	// Many runtimes keep shared memory there; the host's stays out of reach.
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		if err := unix.Mount("tmpfs", "/dev/shm", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mounting /dev/shm: %w", err)
+		}
+		keep["/dev/shm"] = true
+	}
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if !keep[m] {
+			if err := remountReadOnly(m); err != nil {
+				return fmt.Errorf("making %s read-only: %w", m, err)
+			}
+		}
+	}
+	// The working directory was entered before the mounts covered it.
+	if err := os.Chdir(wd); err != nil {
+		return err
+	}
+	if !spec.Sandbox.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up loopback: %w", err)
+		}
+	}
+	// The script runs without capabilities, whatever its user ID, and
+	// nothing it runs can gain any.
+	if err := unix.Prctl(unix.PR_SET_SECUREBITS, secbitNoRoot|secbitNoRootLocked, 0, 0, 0); err != nil {
+		return fmt.Errorf("setting securebits: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("clearing ambient capabilities: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs: %w", err)
+	}
+	return nil
+}
+
+// view is a mount that shapes what an isolated script sees: a hidden path
+// covered by an empty one, or a directory mounted back from a descriptor
+// opened before anything was covered.
+type view struct {
+	path     string
+	fd       int // -1 for a hidden path
+	writable bool
+}
+
+// isolationViews resolves spec's hidden and visible paths into the mounts
+// to make, in order. A deeper path is mounted later, on top: a directory
+// shown inside a hidden one appears again, and a path hidden inside a shown
+// one stays hidden. The script's directory is shown, so it can find what it
+// keeps next to itself.
+func isolationViews(spec sandboxSpec) ([]view, error) {
+	var views []view
+	for _, p := range spec.Hidden {
+		real, err := filepath.EvalSymlinks(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Covering / would take the script's interpreter with it.
+		if real != "/" {
+			views = append(views, view{path: real, fd: -1})
+		}
+	}
+	shown := append([]string{filepath.Dir(spec.Script)}, spec.Writable...)
+	for i, dir := range shown {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			var fd int
+			fd, err = unix.Open(real, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+			views = append(views, view{path: real, fd: fd, writable: i > 0})
+		}
+		if err != nil {
+			for _, v := range views {
+				if v.fd >= 0 {
+					unix.Close(v.fd)
+				}
+			}
+			return nil, err
+		}
+	}
+	slices.SortStableFunc(views, func(a, b view) int {
+		if c := cmp.Compare(strings.Count(a.path, "/"), strings.Count(b.path, "/")); c != 0 {
+			return c
+		}
+		// A path both hidden and shown is covered, then shown again.
+		return cmp.Compare(a.fd, b.fd)
+	})
+	return views, nil
+}
+
+// apply makes v's mount. A hidden directory becomes an empty tmpfs and a
+// hidden file an empty /dev/null; a path inside something already hidden
+// is gone, and skipped. A shown directory is bind mounted from its
+// descriptor, onto a fresh empty directory if a parent was hidden.
+func (v view) apply() error {
+	if v.fd < 0 {
+		fi, err := os.Stat(v.path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return unix.Mount("tmpfs", v.path, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=0700")
+		}
+		return unix.Mount("/dev/null", v.path, "", unix.MS_BIND, "")
+	}
+	if err := os.MkdirAll(v.path, 0o700); err != nil {
+		return err
+	}
+	return unix.Mount("/proc/self/fd/"+strconv.Itoa(v.fd), v.path, "", unix.MS_BIND, "")
+}
+
+// mountPoints lists the mount points in /proc/self/mountinfo, parents
+// before their children.
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var points []string
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		p := unescapeMountPath(fields[4])
+		if !seen[p] {
+			seen[p] = true
+			points = append(points, p)
+		}
+	}
+	return points, sc.Err()
+}
+
+// unescapeMountPath undoes the octal escapes, such as \040 for a space,
+// that mountinfo uses in paths.
+func unescapeMountPath(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// remountReadOnly makes the mount at path read-only. The flags the mount
+// already has are repeated, since a user namespace may not clear them. A
+// mount the helper cannot reach is skipped: the script cannot reach it
+// either.
+func remountReadOnly(path string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		if errors.Is(err, unix.EACCES) || errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+			return nil
+		}
+		return err
+	}
+	flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_RDONLY)
+	for _, f := range []struct{ st, ms uintptr }{
+		{unix.ST_NOSUID, unix.MS_NOSUID},
+		{unix.ST_NODEV, unix.MS_NODEV},
+		{unix.ST_NOEXEC, unix.MS_NOEXEC},
+		{unix.ST_NOATIME, unix.MS_NOATIME},
+		{unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+		{unix.ST_RELATIME, unix.MS_RELATIME},
+	} {
+		if uintptr(st.Flags)&f.st != 0 {
+			flags |= f.ms
+		}
+	}
+	if flags&(unix.MS_NOATIME|unix.MS_RELATIME) == 0 {
+		flags |= unix.MS_STRICTATIME
+	}
+	return unix.Mount("", path, "", flags, "")
+}
+
+// loopbackUp brings up lo, the only interface of a new network namespace,
+// so the script can still talk to itself over localhost.
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
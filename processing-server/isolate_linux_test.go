@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// isolationScript tries each check in a shell of its own and reports which
+// succeeded, as "name: yes" or "name: no".
+func isolationScript(checks [][2]string) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\ncat >/dev/null\ncheck() { if sh -c \"$2\" >/dev/null 2>&1; then echo \"\\\"$1: yes\\\"\"; else echo \"\\\"$1: no\\\"\"; fi; }\n")
+	b.WriteString("printf '{\"results\": [%s]}\\n' \"$({\n")
+	for _, c := range checks {
+		fmt.Fprintf(&b, "check '%s' '%s'\n", c[0], c[1])
+	}
+	b.WriteString("} | paste -sd, -)\"\n")
+	return b.String()
+}
+
+func TestIsolation(t *testing.T) {
+	// The layout of a typical install: scripts, the .env file, the TLS keys
+	// and the data directory side by side in one directory.
+	config := t.TempDir()
+	write := func(name, body string, perm os.FileMode) string {
+		t.Helper()
+		file := filepath.Join(config, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(body), perm); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	write(".env", "MASTER_PASSWORD=hunter2\n", 0o600)
+	write("server.config.json", "{}\n", 0o600)
+	write("tls/key.pem", "private key\n", 0o600)
+	write("data/devices.json", "[]\n", 0o600)
+	write("data/runs/2026-01-01/iso/other/files/secret", "another run\n", 0o600)
+	write("scripts/lib.sh", "helper\n", 0o644)
+
+	checks := [][2]string{
+		{"writes its directory", "echo x > out"},
+		{"writes TMPDIR", `echo x > "$TMPDIR/x"`},
+		{"reads next to itself", "grep -q helper " + config + "/scripts/lib.sh"},
+		{"writes next to itself", "touch " + config + "/scripts/new"},
+		{"writes /tmp", "touch /tmp/isolation-$$"},
+		{"reads .env", "grep -q hunter2 " + config + "/.env"},
+		{"sees the config", "test -e " + config + "/server.config.json"},
+		{"sees the TLS keys", "test -e " + config + "/tls/key.pem"},
+		{"sees the devices", "test -e " + config + "/data/devices.json"},
+		{"sees other runs", "test -e " + config + "/data/runs/2026-01-01/iso/other/files/secret"},
+	}
+	script := write("scripts/iso.sh", isolationScript(checks), 0o755)
+	ep := Endpoint{Name: "iso", ScriptPath: script, TimeoutMS: 10000, Enabled: true, MaxConcurrent: 1,
+		Sandbox: SandboxConfig{Isolate: true}}
+	cfg := &Config{DataDir: filepath.Join(config, "data"), Listen: ListenConfig{CertDir: filepath.Join(config, "tls")}}
+	hidden := secretPaths(cfg, filepath.Join(config, ".env"))
+	if err := probeSandbox(ep, hidden); err != nil {
+		t.Skipf("isolation does not work here: %v", err)
+	}
+
+	out, err := runSandboxed(t, ep, filepath.Join(config, "data", "runs", "2026-01-01", "iso", "run-1"), hidden...)
+	if err != nil {
+		t.Fatalf("isolated run failed: %v", err)
+	}
+	var want []string
+	for i, c := range checks {
+		if i < 3 {
+			want = append(want, c[0]+": yes")
+		} else {
+			want = append(want, c[0]+": no")
+		}
+	}
+	if got := resultStrings(t, out); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("isolated script:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The hidden paths are only covered inside the script's namespace.
+	if raw, err := os.ReadFile(filepath.Join(config, ".env")); err != nil || !strings.Contains(string(raw), "hunter2") {
+		t.Fatalf(".env after the run: %q, %v", raw, err)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// canIsolate reports whether scripts can run in their own namespaces here;
+// namespaces are Linux only.
+const canIsolate = false
+
+// isolate is never called here: the config rejects sandbox.isolate.
+func isolate(cmd *exec.Cmd, sb SandboxConfig) {}
+
+func enterIsolation(spec sandboxSpec) error {
+	return errors.New("isolation needs Linux")
+}
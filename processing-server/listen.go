@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHost       = "127.0.0.1"
+	defaultPort       = 8080
+	defaultSocketMode = 0o600
+)
+
+// listen opens the listener lc describes, with HOST and PORT from env taking
+// precedence over the config. A TCP address that is not loopback is refused
+// unless lc.AllowLAN is set.
+func listen(lc ListenConfig, env environment) (net.Listener, error) {
+	if lc.UnixSocket != "" {
+		return listenUnix(lc.UnixSocket, lc.SocketMode)
+	}
+	host, port := lc.Host, lc.Port
+	if host == "" {
+		host = defaultHost
+	}
+	if port == 0 {
+		port = defaultPort
+	}
+	if v, ok := env.lookup("HOST"); ok && v != "" {
+		host = v
+	}
+	if v, ok := env.lookup("PORT"); ok && v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("PORT must be between 1 and 65535, not %q", v)
+		}
+		port = p
+	}
+
+	// Resolve first and bind exactly the address checked, so hostnames and
+	// wildcards such as 0.0.0.0 are judged by where they lead and a refused
+	// address is never open, not even briefly.
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsLoopback() && !lc.AllowLAN {
+		return nil, fmt.Errorf("refusing to listen on %s: not a loopback address; set listen.allow_lan in the config to serve the LAN", addr)
+	}
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// listenUnix listens on a Unix domain socket at path with the given octal
+// file mode. A stale socket left by a previous run is replaced; one that
+// still accepts connections is not.
+func listenUnix(path, mode string) (net.Listener, error) {
+	perm := os.FileMode(defaultSocketMode)
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("socket_mode: %w", err)
+		}
+		perm = os.FileMode(m)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// freePort returns a TCP port on the loopback address that nothing listens
+// on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// clearListenEnv unsets the process's HOST and PORT for the test.
+func clearListenEnv(t *testing.T) {
+	for _, name := range []string{"HOST", "PORT"} {
+		t.Setenv(name, "") // restores the variable afterwards
+		os.Unsetenv(name)
+	}
+}
+
+func TestListenLoopbackByDefault(t *testing.T) {
+	clearListenEnv(t)
+	port := freePort(t)
+	ln, err := listen(ListenConfig{Port: port}, environment{})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer ln.Close()
+	if got, want := ln.Addr().String(), "127.0.0.1:"+strconv.Itoa(port); got != want {
+		t.Fatalf("listening on %s, want %s", got, want)
+	}
+}
+
+func TestListenRefusesLANWithoutAllowLAN(t *testing.T) {
+	clearListenEnv(t)
+	port := freePort(t)
+	for _, host := range []string{"0.0.0.0", "::"} {
+		ln, err := listen(ListenConfig{Host: host, Port: port}, environment{})
+		if err == nil {
+			ln.Close()
+			t.Fatalf("listen on %q succeeded without allow_lan", host)
+		}
+		if !strings.Contains(err.Error(), "allow_lan") {
+			t.Fatalf("listen on %q: %v, want a hint at allow_lan", host, err)
+		}
+	}
+	// The refused address was never bound.
+	ln, err := net.Listen("tcp", net.JoinHostPort("0.0.0.0", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("port still bound after the refusal: %v", err)
+	}
+	ln.Close()
+
+	// A name is judged by the address it resolves to.
+	ln, err = listen(ListenConfig{Host: "localhost", Port: port}, environment{})
+	if err != nil {
+		t.Fatalf("listen on localhost failed: %v", err)
+	}
+	ln.Close()
+
+	ln, err = listen(ListenConfig{Host: "0.0.0.0", Port: port, AllowLAN: true}, environment{})
+	if err != nil {
+		t.Fatalf("listen with allow_lan failed: %v", err)
+	}
+	defer ln.Close()
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsUnspecified() {
+		t.Fatalf("listening on %s, want all addresses", ip)
+	}
+}
+
+func TestListenEnvOverridesConfig(t *testing.T) {
+	clearListenEnv(t)
+	configured, overridden := freePort(t), freePort(t)
+	lc := ListenConfig{Host: "0.0.0.0", Port: configured}
+
+	ln, err := listen(lc, environment{"HOST": "127.0.0.1", "PORT": strconv.Itoa(overridden)})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	if got, want := ln.Addr().String(), "127.0.0.1:"+strconv.Itoa(overridden); got != want {
+		t.Fatalf("listening on %s, want %s", got, want)
+	}
+	ln.Close()
+
+	// The process environment takes precedence over .env.
+	t.Setenv("HOST", "0.0.0.0")
+	if ln, err := listen(ListenConfig{Port: configured}, environment{"HOST": "127.0.0.1"}); err == nil {
+		ln.Close()
+		t.Fatal("HOST from the process environment was ignored")
+	}
+
+	clearListenEnv(t)
+	for _, port := range []string{"http", "0", "65536"} {
+		if ln, err := listen(ListenConfig{}, environment{"PORT": port}); err == nil {
+			ln.Close()
+			t.Fatalf("PORT=%s accepted", port)
+		}
+	}
+}
+
+func TestListenUnixSocketMode(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		mode string
+		want os.FileMode
+	}{
+		{"", 0o600},
+		{"0660", 0o660},
+		{"640", 0o640},
+	} {
+		path := filepath.Join(dir, "s"+tc.mode+".sock")
+		ln, err := listen(ListenConfig{UnixSocket: path, SocketMode: tc.mode}, environment{})
+		if err != nil {
+			t.Fatalf("listen on %s failed: %v", path, err)
+		}
+		fi, err := os.Stat(path)
+		ln.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != tc.want {
+			t.Errorf("socket_mode %q: socket has mode %v, want %v", tc.mode, fi.Mode(), tc.want)
+		}
+	}
+}
+
+func TestListenUnixStaleAndInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+
+	// A socket left behind by a server that died is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := listen(ListenConfig{UnixSocket: path}, environment{})
+	if err != nil {
+		t.Fatalf("listen over a stale socket failed: %v", err)
+	}
+	defer ln.Close()
+
+	// One that still accepts connections is left alone.
+	if second, err := listen(ListenConfig{UnixSocket: path}, environment{}); err == nil || !strings.Contains(err.Error(), "in use") {
+		if second != nil {
+			second.Close()
+		}
+		t.Fatalf("listen over a socket in use: %v", err)
+	}
+	if conn, err := net.Dial("unix", path); err != nil {
+		t.Fatalf("the first server's socket was removed: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// Nor is anything that is not a socket.
+	file := filepath.Join(t.TempDir(), "server.sock")
+	if err := os.WriteFile(file, []byte("keep"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(ListenConfig{UnixSocket: file}, environment{}); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Fatalf("listen over a regular file: %v", err)
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "keep" {
+		t.Fatalf("regular file changed: %q, %v", data, err)
+	}
+}
+
+func TestShutdownWaitsForRunningScripts(t *testing.T) {
+	clearListenEnv(t)
+	s := newTestServer(t, &testClock{t: time.Now()}, testEndpoint(t, "slow", "#!/bin/sh\nsleep 1\necho '{\"results\": [\"done\"]}'\n"))
+	ln, err := listen(ListenConfig{Port: freePort(t)}, environment{})
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	srv := &http.Server{Handler: s}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	type result struct {
+		code int
+		out  scriptOutput
+		err  error
+	}
+	got := make(chan result, 1)
+	go func() {
+		r, _ := http.NewRequest(http.MethodPost, "http://"+ln.Addr().String()+"/slow", nil)
+		r.Header.Set("Authorization", "Bearer "+testPassword)
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			got <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		var res result
+		res.code = resp.StatusCode
+		res.err = json.NewDecoder(resp.Body).Decode(&res.out)
+		got <- res
+	}()
+	for deadline := time.Now().Add(5 * time.Second); s.queue.running() == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the script never started")
+		}
+	}
+
+	// As main does: stop starting runs, then wait for the running ones.
+	s.queue.close()
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	s.queue.wait()
+	if n := s.queue.running(); n != 0 {
+		t.Fatalf("Shutdown returned with %d scripts running", n)
+	}
+	res := <-got
+	if res.err != nil || res.code != http.StatusOK || len(res.out.Results) != 1 || string(res.out.Results[0]) != `"done"` {
+		t.Fatalf("request during shutdown: %d %+v %v", res.code, res.out, res.err)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatalf("Serve returned %v", err)
+	}
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("still accepting connections after Shutdown")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// maxLogSize is the size at which the log file is rotated.
+	maxLogSize = 10 << 20
+	// logFiles is how many log files are kept: the current one and
+	// logFiles-1 rotated ones named server.log.1 (newest) and up.
+	logFiles = 5
+)
+
+// redactedKeys are log attributes whose values are never written, whatever
+// they hold. Request and response bodies are not logged at all; these catch
+// a credential or payload passed to the logger by mistake.
+var redactedKeys = map[string]bool{
+	"password":      true,
+	"authorization": true,
+	"token":         true,
+	"code":          true,
+	"body":          true,
+	"params":        true,
+	"request":       true,
+}
+
+// newLogger returns a JSON logger writing to w. The caller wraps w in a
+// redactor, which catches secrets inside messages and error strings.
+func newLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if redactedKeys[a.Key] {
+				a.Value = slog.StringValue("[REDACTED]")
+			}
+			return a
+		},
+	}))
+}
+
+// rotatingFile is a log file that is rotated once it would grow past
+// maxLogSize, keeping logFiles files in all.
+type rotatingFile struct {
+	path string
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	rf := &rotatingFile{path: path}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, fi.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.size > 0 && rf.size+int64(len(p)) > maxLogSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// rotate shifts server.log to server.log.1, server.log.1 to server.log.2
+// and so on, dropping the oldest, and starts a new file. The caller holds
+// rf.mu.
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	for i := logFiles - 1; i > 0; i-- {
+		older := fmt.Sprintf("%s.%d", rf.path, i)
+		newer := rf.path
+		if i > 1 {
+			newer = fmt.Sprintf("%s.%d", rf.path, i-1)
+		}
+		if err := os.Rename(newer, older); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return rf.open()
+}
+
+// requestInfo is what a request's log line records beyond the request
+// itself. Handlers fill in the device that made it and the run it started.
+type requestInfo struct {
+	id       string
+	deviceID string
+	runID    string
+}
+
+type requestInfoKey struct{}
+
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{id: ulid.Make().String()}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)), info
+}
+
+// requestID returns r's request ID, or "" outside a request.
+func requestID(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// setRequestDevice records that r was made by device id.
+func setRequestDevice(r *http.Request, id string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.deviceID = id
+	}
+}
+
+// setRequestRun records that r started run id.
+func setRequestRun(r *http.Request, id string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.runID = id
+	}
+}
+
+// requestLogger returns the logger for messages about r.
+func requestLogger(r *http.Request) *slog.Logger {
+	return slog.With("request_id", requestID(r))
+}
+
+// logRequests gives every request an ID, returned in X-Request-Id, and logs
+// one line for it when it is done. Only the method and path are logged: the
+// query, headers and body may hold credentials or personal data.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+		w.Header().Set("X-Request-Id", info.id)
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		status := sw.status
+		switch {
+		case status == 0 && isWebSocket(r):
+			status = http.StatusSwitchingProtocols
+		case status == 0:
+			status = http.StatusOK
+		}
+		attrs := []any{
+			"request_id", info.id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", sw.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote", clientIP(r),
+		}
+		if info.deviceID != "" {
+			attrs = append(attrs, "device_id", info.deviceID)
+		}
+		if info.runID != "" {
+			attrs = append(attrs, "run_id", info.runID)
+		}
+		slog.Info("request", attrs...)
+	})
+}
+
+// statusWriter notes the status and size of a response. Unwrap lets
+// http.ResponseController reach the connection for flushing and hijacking.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoggerRedactsKeys(t *testing.T) {
+	for key := range redactedKeys {
+		var buf bytes.Buffer
+		newLogger(&buf).Info("event", key, "value-of-"+key, slog.Group("nested", key, map[string]any{"a": 1}), "kept", "visible")
+		var line map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("%s: %v: %s", key, err, buf.Bytes())
+		}
+		nested, _ := line["nested"].(map[string]any)
+		if line[key] != "[REDACTED]" || nested[key] != "[REDACTED]" || line["kept"] != "visible" {
+			t.Errorf("%s: %s", key, buf.Bytes())
+		}
+	}
+}
+
+// logChunk is the n-th 1 MiB line written to the log.
+func logChunk(n int) []byte {
+	line := fmt.Sprintf("chunk %04d ", n)
+	return append([]byte(line), bytes.Repeat([]byte{'.'}, 1<<20-len(line)-1)...)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "server.log")
+	rf, err := openRotatingFile(path)
+	if err != nil {
+		t.Fatalf("openRotatingFile failed: %v", err)
+	}
+	perFile := maxLogSize / (1 << 20)
+	write := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if _, err := rf.Write(append(logChunk(i), '\n')); err != nil {
+				t.Fatalf("writing chunk %d: %v", i, err)
+			}
+		}
+	}
+	// firstChunks returns the first chunk in each log file, newest file
+	// first, checking none is over the size limit.
+	firstChunks := func() []string {
+		t.Helper()
+		var first []string
+		for i := range logFiles + 1 {
+			name := path
+			if i > 0 {
+				name = fmt.Sprintf("%s.%d", path, i)
+			}
+			raw, err := os.ReadFile(name)
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(raw) > maxLogSize {
+				t.Fatalf("%s is %d bytes, over %d", name, len(raw), maxLogSize)
+			}
+			first = append(first, string(raw[:len("chunk 0000")]))
+		}
+		return first
+	}
+
+	// A file is rotated when the next line would not fit.
+	write(0, perFile)
+	if got := firstChunks(); strings.Join(got, ",") != "chunk 0000" {
+		t.Fatalf("before rotation: %v", got)
+	}
+	write(perFile, perFile+1)
+	if got := firstChunks(); strings.Join(got, ",") != fmt.Sprintf("chunk %04d,chunk 0000", perFile) {
+		t.Fatalf("after one rotation: %v", got)
+	}
+
+	// Only logFiles files are kept; the oldest is dropped.
+	total := perFile*logFiles + 3
+	write(perFile+1, total)
+	var want []string
+	for i := logFiles - 1; i >= 0; i-- {
+		want = append(want, fmt.Sprintf("chunk %04d", i*perFile+perFile))
+	}
+	if got := firstChunks(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("after %d chunks: %v, want %v", total, got, want)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("log file: %v, mode %v", err, fi.Mode().Perm())
+	}
+
+	// A reopened file carries on from its size.
+	if err := rf.f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rf, err = openRotatingFile(path); err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	write(total, total+perFile-3)
+	if got := firstChunks(); got[0] != want[0] {
+		t.Fatalf("reopened file rotated early: %v", got)
+	}
+	write(total+perFile-3, total+perFile-2)
+	if got := firstChunks(); got[0] != fmt.Sprintf("chunk %04d", total+perFile-3) {
+		t.Fatalf("reopened file not rotated when full: %v", got)
+	}
+}
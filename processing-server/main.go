@@ -1,15 +1,173 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Hello, world!")
-	})
+	// The server also serves as the sandbox helper for its own scripts.
+	if spec, ok := os.LookupEnv(sandboxEnv); ok {
+		runSandboxHelper(spec)
+	}
+	configPath := flag.String("config", "server.config.json", "endpoint config file")
+	envPath := flag.String("env", ".env", "file holding MASTER_PASSWORD")
+	rotateCert := flag.Bool("rotate-cert", false, "replace the TLS key with the pre-generated next key and exit")
+	flag.Parse()
 
-	fmt.Println("Server listening on port 8080")
-	http.ListenAndServe(":8080", nil)
+	env, err := loadDotEnv(*envPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid environment: %v\n", err)
+		os.Exit(1)
+	}
+	password, _ := env.lookup("MASTER_PASSWORD")
+	// From here on nothing may log the password, and scripts never inherit it.
+	slog.SetDefault(newLogger(newRedactor(os.Stderr, password)))
+	os.Unsetenv("MASTER_PASSWORD")
+
+	// Fail closed: no endpoint is served unless the whole config is valid.
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config:\n%v\n", err)
+		os.Exit(1)
+	}
+	hidden := secretPaths(cfg, *envPath)
+	for _, ep := range cfg.Endpoints {
+		if ep.Enabled && ep.Sandbox.Isolate {
+			if err := probeSandbox(ep, hidden); err != nil {
+				fmt.Fprintf(os.Stderr, "endpoint %s: cannot isolate scripts on this machine: %v\n", ep.Name, err)
+				os.Exit(1)
+			}
+		}
+	}
+	logFile, err := openRotatingFile(cfg.LogFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open the log file: %v\n", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(newLogger(newRedactor(io.MultiWriter(os.Stderr, logFile), password)))
+	for _, ep := range cfg.Endpoints {
+		if ep.Enabled {
+			slog.Info("endpoint", "name", ep.Name, "method", ep.Method, "path", ep.Path,
+				"script", ep.ScriptPath, "timeout_ms", ep.TimeoutMS, "max_concurrent", ep.MaxConcurrent)
+		}
+	}
+	devices, err := openDeviceStore(cfg.DataDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot load paired devices: %v\n", err)
+		os.Exit(1)
+	}
+	auth, err := newAuthenticator(password, devices)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid environment: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *rotateCert {
+		certs, err := openCertStore(cfg.Listen.CertDir)
+		if err == nil {
+			err = certs.rotate()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot rotate certificate: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("rotated: %s\nsend SIGHUP to a running server to use the new key\n", certs)
+		return
+	}
+	var certs *certStore
+	if cfg.Listen.useTLS() {
+		if certs, err = openCertStore(cfg.Listen.CertDir); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot load TLS certificate: %v\n", err)
+			os.Exit(1)
+		}
+		slog.Info("tls", "certificate", certs.String())
+	} else if cfg.Listen.AllowLAN {
+		slog.Warn("serving the LAN without TLS; the password crosses the network in cleartext")
+	}
+
+	ln, err := listen(cfg.Listen, env)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot listen: %v\n", err)
+		os.Exit(1)
+	}
+	runs, err := openQueue(cfg, hidden)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cannot open the run queue: %v\n", err)
+		os.Exit(1)
+	}
+	handler := newServer(cfg, auth, runs)
+	srv := &http.Server{Handler: logRequests(handler), ReadHeaderTimeout: 10 * time.Second, IdleTimeout: 2 * time.Minute}
+	if certs != nil {
+		srv.TLSConfig = certs.tlsConfig()
+		go reloadCerts(certs)
+		// With TLS the pairing QR payload carries the code as well.
+		handler.announce = func(c pairingCode) {
+			p := newPairingPayload(ln.Addr(), certs.pins())
+			p.Code = c.String()
+			payload, _ := json.Marshal(p)
+			fmt.Printf("pairing code %s, valid until %s\npairing: %s\n", c, c.expires.Format(time.TimeOnly), payload)
+		}
+	}
+
+	// On SIGTERM or interrupt, stop accepting requests and wait for running
+	// scripts to finish; queued runs wait for the next start. A second
+	// signal kills the process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		stop()
+		slog.Info("shutting down", "running_scripts", runs.running())
+		runs.close()
+		if err := srv.Shutdown(context.Background()); err != nil {
+			slog.Error("shutdown", "err", err)
+		}
+		runs.wait()
+	}()
+
+	slog.Info("listening", "addr", ln.Addr().String())
+	if certs != nil {
+		payload, _ := json.Marshal(newPairingPayload(ln.Addr(), certs.pins()))
+		fmt.Printf("pairing: %s\n", payload)
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("serve", "err", err)
+		os.Exit(1)
+	}
+	<-done
+	slog.Info("stopped")
+}
+
+// reloadCerts rereads the certificate files on SIGHUP, after a rotation,
+// and daily so the certificate is renewed before it expires.
+func reloadCerts(certs *certStore) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	daily := time.NewTicker(24 * time.Hour)
+	for {
+		select {
+		case <-hup:
+		case <-daily.C:
+		}
+		if err := certs.load(); err != nil {
+			slog.Error("tls reload", "err", err)
+			continue
+		}
+		slog.Info("tls", "certificate", certs.String())
+	}
 }
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+// TestMain keeps the server's log lines out of the test output. Sandboxed
+// scripts start the test binary as their sandbox helper, as they would the
+// server.
+func TestMain(m *testing.M) {
+	if spec, ok := os.LookupEnv(sandboxEnv); ok {
+		runSandboxHelper(spec)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
@@ -0,0 +1,31 @@
+//go:build !unix
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op where process groups are not available; a
+// timeout kills the script alone.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil || cmd.ProcessState != nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
+
+// openProgressPipe does nothing where extra file descriptors cannot be
+// passed; scripts report progress on stderr instead.
+func openProgressPipe(cmd *exec.Cmd, w io.Writer) (*progressPipe, error) {
+	return &progressPipe{}, nil
+}
+
+// maxRSS is not reported here.
+func maxRSS(ps *os.ProcessState) int64 {
+	return 0
+}
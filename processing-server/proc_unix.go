@@ -0,0 +1,57 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// setProcessGroup starts the script in a new session, as the leader of a
+// new process group, so a timeout kills everything it spawned and not just
+// the script itself. Without a controlling terminal, a Ctrl-C meant for the
+// server does not reach it either.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	cmd.Cancel = func() error { return killProcessGroup(cmd) }
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// openProgressPipe hands the script a pipe as file descriptor 3, named in
+// LOGWAYSS_PROGRESS_FD, and copies what it writes there to w.
+func openProgressPipe(cmd *exec.Cmd, w io.Writer) (*progressPipe, error) {
+	r, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.ExtraFiles = []*os.File{pw}
+	cmd.Env = append(cmd.Env, progressFDEnv+"=3")
+	p := &progressPipe{r: r, w: pw, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		_, _ = io.Copy(w, r)
+	}()
+	return p, nil
+}
+
+// maxRSS is the script's peak resident set size in bytes.
+func maxRSS(ps *os.ProcessState) int64 {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// Darwin reports bytes, the other systems kilobytes.
+	if runtime.GOOS == "darwin" {
+		return int64(ru.Maxrss)
+	}
+	return int64(ru.Maxrss) * 1024
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// progressFDEnv names the file descriptor a script may write progress
+	// lines to, where the platform supports one.
+	progressFDEnv = "LOGWAYSS_PROGRESS_FD"
+	// maxProgressLine bounds a progress line; longer lines are ignored.
+	maxProgressLine = 4 << 10
+	// maxProgressMessage bounds a progress message, in bytes.
+	maxProgressMessage = 1 << 10
+)
+
+// progressEvent is a line such as {"progress":0.4,"message":"resizing"} that
+// a script writes to report how far along it is.
+type progressEvent struct {
+	Progress float64 `json:"progress"`
+	Message  string  `json:"message,omitempty"`
+}
+
+// progressWriter splits what a script writes into lines and passes each
+// progress line to emit. Other lines are ignored, so it can sit on stderr
+// next to ordinary diagnostics.
+type progressWriter struct {
+	emit     func(progressEvent)
+	line     []byte
+	skipping bool // the current line is too long to be a progress line
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		chunk := b
+		if i >= 0 {
+			chunk = b[:i]
+		}
+		if !p.skipping {
+			if len(p.line)+len(chunk) > maxProgressLine {
+				p.skipping = true
+				p.line = p.line[:0]
+			} else {
+				p.line = append(p.line, chunk...)
+			}
+		}
+		if i < 0 {
+			break
+		}
+		if !p.skipping {
+			p.parse(p.line)
+		}
+		p.line = p.line[:0]
+		p.skipping = false
+		b = b[i+1:]
+	}
+	return n, nil
+}
+
+func (p *progressWriter) parse(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 || line[0] != '{' {
+		return
+	}
+	var ev struct {
+		Progress *float64 `json:"progress"`
+		Message  string   `json:"message"`
+	}
+	if json.Unmarshal(line, &ev) != nil || ev.Progress == nil || *ev.Progress < 0 || *ev.Progress > 1 {
+		return
+	}
+	msg := strings.ToValidUTF8(ev.Message, "�")
+	if len(msg) > maxProgressMessage {
+		msg = msg[:maxProgressMessage]
+		for !utf8.ValidString(msg) {
+			msg = msg[:len(msg)-1]
+		}
+	}
+	p.emit(progressEvent{Progress: *ev.Progress, Message: msg})
+}
+
+// progressPipe is the dedicated progress file descriptor handed to a
+// script. Its zero value, used where the platform has none, does nothing.
+type progressPipe struct {
+	r, w *os.File
+	done chan struct{}
+}
+
+// started closes the server's copy of the write end once the script has
+// its own.
+func (p *progressPipe) started() {
+	if p.w != nil {
+		p.w.Close()
+	}
+}
+
+// close stops reading. Children the script left behind may still hold the
+// write end, so the read end is closed rather than drained.
+func (p *progressPipe) close() {
+	if p.r != nil {
+		p.r.Close()
+		<-p.done
+	}
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"logwayss/core-go/core"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	codeQueueFull      core.ErrorCode = "E_QUEUE_FULL"
+	codeRunCancelled   core.ErrorCode = "E_RUN_CANCELLED"
+	codeRunInterrupted core.ErrorCode = "E_RUN_INTERRUPTED"
+	codeUnavailable    core.ErrorCode = "E_UNAVAILABLE"
+)
+
+const (
+	queueDir = "queue"
+	// maxQueuedRuns bounds the runs waiting for each endpoint.
+	maxQueuedRuns    = 100
+	runSweepInterval = time.Hour
+)
+
+var errShuttingDown = errors.New("the server is shutting down")
+
+type runState string
+
+const (
+	runQueued    runState = "queued"
+	runRunning   runState = "running"
+	runSucceeded runState = "succeeded"
+	runFailed    runState = "failed"
+	runCancelled runState = "cancelled"
+)
+
+// run is one execution of an endpoint's script, as GET /runs/{id} shows it
+// and as the queue directory stores it. The request is kept only until the
+// run finishes. Progress is the latest progress line; it is saved with the
+// next change of state, not as it arrives.
+type run struct {
+	ID         string          `json:"id"`
+	Endpoint   string          `json:"endpoint"`
+	State      runState        `json:"state"`
+	DeviceID   string          `json:"device_id,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	StartedAt  *time.Time      `json:"started_at,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Progress   *progressEvent  `json:"progress,omitempty"`
+	Request    *scriptRequest  `json:"request,omitempty"`
+	Result     *scriptOutput   `json:"result,omitempty"`
+	Error      *core.ErrorBody `json:"error,omitempty"`
+}
+
+// view is the run without its request, for responses.
+func (r run) view() run {
+	r.Request = nil
+	return r
+}
+
+// activeRun is a run that is queued or running.
+type activeRun struct {
+	run
+	// status is the HTTP status of Error, for a caller waiting on the run.
+	status    int
+	cancel    context.CancelFunc
+	cancelled bool
+	done      chan struct{}
+	watchers  []chan runEvent
+}
+
+// runEvent is a change to an active run: "state" with the run when it
+// starts, or "progress" with a progressEvent.
+type runEvent struct {
+	name string
+	data any
+}
+
+// maxBufferedEvents is how many events a watcher may fall behind before
+// further progress is dropped for it.
+const maxBufferedEvents = 32
+
+// lane holds one endpoint's runs.
+type lane struct {
+	ep      Endpoint
+	pending []*activeRun
+	running int
+}
+
+// queue runs scripts in order of arrival, at most max_concurrent at a time
+// per endpoint. Every run is a file in the queue directory, so queued runs
+// survive a restart and finished ones can be fetched, with their artifacts,
+// for the retention period.
+type queue struct {
+	dir       string
+	artifacts string
+	retention time.Duration
+	now       func() time.Time
+	lanes     map[string]*lane
+	hidden    []string
+
+	mu       sync.Mutex
+	active   map[string]*activeRun
+	closed   bool
+	stopping chan struct{}
+	wg       sync.WaitGroup
+}
+
+// openQueue loads the runs in the data directory and starts the queued
+// ones. A run the previous process left running is failed with
+// E_RUN_INTERRUPTED rather than started again, since scripts need not be
+// idempotent. Isolated scripts do not see hidden.
+func openQueue(cfg *Config, hidden []string) (*queue, error) {
+	q := &queue{
+		dir:       filepath.Join(cfg.DataDir, queueDir),
+		artifacts: filepath.Join(cfg.DataDir, runsDir),
+		retention: time.Duration(cfg.RunRetentionDays) * 24 * time.Hour,
+		now:       time.Now,
+		lanes:     make(map[string]*lane),
+		hidden:    hidden,
+		active:    make(map[string]*activeRun),
+		stopping:  make(chan struct{}),
+	}
+	for _, ep := range cfg.Endpoints {
+		if ep.Enabled {
+			q.lanes[ep.Name] = &lane{ep: ep}
+		}
+	}
+	if err := os.MkdirAll(q.dir, 0o700); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// File names are run IDs, so this is the order the runs arrived in.
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), ".json")
+		if !ok {
+			continue
+		}
+		r, err := q.load(id)
+		if err != nil {
+			slog.Warn("skipping stored run", "file", f.Name(), "err", err)
+			continue
+		}
+		ar := &activeRun{run: r, done: make(chan struct{})}
+		l := q.lanes[r.Endpoint]
+		switch {
+		case r.State != runQueued && r.State != runRunning:
+			continue
+		case l == nil:
+			q.finish(ar, nil, &apiError{Status: http.StatusNotFound, ErrorBody: core.ErrorBody{
+				Code: core.CodeNotFound, Message: fmt.Sprintf("endpoint %s is no longer enabled", r.Endpoint)}})
+		case r.State == runRunning:
+			q.finish(ar, nil, &apiError{Status: http.StatusServiceUnavailable, ErrorBody: core.ErrorBody{
+				Code: codeRunInterrupted, Message: "the server stopped while the script was running"}})
+		default:
+			q.active[r.ID] = ar
+			l.pending = append(l.pending, ar)
+		}
+	}
+	q.sweep()
+	for _, l := range q.lanes {
+		q.dispatch(l)
+	}
+	go func() {
+		for range time.Tick(runSweepInterval) {
+			q.mu.Lock()
+			q.sweep()
+			q.mu.Unlock()
+		}
+	}()
+	return q, nil
+}
+
+// submit queues a run of ep for the request with requestID. The returned
+// run must only be read after its done channel is closed; its first state
+// is returned separately.
+func (q *queue) submit(ep Endpoint, req scriptRequest, deviceID, requestID string) (*activeRun, run, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, run{}, &apiError{Status: http.StatusServiceUnavailable, ErrorBody: core.ErrorBody{
+			Code: codeUnavailable, Message: errShuttingDown.Error()}}
+	}
+	l := q.lanes[ep.Name]
+	if len(l.pending) >= maxQueuedRuns {
+		return nil, run{}, &apiError{Status: http.StatusServiceUnavailable, ErrorBody: core.ErrorBody{
+			Code: codeQueueFull, Message: fmt.Sprintf("endpoint %s already has %d runs waiting", ep.Name, maxQueuedRuns)}}
+	}
+	ar := &activeRun{
+		run: run{
+			ID:        ulid.Make().String(),
+			Endpoint:  ep.Name,
+			State:     runQueued,
+			DeviceID:  deviceID,
+			RequestID: requestID,
+			CreatedAt: q.now().UTC(),
+			Request:   &req,
+		},
+		done: make(chan struct{}),
+	}
+	if err := q.save(ar.run); err != nil {
+		return nil, run{}, err
+	}
+	q.active[ar.ID] = ar
+	l.pending = append(l.pending, ar)
+	q.dispatch(l)
+	return ar, ar.view(), nil
+}
+
+// dispatch starts as many of l's queued runs as its limit allows. The
+// caller holds q.mu.
+func (q *queue) dispatch(l *lane) {
+	for !q.closed && l.running < l.ep.MaxConcurrent && len(l.pending) > 0 {
+		ar := l.pending[0]
+		l.pending = l.pending[1:]
+		ctx, cancel := context.WithCancel(context.Background())
+		now := q.now().UTC()
+		ar.cancel = cancel
+		ar.State = runRunning
+		ar.StartedAt = &now
+		if err := q.save(ar.run); err != nil {
+			slog.Error("saving run", "run_id", ar.ID, "err", err)
+		}
+		slog.Info("run started", "run_id", ar.ID, "endpoint", ar.Endpoint, "request_id", ar.RequestID)
+		q.notify(ar, runEvent{name: "state", data: ar.view()})
+		l.running++
+		q.wg.Add(1)
+		go q.execute(ctx, l, ar)
+	}
+}
+
+func (q *queue) execute(ctx context.Context, l *lane, ar *activeRun) {
+	defer q.wg.Done()
+	out, err := runScript(ctx, scriptRun{
+		id:     ar.ID,
+		ep:     l.ep,
+		req:    *ar.Request,
+		dir:    q.artifactDir(ar.run),
+		hidden: q.hidden,
+		progress: func(ev progressEvent) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			ar.Progress = &ev
+			q.notify(ar, runEvent{name: "progress", data: ev})
+		},
+	})
+	ar.cancel()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l.running--
+	q.finish(ar, out, err)
+	q.dispatch(l)
+}
+
+// finish records a run's outcome and wakes whoever waits for it. The caller
+// holds q.mu.
+func (q *queue) finish(ar *activeRun, out *scriptOutput, err error) {
+	now := q.now().UTC()
+	ar.FinishedAt = &now
+	ar.Request = nil
+	var apiErr *apiError
+	var fields []any
+	switch {
+	case ar.cancelled:
+		ar.State = runCancelled
+		apiErr = &apiError{Status: http.StatusConflict, ErrorBody: core.ErrorBody{
+			Code: codeRunCancelled, Message: "the run was cancelled"}}
+	case err == nil:
+		ar.State = runSucceeded
+		ar.Result = out
+	case errors.As(err, &apiErr):
+		ar.State = runFailed
+		fields = append(fields, "error", apiErr.Code, "message", apiErr.Message)
+	default:
+		ar.State = runFailed
+		fields = append(fields, "error", core.CodeInternal, "err", err)
+		apiErr = &apiError{Status: http.StatusInternalServerError, ErrorBody: core.ErrorBody{
+			Code: core.CodeInternal, Message: "script could not be run"}}
+	}
+	if apiErr != nil {
+		ar.status = apiErr.Status
+		ar.Error = &apiErr.ErrorBody
+	}
+	fields = append([]any{"run_id", ar.ID, "endpoint", ar.Endpoint, "request_id", ar.RequestID, "state", ar.State}, fields...)
+	if ar.StartedAt != nil {
+		fields = append(fields, "duration_ms", now.Sub(*ar.StartedAt).Milliseconds())
+	}
+	slog.Info("run finished", fields...)
+	if err := q.save(ar.run); err != nil {
+		slog.Error("saving run", "run_id", ar.ID, "err", err)
+	}
+	delete(q.active, ar.ID)
+	close(ar.done)
+}
+
+// await waits for ar to finish. If ctx ends first the run is cancelled. If
+// the server starts shutting down while ar is still queued, await returns
+// errShuttingDown and the run stays queued for the next start.
+func (q *queue) await(ctx context.Context, ar *activeRun) error {
+	stopping := q.stopping
+	for {
+		select {
+		case <-ar.done:
+			return nil
+		case <-ctx.Done():
+			q.cancel(ar.ID)
+			return ctx.Err()
+		case <-stopping:
+			if q.queued(ar) {
+				return errShuttingDown
+			}
+			stopping = nil // a running script is waited for
+		}
+	}
+}
+
+// watch returns the run with this ID, or os.ErrNotExist. If the run is
+// active it also returns it, to wait on, and a channel of its events;
+// unwatch must be called when the caller is done with them.
+func (q *queue) watch(id string) (run, *activeRun, chan runEvent, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ar := q.active[id]
+	if ar == nil {
+		r, err := q.load(id)
+		return r.view(), nil, nil, err
+	}
+	events := make(chan runEvent, maxBufferedEvents)
+	ar.watchers = append(ar.watchers, events)
+	return ar.view(), ar, events, nil
+}
+
+func (q *queue) unwatch(ar *activeRun, events chan runEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ar.watchers = slices.DeleteFunc(ar.watchers, func(c chan runEvent) bool { return c == events })
+}
+
+// notify passes ev to ar's watchers, dropping it for any that have fallen
+// behind. The caller holds q.mu.
+func (q *queue) notify(ar *activeRun, ev runEvent) {
+	for _, w := range ar.watchers {
+		select {
+		case w <- ev:
+		default:
+		}
+	}
+}
+
+// queued reports whether ar has yet to start.
+func (q *queue) queued(ar *activeRun) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return ar.State == runQueued
+}
+
+// get returns the run with this ID, or os.ErrNotExist.
+func (q *queue) get(id string) (run, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ar := q.active[id]; ar != nil {
+		return ar.view(), nil
+	}
+	r, err := q.load(id)
+	return r.view(), err
+}
+
+// cancel stops a run: a queued run is cancelled at once, a running one has
+// its process group killed and turns cancelled shortly after. Cancelling a
+// finished run changes nothing.
+func (q *queue) cancel(id string) (run, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ar := q.active[id]
+	if ar == nil {
+		r, err := q.load(id)
+		return r.view(), err
+	}
+	ar.cancelled = true
+	if ar.State == runQueued {
+		l := q.lanes[ar.Endpoint]
+		l.pending = slices.DeleteFunc(l.pending, func(p *activeRun) bool { return p == ar })
+		q.finish(ar, nil, nil)
+	} else {
+		ar.cancel()
+	}
+	return ar.view(), nil
+}
+
+// close stops starting runs; queued runs stay on disk for the next start.
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.stopping)
+	}
+}
+
+// wait blocks until every running script has finished.
+func (q *queue) wait() {
+	q.wg.Wait()
+}
+
+// running returns how many scripts are running.
+func (q *queue) running() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, l := range q.lanes {
+		n += l.running
+	}
+	return n
+}
+
+// sweep deletes finished runs older than the retention period, with their
+// artifact directories, and artifact directories left without a run. The
+// caller holds q.mu.
+func (q *queue) sweep() {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		slog.Error("sweeping runs", "err", err)
+		return
+	}
+	cutoff := q.now().Add(-q.retention)
+	// expired reports whether run id is done with: finished before the
+	// cutoff, or gone with only its directory left.
+	expired := func(id string) bool {
+		if q.active[id] != nil {
+			return false
+		}
+		r, err := q.load(id)
+		if errors.Is(err, os.ErrNotExist) {
+			return true
+		}
+		return err == nil && r.FinishedAt != nil && r.FinishedAt.Before(cutoff)
+	}
+	busy := make(map[string]bool)
+	for _, ar := range q.active {
+		busy[ar.CreatedAt.UTC().Format(time.DateOnly)] = true
+	}
+	// Directories go first, so a run is never left without its artifacts.
+	sweepArtifacts(q.artifacts, expired, busy)
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), ".json")
+		if ok && expired(id) {
+			os.Remove(filepath.Join(q.dir, f.Name()))
+		}
+	}
+}
+
+// artifactDir is where r keeps its working directory and output.
+func (q *queue) artifactDir(r run) string {
+	return artifactDir(q.artifacts, r)
+}
+
+// load reads a stored run; the ID is checked first, so it can never name a
+// file outside the queue directory.
+func (q *queue) load(id string) (run, error) {
+	if _, err := ulid.ParseStrict(id); err != nil {
+		return run{}, os.ErrNotExist
+	}
+	raw, err := os.ReadFile(filepath.Join(q.dir, id+".json"))
+	if err != nil {
+		return run{}, err
+	}
+	var r run
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return run{}, err
+	}
+	return r, nil
+}
+
+func (q *queue) save(r run) error {
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(q.dir, r.ID+".json"), raw, 0o600)
+}
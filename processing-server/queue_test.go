@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// gatedScript answers once the file gate exists, so a test decides when
+// its runs finish.
+func gatedScript(gate string) string {
+	return "#!/bin/sh\ncat >/dev/null\nwhile [ ! -e '" + gate + "' ]; do sleep 0.01; done\necho '{}'\n"
+}
+
+func openGate(t *testing.T, gate string) {
+	t.Helper()
+	if err := os.WriteFile(gate, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// awaitRun waits for the run with this ID to finish and returns it.
+func awaitRun(t *testing.T, q *queue, id string) run {
+	t.Helper()
+	r, ar, events, err := q.watch(id)
+	if err != nil {
+		t.Fatalf("watch(%s) failed: %v", id, err)
+	}
+	if ar == nil {
+		return r
+	}
+	q.unwatch(ar, events)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := q.await(ctx, ar); err != nil {
+		t.Fatalf("run %s did not finish: %v", id, err)
+	}
+	return ar.view()
+}
+
+func submit(t *testing.T, q *queue, ep Endpoint) run {
+	t.Helper()
+	_, first, err := q.submit(ep, scriptRequest{EntryIDs: []string{}, Params: map[string]any{}}, "", "")
+	if err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	return first
+}
+
+// storeRun writes r to the queue directory in dataDir, as a previous
+// process would have left it.
+func storeRun(t *testing.T, dataDir string, r run) {
+	t.Helper()
+	raw, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dataDir, queueDir), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, queueDir, r.ID+".json"), raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueueMaxConcurrent(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	wide := testEndpoint(t, "wide", gatedScript(gate))
+	wide.MaxConcurrent = 2
+	narrow := testEndpoint(t, "narrow", gatedScript(gate))
+	q := openTestQueue(t, t.TempDir(), wide, narrow)
+	defer openGate(t, gate)
+
+	runs := []run{submit(t, q, wide), submit(t, q, wide), submit(t, q, wide), submit(t, q, narrow)}
+	for i, want := range []runState{runRunning, runRunning, runQueued, runRunning} {
+		if got, _ := q.get(runs[i].ID); got.State != want {
+			t.Errorf("run %d is %s, want %s", i, got.State, want)
+		}
+	}
+	if n := q.running(); n != 3 {
+		t.Fatalf("%d scripts running, want 3", n)
+	}
+
+	openGate(t, gate)
+	var finished []run
+	for _, r := range runs {
+		finished = append(finished, awaitRun(t, q, r.ID))
+	}
+	for i, r := range finished {
+		if r.State != runSucceeded {
+			t.Fatalf("run %d %s: %+v", i, r.State, r.Error)
+		}
+	}
+	first := *finished[0].FinishedAt
+	if finished[1].FinishedAt.Before(first) {
+		first = *finished[1].FinishedAt
+	}
+	if finished[2].StartedAt.Before(first) {
+		t.Fatalf("third run started at %v, before either of the first two finished (%v)", finished[2].StartedAt, first)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", gatedScript(gate))
+	other := testEndpoint(t, "other", echoScript)
+	q := openTestQueue(t, t.TempDir(), ep, other)
+	defer openGate(t, gate)
+
+	submit(t, q, ep) // running
+	var last run
+	for range maxQueuedRuns {
+		last = submit(t, q, ep)
+	}
+	_, _, err := q.submit(ep, scriptRequest{}, "", "")
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.Code != codeQueueFull || apiErr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("submit to a full queue: %v", err)
+	}
+	if r := awaitRun(t, q, submit(t, q, other).ID); r.State != runSucceeded {
+		t.Fatalf("another endpoint's run %s: %+v", r.State, r.Error)
+	}
+
+	// Cancelling a waiting run makes room.
+	if _, err := q.cancel(last.ID); err != nil {
+		t.Fatal(err)
+	}
+	submit(t, q, ep)
+}
+
+func TestQueueCancel(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", gatedScript(gate))
+	q := openTestQueue(t, t.TempDir(), ep)
+	defer openGate(t, gate)
+	running, queued := submit(t, q, ep), submit(t, q, ep)
+
+	got, err := q.cancel(queued.ID)
+	if err != nil || got.State != runCancelled || got.Error == nil || got.Error.Code != codeRunCancelled || got.StartedAt != nil {
+		t.Fatalf("cancelling a queued run: %+v, %v", got, err)
+	}
+	if stored, err := q.load(queued.ID); err != nil || stored.State != runCancelled || stored.Request != nil {
+		t.Fatalf("stored cancelled run: %+v, %v", stored, err)
+	}
+
+	// A running run turns cancelled once its script has been killed; the
+	// gate is never opened, so it cannot have finished by itself.
+	if got, err := q.cancel(running.ID); err != nil || got.State != runRunning {
+		t.Fatalf("cancelling a running run: %+v, %v", got, err)
+	}
+	r := awaitRun(t, q, running.ID)
+	if r.State != runCancelled || r.Error.Code != codeRunCancelled || r.Result != nil {
+		t.Fatalf("cancelled running run: %+v", r)
+	}
+
+	// Cancelling a finished run changes nothing.
+	if got, err := q.cancel(running.ID); err != nil || got.State != runCancelled || !got.FinishedAt.Equal(*r.FinishedAt) {
+		t.Fatalf("cancelling a finished run: %+v, %v", got, err)
+	}
+	if _, err := q.cancel(ulid.Make().String()); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("cancelling an unknown run: %v", err)
+	}
+	if _, err := q.cancel("../queue"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("cancelling a path: %v", err)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", gatedScript(gate))
+	q := openTestQueue(t, dataDir, ep)
+	running, queued := submit(t, q, ep), submit(t, q, ep)
+
+	// Shutting down waits for the running script and leaves the other
+	// queued, request included.
+	q.close()
+	if _, _, err := q.submit(ep, scriptRequest{}, "", ""); err == nil {
+		t.Fatal("submit after close succeeded")
+	}
+	openGate(t, gate)
+	q.wait()
+	if r, _ := q.get(running.ID); r.State != runSucceeded {
+		t.Fatalf("running run after shutdown: %s", r.State)
+	}
+	if r, err := q.load(queued.ID); err != nil || r.State != runQueued || r.Request == nil {
+		t.Fatalf("queued run after shutdown: %+v, %v", r, err)
+	}
+
+	restarted := openTestQueue(t, dataDir, ep)
+	if r := awaitRun(t, restarted, queued.ID); r.State != runSucceeded || !r.CreatedAt.Equal(queued.CreatedAt) {
+		t.Fatalf("queued run after restart: %+v", r)
+	}
+	if r, err := restarted.get(running.ID); err != nil || r.State != runSucceeded {
+		t.Fatalf("finished run after restart: %+v, %v", r, err)
+	}
+}
+
+func TestQueueInterruptedRuns(t *testing.T) {
+	dataDir := t.TempDir()
+	ep := testEndpoint(t, "echo", echoScript)
+	created := time.Now().UTC().Add(-time.Minute).Truncate(time.Second)
+	started := created.Add(time.Second)
+	req := &scriptRequest{EntryIDs: []string{}, Params: map[string]any{}}
+	interrupted := run{ID: ulid.Make().String(), Endpoint: "echo", State: runRunning, CreatedAt: created, StartedAt: &started, Request: req}
+	disabled := run{ID: ulid.Make().String(), Endpoint: "gone", State: runQueued, CreatedAt: created, Request: req}
+	waiting := run{ID: ulid.Make().String(), Endpoint: "echo", State: runQueued, CreatedAt: created, Request: req}
+	for _, r := range []run{interrupted, disabled, waiting} {
+		storeRun(t, dataDir, r)
+	}
+
+	q := openTestQueue(t, dataDir, ep)
+	r, err := q.get(interrupted.ID)
+	if err != nil || r.State != runFailed || r.Error.Code != codeRunInterrupted || r.FinishedAt == nil {
+		t.Fatalf("interrupted run: %+v, %v", r, err)
+	}
+	if stored, _ := q.load(interrupted.ID); stored.State != runFailed || stored.Request != nil {
+		t.Fatalf("stored interrupted run: %+v", stored)
+	}
+	if r, _ := q.get(disabled.ID); r.State != runFailed || r.Error.Code != "E_NOT_FOUND" {
+		t.Fatalf("run of a disabled endpoint: %+v", r)
+	}
+	if r := awaitRun(t, q, waiting.ID); r.State != runSucceeded {
+		t.Fatalf("queued run: %+v", r)
+	}
+	if _, err := os.Stat(filepath.Join(q.artifactDir(interrupted), manifestArtifact)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the interrupted run was started again: %v", err)
+	}
+}
+
+func TestQueueSweep(t *testing.T) {
+	dataDir := t.TempDir()
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", gatedScript(gate))
+	defer openGate(t, gate)
+	now := time.Now().UTC()
+	day := func(n int) time.Time { return now.AddDate(0, 0, -n) }
+	at := func(t time.Time) *time.Time { return &t }
+	req := &scriptRequest{EntryIDs: []string{}, Params: map[string]any{}}
+	runs := map[string]run{
+		// Finished well before the retention period.
+		"expired": {ID: ulid.Make().String(), Endpoint: "slow", State: runSucceeded, CreatedAt: day(30), FinishedAt: at(day(20))},
+		// Created before the retention period but finished recently.
+		"recent": {ID: ulid.Make().String(), Endpoint: "slow", State: runSucceeded, CreatedAt: day(29), FinishedAt: at(day(1))},
+		// Waiting since before the retention period.
+		"waiting": {ID: ulid.Make().String(), Endpoint: "slow", State: runQueued, CreatedAt: day(28), Request: req},
+	}
+	root := filepath.Join(dataDir, runsDir)
+	for _, r := range runs {
+		storeRun(t, dataDir, r)
+		if err := os.MkdirAll(filepath.Join(artifactDir(root, r), artifactFilesDir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A directory whose run is gone.
+	orphan := artifactDir(root, run{ID: ulid.Make().String(), Endpoint: "slow", CreatedAt: day(1)})
+	if err := os.MkdirAll(orphan, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	q := openTestQueue(t, dataDir, ep)
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+	check := func(when string, want map[string]bool) {
+		t.Helper()
+		for name, kept := range want {
+			r := runs[name]
+			_, err := q.load(r.ID)
+			if got := err == nil; got != kept {
+				t.Errorf("%s: run %s kept = %v, want %v", when, name, got, kept)
+			}
+			if got := exists(artifactDir(root, r)); got != kept {
+				t.Errorf("%s: directory of run %s kept = %v, want %v", when, name, got, kept)
+			}
+		}
+	}
+	check("at startup", map[string]bool{"expired": false, "recent": true, "waiting": true})
+	if exists(orphan) || exists(filepath.Dir(orphan)) {
+		t.Error("the directory without a run was kept")
+	}
+	if exists(filepath.Join(root, day(30).Format(time.DateOnly))) {
+		t.Error("the expired run's empty day directory was kept")
+	}
+	if r, _ := q.get(runs["waiting"].ID); r.State != runRunning {
+		t.Fatalf("waiting run is %s", r.State)
+	}
+
+	// Later the recent run expires too, but not the one still running.
+	q.mu.Lock()
+	q.now = func() time.Time { return now.Add(7 * 24 * time.Hour) }
+	q.sweep()
+	q.mu.Unlock()
+	check("a week later", map[string]bool{"recent": false, "waiting": true})
+}
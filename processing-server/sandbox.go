@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sandboxEnv carries a sandboxSpec from the server to the copy of itself
+// that sets up a script's sandbox and then replaces itself with the script.
+const sandboxEnv = "LOGWAYSS_SANDBOX"
+
+// sandboxSpec is what the sandbox helper needs to prepare a script.
+type sandboxSpec struct {
+	Script  string        `json:"script"`
+	Sandbox SandboxConfig `json:"sandbox"`
+	// Writable are the only directories an isolated script may write to.
+	Writable []string `json:"writable,omitempty"`
+	// Hidden are covered up for an isolated script, except where they hold
+	// the script's own directory or a Writable one.
+	Hidden []string `json:"hidden,omitempty"`
+	// Probe makes the helper exit once the sandbox is set up.
+	Probe bool `json:"probe,omitempty"`
+}
+
+// sandbox makes cmd start the sandbox helper, which applies spec and then
+// runs the script, instead of starting the script itself. cmd must already
+// have its process attributes.
+func sandbox(cmd *exec.Cmd, spec sandboxSpec) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	cmd.Path = self
+	cmd.Err = nil
+	cmd.Env = append(cmd.Env, sandboxEnv+"="+string(raw))
+	if spec.Sandbox.Isolate {
+		isolate(cmd, spec.Sandbox)
+	}
+	return nil
+}
+
+// secretPaths are what isolated scripts must not see: the data directory,
+// with paired devices and other runs, the TLS keys, and the .env file with
+// the directory it is in.
+func secretPaths(cfg *Config, envPath string) []string {
+	paths := []string{cfg.DataDir, cfg.Listen.CertDir}
+	if env, err := filepath.Abs(envPath); err == nil {
+		paths = append(paths, filepath.Dir(env), env)
+	}
+	return paths
+}
+
+// probeSandbox sets up ep's sandbox, hiding hidden, without running the
+// script, so an endpoint whose sandbox cannot work on this machine fails at
+// startup rather than on every call.
+func probeSandbox(ep Endpoint, hidden []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ep.ScriptPath)
+	setProcessGroup(cmd)
+	dir, err := os.MkdirTemp("", "logwayss-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	cmd.Dir = dir
+	err = sandbox(cmd, sandboxSpec{Script: ep.ScriptPath, Sandbox: ep.Sandbox, Writable: []string{dir}, Hidden: hidden, Probe: true})
+	if err != nil {
+		return err
+	}
+	out, err := cmd.CombinedOutput()
+	if msg := strings.TrimSpace(string(out)); err != nil && msg != "" {
+		return errors.New(msg)
+	}
+	return err
+}
+
+// sandboxFailed ends the sandbox helper. The script has not run, so the
+// exit status is the one shells use for a command that cannot be executed.
+func sandboxFailed(err error) {
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(126)
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os"
+
+// canSandbox reports whether scripts can be given resource limits here.
+const canSandbox = false
+
+// runSandboxHelper is never called here: the config rejects sandboxes.
+func runSandboxHelper(raw string) {}
+
+func limitExceeded(sb SandboxConfig, ps *os.ProcessState) string {
+	return ""
+}
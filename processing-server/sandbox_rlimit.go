@@ -0,0 +1,111 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// canSandbox reports whether scripts can be given resource limits here.
+const canSandbox = true
+
+// runSandboxHelper is the sandbox helper: the server started again with a
+// sandboxSpec in sandboxEnv. It sets up the sandbox and replaces itself with
+// the script, which keeps its process ID, so the server waits for and kills
+// the script as if it had started it directly. It never returns.
+func runSandboxHelper(raw string) {
+	// Isolation changes per-thread attributes that must still hold at exec.
+	runtime.LockOSThread()
+	var spec sandboxSpec
+	if err := json.Unmarshal([]byte(raw), &spec); err != nil {
+		sandboxFailed(err)
+	}
+	if spec.Sandbox.Isolate {
+		if err := enterIsolation(spec); err != nil {
+			sandboxFailed(err)
+		}
+	}
+	if spec.Probe {
+		os.Exit(0)
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, sandboxEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	// The limits come last: the helper itself must not run into them.
+	if err := setLimits(spec.Sandbox); err != nil {
+		sandboxFailed(err)
+	}
+	sandboxFailed(syscall.Exec(spec.Script, os.Args, env))
+}
+
+// setLimits applies sb's resource limits, which the script inherits. A
+// limit above the current hard limit is lowered to it.
+func setLimits(sb SandboxConfig) error {
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, uint64(sb.CPUSeconds)},
+		{syscall.RLIMIT_AS, uint64(sb.MemoryMB) << 20},
+		{syscall.RLIMIT_NOFILE, uint64(sb.OpenFiles)},
+		{unix.RLIMIT_NPROC, uint64(sb.Processes)},
+	}
+	for _, l := range limits {
+		if l.value == 0 {
+			continue
+		}
+		var cur syscall.Rlimit
+		if err := syscall.Getrlimit(l.resource, &cur); err != nil {
+			return err
+		}
+		want := syscall.Rlimit{Cur: capRlimit(l.value, cur.Max), Max: capRlimit(l.value, cur.Max)}
+		if l.resource == syscall.RLIMIT_CPU {
+			// SIGXCPU at the limit, SIGKILL a second later if it is ignored.
+			want.Max = capRlimit(l.value+1, cur.Max)
+		}
+		// syscall.Setrlimit, unlike its x/sys counterpart, also stops
+		// syscall.Exec from restoring the original RLIMIT_NOFILE.
+		if err := syscall.Setrlimit(l.resource, &want); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capRlimit is v, or hard if that is lower, as the platform's rlimit type.
+func capRlimit[T int64 | uint64](v uint64, hard T) T {
+	return T(min(v, uint64(hard)))
+}
+
+// limitExceeded names the sandbox limit that killed a script, or returns ""
+// if none did. The CPU limit is certain: the kernel signals it. A crash
+// under a memory limit is blamed on the limit, since a failed allocation is
+// how most runtimes die when they reach it.
+func limitExceeded(sb SandboxConfig, ps *os.ProcessState) string {
+	if ps == nil {
+		return ""
+	}
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return ""
+	}
+	cpu := ps.UserTime() + ps.SystemTime()
+	switch sig := ws.Signal(); {
+	case sb.CPUSeconds > 0 && (sig == syscall.SIGXCPU ||
+		sig == syscall.SIGKILL && cpu >= time.Duration(sb.CPUSeconds)*time.Second):
+		return "cpu_seconds"
+	case sb.MemoryMB > 0 && (sig == syscall.SIGSEGV || sig == syscall.SIGBUS || sig == syscall.SIGABRT):
+		return "memory_mb"
+	}
+	return ""
+}
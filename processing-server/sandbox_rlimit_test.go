@@ -0,0 +1,121 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// runSandboxed runs ep's script once in the run directory dir, hiding
+// hidden if the script is isolated.
+func runSandboxed(t *testing.T, ep Endpoint, dir string, hidden ...string) (*scriptOutput, error) {
+	t.Helper()
+	return runScript(context.Background(), scriptRun{id: "run-1", ep: ep, dir: dir, hidden: hidden, progress: func(progressEvent) {}})
+}
+
+// resultStrings returns out's results, which must be strings.
+func resultStrings(t *testing.T, out *scriptOutput) []string {
+	t.Helper()
+	var got []string
+	for _, raw := range out.Results {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			t.Fatalf("result %s: %v", raw, err)
+		}
+		got = append(got, s)
+	}
+	return got
+}
+
+// limitsScript reports the open files, CPU seconds with their hard limit,
+// and address space in KiB it may use.
+const limitsScript = "#!/bin/sh\ncat >/dev/null\n" +
+	`printf '{"results": ["%s", "%s", "%s", "%s"]}\n' "$(ulimit -n)" "$(ulimit -t)" "$(ulimit -Ht)" "$(ulimit -v)"` + "\n"
+
+func TestSetLimits(t *testing.T) {
+	var nofile syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &nofile); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		sb   SandboxConfig
+		want string
+	}{
+		{SandboxConfig{OpenFiles: 64, CPUSeconds: 5, MemoryMB: 256}, "64,5,6,262144"},
+		{SandboxConfig{OpenFiles: 64}, "64,unlimited,unlimited,unlimited"},
+		// A limit above the hard limit is lowered to it.
+		{SandboxConfig{OpenFiles: 1 << 30}, strconv.FormatUint(uint64(nofile.Max), 10) + ",unlimited,unlimited,unlimited"},
+	}
+	for _, tc := range cases {
+		ep := testEndpoint(t, "limits", limitsScript)
+		ep.Sandbox = tc.sb
+		out, err := runSandboxed(t, ep, t.TempDir())
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.sb, err)
+		}
+		if got := strings.Join(resultStrings(t, out), ","); got != tc.want {
+			t.Errorf("%+v: limits %s, want %s", tc.sb, got, tc.want)
+		}
+	}
+}
+
+func TestLimitExceeded(t *testing.T) {
+	cpu := SandboxConfig{CPUSeconds: 1}
+	mem := SandboxConfig{MemoryMB: 64}
+	both := SandboxConfig{CPUSeconds: 1, MemoryMB: 64}
+	cases := []struct {
+		script string
+		sb     SandboxConfig
+		want   string
+	}{
+		{"kill -XCPU $$", cpu, "cpu_seconds"},
+		{"kill -XCPU $$", mem, ""},
+		{"kill -SEGV $$", mem, "memory_mb"},
+		{"kill -BUS $$", mem, "memory_mb"},
+		{"kill -ABRT $$", mem, "memory_mb"},
+		{"kill -SEGV $$", cpu, ""},
+		// Killed well before its CPU time ran out, as on a timeout.
+		{"kill -KILL $$", cpu, ""},
+		{"kill -TERM $$", both, ""},
+		{"exit 1", both, ""},
+	}
+	for _, tc := range cases {
+		cmd := exec.Command("sh", "-c", tc.script)
+		var exitErr *exec.ExitError
+		if err := cmd.Run(); !errors.As(err, &exitErr) {
+			t.Fatalf("%s: %v", tc.script, err)
+		}
+		if got := limitExceeded(tc.sb, cmd.ProcessState); got != tc.want {
+			t.Errorf("%s under %+v: %q, want %q", tc.script, tc.sb, got, tc.want)
+		}
+	}
+	if got := limitExceeded(both, nil); got != "" {
+		t.Errorf("a script that never ran: %q", got)
+	}
+}
+
+func TestScriptCPULimit(t *testing.T) {
+	for _, script := range []string{
+		"while :; do :; done",
+		// SIGKILL a second later when SIGXCPU is ignored.
+		"trap '' XCPU\nwhile :; do :; done",
+	} {
+		ep := testEndpoint(t, "spin", "#!/bin/sh\ncat >/dev/null\n"+script+"\n")
+		ep.Sandbox = SandboxConfig{CPUSeconds: 1}
+		_, err := runSandboxed(t, ep, t.TempDir())
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) || apiErr.Code != codeScriptLimit {
+			t.Fatalf("%q: got %v, want %s", script, err, codeScriptLimit)
+		}
+		if d, _ := apiErr.Details.(*scriptDetails); d == nil || d.Limit != "cpu_seconds" {
+			t.Fatalf("%q: details %+v", script, apiErr.Details)
+		}
+	}
+}
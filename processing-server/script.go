@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"logwayss/core-go/core"
+)
+
+// Server error codes, from spec-and-tests/api/error-codes.json.
+const (
+	codeScriptTimeout core.ErrorCode = "E_SCRIPT_TIMEOUT"
+	codeScriptOutput  core.ErrorCode = "E_SCRIPT_OUTPUT"
+	codeScriptFailed  core.ErrorCode = "E_SCRIPT_FAILED"
+	codeScriptLimit   core.ErrorCode = "E_SCRIPT_LIMIT"
+)
+
+const (
+	// maxScriptOutput bounds what a script may write to stdout.
+	maxScriptOutput = 16 << 20
+	// maxStderrTail is how much of the end of stderr an error reports.
+	maxStderrTail = 8 << 10
+	// maxStderrArtifact bounds the stderr kept in a run's directory.
+	maxStderrArtifact = 16 << 20
+	// scriptWaitDelay is how long a finished script's leftover children may
+	// hold its output open before they are killed.
+	scriptWaitDelay = 2 * time.Second
+)
+
+// secretEnv lists environment variables scripts never see.
+var secretEnv = []string{"MASTER_PASSWORD"}
+
+// scriptRequest is what a script reads on stdin.
+type scriptRequest struct {
+	EntryIDs []string       `json:"entry_ids"`
+	Params   map[string]any `json:"params"`
+}
+
+// scriptOutput is what a script must write on stdout, and what the endpoint
+// returns.
+type scriptOutput struct {
+	Results    []json.RawMessage `json:"results,omitempty"`
+	NewEntries []core.NewEntry   `json:"new_entries,omitempty"`
+	Warnings   []string          `json:"warnings,omitempty"`
+}
+
+// scriptDetails are the error details of a failed run.
+type scriptDetails struct {
+	ExitCode        *int         `json:"exit_code,omitempty"`
+	Limit           string       `json:"limit,omitempty"`
+	Stderr          string       `json:"stderr,omitempty"`
+	StderrTruncated bool         `json:"stderr_truncated,omitempty"`
+	Issues          []core.Issue `json:"issues,omitempty"`
+}
+
+// apiError is an error reported to the client in the error envelope.
+type apiError struct {
+	Status int
+	core.ErrorBody
+}
+
+func (e *apiError) Error() string { return string(e.Code) + ": " + e.Message }
+
+// scriptRun is one execution of a script.
+type scriptRun struct {
+	id  string
+	ep  Endpoint
+	req scriptRequest
+	// dir is the run's artifact directory; the script runs in its files
+	// subdirectory.
+	dir string
+	// progress receives the progress lines the script writes.
+	progress func(progressEvent)
+	// hidden are the paths an isolated script must not see.
+	hidden []string
+}
+
+// runScript runs sr's script with its request on stdin, in the run's own
+// working directory, session and process group, and in the endpoint's
+// sandbox if it has one. When timeout_ms passes, the whole group is
+// killed. Progress lines the script writes to stderr or its progress file
+// descriptor are passed to sr.progress. Whatever the outcome, the run
+// directory is left with the script's stdout, stderr and a manifest.
+func runScript(ctx context.Context, sr scriptRun) (*scriptOutput, error) {
+	ep := sr.ep
+	input, err := json.Marshal(sr.req)
+	if err != nil {
+		return nil, err
+	}
+	work := filepath.Join(sr.dir, artifactFilesDir)
+	if err := os.MkdirAll(work, 0o700); err != nil {
+		return nil, err
+	}
+	stderrFile, err := os.OpenFile(filepath.Join(sr.dir, stderrArtifact), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer stderrFile.Close()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(ep.TimeoutMS)*time.Millisecond)
+	defer cancel()
+
+	stdout := &cappedBuffer{limit: maxScriptOutput}
+	stderr := &tailBuffer{limit: maxStderrTail}
+	stderrCopy := &cappedWriter{w: stderrFile, limit: maxStderrArtifact}
+	cmd := exec.CommandContext(ctx, ep.ScriptPath)
+	cmd.Dir = work
+	cmd.Env = append(scriptEnv(), runIDEnv+"="+sr.id)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(stderr, stderrCopy, &progressWriter{emit: sr.progress})
+	cmd.WaitDelay = scriptWaitDelay
+	setProcessGroup(cmd)
+	if ep.Sandbox.enabled() {
+		spec := sandboxSpec{Script: ep.ScriptPath, Sandbox: ep.Sandbox, Writable: []string{work}}
+		if ep.Sandbox.Isolate {
+			// An isolated script can write nowhere else, so it gets a
+			// temporary directory of its own.
+			tmp := filepath.Join(sr.dir, "tmp")
+			if err := os.MkdirAll(tmp, 0o700); err != nil {
+				return nil, err
+			}
+			defer os.RemoveAll(tmp)
+			cmd.Env = append(cmd.Env, "TMPDIR="+tmp)
+			spec.Writable = append(spec.Writable, tmp)
+			spec.Hidden = sr.hidden
+		}
+		if err := sandbox(cmd, spec); err != nil {
+			return nil, err
+		}
+	}
+	pipe, err := openProgressPipe(cmd, &progressWriter{emit: sr.progress})
+	if err != nil {
+		return nil, err
+	}
+	started := time.Now()
+	err = cmd.Start()
+	pipe.started()
+	if err == nil {
+		err = cmd.Wait()
+	}
+	// Nothing the script started may outlive the request.
+	_ = killProcessGroup(cmd)
+	pipe.close()
+	finished := time.Now()
+
+	var out *scriptOutput
+	limit := limitExceeded(ep.Sandbox, cmd.ProcessState)
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = stderr.fail(http.StatusGatewayTimeout, codeScriptTimeout,
+			fmt.Sprintf("script exceeded its timeout of %d ms and was terminated", ep.TimeoutMS), nil)
+	case ctx.Err() != nil:
+		err = ctx.Err()
+	case limit == "cpu_seconds":
+		err = stderr.fail(http.StatusBadGateway, codeScriptLimit,
+			fmt.Sprintf("script exceeded its CPU limit of %d s and was killed", ep.Sandbox.CPUSeconds), &scriptDetails{Limit: limit})
+	case limit == "memory_mb":
+		err = stderr.fail(http.StatusBadGateway, codeScriptLimit,
+			fmt.Sprintf("script crashed under its memory limit of %d MB, most likely by reaching it", ep.Sandbox.MemoryMB), &scriptDetails{Limit: limit})
+	case errors.Is(err, exec.ErrWaitDelay):
+		// The script itself exited cleanly; only its children lingered.
+		out, err = parseOutput(stdout, stderr)
+	case err != nil:
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			code := exitErr.ExitCode()
+			err = stderr.fail(http.StatusBadGateway, codeScriptFailed,
+				fmt.Sprintf("script exited with status %d", code), &scriptDetails{ExitCode: &code})
+		}
+	default:
+		out, err = parseOutput(stdout, stderr)
+	}
+	m := runManifest{
+		RunID:       sr.id,
+		Endpoint:    ep.Name,
+		Script:      ep.ScriptPath,
+		InputSHA256: fmt.Sprintf("%x", sha256.Sum256(input)),
+		StartedAt:   started.UTC(),
+		FinishedAt:  finished.UTC(),
+		DurationMS:  finished.Sub(started).Milliseconds(),
+		Stdout:      outputFile{Size: int64(stdout.Len()), Truncated: stdout.overflow},
+		Stderr:      outputFile{Size: stderrCopy.n, Truncated: stderrCopy.overflow},
+	}
+	if ps := cmd.ProcessState; ps != nil {
+		if code := ps.ExitCode(); code >= 0 {
+			m.ExitCode = &code
+		}
+		m.Resources = newResourceUsage(ps)
+	}
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		m.Error = apiErr.Code
+	}
+	if werr := writeArtifacts(sr.dir, stdout.Bytes(), m); werr != nil {
+		slog.Error("writing artifacts", "run_id", sr.id, "endpoint", ep.Name, "err", werr)
+	}
+	return out, err
+}
+
+// parseOutput checks a script's stdout against the response contract. New
+// entries must pass the same validation core applies when they are created.
+func parseOutput(stdout *cappedBuffer, stderr *tailBuffer) (*scriptOutput, error) {
+	fail := func(msg string, issues []core.Issue) error {
+		return stderr.fail(http.StatusBadGateway, codeScriptOutput, msg, &scriptDetails{Issues: issues})
+	}
+	if stdout.overflow {
+		return nil, fail(fmt.Sprintf("script output exceeds %d bytes", maxScriptOutput), nil)
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, fail("script wrote no output", nil)
+	}
+	dec := json.NewDecoder(bytes.NewReader(stdout.Bytes()))
+	dec.DisallowUnknownFields()
+	var out scriptOutput
+	if err := dec.Decode(&out); err != nil {
+		return nil, fail("script output is not a valid response: "+err.Error(), nil)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fail("script output has data after the response object", nil)
+	}
+	var issues []core.Issue
+	for i := range out.NewEntries {
+		for _, issue := range core.Issues(out.NewEntries[i].Validate()) {
+			issue.Path = fmt.Sprintf("new_entries[%d].%s", i, issue.Path)
+			issues = append(issues, issue)
+		}
+	}
+	if issues != nil {
+		return nil, fail("script returned invalid new_entries", issues)
+	}
+	return &out, nil
+}
+
+// scriptEnv is the server's environment without its secrets.
+func scriptEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		secret := false
+		for _, s := range secretEnv {
+			secret = secret || name == s
+		}
+		if !secret {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// cappedBuffer keeps the first limit bytes written and notes whether more
+// arrived. It never fails a write, so an oversized response is reported
+// rather than killing the script with a broken pipe. The buffer is not
+// embedded: its ReadFrom would let io.Copy bypass the limit.
+type cappedBuffer struct {
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.limit - b.buf.Len(); n > room {
+		b.overflow = true
+		p = p[:max(room, 0)]
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+func (b *cappedBuffer) Bytes() []byte { return b.buf.Bytes() }
+
+func (b *cappedBuffer) Len() int { return b.buf.Len() }
+
+// cappedWriter passes the first limit bytes to w and drops the rest. Like
+// cappedBuffer it never fails a write; a write error stops further copying.
+type cappedWriter struct {
+	w        io.Writer
+	limit    int64
+	n        int64
+	overflow bool
+	err      error
+}
+
+func (c *cappedWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := c.limit - c.n; int64(len(p)) > room {
+		c.overflow = true
+		p = p[:max(room, 0)]
+	}
+	if c.err == nil && len(p) > 0 {
+		var m int
+		m, c.err = c.w.Write(p)
+		c.n += int64(m)
+	}
+	return n, nil
+}
+
+// tailBuffer keeps the last limit bytes written.
+type tailBuffer struct {
+	buf       []byte
+	limit     int
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.limit; over > 0 {
+		b.truncated = true
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// fail returns an apiError whose details carry the captured stderr.
+func (b *tailBuffer) fail(status int, code core.ErrorCode, msg string, details *scriptDetails) error {
+	if details == nil {
+		details = &scriptDetails{}
+	}
+	details.Stderr = strings.ToValidUTF8(string(b.buf), "�")
+	details.StderrTruncated = b.truncated
+	return &apiError{Status: status, ErrorBody: core.ErrorBody{Code: code, Message: msg, Details: details}}
+}
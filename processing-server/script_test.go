@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"logwayss/core-go/core"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// runTestScript runs script as an endpoint with timeoutMS and an empty
+// request.
+func runTestScript(t *testing.T, script string, timeoutMS int) (*scriptOutput, error) {
+	t.Helper()
+	ep := testEndpoint(t, "test", script)
+	ep.TimeoutMS = timeoutMS
+	return runScript(context.Background(), testScriptRun(t, ep))
+}
+
+// testScriptRun returns a run of ep with an empty request in a new run
+// directory.
+func testScriptRun(t *testing.T, ep Endpoint) scriptRun {
+	return scriptRun{
+		id:       ulid.Make().String(),
+		ep:       ep,
+		req:      scriptRequest{EntryIDs: []string{}, Params: map[string]any{}},
+		dir:      t.TempDir(),
+		progress: func(progressEvent) {},
+	}
+}
+
+// wantScriptError fails t unless err is an apiError with status and code,
+// and returns its details.
+func wantScriptError(t *testing.T, err error, status int, code core.ErrorCode) *scriptDetails {
+	t.Helper()
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("got %v, want %s", err, code)
+	}
+	if apiErr.Status != status || apiErr.Code != code {
+		t.Fatalf("got %d %s (%s), want %d %s", apiErr.Status, apiErr.Code, apiErr.Message, status, code)
+	}
+	details, _ := apiErr.Details.(*scriptDetails)
+	if details == nil {
+		t.Fatalf("%s has no script details", code)
+	}
+	return details
+}
+
+func TestRunScript(t *testing.T) {
+	ep := testEndpoint(t, "test", `#!/bin/sh
+echo working >&2
+printf '{"results": [1, "%s"], "warnings": ["partial"]}\n' "$(pwd -P)"
+`)
+	sr := testScriptRun(t, ep)
+	out, err := runScript(context.Background(), sr)
+	if err != nil {
+		t.Fatalf("runScript failed: %v", err)
+	}
+	var dir string
+	if len(out.Results) != 2 || string(out.Results[0]) != "1" || json.Unmarshal(out.Results[1], &dir) != nil {
+		t.Fatalf("unexpected results: %s", out.Results)
+	}
+	if len(out.Warnings) != 1 || out.Warnings[0] != "partial" {
+		t.Fatalf("unexpected warnings: %q", out.Warnings)
+	}
+	if want, _ := filepath.EvalSymlinks(filepath.Join(sr.dir, artifactFilesDir)); dir != want {
+		t.Fatalf("script ran in %q, want the run's directory %q", dir, want)
+	}
+}
+
+func TestRunScriptTimeoutKillsProcessGroup(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "late")
+	// The background child outlives the script unless its group is killed.
+	script := fmt.Sprintf("#!/bin/sh\n(sleep 1; echo late > %q) &\necho started >&2\nsleep 30\n", marker)
+	start := time.Now()
+	_, err := runTestScript(t, script, 200)
+	details := wantScriptError(t, err, http.StatusGatewayTimeout, codeScriptTimeout)
+	if elapsed := time.Since(start); elapsed > scriptWaitDelay {
+		t.Fatalf("timed-out script took %v to stop", elapsed)
+	}
+	if details.Stderr != "started\n" {
+		t.Fatalf("stderr = %q, want the script's output", details.Stderr)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("a child of the timed-out script kept running: stat err %v", err)
+	}
+}
+
+func TestRunScriptFailed(t *testing.T) {
+	_, err := runTestScript(t, "#!/bin/sh\necho 'no model configured' >&2\nexit 3\n", 10000)
+	details := wantScriptError(t, err, http.StatusBadGateway, codeScriptFailed)
+	if details.ExitCode == nil || *details.ExitCode != 3 {
+		t.Fatalf("exit_code = %v, want 3", details.ExitCode)
+	}
+	if details.Stderr != "no model configured\n" || details.StderrTruncated {
+		t.Fatalf("stderr = %q (truncated %v)", details.Stderr, details.StderrTruncated)
+	}
+
+	// Only the end of a long stderr is kept.
+	_, err = runTestScript(t, fmt.Sprintf("#!/bin/sh\nhead -c %d /dev/zero | tr '\\0' x >&2\necho end >&2\nexit 1\n", 2*maxStderrTail), 10000)
+	details = wantScriptError(t, err, http.StatusBadGateway, codeScriptFailed)
+	if len(details.Stderr) != maxStderrTail || !details.StderrTruncated || !strings.HasSuffix(details.Stderr, "xend\n") {
+		t.Fatalf("stderr of %d bytes (truncated %v) ends %q", len(details.Stderr), details.StderrTruncated, details.Stderr[max(len(details.Stderr)-8, 0):])
+	}
+}
+
+func TestRunScriptBadOutput(t *testing.T) {
+	cases := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{"empty", "", "script wrote no output"},
+		{"malformed", `echo '{"results": ['`, "script output is not a valid response"},
+		{"not an object", `echo '["done"]'`, "script output is not a valid response"},
+		{"unknown field", `echo '{"results": [], "result": 1}'`, `json: unknown field "result"`},
+		{"trailing data", `echo '{}'; echo '{}'`, "script output has data after the response object"},
+		{"over-long", fmt.Sprintf("head -c %d /dev/zero", maxScriptOutput+1), fmt.Sprintf("script output exceeds %d bytes", maxScriptOutput)},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := runTestScript(t, "#!/bin/sh\n"+tc.output+"\n", 10000)
+			wantScriptError(t, err, http.StatusBadGateway, codeScriptOutput)
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("got %q, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunScriptInvalidNewEntries(t *testing.T) {
+	out, err := runTestScript(t, `#!/bin/sh
+echo '{"new_entries": [{"type": "text", "payload": {"text": "ok"}}, {"type": "nope", "payload": {}}]}'
+`, 10000)
+	details := wantScriptError(t, err, http.StatusBadGateway, codeScriptOutput)
+	if len(details.Issues) == 0 {
+		t.Fatalf("no issues reported for %+v", out)
+	}
+	first := details.Issues[0]
+	if first.Path != "new_entries[1].type" || first.Code != core.CodeEnum {
+		t.Fatalf("first issue %+v, want new_entries[1].type %s", first, core.CodeEnum)
+	}
+	for _, issue := range details.Issues {
+		if !strings.HasPrefix(issue.Path, "new_entries[1].") {
+			t.Errorf("issue %+v is not about the invalid entry", issue)
+		}
+	}
+}
+
+func TestScriptEnvHidesSecrets(t *testing.T) {
+	t.Setenv("MASTER_PASSWORD", "hunter2")
+	t.Setenv("LOGWAYSS_TEST_VISIBLE", "yes")
+	out, err := runTestScript(t, `#!/bin/sh
+printf '{"results": ["%s", "%s"]}\n' "${MASTER_PASSWORD-unset}" "${LOGWAYSS_TEST_VISIBLE-unset}"
+`, 10000)
+	if err != nil {
+		t.Fatalf("runScript failed: %v", err)
+	}
+	if len(out.Results) != 2 || string(out.Results[0]) != `"unset"` || string(out.Results[1]) != `"yes"` {
+		t.Fatalf("script saw the environment %s, want MASTER_PASSWORD unset and the rest kept", out.Results)
+	}
+}
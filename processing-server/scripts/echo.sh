@@ -0,0 +1,3 @@
+#!/bin/sh
+# Example endpoint script: returns its request as the single result.
+printf '{"results":[%s]}\n' "$(cat)"
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"logwayss/core-go/core"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	// maxRequestBody bounds an endpoint request.
+	maxRequestBody = 1 << 20
+	// maxEntryIDs bounds entry_ids in one request.
+	maxEntryIDs = 10000
+)
+
+// server authenticates every request and routes each enabled endpoint in
+// the config to its script.
+type server struct {
+	mux       *http.ServeMux
+	auth      *authenticator
+	endpoints map[string]bool // enabled endpoint names
+	queue     *queue
+	// announce shows a new pairing code on the server console.
+	announce func(pairingCode)
+}
+
+func newServer(cfg *Config, auth *authenticator, runs *queue) *server {
+	s := &server{mux: http.NewServeMux(), auth: auth, endpoints: make(map[string]bool), queue: runs}
+	s.announce = func(c pairingCode) {
+		fmt.Printf("pairing code %s, valid until %s\n", c, c.expires.Format(time.TimeOnly))
+	}
+	for _, ep := range cfg.Endpoints {
+		if ep.Enabled {
+			s.mux.Handle(ep.Method+" "+ep.Path, s.endpoint(ep))
+			s.endpoints[ep.Name] = true
+		}
+	}
+	s.mux.HandleFunc("GET /runs/{id}", s.getRun)
+	s.mux.HandleFunc("POST /runs/{id}/cancel", s.cancelRun)
+	s.mux.HandleFunc("GET /runs/{id}/events", s.runEvents)
+	s.mux.HandleFunc("GET /runs/{id}/artifacts", s.runArtifacts)
+	s.mux.HandleFunc("GET /runs/{id}/artifacts/{path...}", s.downloadArtifact)
+	s.mux.HandleFunc("POST /admin/pairing-codes", s.admin(s.newPairingCode))
+	s.mux.HandleFunc("GET /admin/devices", s.admin(s.listDevices))
+	s.mux.HandleFunc("DELETE /admin/devices/{id}", s.admin(s.revokeDevice))
+	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, &apiError{Status: http.StatusNotFound, ErrorBody: core.ErrorBody{
+			Code: core.CodeNotFound, Message: fmt.Sprintf("no endpoint at %s %s", r.Method, r.URL.Path)}})
+	})
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Pairing is how a device gets its credential, so it cannot require one;
+	// a wrong code counts as a failed attempt instead.
+	if r.Method == http.MethodPost && r.URL.Path == pairPath {
+		s.pair(w, r)
+		return
+	}
+	dev, ok := s.auth.allow(w, r)
+	if !ok {
+		return
+	}
+	if dev != nil {
+		r = r.WithContext(context.WithValue(r.Context(), deviceKey{}, dev))
+		setRequestDevice(r, dev.ID)
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+type deviceKey struct{}
+
+// requestDevice returns the device that made r, or nil if r carried
+// MASTER_PASSWORD.
+func requestDevice(r *http.Request) *device {
+	dev, _ := r.Context().Value(deviceKey{}).(*device)
+	return dev
+}
+
+func (s *server) endpoint(ep Endpoint) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dev := requestDevice(r); dev != nil && !dev.allows(ep.Name) {
+			writeError(w, &apiError{Status: http.StatusForbidden, ErrorBody: core.ErrorBody{
+				Code: codeForbidden, Message: fmt.Sprintf("this device may not call endpoint %s", ep.Name)}})
+			return
+		}
+		req, err := decodeRequest(w, r)
+		if err != nil {
+			s.fail(w, r, "endpoint "+ep.Name, err)
+			return
+		}
+		var deviceID string
+		if dev := requestDevice(r); dev != nil {
+			deviceID = dev.ID
+		}
+		ar, first, err := s.queue.submit(ep, req, deviceID, requestID(r))
+		if err != nil {
+			s.fail(w, r, "endpoint "+ep.Name, err)
+			return
+		}
+		setRequestRun(r, ar.ID)
+		w.Header().Set("Location", "/runs/"+ar.ID)
+		if preferAsync(r) {
+			w.Header().Set("Preference-Applied", "respond-async")
+			writeJSON(w, http.StatusAccepted, first)
+			return
+		}
+		err = s.queue.await(r.Context(), ar)
+		switch {
+		case errors.Is(err, errShuttingDown):
+			writeError(w, &apiError{Status: http.StatusServiceUnavailable, ErrorBody: core.ErrorBody{
+				Code: codeUnavailable, Message: fmt.Sprintf("the server is shutting down; run %s stays queued", ar.ID)}})
+		case err != nil:
+			// The client went away and the run was cancelled.
+		case ar.State == runSucceeded:
+			writeJSON(w, http.StatusOK, ar.Result)
+		default:
+			writeError(w, &apiError{Status: ar.status, ErrorBody: *ar.Error})
+		}
+	}
+}
+
+// preferAsync reports whether the client sent `Prefer: respond-async`
+// (RFC 7240), asking for 202 and a run to poll instead of the result.
+func preferAsync(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for pref := range strings.SplitSeq(v, ",") {
+			name, _, _ := strings.Cut(pref, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runID is the run ID in r's path. A device only sees its own runs, so for
+// anyone else's it is "", which no run has.
+func (s *server) runID(r *http.Request) string {
+	id := r.PathValue("id")
+	if dev := requestDevice(r); dev != nil {
+		if found, err := s.queue.get(id); err != nil || found.DeviceID != dev.ID {
+			return ""
+		}
+	}
+	setRequestRun(r, id)
+	return id
+}
+
+func (s *server) getRun(w http.ResponseWriter, r *http.Request) {
+	s.runResponse(w, r, s.queue.get)
+}
+
+func (s *server) cancelRun(w http.ResponseWriter, r *http.Request) {
+	s.runResponse(w, r, s.queue.cancel)
+}
+
+// runResponse looks up the run named in the path with lookup and writes it.
+func (s *server) runResponse(w http.ResponseWriter, r *http.Request, lookup func(string) (run, error)) {
+	found, err := lookup(s.runID(r))
+	if err != nil {
+		s.runError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
+
+// runError writes the error of looking up the run named in the path.
+func (s *server) runError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, &apiError{Status: http.StatusNotFound, ErrorBody: core.ErrorBody{
+			Code: core.CodeNotFound, Message: fmt.Sprintf("no run %s", r.PathValue("id"))}})
+		return
+	}
+	s.fail(w, r, "runs", err)
+}
+
+// decodeRequest reads `{ entry_ids: string[], params: object }`. Both fields
+// are optional and an empty body is an empty request.
+func decodeRequest(w http.ResponseWriter, r *http.Request) (scriptRequest, error) {
+	req := scriptRequest{EntryIDs: []string{}, Params: map[string]any{}}
+	fields, err := readObject(w, r)
+	if err != nil {
+		return req, err
+	}
+	var found []core.Issue
+	invalid := func(path string, code core.ErrorCode, msg string) {
+		found = append(found, core.Issue{Path: path, Code: code, Message: msg})
+	}
+	names := slices.Sorted(maps.Keys(fields))
+	for _, name := range names {
+		raw := fields[name]
+		switch name {
+		case "entry_ids":
+			var ids []any
+			if err := json.Unmarshal(raw, &ids); err != nil {
+				invalid("entry_ids", core.CodeType, "must be an array")
+				continue
+			}
+			if len(ids) > maxEntryIDs {
+				invalid("entry_ids", core.CodeTooMany, fmt.Sprintf("must have at most %d items", maxEntryIDs))
+			}
+			for i, v := range ids {
+				id, ok := v.(string)
+				if !ok {
+					invalid(fmt.Sprintf("entry_ids[%d]", i), core.CodeType, "must be a string")
+				} else if _, err := ulid.ParseStrict(id); err != nil {
+					invalid(fmt.Sprintf("entry_ids[%d]", i), core.CodeFormat, "must be an entry ID")
+				} else {
+					req.EntryIDs = append(req.EntryIDs, id)
+				}
+			}
+		case "params":
+			var params map[string]any
+			if err := json.Unmarshal(raw, &params); err != nil || params == nil {
+				invalid("params", core.CodeType, "must be an object")
+				continue
+			}
+			req.Params = params
+		default:
+			invalid(name, core.CodeUnknownField, "is not allowed")
+		}
+	}
+	if found != nil {
+		return req, invalidRequest(found...)
+	}
+	return req, nil
+}
+
+// readObject reads a request body holding a JSON object of at most
+// maxRequestBody bytes. An empty body is an empty object.
+func readObject(w http.ResponseWriter, r *http.Request) (map[string]json.RawMessage, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return nil, &apiError{Status: http.StatusRequestEntityTooLarge, ErrorBody: core.ErrorBody{
+			Code: core.CodeValidation, Message: "request body is too large",
+			Details: []core.Issue{{Path: "", Code: core.CodeTooLong, Message: fmt.Sprintf("must be at most %d bytes", maxRequestBody)}}}}
+	case err != nil:
+		return nil, err
+	case len(body) == 0:
+		return map[string]json.RawMessage{}, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil || fields == nil {
+		return nil, invalidRequest(core.Issue{Path: "", Code: core.CodeType, Message: "must be a JSON object"})
+	}
+	return fields, nil
+}
+
+func invalidRequest(issues ...core.Issue) *apiError {
+	return &apiError{Status: http.StatusBadRequest, ErrorBody: core.ErrorBody{
+		Code: core.CodeValidation, Message: "invalid request", Details: issues}}
+}
+
+func writeError(w http.ResponseWriter, e *apiError) {
+	writeJSON(w, e.Status, core.ErrorEnvelope{Error: e.ErrorBody})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
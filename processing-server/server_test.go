@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"logwayss/core-go/core"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// echoScript answers every request with its run ID.
+const echoScript = "#!/bin/sh\ncat >/dev/null\nprintf '{\"results\": [\"%s\"]}\\n' \"$LOGWAYSS_RUN_ID\"\n"
+
+// requestScript answers with the request it read on stdin.
+const requestScript = "#!/bin/sh\nprintf '{\"results\": [%s]}\\n' \"$(cat)\"\n"
+
+// testEndpoint writes script to a new directory and returns an enabled
+// endpoint POST /<name> that runs it.
+func testEndpoint(t *testing.T, name, script string) Endpoint {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name+".sh")
+	if err := os.WriteFile(file, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return Endpoint{Name: name, Method: http.MethodPost, Path: "/" + name, ScriptPath: file,
+		TimeoutMS: 10000, Enabled: true, MaxConcurrent: 1}
+}
+
+// openTestQueue opens the queue in dataDir for eps. It is closed, and its
+// scripts waited for, when the test ends.
+func openTestQueue(t *testing.T, dataDir string, eps ...Endpoint) *queue {
+	t.Helper()
+	q, err := openQueue(&Config{DataDir: dataDir, RunRetentionDays: 7, Endpoints: eps}, nil)
+	if err != nil {
+		t.Fatalf("openQueue failed: %v", err)
+	}
+	t.Cleanup(func() {
+		q.close()
+		q.wait()
+	})
+	return q
+}
+
+// newTestServer returns a server for testPassword, on clock, running eps.
+func newTestServer(t *testing.T, clock *testClock, eps ...Endpoint) *server {
+	t.Helper()
+	s := newServer(&Config{Endpoints: eps}, newTestAuth(t, clock), openTestQueue(t, t.TempDir(), eps...))
+	s.announce = func(pairingCode) {}
+	return s
+}
+
+// pairTestDevice pairs a device with scopes directly in the store and
+// returns it with its token.
+func pairTestDevice(t *testing.T, s *server, name string, scopes ...string) (device, string) {
+	t.Helper()
+	code, err := s.auth.devices.newCode(scopes)
+	if err != nil {
+		t.Fatalf("newCode failed: %v", err)
+	}
+	dev, token, err := s.auth.devices.redeem(code.code, name)
+	if err != nil {
+		t.Fatalf("redeem failed: %v", err)
+	}
+	return dev, token
+}
+
+// serve sends a request with the bearer credential to s and returns the
+// response. remote is the client's address.
+func serve(s *server, remote, method, path, bearer, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = remote
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+// errorBody decodes the error envelope of w.
+func errorBody(t *testing.T, w *httptest.ResponseRecorder) struct {
+	Code    core.ErrorCode `json:"code"`
+	Message string         `json:"message"`
+	Details []core.Issue   `json:"details"`
+} {
+	t.Helper()
+	var env struct {
+		Error struct {
+			Code    core.ErrorCode `json:"code"`
+			Message string         `json:"message"`
+			Details []core.Issue   `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatalf("response %d %s is not an error envelope: %v", w.Code, w.Body, err)
+	}
+	return env.Error
+}
+
+func TestEndpointRequest(t *testing.T) {
+	s := newTestServer(t, &testClock{t: time.Now()}, testEndpoint(t, "echo", requestScript))
+	id := ulid.Make().String()
+	cases := []struct {
+		body string
+		want string
+	}{
+		{"", `{"entry_ids":[],"params":{}}`},
+		{`{"entry_ids": ["` + id + `"], "params": {"lang": "en"}}`, `{"entry_ids":["` + id + `"],"params":{"lang":"en"}}`},
+	}
+	for _, tc := range cases {
+		w := serve(s, "192.0.2.1:1", "POST", "/echo", testPassword, tc.body)
+		var out scriptOutput
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &out) != nil || len(out.Results) != 1 {
+			t.Fatalf("request %q: %d %s", tc.body, w.Code, w.Body)
+		}
+		if got := string(out.Results[0]); got != tc.want {
+			t.Fatalf("request %q: script read %s, want %s", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestEndpointRequestValidation(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	s := newTestServer(t, &testClock{t: time.Now()}, testEndpoint(t, "touch", fmt.Sprintf("#!/bin/sh\ntouch %q\necho '{}'\n", marker)))
+	tooMany := make([]string, maxEntryIDs+1)
+	for i := range tooMany {
+		tooMany[i] = `"` + ulid.Make().String() + `"`
+	}
+	cases := []struct {
+		name   string
+		body   string
+		status int
+		// want are the reported issues as "path code".
+		want []string
+	}{
+		{"not an object", `[]`, http.StatusBadRequest, []string{" E_TYPE"}},
+		{"not JSON", `{"entry_ids":`, http.StatusBadRequest, []string{" E_TYPE"}},
+		{"entry_ids not an array", `{"entry_ids": "01"}`, http.StatusBadRequest, []string{"entry_ids E_TYPE"}},
+		{"bad entry_ids", `{"entry_ids": [1, "not-an-id"]}`, http.StatusBadRequest,
+			[]string{"entry_ids[0] E_TYPE", "entry_ids[1] E_FORMAT"}},
+		{"too many entry_ids", `{"entry_ids": [` + strings.Join(tooMany, ",") + `]}`, http.StatusBadRequest,
+			[]string{"entry_ids E_TOO_MANY"}},
+		{"params not an object", `{"params": ["x"]}`, http.StatusBadRequest, []string{"params E_TYPE"}},
+		{"null params", `{"params": null}`, http.StatusBadRequest, []string{"params E_TYPE"}},
+		{"unknown field", `{"entry_ids": [], "mode": "fast"}`, http.StatusBadRequest, []string{"mode E_UNKNOWN_FIELD"}},
+		{"too large", `{"params": {"text": "` + strings.Repeat("x", maxRequestBody) + `"}}`, http.StatusRequestEntityTooLarge,
+			[]string{" E_TOO_LONG"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(s, "192.0.2.1:1", "POST", "/touch", testPassword, tc.body)
+			e := errorBody(t, w)
+			if w.Code != tc.status || e.Code != core.CodeValidation {
+				t.Fatalf("got %d %s, want %d %s", w.Code, e.Code, tc.status, core.CodeValidation)
+			}
+			var got []string
+			for _, issue := range e.Details {
+				got = append(got, issue.Path+" "+string(issue.Code))
+			}
+			if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+				t.Fatalf("got issues:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tc.want, "\n"))
+			}
+			if _, err := os.Stat(marker); !os.IsNotExist(err) {
+				t.Fatal("the script ran for an invalid request")
+			}
+		})
+	}
+}
+
+func TestEndpointErrors(t *testing.T) {
+	off := testEndpoint(t, "off", requestScript)
+	off.Enabled = false
+	slow := testEndpoint(t, "slow", "#!/bin/sh\necho waiting >&2\nsleep 30\n")
+	slow.TimeoutMS = 100
+	s := newTestServer(t, &testClock{t: time.Now()}, off, slow, testEndpoint(t, "fail", "#!/bin/sh\necho broken >&2\nexit 2\n"))
+
+	for _, path := range []string{"/off", "/missing"} {
+		if w := serve(s, "192.0.2.1:1", "POST", path, testPassword, ""); w.Code != http.StatusNotFound || errorBody(t, w).Code != core.CodeNotFound {
+			t.Fatalf("POST %s: %d %s", path, w.Code, w.Body)
+		}
+	}
+	if w := serve(s, "192.0.2.1:1", "GET", "/fail", testPassword, ""); w.Code != http.StatusNotFound && w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET on a POST endpoint: %d %s", w.Code, w.Body)
+	}
+
+	// Script errors keep their details in the envelope.
+	var env struct {
+		Error struct {
+			Code    core.ErrorCode `json:"code"`
+			Details scriptDetails  `json:"details"`
+		} `json:"error"`
+	}
+	w := serve(s, "192.0.2.1:1", "POST", "/slow", testPassword, "")
+	if w.Code != http.StatusGatewayTimeout || json.Unmarshal(w.Body.Bytes(), &env) != nil ||
+		env.Error.Code != codeScriptTimeout || env.Error.Details.Stderr != "waiting\n" {
+		t.Fatalf("timed-out script: %d %s", w.Code, w.Body)
+	}
+	w = serve(s, "192.0.2.1:1", "POST", "/fail", testPassword, "")
+	if w.Code != http.StatusBadGateway || json.Unmarshal(w.Body.Bytes(), &env) != nil || env.Error.Code != codeScriptFailed ||
+		env.Error.Details.ExitCode == nil || *env.Error.Details.ExitCode != 2 || env.Error.Details.Stderr != "broken\n" {
+		t.Fatalf("failed script: %d %s", w.Code, w.Body)
+	}
+
+	// Last, since the failure backs the client off.
+	if w := serve(s, "192.0.2.1:1", "POST", "/fail", "", ""); w.Code != http.StatusUnauthorized || errorCode(t, w) != string(codeUnauthorized) {
+		t.Fatalf("request without a credential: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestEndpointScopes(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	s := newTestServer(t, clock, testEndpoint(t, "echo", echoScript), testEndpoint(t, "other", echoScript))
+	_, token := pairTestDevice(t, s, "phone", "echo")
+
+	if w := serve(s, "192.0.2.1:1", "POST", "/echo", token, ""); w.Code != http.StatusOK {
+		t.Fatalf("device calling its endpoint: %d %s", w.Code, w.Body)
+	}
+	w := serve(s, "192.0.2.1:1", "POST", "/other", token, "")
+	if w.Code != http.StatusForbidden || errorCode(t, w) != string(codeForbidden) {
+		t.Fatalf("device calling another endpoint: %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Location") != "" {
+		t.Fatal("a forbidden call created a run")
+	}
+	if w := serve(s, "192.0.2.1:1", "POST", "/other", testPassword, ""); w.Code != http.StatusOK {
+		t.Fatalf("MASTER_PASSWORD calling any endpoint: %d %s", w.Code, w.Body)
+	}
+
+	_, all := pairTestDevice(t, s, "laptop", allEndpoints)
+	if w := serve(s, "192.0.2.1:1", "POST", "/other", all, ""); w.Code != http.StatusOK {
+		t.Fatalf("device with scope *: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRunsIsolatedByDevice(t *testing.T) {
+	clock := &testClock{t: time.Now()}
+	s := newTestServer(t, clock, testEndpoint(t, "echo", echoScript))
+	_, mine := pairTestDevice(t, s, "phone", allEndpoints)
+	_, theirs := pairTestDevice(t, s, "laptop", allEndpoints)
+
+	w := serve(s, "192.0.2.1:1", "POST", "/echo", mine, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("call failed: %d %s", w.Code, w.Body)
+	}
+	loc := w.Header().Get("Location")
+	var out scriptOutput
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || len(out.Results) != 1 || string(out.Results[0]) != `"`+strings.TrimPrefix(loc, "/runs/")+`"` {
+		t.Fatalf("unexpected result %s for %s", w.Body, loc)
+	}
+
+	paths := []struct{ method, path string }{
+		{"GET", loc},
+		{"POST", loc + "/cancel"},
+		{"GET", loc + "/events"},
+		{"GET", loc + "/artifacts"},
+		{"GET", loc + "/artifacts/stdout"},
+	}
+	for _, p := range paths {
+		if w := serve(s, "192.0.2.1:1", p.method, p.path, mine, ""); w.Code != http.StatusOK {
+			t.Errorf("%s %s by the device that made the run: %d %s", p.method, p.path, w.Code, w.Body)
+		}
+		if w := serve(s, "192.0.2.1:1", p.method, p.path, theirs, ""); w.Code != http.StatusNotFound || errorCode(t, w) != "E_NOT_FOUND" {
+			t.Errorf("%s %s by another device: %d %s", p.method, p.path, w.Code, w.Body)
+		}
+		if w := serve(s, "192.0.2.1:1", p.method, p.path, testPassword, ""); w.Code != http.StatusOK {
+			t.Errorf("%s %s with MASTER_PASSWORD: %d %s", p.method, p.path, w.Code, w.Body)
+		}
+	}
+
+	// A run made with MASTER_PASSWORD belongs to no device.
+	w = serve(s, "192.0.2.1:1", "POST", "/echo", testPassword, "")
+	if w := serve(s, "192.0.2.1:1", "GET", w.Header().Get("Location"), mine, ""); w.Code != http.StatusNotFound {
+		t.Errorf("device reading a MASTER_PASSWORD run: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	certFile    = "cert.pem"
+	keyFile     = "key.pem"
+	nextKeyFile = "next-key.pem"
+
+	// certLifetime is how long an issued certificate is valid; it is
+	// reissued for the same key certRenewBefore its expiry, which leaves
+	// the pins unchanged.
+	certLifetime    = 365 * 24 * time.Hour
+	certRenewBefore = 30 * 24 * time.Hour
+)
+
+// certStore keeps the server's self-signed certificate and keys in a
+// directory. Clients pin the SPKI of the current key and of the next key,
+// which is generated ahead of time: rotation promotes the next key and
+// creates a new one, so a client holding both pins keeps working.
+type certStore struct {
+	dir string
+	now func() time.Time
+
+	mu    sync.Mutex // serialises changes to the files
+	state atomic.Pointer[certState]
+}
+
+type certState struct {
+	cert     *tls.Certificate
+	notAfter time.Time
+	pin      string
+	nextPin  string
+}
+
+// openCertStore loads the certificate and keys in dir, creating any that
+// are missing.
+func openCertStore(dir string) (*certStore, error) {
+	c := &certStore{dir: dir, now: time.Now}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load rereads the files, so a rotation done by another process takes
+// effect, and renews the certificate if it is close to expiry.
+func (c *certStore) load() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refresh()
+}
+
+// rotate replaces the current key with the next one and generates a new
+// next key. Clients that pinned only the old key must pair again.
+func (c *certStore) rotate() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Make sure a next key exists before promoting it. A crash after the
+	// rename leaves a certificate that does not match the key, and the
+	// next refresh reissues it.
+	if err := c.refresh(); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(c.dir, nextKeyFile), filepath.Join(c.dir, keyFile)); err != nil {
+		return err
+	}
+	return c.refresh()
+}
+
+// refresh brings the files up to date and publishes them. The caller holds
+// c.mu.
+func (c *certStore) refresh() error {
+	if err := os.MkdirAll(c.dir, 0o700); err != nil {
+		return err
+	}
+	key, err := c.loadKey(keyFile)
+	if err != nil {
+		return err
+	}
+	next, err := c.loadKey(nextKeyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := c.loadCert(key)
+	if err != nil {
+		return err
+	}
+	if leaf == nil {
+		if leaf, err = c.issue(key); err != nil {
+			return err
+		}
+	}
+	pin, err := spkiPin(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	nextPin, err := spkiPin(&next.PublicKey)
+	if err != nil {
+		return err
+	}
+	c.state.Store(&certState{
+		cert:     &tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf},
+		notAfter: leaf.NotAfter,
+		pin:      pin,
+		nextPin:  nextPin,
+	})
+	return nil
+}
+
+// loadKey reads an ECDSA key, generating it if the file does not exist.
+// Like .env, a key file other users can access is refused.
+func (c *certStore) loadKey(name string) (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(c.dir, name)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if perm := fi.Mode().Perm(); perm&0o007 != 0 {
+		return nil, fmt.Errorf("%s is accessible by other users (mode %#o); run chmod 600 %s", path, perm, path)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: not a PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ECDSA key", path)
+	}
+	return key, nil
+}
+
+// loadCert returns the stored certificate, or nil if it is missing, does
+// not belong to key or needs renewing.
+func (c *certStore) loadCert(key *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	path := filepath.Join(c.dir, certFile)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: not a PEM certificate", path)
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if pub, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || !pub.Equal(&key.PublicKey) {
+		return nil, nil
+	}
+	if c.now().Add(certRenewBefore).After(leaf.NotAfter) {
+		return nil, nil
+	}
+	return leaf, nil
+}
+
+// issue creates and stores a self-signed certificate for key. Its names
+// cover localhost and the machine's current addresses, though clients are
+// expected to check the pin rather than the name.
+func (c *certStore) issue(key *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := c.now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "logwayss processing-server"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           append([]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, localIPs()...),
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		tmpl.DNSNames = append(tmpl.DNSNames, host)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAtomic(filepath.Join(c.dir, certFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.state.Load().cert, nil
+}
+
+func (c *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: c.getCertificate}
+}
+
+// pins returns the pins of the current and the next key.
+func (c *certStore) pins() []string {
+	st := c.state.Load()
+	return []string{st.pin, st.nextPin}
+}
+
+func (c *certStore) String() string {
+	st := c.state.Load()
+	return fmt.Sprintf("key %s, next key %s, certificate expires %s", st.pin, st.nextPin, st.notAfter.Format(time.DateOnly))
+}
+
+// spkiPin is "sha256/" and the base64 SHA-256 of the DER-encoded
+// SubjectPublicKeyInfo, the form used by HPKP and OkHttp.
+func spkiPin(pub any) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// pairingPayload is what the pairing QR code encodes: where the server can
+// be reached, which keys to pin and, once one is issued, the pairing code.
+type pairingPayload struct {
+	Version int      `json:"v"`
+	URLs    []string `json:"urls"`
+	Pins    []string `json:"pins"`
+	Code    string   `json:"code,omitempty"`
+}
+
+func newPairingPayload(addr net.Addr, pins []string) pairingPayload {
+	p := pairingPayload{Version: 1, URLs: []string{}, Pins: pins}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return p
+	}
+	ips := []net.IP{tcp.IP}
+	if tcp.IP.IsUnspecified() {
+		ips = localIPs()
+	}
+	for _, ip := range ips {
+		p.URLs = append(p.URLs, "https://"+net.JoinHostPort(ip.String(), strconv.Itoa(tcp.Port)))
+	}
+	return p
+}
+
+// localIPs returns the machine's routable interface addresses.
+func localIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.IsGlobalUnicast() {
+			ips = append(ips, n.IP)
+		}
+	}
+	return ips
+}
+
+// writeFileAtomic replaces path with data, so a crash never leaves a
+// truncated key or certificate behind.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
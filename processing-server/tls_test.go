@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// filePin computes the pin of the key in dir/name independently of spkiPin.
+func filePin(t *testing.T, dir, name string) string {
+	t.Helper()
+	raw, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		t.Fatalf("%s is not PEM", name)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.(*ecdsa.PrivateKey).Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(der)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// servedPin completes a TLS handshake with c's configuration and returns
+// the pin of the key it presented.
+func servedPin(t *testing.T, c *certStore) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", c.tlsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		conn.Close()
+	}()
+	// Pinning replaces chain verification, as in the apps.
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	defer conn.Close()
+	pin, err := spkiPin(conn.ConnectionState().PeerCertificates[0].PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pin
+}
+
+func TestCertStorePins(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "tls")
+	c, err := openCertStore(dir)
+	if err != nil {
+		t.Fatalf("openCertStore failed: %v", err)
+	}
+	for name, want := range map[string]os.FileMode{keyFile: 0o600, nextKeyFile: 0o600, certFile: 0o644} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || fi.Mode().Perm() != want {
+			t.Fatalf("%s: %v, mode %v, want %v", name, err, fi.Mode().Perm(), want)
+		}
+	}
+	pins := c.pins()
+	if want := []string{filePin(t, dir, keyFile), filePin(t, dir, nextKeyFile)}; !slices.Equal(pins, want) {
+		t.Fatalf("pins = %v, want %v", pins, want)
+	}
+	if pins[0] == pins[1] {
+		t.Fatal("current and next key are the same")
+	}
+	if got := servedPin(t, c); got != pins[0] {
+		t.Fatalf("server presented %s, want %s", got, pins[0])
+	}
+	leaf := c.state.Load().cert.Leaf
+	if !slices.Contains(leaf.DNSNames, "localhost") || leaf.NotAfter.Sub(leaf.NotBefore) < certLifetime {
+		t.Fatalf("unexpected certificate: names %v, valid %v to %v", leaf.DNSNames, leaf.NotBefore, leaf.NotAfter)
+	}
+
+	// Opening the directory again keeps the keys.
+	again, err := openCertStore(dir)
+	if err != nil {
+		t.Fatalf("reopening failed: %v", err)
+	}
+	if !slices.Equal(again.pins(), pins) {
+		t.Fatalf("pins changed on reopening: %v, was %v", again.pins(), pins)
+	}
+}
+
+func TestCertStoreRotate(t *testing.T) {
+	dir := t.TempDir()
+	running, err := openCertStore(dir)
+	if err != nil {
+		t.Fatalf("openCertStore failed: %v", err)
+	}
+	before := running.pins()
+
+	// -rotate-cert runs in a separate process and the server reloads.
+	rotator, err := openCertStore(dir)
+	if err != nil {
+		t.Fatalf("openCertStore failed: %v", err)
+	}
+	if err := rotator.rotate(); err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	after := rotator.pins()
+	if after[0] != before[1] || after[1] == before[0] || after[1] == before[1] {
+		t.Fatalf("rotation: pins %v, was %v", after, before)
+	}
+	if got := filePin(t, dir, keyFile); got != after[0] {
+		t.Fatalf("%s holds %s, want the old next key %s", keyFile, got, after[0])
+	}
+
+	if got := servedPin(t, running); got != before[0] {
+		t.Fatalf("before reload the server presented %s, want %s", got, before[0])
+	}
+	if err := running.load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !slices.Equal(running.pins(), after) {
+		t.Fatalf("reloaded pins %v, want %v", running.pins(), after)
+	}
+	if got := servedPin(t, running); got != after[0] {
+		t.Fatalf("after reload the server presented %s, want %s", got, after[0])
+	}
+}
+
+func TestCertStoreRenews(t *testing.T) {
+	dir := t.TempDir()
+	c, err := openCertStore(dir)
+	if err != nil {
+		t.Fatalf("openCertStore failed: %v", err)
+	}
+	pins, first := c.pins(), c.state.Load().notAfter
+
+	c.now = func() time.Time { return time.Now().Add(certLifetime - certRenewBefore + time.Hour) }
+	if err := c.load(); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if renewed := c.state.Load().notAfter; !renewed.After(first) {
+		t.Fatalf("certificate not renewed: expires %v, was %v", renewed, first)
+	}
+	if !slices.Equal(c.pins(), pins) {
+		t.Fatalf("renewal changed the pins: %v, was %v", c.pins(), pins)
+	}
+}
+
+func TestCertStoreRefusesExposedKey(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := openCertStore(dir); err != nil {
+		t.Fatalf("openCertStore failed: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(dir, keyFile), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := openCertStore(dir)
+	if err == nil || !strings.Contains(err.Error(), "accessible by other users") {
+		t.Fatalf("openCertStore with a readable key: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, keyFile), []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openCertStore(dir); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("openCertStore with a corrupt key: %v", err)
+	}
+}
+
+func TestPairingPayload(t *testing.T) {
+	c, err := openCertStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	p := newPairingPayload(ln.Addr(), c.pins())
+	if p.Version != 1 || len(p.URLs) != 1 || !strings.HasPrefix(p.URLs[0], "https://127.0.0.1:") || !slices.Equal(p.Pins, c.pins()) {
+		t.Fatalf("unexpected payload: %+v", p)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"logwayss/core-go/core"
+)
+
+// wsGUID is the fixed key suffix of the WebSocket handshake (RFC 6455).
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsText  = 0x1
+	wsClose = 0x8
+	wsPing  = 0x9
+	wsPong  = 0xa
+
+	// maxWSFrame bounds a frame from the client, which has nothing to say
+	// beyond control frames.
+	maxWSFrame     = 4 << 10
+	wsWriteTimeout = 10 * time.Second
+)
+
+var errWSHandshake = errors.New("bad WebSocket handshake")
+
+// wsConn is the server end of a WebSocket that only sends. It writes text
+// messages, answers pings and close frames, and discards anything else the
+// client sends.
+type wsConn struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	mu     sync.Mutex // serialises frames
+	closed chan struct{}
+}
+
+// isWebSocket reports whether r asks to upgrade to a WebSocket.
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for token := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket completes the handshake and takes over the connection.
+// On failure it has already written the error response.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, &apiError{Status: http.StatusBadRequest, ErrorBody: core.ErrorBody{
+			Code: core.CodeValidation, Message: "unsupported WebSocket handshake; version 13 is required"}})
+		return nil, errWSHandshake
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// HTTP/2 connections cannot be taken over.
+		writeError(w, &apiError{Status: http.StatusBadRequest, ErrorBody: core.ErrorBody{
+			Code: core.CodeValidation, Message: "WebSocket needs HTTP/1.1"}})
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &wsConn{conn: conn, rw: rw, closed: make(chan struct{})}
+	go c.readLoop()
+	return c, nil
+}
+
+// send writes {"event": name, "data": data} as a text message.
+func (c *wsConn) send(name string, data any) error {
+	raw, err := json.Marshal(map[string]any{"event": name, "data": data})
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, raw)
+}
+
+func (c *wsConn) ping() error {
+	return c.writeFrame(wsPing, nil)
+}
+
+// gone is closed once the client has closed the connection or it failed.
+func (c *wsConn) gone() <-chan struct{} {
+	return c.closed
+}
+
+// close sends a normal closure and drops the connection.
+func (c *wsConn) close() {
+	_ = c.writeFrame(wsClose, []byte{0x03, 0xe8}) // 1000: normal closure
+	c.conn.Close()
+}
+
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// readLoop reads the client's frames until the connection closes. Client
+// frames must be masked; anything malformed ends the connection.
+func (c *wsConn) readLoop() {
+	defer close(c.closed)
+	defer c.conn.Close()
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+			return
+		}
+		op, masked := head[0]&0x0f, head[1]&0x80 != 0
+		n := uint64(head[1] & 0x7f)
+		switch n {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return
+			}
+			n = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+				return
+			}
+			n = binary.BigEndian.Uint64(ext[:])
+		}
+		if !masked || n > maxWSFrame {
+			return
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch op {
+		case wsClose:
+			_ = c.writeFrame(wsClose, payload[:min(len(payload), 2)])
+			return
+		case wsPing:
+			_ = c.writeFrame(wsPong, payload)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsFrame is a frame as the test client sees it.
+type wsFrame struct {
+	op      byte
+	payload []byte
+}
+
+// readFrame reads one frame; the server never masks its frames.
+func readFrame(t *testing.T, r io.Reader) wsFrame {
+	t.Helper()
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		t.Fatalf("reading a frame: %v", err)
+	}
+	if head[0]&0xf0 != 0x80 || head[1]&0x80 != 0 {
+		t.Fatalf("frame header %x: want FIN, no reserved bits and no mask", head)
+	}
+	n := uint64(head[1])
+	switch n {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("reading a %d byte payload: %v", n, err)
+	}
+	return wsFrame{head[0] & 0x0f, payload}
+}
+
+// clientFrame encodes a frame as a client must send it, masked.
+func clientFrame(op byte, payload []byte, masked bool) []byte {
+	b := []byte{0x80 | op, byte(len(payload))}
+	if !masked {
+		return append(b, payload...)
+	}
+	b[1] |= 0x80
+	mask := []byte{1, 2, 3, 4}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// pipeWS returns a wsConn over one end of a pipe, reading client frames,
+// and the other end.
+func pipeWS(t *testing.T) (*wsConn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	c := &wsConn{conn: server, rw: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), closed: make(chan struct{})}
+	go c.readLoop()
+	return c, client
+}
+
+func TestWSFrameLengths(t *testing.T) {
+	c, client := pipeWS(t)
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte{'x'}, n)
+		errc := make(chan error, 1)
+		go func() { errc <- c.writeFrame(wsText, payload) }()
+		f := readFrame(t, client)
+		if err := <-errc; err != nil {
+			t.Fatalf("writing %d bytes: %v", n, err)
+		}
+		if f.op != wsText || !bytes.Equal(f.payload, payload) {
+			t.Fatalf("%d bytes: got op %d with %d bytes", n, f.op, len(f.payload))
+		}
+	}
+}
+
+func TestWSControlFrames(t *testing.T) {
+	c, client := pipeWS(t)
+
+	// Pings are answered with the same payload; other frames are ignored.
+	go client.Write(append(clientFrame(wsText, []byte("ignored"), true), clientFrame(wsPing, []byte("hi"), true)...))
+	if f := readFrame(t, client); f.op != wsPong || string(f.payload) != "hi" {
+		t.Fatalf("ping answered with op %d %q", f.op, f.payload)
+	}
+
+	// A close frame is echoed with its status code and ends the connection.
+	go client.Write(clientFrame(wsClose, []byte{0x03, 0xe9, 'b', 'y', 'e'}, true))
+	if f := readFrame(t, client); f.op != wsClose || !bytes.Equal(f.payload, []byte{0x03, 0xe9}) {
+		t.Fatalf("close answered with op %d %x", f.op, f.payload)
+	}
+	select {
+	case <-c.gone():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after a close frame")
+	}
+}
+
+func TestWSRejectsBadFrames(t *testing.T) {
+	cases := map[string][]byte{
+		"unmasked":  clientFrame(wsText, []byte("hello"), false),
+		"too large": {0x80 | wsText, 0x80 | 127, 0, 0, 0, 0, 0, 0, 0x10, 1},
+	}
+	for name, frame := range cases {
+		c, client := pipeWS(t)
+		go client.Write(frame)
+		select {
+		case <-c.gone():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s frame did not end the connection", name)
+		}
+	}
+}
+
+// dialWS asks to upgrade path at addr to a WebSocket, with the password and
+// the extra header lines, and returns the response, the connection and a
+// reader for what follows the response.
+func dialWS(t *testing.T, addr, path, header string) (*http.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + addr + "\r\nAuthorization: Bearer " + testPassword + "\r\n" +
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" + header + "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("reading the handshake response: %v", err)
+	}
+	return resp, conn, br
+}
+
+// The key and accept value are the example in RFC 6455, section 1.3.
+const (
+	testWSKey    = "dGhlIHNhbXBsZSBub25jZQ=="
+	testWSAccept = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+)
+
+func TestWSHandshake(t *testing.T) {
+	ep := testEndpoint(t, "echo", echoScript)
+	s := newTestServer(t, &testClock{t: time.Now()}, ep)
+	srv := startTestServer(t, s)
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	path := "/runs/" + awaitRun(t, s.queue, submit(t, s.queue, ep).ID).ID + "/events"
+
+	for _, header := range []string{
+		"Sec-WebSocket-Key: " + testWSKey + "\r\nSec-WebSocket-Version: 8\r\n",
+		"Sec-WebSocket-Version: 13\r\n",
+	} {
+		resp, _, _ := dialWS(t, addr, path, header)
+		if resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Sec-WebSocket-Version") != "13" {
+			t.Errorf("handshake with %q: %d %v", header, resp.StatusCode, resp.Header)
+		}
+	}
+
+	resp, conn, br := dialWS(t, addr, path, "Sec-WebSocket-Key: "+testWSKey+"\r\nSec-WebSocket-Version: 13\r\n")
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != testWSAccept ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || !strings.EqualFold(resp.Header.Get("Connection"), "upgrade") {
+		t.Fatalf("handshake: %d %v", resp.StatusCode, resp.Header)
+	}
+	// A finished run gets its result and a normal closure.
+	expectWSEvent(t, br, "result", "succeeded")
+	if f := readFrame(t, br); f.op != wsClose || !bytes.Equal(f.payload, []byte{0x03, 0xe8}) {
+		t.Fatalf("got op %d %x, want a normal closure", f.op, f.payload)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("connection not closed: %v", err)
+	}
+	conn.Close()
+}
+
+// expectWSEvent reads the next message and checks its event name and the
+// state or progress in its data.
+func expectWSEvent(t *testing.T, r io.Reader, name, want string) {
+	t.Helper()
+	f := readFrame(t, r)
+	var msg struct {
+		Event string         `json:"event"`
+		Data  map[string]any `json:"data"`
+	}
+	if f.op != wsText || json.Unmarshal(f.payload, &msg) != nil {
+		t.Fatalf("got op %d %q, want a JSON text message", f.op, f.payload)
+	}
+	got := msg.Data["state"]
+	if name == "progress" {
+		got = msg.Data["progress"]
+	}
+	if msg.Event != name || fmt.Sprint(got) != want {
+		t.Fatalf("got message %s, want %s with %s", f.payload, name, want)
+	}
+}
+
+func TestEventsWebSocket(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", progressScript(gate))
+	s := newTestServer(t, &testClock{t: time.Now()}, ep)
+	srv := startTestServer(t, s)
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	defer openGate(t, gate)
+	header := "Sec-WebSocket-Key: " + testWSKey + "\r\nSec-WebSocket-Version: 13\r\n"
+
+	r := submit(t, s.queue, ep)
+	resp, _, br := dialWS(t, addr, "/runs/"+r.ID+"/events", header)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %d", resp.StatusCode)
+	}
+	expectWSEvent(t, br, "state", "running")
+	openGate(t, gate)
+	expectWSEvent(t, br, "progress", "0.5")
+	expectWSEvent(t, br, "progress", "1")
+	expectWSEvent(t, br, "result", "succeeded")
+	if f := readFrame(t, br); f.op != wsClose {
+		t.Fatalf("got op %d after the result, want close", f.op)
+	}
+}
+
+func TestEventsWebSocketClientCloses(t *testing.T) {
+	gate := filepath.Join(t.TempDir(), "gate")
+	ep := testEndpoint(t, "slow", gatedScript(gate))
+	s := newTestServer(t, &testClock{t: time.Now()}, ep)
+	srv := startTestServer(t, s)
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	defer openGate(t, gate)
+
+	r := submit(t, s.queue, ep)
+	_, conn, br := dialWS(t, addr, "/runs/"+r.ID+"/events", "Sec-WebSocket-Key: "+testWSKey+"\r\nSec-WebSocket-Version: 13\r\n")
+	expectWSEvent(t, br, "state", "running")
+	if _, err := conn.Write(clientFrame(wsClose, []byte{0x03, 0xe8}, true)); err != nil {
+		t.Fatal(err)
+	}
+	if f := readFrame(t, br); f.op != wsClose {
+		t.Fatalf("got op %d, want the close echoed", f.op)
+	}
+
+	// The handler stops watching the run, which carries on.
+	watchers := func() int {
+		s.queue.mu.Lock()
+		defer s.queue.mu.Unlock()
+		return len(s.queue.active[r.ID].watchers)
+	}
+	for deadline := time.Now().Add(5 * time.Second); watchers() > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the closed WebSocket still watches the run")
+		}
+	}
+	openGate(t, gate)
+	if got := awaitRun(t, s.queue, r.ID); got.State != runSucceeded {
+		t.Fatalf("run after the client left: %s", got.State)
+	}
+}
@@ -91,6 +91,9 @@ if [ ! -d "${ROOT_DIR}/core-js/node_modules" ]; then
 fi
 run_test "core-js" "js" "${ROOT_DIR}/core-js" npm test
 
+# processing-server
+run_test "processing-server" "go" "${ROOT_DIR}/processing-server" go test -v ./...
+
 
 
 # --- Final Summary ---